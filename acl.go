@@ -0,0 +1,811 @@
+package localredis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	// registered here as the rules are checked against commandMap
+	commandMap["auth"] = auth
+	commandMap["acl"] = aclCommand
+	for name := range commandCategories {
+		if i := strings.IndexByte(name, '|'); i > 0 {
+			commandSubcommands[name[:i]] = append(commandSubcommands[name[:i]], name)
+		}
+	}
+}
+
+const (
+	errNoAuth     = "NOAUTH Authentication required."
+	errWrongPass  = "WRONGPASS invalid username-password pair or user is disabled."
+	errNoPermKey  = "NOPERM No permissions to access a key"
+	errNoPermChan = "NOPERM No permissions to access a channel"
+)
+
+// noAuthCommands are run before the authentication, whatever the
+// permissions of the user.
+var noAuthCommands = map[string]bool{
+	"auth":  true,
+	"hello": true,
+	"quit":  true,
+}
+
+// aclCategories are the command categories of the ACL rules, as listed by
+// ACL CAT.
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap",
+	"hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow", "blocking",
+	"dangerous", "connection", "transaction", "scripting",
+}
+
+// commandCategories are the categories of the commands, and of the
+// subcommands as command|subcommand when they differ by subcommand.
+var commandCategories = map[string]string{
+	"set":      "write string slow",
+	"get":      "read string fast",
+	"ping":     "fast connection",
+	"quit":     "fast connection",
+	"getex":    "write string fast",
+	"persist":  "keyspace write fast",
+	"ttl":      "keyspace read fast",
+	"pptl":     "keyspace read fast",
+	"exists":   "keyspace read fast",
+	"del":      "keyspace write slow",
+	"hello":    "fast connection",
+	"auth":     "fast connection",
+	"select":   "fast connection",
+	"swapdb":   "keyspace write fast dangerous",
+	"move":     "keyspace write fast",
+	"dbsize":   "keyspace read fast",
+	"flushdb":  "keyspace write slow dangerous",
+	"flushall": "keyspace write slow dangerous",
+	"type":     "keyspace read fast",
+	"save":     "admin slow dangerous",
+	"bgsave":   "admin slow dangerous",
+	"lastsave": "admin fast dangerous",
+	"dump":     "keyspace read slow",
+	"restore":  "keyspace write slow dangerous",
+
+	"bgrewriteaof": "admin slow dangerous",
+	"role":         "admin fast dangerous",
+	"info":         "slow dangerous",
+	"replconf":     "admin slow dangerous",
+	"psync":        "admin slow dangerous",
+	"sync":         "admin slow dangerous",
+	"wait":         "slow connection",
+	"subscribe":    "pubsub slow",
+	"unsubscribe":  "pubsub slow",
+	"psubscribe":   "pubsub slow",
+	"punsubscribe": "pubsub slow",
+	"publish":      "pubsub fast",
+	"pubsub":       "pubsub slow",
+	"sentinel":     "admin slow dangerous",
+	"cluster":      "slow",
+	"asking":       "fast connection",
+	"readonly":     "fast connection",
+	"readwrite":    "fast connection",
+	"config":       "admin slow dangerous",
+	"monitor":      "admin slow dangerous",
+	"slowlog":      "admin slow dangerous",
+	"latency":      "admin slow dangerous",
+	"object":       "keyspace read slow",
+	"memory":       "slow",
+	"replicaof":    "admin slow dangerous",
+	"slaveof":      "admin slow dangerous",
+	"eval":         "slow scripting",
+	"evalsha":      "slow scripting",
+	"eval_ro":      "slow scripting",
+	"evalsha_ro":   "slow scripting",
+	"script":       "slow scripting",
+	"fcall":        "slow scripting",
+	"fcall_ro":     "slow scripting",
+	"function":     "slow scripting",
+
+	"client":          "slow connection",
+	"client|id":       "slow connection",
+	"client|setname":  "slow connection",
+	"client|getname":  "slow connection",
+	"client|setinfo":  "slow connection",
+	"client|info":     "slow connection",
+	"client|reply":    "slow connection",
+	"client|list":     "admin slow dangerous connection",
+	"client|kill":     "admin slow dangerous connection",
+	"client|pause":    "admin slow dangerous connection",
+	"client|unpause":  "admin slow dangerous connection",
+	"client|no-evict": "admin slow dangerous connection",
+
+	"acl":         "admin slow dangerous",
+	"acl|whoami":  "slow",
+	"acl|cat":     "slow",
+	"acl|setuser": "admin slow dangerous",
+	"acl|getuser": "admin slow dangerous",
+	"acl|deluser": "admin slow dangerous",
+	"acl|list":    "admin slow dangerous",
+	"acl|users":   "admin slow dangerous",
+	"acl|log":     "admin slow dangerous",
+}
+
+// commandSubcommands are the subcommands of commandCategories by command.
+var commandSubcommands = map[string][]string{}
+
+func hasCategory(name, category string) bool {
+	if category == "all" {
+		return true
+	}
+	for _, c := range strings.Fields(commandCategories[name]) {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// aclUser is a user of the ACL with its rules. The clients keep the user
+// they authenticated as, so a user is changed in place.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // SHA-256 in hexadecimal
+
+	// allowed are the commands and the command|subcommand allowed or not
+	// by the rules, the others are allowed by allCommands.
+	allowed      map[string]bool
+	allCommands  bool
+	commandRules []string
+
+	keys     []aclKeyPattern
+	channels []string
+}
+
+// aclKeyPattern is a key pattern allowing the reads, the writes or both.
+type aclKeyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+func newACLUser(name string) *aclUser {
+	u := &aclUser{name: name}
+	u.reset()
+	return u
+}
+
+// newDefaultUser is the user of the clients until they authenticate,
+// allowed everything without a password.
+func newDefaultUser() *aclUser {
+	u := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "allcommands"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+func (u *aclUser) reset() {
+	u.enabled, u.nopass, u.passwords = false, false, nil
+	u.allowed, u.allCommands, u.commandRules = map[string]bool{}, false, []string{"-@all"}
+	u.keys, u.channels = nil, nil
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.allowed = make(map[string]bool, len(u.allowed))
+	for name, allow := range u.allowed {
+		c.allowed[name] = allow
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keys = append([]aclKeyPattern(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// applyRule applies a rule of ACL SETUSER, e.g. `on`, `>password`,
+// `~key:*`, `%R~pattern`, `&channel` or `+@read`.
+func (u *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+		return nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+		return nil
+	case "allkeys":
+		u.keys = []aclKeyPattern{{"*", true, true}}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.channels = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		return u.applyRule("+@all")
+	case "nocommands":
+		return u.applyRule("-@all")
+	case "reset":
+		u.reset()
+		return nil
+	}
+	if rule == "" {
+		return errors.New("Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		if hash := hashPassword(rule[1:]); !u.hasPassword(hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case '#':
+		hash := rule[1:]
+		if !validPasswordHash(hash) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if !u.hasPassword(hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case '<', '!':
+		hash := rule[1:]
+		if rule[0] == '<' {
+			hash = hashPassword(rule[1:])
+		} else if !validPasswordHash(hash) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if !u.hasPassword(hash) {
+			return errors.New("The password you are trying to remove from the user does not exist")
+		}
+		for i, h := range u.passwords {
+			if h == hash {
+				u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+				break
+			}
+		}
+	case '~':
+		u.keys = append(u.keys, aclKeyPattern{rule[1:], true, true})
+	case '%':
+		i := strings.IndexByte(rule, '~')
+		if i < 2 {
+			return errors.New("Syntax error")
+		}
+		p := aclKeyPattern{pattern: rule[i+1:]}
+		for _, c := range strings.ToUpper(rule[1:i]) {
+			switch c {
+			case 'R':
+				p.read = true
+			case 'W':
+				p.write = true
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		u.keys = append(u.keys, p)
+	case '&':
+		u.channels = append(u.channels, rule[1:])
+	case '+', '-':
+		return u.applyCommandRule(rule[0] == '+', strings.ToLower(rule[1:]))
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func validPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *aclUser) hasPassword(hash string) bool {
+	for _, h := range u.passwords {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCommandRule allows or denies a command, a command|subcommand or a
+// @category of commands.
+func (u *aclUser) applyCommandRule(allow bool, target string) error {
+	sign := "-"
+	if allow {
+		sign = "+"
+	}
+	switch {
+	case target == "@all":
+		u.allowed, u.allCommands = map[string]bool{}, allow
+		u.commandRules = []string{sign + target}
+		return nil
+	case strings.HasPrefix(target, "@"):
+		category := target[1:]
+		if !validCategory(category) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		for name := range commandMap {
+			for _, sub := range commandSubcommands[name] {
+				if hasCategory(sub, category) {
+					u.allowed[sub] = allow
+				} else if _, ok := u.allowed[sub]; !ok {
+					// kept as it is when the command changes
+					u.allowed[sub] = u.commandAllowed(name, sub)
+				}
+			}
+			if hasCategory(name, category) {
+				u.allowed[name] = allow
+			}
+		}
+	default:
+		name := target
+		if i := strings.IndexByte(target, '|'); i >= 0 {
+			name = target[:i]
+			if i == len(target)-1 {
+				return errors.New("Syntax error")
+			}
+		}
+		if _, ok := commandMap[name]; !ok {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		if name == target {
+			for other := range u.allowed {
+				if strings.HasPrefix(other, name+"|") {
+					delete(u.allowed, other)
+				}
+			}
+		}
+		u.allowed[target] = allow
+	}
+	u.commandRules = append(u.commandRules, sign+target)
+	return nil
+}
+
+func validCategory(category string) bool {
+	for _, c := range aclCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// commandAllowed tells whether the user may run the command name, sub
+// being name|first argument.
+func (u *aclUser) commandAllowed(name, sub string) bool {
+	if allow, ok := u.allowed[sub]; ok && sub != "" {
+		return allow
+	}
+	if allow, ok := u.allowed[name]; ok {
+		return allow
+	}
+	return u.allCommands
+}
+
+func (u *aclUser) keyAllowed(key string, read, write bool) bool {
+	for _, p := range u.keys {
+		if (!read || p.read) && (!write || p.write) && globMatch(p.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelAllowed tells whether the user may use the channel, a pattern of
+// PSUBSCRIBE must be one of the patterns of the user.
+func (u *aclUser) channelAllowed(channel string, pattern bool) bool {
+	for _, p := range u.channels {
+		if p == "*" || p == channel || !pattern && globMatch(p, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// flags are the flags replied by ACL GETUSER.
+func (u *aclUser) flags() []interface{} {
+	flags := []interface{}{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) keysRule() string {
+	rules := make([]string, 0, len(u.keys))
+	for _, p := range u.keys {
+		switch {
+		case p.read && p.write:
+			rules = append(rules, "~"+p.pattern)
+		case p.read:
+			rules = append(rules, "%R~"+p.pattern)
+		default:
+			rules = append(rules, "%W~"+p.pattern)
+		}
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) channelsRule() string {
+	rules := make([]string, 0, len(u.channels))
+	for _, p := range u.channels {
+		rules = append(rules, "&"+p)
+	}
+	return strings.Join(rules, " ")
+}
+
+// describe is the line of the user in ACL LIST, its rules from scratch.
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name}
+	parts = append(parts, argStrings(u.flags())...)
+	for _, hash := range u.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if keys := u.keysRule(); keys != "" {
+		parts = append(parts, keys)
+	}
+	// without all the channels the list starts from none
+	switch channels := u.channelsRule(); channels {
+	case "&*":
+		parts = append(parts, channels)
+	case "":
+		parts = append(parts, "resetchannels")
+	default:
+		parts = append(parts, "resetchannels", channels)
+	}
+	return strings.Join(append(parts, u.commandRules...), " ")
+}
+
+// aclLogEntry is a denied command or authentication in ACL LOG, the same
+// denial within a minute counts on the same entry.
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string // command, key, channel or auth
+	context    string // toplevel or lua
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// logACLDenial adds a denial to ACL LOG, the server lock must be held.
+func (s *Client) logACLDenial(cc *ClientConn, reason, context, object, username string) {
+	now := time.Now()
+	for _, e := range s.aclLog {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username &&
+			now.Sub(e.updated) < time.Minute {
+			e.count++
+			e.updated = now
+			e.clientInfo = cc.info()
+			return
+		}
+	}
+	s.aclLogID++
+	entry := &aclLogEntry{
+		id: s.aclLogID, count: 1, reason: reason, context: context, object: object,
+		username: username, clientInfo: cc.info(), created: now, updated: now,
+	}
+	s.aclLog = append([]*aclLogEntry{entry}, s.aclLog...)
+	s.trimACLLog()
+}
+
+func (s *Client) trimACLLog() {
+	if len(s.aclLog) > s.aclLogMaxLen {
+		s.aclLog = s.aclLog[:s.aclLogMaxLen]
+	}
+}
+
+// aclCheck returns the error replied when the client may not run the
+// command, or "". Clients without a user are the internal ones, e.g. the
+// link to the master. The server lock must be held.
+func (s *Client) aclCheck(cc *ClientConn, name string, args []interface{}, context string) string {
+	u := cc.user
+	if u == nil || noAuthCommands[name] {
+		return ""
+	}
+	if !cc.authenticated {
+		return errNoAuth
+	}
+	sub := ""
+	if len(args) > 0 {
+		sub = name + "|" + strings.ToLower(argString(args[0]))
+	}
+	if !u.commandAllowed(name, sub) {
+		object := name
+		if _, ok := commandCategories[sub]; ok {
+			object = sub
+		}
+		s.logACLDenial(cc, "command", context, object, u.name)
+		return fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", u.name, object)
+	}
+	write := writeCommands[name]
+	read := !write
+	switch name {
+	case "eval", "evalsha", "fcall", "getex":
+		read = true
+	}
+	for _, key := range commandKeys(name, args) {
+		if !u.keyAllowed(key, read, write) {
+			s.logACLDenial(cc, "key", context, key, u.name)
+			return errNoPermKey
+		}
+	}
+	var channels []interface{}
+	switch name {
+	case "publish":
+		if len(args) > 0 {
+			channels = args[:1]
+		}
+	case "subscribe", "psubscribe":
+		channels = args
+	}
+	for _, channel := range channels {
+		if !u.channelAllowed(argString(channel), name == "psubscribe") {
+			s.logACLDenial(cc, "channel", context, argString(channel), u.name)
+			return errNoPermChan
+		}
+	}
+	return ""
+}
+
+// authenticate authenticates cc as the user username, the server lock
+// must be held.
+func (s *Client) authenticate(cc *ClientConn, username, password string) bool {
+	u, ok := s.users[username]
+	if !ok || !u.enabled || !u.nopass && !u.hasPassword(hashPassword(password)) {
+		s.logACLDenial(cc, "auth", "toplevel", "AUTH", username)
+		return false
+	}
+	cc.user, cc.authenticated = u, true
+	return true
+}
+
+// setRequirepass sets the password of the default user like requirepass,
+// no password makes the default user nopass.
+func (s *Client) setRequirepass(password string) {
+	u := s.users["default"]
+	u.nopass, u.passwords = password == "", nil
+	if password != "" {
+		u.passwords = []string{hashPassword(password)}
+	}
+}
+
+// auth handles `AUTH [username] password`, the password alone
+// authenticates the default user.
+func auth(c net.Conn, args []interface{}) {
+	cc := clientOf(c)
+	s := cc.srv
+	var username, password string
+	switch len(args) {
+	case 1:
+		if s.users["default"].nopass {
+			SendError(c, "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+			return
+		}
+		username, password = "default", argString(args[0])
+	case 2:
+		username, password = argString(args[0]), argString(args[1])
+	default:
+		SendError(c, "ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	if !s.authenticate(cc, username, password) {
+		SendError(c, errWrongPass)
+		return
+	}
+	SendOk(c)
+}
+
+// aclCommand handles the ACL subcommands SETUSER, GETUSER, DELUSER, LIST,
+// USERS, WHOAMI, CAT and LOG.
+func aclCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'acl' command")
+		return
+	}
+	cc := clientOf(c)
+	s := cc.srv
+	subArg := argString(args[0])
+	sub := strings.ToLower(subArg)
+	args = args[1:]
+	wrongArgs := func() {
+		SendError(c, fmt.Sprintf("ERR wrong number of arguments for 'acl|%s' command", sub))
+	}
+	switch sub {
+	case "setuser":
+		if len(args) < 1 {
+			wrongArgs()
+			return
+		}
+		name := argString(args[0])
+		u, exists := s.users[name]
+		if !exists {
+			u = newACLUser(name)
+		}
+		// the rules apply all or nothing
+		changed := u.clone()
+		for _, rule := range args[1:] {
+			if err := changed.applyRule(argString(rule)); err != nil {
+				SendError(c, fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %s", argString(rule), err))
+				return
+			}
+		}
+		*u = *changed
+		s.users[name] = u
+		SendOk(c)
+	case "getuser":
+		if len(args) != 1 {
+			wrongArgs()
+			return
+		}
+		u, ok := s.users[argString(args[0])]
+		if !ok {
+			SendNil(c)
+			return
+		}
+		passwords := make([]interface{}, len(u.passwords))
+		for i, hash := range u.passwords {
+			passwords[i] = hash
+		}
+		SendValue(c, RespMap{
+			"flags", u.flags(),
+			"passwords", passwords,
+			"commands", strings.Join(u.commandRules, " "),
+			"keys", u.keysRule(),
+			"channels", u.channelsRule(),
+			"selectors", []interface{}{},
+		})
+	case "deluser":
+		if len(args) < 1 {
+			wrongArgs()
+			return
+		}
+		deleted := map[*aclUser]bool{}
+		for _, arg := range args {
+			name := argString(arg)
+			if name == "default" {
+				SendError(c, "ERR The 'default' user cannot be removed")
+				return
+			}
+			if u, ok := s.users[name]; ok {
+				deleted[u] = true
+			}
+		}
+		for u := range deleted {
+			delete(s.users, u.name)
+		}
+		SendValue(c, len(deleted))
+		// like redis the clients of a removed user are disconnected
+		for _, other := range s.listClients() {
+			if deleted[other.user] {
+				other.Close()
+			}
+		}
+	case "list", "users":
+		if len(args) != 0 {
+			wrongArgs()
+			return
+		}
+		names := make([]string, 0, len(s.users))
+		for name := range s.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		reply := make([]interface{}, len(names))
+		for i, name := range names {
+			if sub == "list" {
+				reply[i] = s.users[name].describe()
+			} else {
+				reply[i] = name
+			}
+		}
+		SendValue(c, reply)
+	case "whoami":
+		if len(args) != 0 {
+			wrongArgs()
+			return
+		}
+		SendValue(c, cc.userName())
+	case "cat":
+		switch len(args) {
+		case 0:
+			categories := make([]interface{}, len(aclCategories))
+			for i, category := range aclCategories {
+				categories[i] = category
+			}
+			SendValue(c, categories)
+		case 1:
+			category := strings.ToLower(argString(args[0]))
+			if !validCategory(category) {
+				SendError(c, fmt.Sprintf("ERR Unknown category '%s'", argString(args[0])))
+				return
+			}
+			var names []string
+			for name := range commandCategories {
+				if hasCategory(name, category) {
+					if _, ok := commandMap[strings.SplitN(name, "|", 2)[0]]; ok {
+						names = append(names, name)
+					}
+				}
+			}
+			sort.Strings(names)
+			reply := make([]interface{}, len(names))
+			for i, name := range names {
+				reply[i] = name
+			}
+			SendValue(c, reply)
+		default:
+			wrongArgs()
+		}
+	case "log":
+		if len(args) > 1 {
+			wrongArgs()
+			return
+		}
+		count := len(s.aclLog)
+		if len(args) == 1 {
+			if strings.EqualFold(argString(args[0]), "reset") {
+				s.aclLog = nil
+				SendOk(c)
+				return
+			}
+			n, err := strconv.Atoi(argString(args[0]))
+			if err != nil || n < 0 {
+				SendError(c, "ERR value is out of range, must be positive")
+				return
+			}
+			if n < count {
+				count = n
+			}
+		}
+		now := time.Now()
+		entries := make([]interface{}, count)
+		for i, e := range s.aclLog[:count] {
+			entries[i] = RespMap{
+				"count", e.count,
+				"reason", e.reason,
+				"context", e.context,
+				"object", e.object,
+				"username", e.username,
+				"age-seconds", now.Sub(e.created).Seconds(),
+				"client-info", e.clientInfo,
+				"entry-id", int(e.id),
+				"timestamp-created", int(e.created.UnixNano() / int64(time.Millisecond)),
+				"timestamp-last-updated", int(e.updated.UnixNano() / int64(time.Millisecond)),
+			}
+		}
+		SendValue(c, entries)
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", subArg))
+	}
+}
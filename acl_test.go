@@ -0,0 +1,168 @@
+package localredis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"auth", "pass"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR AUTH <password> called without any password") {
+		t.Errorf("auth without requirepass replied %q", reply)
+	}
+	runCommand(cc, []interface{}{"config", "set", "requirepass", "s3cret"})
+	mconn.Reset()
+
+	other := NewConnOverride()
+	oc := srv.addClient(other)
+	runCommand(oc, []interface{}{"get", "k"})
+	runCommand(oc, []interface{}{"hello", "3"})
+	runCommand(oc, []interface{}{"auth", "wrong"})
+	runCommand(oc, []interface{}{"auth", "default", "s3cret"})
+	runCommand(oc, []interface{}{"get", "k"})
+	expected := "-" + errNoAuth + "\r\n" +
+		"-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n" +
+		"-" + errWrongPass + "\r\n+OK\r\n-1\r\n"
+	if reply := readReply(t, other); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+
+	third := NewConnOverride()
+	tc := srv.addClient(third)
+	runCommand(tc, []interface{}{"hello", "3", "auth", "default", "nope"})
+	if reply := readReply(t, third); reply != "-"+errWrongPass+"\r\n" {
+		t.Errorf("hello with a wrong password replied %q", reply)
+	}
+	runCommand(tc, []interface{}{"hello", "3", "auth", "default", "s3cret"})
+	runCommand(tc, []interface{}{"acl", "whoami"})
+	if reply := readReply(t, third); !strings.HasPrefix(reply, "%7\r\n") || !strings.HasSuffix(reply, "$7\r\ndefault\r\n") {
+		t.Errorf("hello auth replied %q", reply)
+	}
+
+	// the clients connected before requirepass stay authenticated
+	runCommand(cc, []interface{}{"dbsize"})
+	if reply := readReply(t, mconn); reply != ":0\r\n" {
+		t.Errorf("got %q", reply)
+	}
+}
+
+func TestACLPermissions(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"acl", "setuser", "app", "on", ">pw", "~app:*", "%R~shared:*", "%W~log:*", "&news.*",
+		"+@all", "-@admin", "-@dangerous", "+config|get", "-set"})
+	runCommand(cc, []interface{}{"acl", "setuser", "app", "+set"})
+	runCommand(cc, []interface{}{"auth", "app", "pw"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n+OK\r\n+OK\r\n" {
+		t.Fatalf("setup replied %q", reply)
+	}
+	for _, tc := range []struct {
+		args  []interface{}
+		reply string
+	}{
+		{[]interface{}{"set", "app:1", "v"}, "+OK\r\n"},
+		{[]interface{}{"get", "app:1"}, "+v\r\n"},
+		{[]interface{}{"get", "shared:1"}, "-1\r\n"},
+		{[]interface{}{"set", "shared:1", "v"}, "-" + errNoPermKey + "\r\n"},
+		{[]interface{}{"set", "log:1", "v"}, "+OK\r\n"},
+		{[]interface{}{"getex", "log:1", "persist"}, "-" + errNoPermKey + "\r\n"},
+		{[]interface{}{"getex", "app:1", "persist"}, "+v\r\n"},
+		{[]interface{}{"get", "other"}, "-" + errNoPermKey + "\r\n"},
+		{[]interface{}{"flushall"}, "-NOPERM User app has no permissions to run the 'flushall' command\r\n"},
+		{[]interface{}{"config", "set", "hz", "20"}, "-NOPERM User app has no permissions to run the 'config' command\r\n"},
+		{[]interface{}{"config", "get", "hz"}, "*2\r\n+hz\r\n+10\r\n"},
+		{[]interface{}{"acl", "whoami"}, "+app\r\n"},
+		{[]interface{}{"acl", "list"}, "-NOPERM User app has no permissions to run the 'acl|list' command\r\n"},
+		{[]interface{}{"publish", "news.today", "hi"}, ":0\r\n"},
+		{[]interface{}{"publish", "sports", "hi"}, "-" + errNoPermChan + "\r\n"},
+		{[]interface{}{"psubscribe", "news.*x"}, "-" + errNoPermChan + "\r\n"},
+		{[]interface{}{"eval", "return redis.call('get', KEYS[1])", "1", "other"}, "-" + errNoPermKey + "\r\n"},
+		{[]interface{}{"eval", "return redis.call('flushall')", "0"}, "-NOPERM User app has no permissions to run the 'flushall' command\r\n"},
+	} {
+		runCommand(cc, tc.args)
+		if reply := readReply(t, mconn); !strings.HasPrefix(reply, strings.TrimSuffix(tc.reply, "\r\n")) {
+			t.Errorf("%v replied %q, expected %q", tc.args, reply, tc.reply)
+		}
+	}
+
+	runCommand(cc, []interface{}{"auth", "default", ""})
+	mconn.Reset()
+	runCommand(cc, []interface{}{"acl", "log", "2"})
+	reply := readReply(t, mconn)
+	for _, field := range []string{"+reason\r\n+command\r\n", "+context\r\n+lua\r\n", "+object\r\n+flushall\r\n", "+username\r\n+app\r\n"} {
+		if !strings.Contains(reply, field) {
+			t.Errorf("%q missing in the ACL log %q", field, reply)
+		}
+	}
+	if !strings.HasPrefix(reply, "*2\r\n") {
+		t.Errorf("expected 2 log entries, got %q", reply)
+	}
+	if n := len(srv.aclLog); n != 10 {
+		t.Errorf("%d entries in the ACL log", n)
+	}
+	if stat := srv.stats.commands["flushall"]; stat == nil || stat.rejected != 1 {
+		t.Errorf("the denied flushall is not counted as rejected: %+v", stat)
+	}
+}
+
+func TestACLUsers(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	hash := hashPassword("pw")
+	runCommand(cc, []interface{}{"acl", "setuser", "bob", "on", "#" + hash, "~k*", "resetchannels", "+@read", "-get"})
+	runCommand(cc, []interface{}{"acl", "setuser", "bob", "off", "+nosuch"})
+	runCommand(cc, []interface{}{"acl", "setuser", "bob", "<nope"})
+	runCommand(cc, []interface{}{"acl", "users"})
+	expected := "+OK\r\n" +
+		"-ERR Error in ACL SETUSER modifier '+nosuch': Unknown command or category name in ACL\r\n" +
+		"-ERR Error in ACL SETUSER modifier '<nope': The password you are trying to remove from the user does not exist\r\n" +
+		"*2\r\n+bob\r\n+default\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+
+	runCommand(cc, []interface{}{"acl", "list"})
+	expected = "*2\r\n+user bob on #" + hash + " ~k* resetchannels -@all +@read -get\r\n+user default on nopass ~* &* +@all\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+	runCommand(cc, []interface{}{"acl", "getuser", "bob"})
+	expected = "*12\r\n+flags\r\n*1\r\n+on\r\n+passwords\r\n*1\r\n+" + hash +
+		"\r\n+commands\r\n+-@all +@read -get\r\n+keys\r\n+~k*\r\n+channels\r\n+\r\n+selectors\r\n*0\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+
+	bob := NewConnOverride()
+	bc := srv.addClient(bob)
+	runCommand(bc, []interface{}{"auth", "bob", "pw"})
+	runCommand(bc, []interface{}{"exists", "k1"})
+	runCommand(bc, []interface{}{"get", "k1"})
+	if reply := readReply(t, bob); reply != "+OK\r\n:0\r\n-NOPERM User bob has no permissions to run the 'get' command\r\n" {
+		t.Errorf("got %q", reply)
+	}
+	runCommand(cc, []interface{}{"client", "kill", "user", "nobody"})
+	runCommand(cc, []interface{}{"client", "kill", "user", "bob"})
+	if reply := readReply(t, mconn); reply != ":0\r\n:1\r\n" {
+		t.Errorf("CLIENT KILL USER replied %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"acl", "cat", "scripting"})
+	if reply := readReply(t, mconn); !strings.Contains(reply, "+eval\r\n") || strings.Contains(reply, "+get\r\n") {
+		t.Errorf("invalid scripting category %q", reply)
+	}
+	runCommand(cc, []interface{}{"acl", "cat", "nosuch"})
+	runCommand(cc, []interface{}{"acl", "deluser", "default"})
+	runCommand(cc, []interface{}{"acl", "deluser", "bob", "nobody"})
+	runCommand(cc, []interface{}{"acl", "getuser", "bob"})
+	expected = "-ERR Unknown category 'nosuch'\r\n-ERR The 'default' user cannot be removed\r\n:1\r\n-1\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+}
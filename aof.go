@@ -0,0 +1,393 @@
+package localredis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The fsync policies of the append only file.
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
+// appendOnlyFile logs every write command in RESP form, like the AOF of
+// redis. Commands are fed with the server lock held.
+type appendOnlyFile struct {
+	mu       sync.Mutex
+	path     string
+	fsync    string
+	file     *os.File
+	selected int
+	closed   bool
+	done     chan struct{}
+
+	rewriting       bool
+	rewriteBuf      []byte
+	rewriteSelected int
+	lastRewriteErr  error
+}
+
+func validFsync(policy string) bool {
+	return policy == FsyncAlways || policy == FsyncEverySec || policy == FsyncNo
+}
+
+func newAppendOnlyFile(path, fsync string, file *os.File) *appendOnlyFile {
+	a := &appendOnlyFile{
+		path:     path,
+		fsync:    fsync,
+		file:     file,
+		selected: -1,
+		done:     make(chan struct{}),
+	}
+	go a.syncEverySecond()
+	return a
+}
+
+func (a *appendOnlyFile) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			file, policy := a.file, a.fsync
+			a.mu.Unlock()
+			if policy == FsyncEverySec {
+				file.Sync()
+			}
+		}
+	}
+}
+
+func appendRESPCommand(buf []byte, args []string) []byte {
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		buf = append(buf, createBulkString(arg)...)
+	}
+	return buf
+}
+
+// appendSelected appends args to buf, preceded by a SELECT when the
+// database db is not the one selected last in buf.
+func appendSelected(buf []byte, selected *int, db int, args []string) []byte {
+	if db != *selected {
+		buf = appendRESPCommand(buf, []string{"SELECT", strconv.Itoa(db)})
+		*selected = db
+	}
+	return appendRESPCommand(buf, args)
+}
+
+func (a *appendOnlyFile) feed(db int, args []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	buf := appendSelected(nil, &a.selected, db, args)
+	_, err := a.file.Write(buf)
+	if a.fsync == FsyncAlways {
+		a.file.Sync()
+	}
+	if a.rewriting {
+		a.rewriteBuf = appendSelected(a.rewriteBuf, &a.rewriteSelected, db, args)
+	}
+	return err
+}
+
+func (a *appendOnlyFile) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	close(a.done)
+	a.file.Sync()
+	return a.file.Close()
+}
+
+// propagate feeds a write command executed on the database db to the
+// append only file and to the replicas, the server lock must be held. A
+// replica forwards the stream of its master as is instead.
+func (s *Client) propagate(db int, args ...string) {
+	if s.aof != nil {
+		if err := s.aof.feed(db, args); err != nil {
+			s.log().Error("writing to the AOF file failed", "path", s.aof.path, "err", err)
+		}
+	}
+	if s.replica == nil {
+		s.feedReplicas(appendSelected(nil, &s.replSelected, db, args))
+	}
+}
+
+// propagatedCommand reports whether the command is logged as is, scripts
+// are logged by the effects of their commands instead.
+func propagatedCommand(name string, args []interface{}) bool {
+	switch name {
+	case "eval", "evalsha", "fcall":
+		return false
+	case "function":
+		if len(args) == 0 {
+			return false
+		}
+		switch strings.ToLower(argString(args[0])) {
+		case "load", "delete", "flush", "restore":
+			return true
+		}
+		return false
+	}
+	return writeCommands[name]
+}
+
+// propagationArgs returns the command to log for a write command that
+// succeeded, relative expirations are turned into absolute ones so the
+// replay doesn't extend the life of the keys.
+func propagationArgs(db *database, name string, vals []interface{}) []string {
+	args := make([]string, len(vals))
+	for i, v := range vals {
+		args[i] = argString(v)
+	}
+	switch name {
+	case "set":
+		if len(args) < 3 {
+			return args
+		}
+		until, ok := db.timeout[args[1]]
+		if !ok {
+			return args
+		}
+		return []string{args[0], args[1], args[2], "PXAT", strconv.FormatInt(until.UnixMilli(), 10)}
+	case "getex":
+		if len(args) < 3 {
+			return nil
+		}
+		key := args[1]
+		if strings.ToLower(args[2]) == "persist" {
+			return []string{"PERSIST", key}
+		}
+		until, ok := db.timeout[key]
+		val, exists := db.load(key)
+		if !ok || !exists {
+			return nil
+		}
+		return []string{"SET", key, argString(val), "PXAT", strconv.FormatInt(until.UnixMilli(), 10)}
+	case "restore":
+		if len(args) < 4 {
+			return args
+		}
+		if _, ok := db.load(args[1]); !ok {
+			// restored with an expiration already passed
+			return []string{"DEL", args[1]}
+		}
+		ttl := "0"
+		if until, ok := db.timeout[args[1]]; ok {
+			ttl = strconv.FormatInt(until.UnixMilli(), 10)
+		}
+		restored := []string{args[0], args[1], ttl, args[3]}
+		for i := 4; i < len(args); i++ {
+			if strings.ToLower(args[i]) != "absttl" {
+				restored = append(restored, args[i])
+			}
+		}
+		return append(restored, "ABSTTL")
+	}
+	return args
+}
+
+// OpenAOF starts logging the write commands to the append only file at
+// path. An existing file is replayed first, replacing the content of the
+// server, otherwise the file is created from the current content.
+func (s *Client) OpenAOF(path, fsync string) error {
+	if !validFsync(fsync) {
+		return fmt.Errorf("invalid fsync policy %q, expected one of always, everysec, no", fsync)
+	}
+	s.mu.Lock()
+	defer s.unlock()
+	if s.aof != nil {
+		s.aof.close()
+		s.aof = nil
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		valid, err := s.replayAOF(data)
+		if err != nil {
+			return err
+		}
+		if valid < len(data) {
+			s.log().Warn("short read while loading the AOF file, truncating it", "path", path, "offset", valid)
+			if err := os.Truncate(path, int64(valid)); err != nil {
+				return err
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		return s.createAOF(path, fsync)
+	default:
+		return err
+	}
+	return s.appendAOF(path, fsync)
+}
+
+// createAOF starts the append only file at path from the current content
+// of the server, the server lock must be held.
+func (s *Client) createAOF(path, fsync string) error {
+	if err := writeSnapshot(path, s.rdbSnapshot()); err != nil {
+		return err
+	}
+	return s.appendAOF(path, fsync)
+}
+
+func (s *Client) appendAOF(path, fsync string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.aof = newAppendOnlyFile(path, fsync, file)
+	s.appendonly = true
+	s.aofFsync = fsync
+	return nil
+}
+
+// CloseAOF syncs and closes the append only file, the write commands are
+// not logged anymore.
+func (s *Client) CloseAOF() error {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.aof == nil {
+		return nil
+	}
+	err := s.aof.close()
+	s.aof = nil
+	s.appendonly = false
+	return err
+}
+
+// OpenAOF starts the append only file of the default server.
+func OpenAOF(path, fsync string) error {
+	return defaultClient.OpenAOF(path, fsync)
+}
+
+// CloseAOF closes the append only file of the default server.
+func CloseAOF() error {
+	return defaultClient.CloseAOF()
+}
+
+// replayAOF runs the commands of an append only file, with or without an
+// RDB preamble, and returns the length of its valid part. A command cut
+// at the end of the file, e.g. by a crash while writing it, is ignored.
+func (s *Client) replayAOF(data []byte) (int, error) {
+	for _, db := range s.dbs {
+		db.flush()
+	}
+	pos := 0
+	if bytes.HasPrefix(data, []byte("REDIS")) {
+		n, err := s.loadRDB(data)
+		if err != nil {
+			return 0, err
+		}
+		pos = n
+	}
+	out := NewConnOverride()
+	cc := newClientConn(s, out)
+	for pos < len(data) {
+		n := frameLength(data[pos:])
+		if n < 0 {
+			break
+		}
+		if data[pos] != byte(arrayType) {
+			return 0, fmt.Errorf("Bad file format reading the append only file at offset %d", pos)
+		}
+		vals, _, err := fetchArray(data[pos : pos+n])
+		if err != nil || len(vals) == 0 {
+			return 0, fmt.Errorf("Bad file format reading the append only file at offset %d", pos)
+		}
+		name := strings.ToLower(argString(vals[0]))
+		cmd, ok := commandMap[name]
+		if !ok {
+			return 0, fmt.Errorf("Unknown command '%s' reading the append only file", argString(vals[0]))
+		}
+		cmd(cc, vals[1:])
+		out.Reset()
+		pos += n
+	}
+	return pos, nil
+}
+
+// bgrewriteaof compacts the log: the current content is written as an
+// RDB preamble in the background while the new commands are kept aside,
+// then appended to it before the new file replaces the old one.
+func bgrewriteaof(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	a := s.aof
+	if a == nil {
+		SendError(c, "ERR Append only file is not enabled")
+		return
+	}
+	a.mu.Lock()
+	if a.rewriting {
+		a.mu.Unlock()
+		SendError(c, "ERR Background append only file rewriting already in progress")
+		return
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	a.rewriteSelected = -1
+	a.mu.Unlock()
+	data := s.rdbSnapshot()
+	go func() {
+		tmp := filepath.Join(filepath.Dir(a.path), fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := os.WriteFile(tmp, data, 0o644)
+		s.mu.Lock()
+		defer s.unlock()
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.rewriting = false
+		if err == nil && !a.closed {
+			err = a.swap(tmp)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			s.log().Error("background AOF rewrite failed", "err", err)
+		}
+		a.lastRewriteErr = err
+	}()
+	c.Write([]byte(createSimpleString("Background append only file rewriting started")))
+}
+
+// swap appends the commands logged during the rewrite to tmp and puts it
+// in place of the log, a.mu must be held.
+func (a *appendOnlyFile) swap(tmp string) error {
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(a.rewriteBuf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		file.Close()
+		return err
+	}
+	a.file.Close()
+	a.file = file
+	a.selected = a.rewriteSelected
+	a.rewriteBuf = nil
+	return nil
+}
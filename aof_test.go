@@ -0,0 +1,131 @@
+package localredis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAOFLogAndReplay(t *testing.T) {
+	useCommand(t, "set", setmap)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv := NewClient()
+	if err := srv.OpenAOF(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	commands := [][]interface{}{
+		{"set", "a", "1"},
+		{"set", "ttl", "v", "ex", "100"},
+		{"set", "gone", "v"},
+		{"del", "gone"},
+		{"select", "2"},
+		{"set", "b", "2"},
+		{"get", "b"},
+		{"set", "bad", "v", "ex", "nan"},
+		{"eval", "redis.call('set', KEYS[1], ARGV[1])", "1", "scripted", "3"},
+	}
+	for _, cmd := range commands {
+		runCommand(cc, cmd)
+	}
+	if err := srv.CloseAOF(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	for _, unexpected := range []string{"$3\r\nget\r\n", "$3\r\nbad\r\n", "$4\r\neval\r\n", "$2\r\nex\r\n"} {
+		if strings.Contains(log, unexpected) {
+			t.Errorf("unexpected %q in the log", unexpected)
+		}
+	}
+	if !strings.Contains(log, "$4\r\nPXAT\r\n") {
+		t.Error("relative expiration not logged as PXAT")
+	}
+
+	// a command cut by a crash is dropped from the log
+	truncated := append(data, "*3\r\n$3\r\nset\r\n$1\r\nc"...)
+	if err := os.WriteFile(path, truncated, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewClient()
+	if err := loaded.OpenAOF(path, FsyncNo); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.CloseAOF()
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Errorf("truncated tail not removed, size %d expected %d", info.Size(), len(data))
+	}
+	expected := map[int]map[string]string{
+		0: {"a": "1", "ttl": "v"},
+		2: {"b": "2", "scripted": "3"},
+	}
+	for db, keys := range expected {
+		for k, v := range keys {
+			if got, _ := loaded.dbs[db].load(k); got != v {
+				t.Errorf("db %d key %s replayed as %v, expected %s", db, k, got, v)
+			}
+		}
+	}
+	if _, ok := loaded.dbs[0].load("gone"); ok {
+		t.Error("deleted key replayed")
+	}
+	if ttl := time.Until(loaded.dbs[0].timeout["ttl"]); ttl < 90*time.Second || ttl > 100*time.Second {
+		t.Errorf("invalid replayed expiration %v", ttl)
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	useCommand(t, "set", setmap)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv := NewClient()
+	if err := srv.OpenAOF(path, FsyncEverySec); err != nil {
+		t.Fatal(err)
+	}
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	for i := 0; i < 50; i++ {
+		runCommand(cc, []interface{}{"set", "counter", argString(i)})
+	}
+	runCommand(cc, []interface{}{"select", "1"})
+	mconn.Reset()
+	before, _ := os.Stat(path)
+
+	runCommand(cc, []interface{}{"bgrewriteaof"})
+	if reply := readReply(t, mconn); reply != "+Background append only file rewriting started\r\n" {
+		t.Fatalf("invalid bgrewriteaof reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"set", "during", "rewrite"})
+	for rewriting := true; rewriting; {
+		srv.aof.mu.Lock()
+		rewriting = srv.aof.rewriting
+		srv.aof.mu.Unlock()
+	}
+	runCommand(cc, []interface{}{"set", "after", "rewrite"})
+	if err := srv.CloseAOF(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("log not compacted, %d bytes before and %d after", before.Size(), after.Size())
+	}
+
+	loaded := NewClient()
+	if err := loaded.OpenAOF(path, FsyncNo); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.CloseAOF()
+	if v, _ := loaded.dbs[0].load("counter"); v != "49" {
+		t.Errorf("invalid counter after rewrite, got %v", v)
+	}
+	for _, k := range []string{"during", "after"} {
+		if v, _ := loaded.dbs[1].load(k); v != "rewrite" {
+			t.Errorf("key %s written around the rewrite lost, got %v", k, v)
+		}
+	}
+}
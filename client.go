@@ -1,15 +1,16 @@
 package localredis
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,19 +20,149 @@ var (
 	integerRegex      = regexp.MustCompile(`:\d+\r\n`)
 	bulkStringRegex   = regexp.MustCompile(`\$\d+\r\n`)
 	arrayRegex        = regexp.MustCompile(`\*\d+\r\n`)
-	defaultClient     = Client{
-		storage: sync.Map{},
-		persist: map[string]bool{},
-		timeout: map[string]time.Time{},
-	}
+	defaultClient     *Client
 )
 
+func init() {
+	// not initialized with the variables as the server refers to it
+	// through the keyspace notifications
+	defaultClient = NewClient()
+}
+
 type redisType byte
 type Client struct {
-	listener net.Listener
-	storage  sync.Map
-	persist  map[string]bool
-	timeout  map[string]time.Time
+	// listeners are served concurrently, the first TCP one is the port
+	// of the server.
+	listeners []net.Listener
+	mu        sync.Mutex
+	dbs       []*database
+	scripts   map[string]string
+
+	// busy is the script being run, read by the clients waiting on mu
+	// through busyMu.
+	busyMu             sync.Mutex
+	busy               *busyScript
+	busyReplyThreshold int
+
+	libraries map[string]*library
+	functions map[string]*function
+
+	dir           string
+	dbFilename    string
+	lastSave      time.Time
+	dirty         int
+	bgsaveRunning bool
+	lastBgsaveErr error
+	aof           *appendOnlyFile
+
+	configFile       string
+	databases        int
+	maxmemory        int64
+	maxmemoryPolicy  string
+	maxmemorySamples int
+	lfuLogFactor     int
+	lfuDecayTime     int
+	evictionPool     []evictionCandidate
+
+	// the thresholds of the compact encodings replied by OBJECT ENCODING
+	hashMaxListpackEntries int
+	hashMaxListpackValue   int
+	setMaxIntsetEntries    int
+	setMaxListpackEntries  int
+	setMaxListpackValue    int
+	zsetMaxListpackEntries int
+	zsetMaxListpackValue   int
+	listMaxListpackSize    int
+
+	maxclients      int
+	timeout         int64 // seconds, accessed atomically
+	hz              int
+	requirepass     string
+	appendonly      bool
+	aofFilename     string
+	aofFsync        string
+	replicaReadOnly bool
+	backlogSize     int64
+
+	replica          *replicaLink
+	replID           string
+	replID2          string
+	replOffset       int64
+	secondReplOffset int64
+	replSynced       bool
+	replSelected     int
+	replStreamDB     int
+	replicas         []*attachedReplica
+	backlog          *replBacklog
+	replAcked        *sync.Cond
+
+	runID      string
+	started    time.Time
+	stats      serverStats
+	memoryPeak int64
+
+	blockedClients int
+
+	// cronStop stops the serverCron running while there are listeners
+	cronStop chan struct{}
+
+	slowlog           []slowlogEntry
+	slowlogID         int64
+	slowlogSlowerThan int
+	slowlogMaxLen     int
+	latency           map[string]*latencyEvent
+	latencyThreshold  int
+
+	notifyFlags int
+
+	users        map[string]*aclUser
+	aclLog       []*aclLogEntry
+	aclLogID     int64
+	aclLogMaxLen int
+
+	sentinel *sentinelState
+	cluster  *clusterNode
+
+	channels map[string]map[*ClientConn]bool
+	patterns map[string]map[*ClientConn]bool
+	monitors map[*ClientConn]bool
+	// pushTargets are the clients with messages queued by push
+	pushTargets map[*ClientConn]bool
+
+	logger atomic.Value
+
+	clientsMu    sync.Mutex
+	clients      map[int64]*ClientConn
+	lastClientID int64
+	pausedUntil  time.Time
+	pauseAll     bool
+}
+
+func NewClient() *Client {
+	s := &Client{
+		clients: map[int64]*ClientConn{},
+		scripts: map[string]string{},
+
+		libraries: map[string]*library{},
+		functions: map[string]*function{},
+
+		channels: map[string]map[*ClientConn]bool{},
+		patterns: map[string]map[*ClientConn]bool{},
+		monitors: map[*ClientConn]bool{},
+		users:    map[string]*aclUser{"default": newDefaultUser()},
+
+		lastSave: time.Now(),
+		runID:    newReplID(),
+		started:  time.Now(),
+
+		replID:           newReplID(),
+		replID2:          strings.Repeat("0", 40),
+		secondReplOffset: -1,
+		replSelected:     -1,
+	}
+	s.replAcked = sync.NewCond(&s.mu)
+	s.setConfigDefaults()
+	return s
 }
 
 const (
@@ -40,6 +171,14 @@ const (
 	integerType      redisType = ':'
 	bulkStringType   redisType = '$'
 	arrayType        redisType = '*'
+	nullType         redisType = '_'
+	booleanType      redisType = '#'
+	doubleType       redisType = ','
+	bigNumberType    redisType = '('
+	verbatimType     redisType = '='
+	mapType          redisType = '%'
+	setType          redisType = '~'
+	pushType         redisType = '>'
 	terminal                   = "\r\n"
 	bufferLength               = 4096
 )
@@ -163,22 +302,38 @@ func fetchError(inputbytes []byte) (errstr error, pos int, err error) {
 	return fmt.Errorf("%s", string(inputbytes[loc[0]+1:loc[1]-2])), loc[1], nil
 }
 
+// ListenAndServe serves the default server on addressPort.
 func ListenAndServe(addressPort string) error {
+	return defaultClient.ListenAndServe(addressPort)
+}
+
+// ListenAndServe listens on the TCP address addressPort and serves the
+// connections until the listener is closed.
+func (s *Client) ListenAndServe(addressPort string) error {
 	l, err := net.Listen("tcp", addressPort)
-	defaultClient.listener = l
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if l != nil {
-			l.Close()
-		}
-	}()
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l, several servers can be served in
+// the same process each with its own listeners, and a server can serve
+// several listeners at once.
+func (s *Client) Serve(l net.Listener) error {
+	s.addListener(l)
+	s.log().Info("accepting connections", "network", l.Addr().Network(), "addr", l.Addr().String())
+	defer s.removeListener(l)
+	defer l.Close()
 	acceptingFailure := 0
 	errorStackTrace := []error{}
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.log().Warn("accepting a connection failed", "err", err)
 			if acceptingFailure < 10 {
 				errorStackTrace = append(errorStackTrace, err)
 			} else {
@@ -190,105 +345,196 @@ func ListenAndServe(addressPort string) error {
 				return fmt.Errorf(strings.Join(msgString, "\n"))
 			}
 			acceptingFailure++
+			continue
 		}
-		go handleCommand(c)
+		rejected := s.tooManyClients()
+		s.countConnection(rejected)
+		if rejected {
+			c.Write([]byte("-ERR max number of clients reached\r\n"))
+			c.Close()
+			continue
+		}
+		go s.handleCommand(c)
+	}
+}
+
+// tooManyClients tells whether the connected clients reached maxclients.
+func (s *Client) tooManyClients() bool {
+	s.mu.Lock()
+	max := s.maxclients
+	s.unlock()
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	return len(s.clients) >= max
+}
+
+// countConnection counts an accepted connection in the stats.
+func (s *Client) countConnection(rejected bool) {
+	s.mu.Lock()
+	defer s.unlock()
+	s.stats.connectionsReceived++
+	if rejected {
+		s.stats.rejectedConnections++
 	}
 }
 
-func handleCommand(c net.Conn) {
+func (s *Client) handleCommand(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	c := s.addClient(conn)
 	defer func() {
-		if c != nil {
-			c.Close()
-		}
+		s.mu.Lock()
+		s.removeReplica(c)
+		s.unsubscribeAll(c)
+		delete(s.monitors, c)
+		s.unlock()
+		s.removeClient(c)
+		c.Close()
 	}()
+	s.log().Debug("client connected", "conn", c.id, "addr", c.RemoteAddr().String())
 	var prevbuf []byte
 	for {
-		buff := make([]byte, bufferLength)
-		if c == nil {
-			return
+		// the clients idle for the timeout are closed, except the
+		// subscribers and the replicas
+		deadline := time.Time{}
+		if timeout := atomic.LoadInt64(&s.timeout); timeout > 0 && c.subscriptions() == 0 && !c.replica {
+			deadline = time.Now().Add(time.Duration(timeout) * time.Second)
 		}
+		c.SetReadDeadline(deadline)
+		buff := make([]byte, bufferLength)
 		n, err := c.Read(buff)
-		if errors.Is(err, io.EOF) || n <= 0 {
+		var netErr net.Error
+		switch {
+		case errors.Is(err, io.EOF) || n <= 0:
+			s.log().Debug("client disconnected", "conn", c.id)
 			return
-		} else if err != nil {
-			log.Println(err)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			s.log().Debug("closing idle client", "conn", c.id)
+			return
+		case err != nil:
+			s.log().Warn("reading from client failed", "conn", c.id, "err", err)
 			return
 		}
 		var rest []byte
-		log.Println("prevbuf:", string(prevbuf))
 		if len(prevbuf) > 0 {
 			rest = append(prevbuf, buff[:n]...)
 		} else {
 			rest = buff[:n]
 		}
-		log.Println("currbuf:", string(rest))
-		_, rest, err = interpret(c, rest)
-		if err != nil {
-			log.Println(err)
-			return
+		// pipelined clients send several commands in a single write, so
+		// every complete frame is interpreted before reading again.
+		for len(rest) > 0 {
+			framelen := frameLength(rest)
+			if framelen < 0 {
+				break
+			}
+			_, _, err = interpret(c, rest[:framelen])
+			if err != nil {
+				s.log().Warn("protocol error", "conn", c.id, "err", err)
+				return
+			}
+			rest = rest[framelen:]
 		}
-		log.Println("rest:", string(rest))
 		if len(rest) > 0 {
-			prevbuf = append(prevbuf, rest...)
+			prevbuf = append([]byte{}, rest...)
 		} else {
-			log.Println("rest is empty")
+			prevbuf = nil
 		}
 	}
 }
 
+// frameLength returns the length of the first complete frame in buf, or -1
+// when more bytes are needed to complete it.
+func frameLength(buf []byte) int {
+	if len(buf) == 0 {
+		return -1
+	}
+	line := bytes.Index(buf, []byte(terminal))
+	switch redisType(buf[0]) {
+	case simpleStringType, errorType, integerType:
+		if line < 0 {
+			return -1
+		}
+		return line + 2
+	case bulkStringType:
+		if line < 0 {
+			return -1
+		}
+		num, err := strconv.Atoi(string(buf[1:line]))
+		if err != nil || num < 0 {
+			return line + 2
+		}
+		total := line + 2 + num + 2
+		if len(buf) < total {
+			return -1
+		}
+		return total
+	case arrayType:
+		if line < 0 {
+			return -1
+		}
+		num, err := strconv.Atoi(string(buf[1:line]))
+		if err != nil || num < 0 {
+			return line + 2
+		}
+		pos := line + 2
+		for i := 0; i < num; i++ {
+			elemlen := frameLength(buf[pos:])
+			if elemlen < 0 {
+				return -1
+			}
+			pos += elemlen
+		}
+		return pos
+	default:
+		newline := bytes.IndexByte(buf, '\n')
+		if newline < 0 {
+			return -1
+		}
+		return newline + 1
+	}
+}
+
 func interpret(c net.Conn, buff []byte) (complete bool, restbuf []byte, err error) {
 	restbuf = buff
 	switch redisType(buff[0]) {
 	case simpleStringType:
-		str, idx, errstr := fetchSimpleString(buff)
+		_, idx, errstr := fetchSimpleString(buff)
 		restbuf = buff[idx:]
-		log.Println(errstr)
-		log.Println(str)
 		err = errstr
 	case integerType:
-		valint, idx, errstr := fetchInteger(buff)
+		_, idx, errstr := fetchInteger(buff)
 		restbuf = buff[idx:]
-		log.Println(errstr)
-		log.Println(valint)
 		err = errstr
 	case bulkStringType:
-		str, idx, errstr := fetchBulkString(buff)
+		_, idx, errstr := fetchBulkString(buff)
 		restbuf = buff[idx:]
-		log.Println(str)
 		err = errstr
 	case arrayType:
 		vals, idx, errstr := fetchArray(buff)
 		restbuf = buff[idx:]
-		log.Println(vals)
 		err = errstr
 		runCommand(c, vals)
 	case errorType:
 		if len(buff) > 1 && buff[1] == '1' {
 			return
 		}
-		valerr, idx, errstr := fetchError(buff)
+		_, idx, errstr := fetchError(buff)
 		restbuf = buff[idx:]
-		log.Println(valerr)
 		err = errstr
 
 	default:
-		inline := strings.Split(string(buff), "\n")
+		inline := strings.Fields(string(buff))
 		restbuf = []byte{}
 		if len(inline) < 1 {
 			return
 		}
-		cmd, ok := commandMap[strings.ToLower(inline[0])]
-		if !ok {
-			return
+		args := make([]interface{}, len(inline))
+		for i, s := range inline {
+			args[i] = s
 		}
-		var args []interface{}
-		if len(inline) > 1 {
-			args = make([]interface{}, len(inline[1:]))
-			for i, s := range inline[1:] {
-				args[i] = s
-			}
-		}
-		cmd(c, args)
+		runCommand(c, args)
 	}
 	return
 }
@@ -306,43 +552,71 @@ func createSimpleString(input string) string {
 }
 
 func createArrayRepr(arrs []interface{}) (result string) {
-	result = fmt.Sprintf("*%d\r\n", len(arrs))
+	return createAggregate(arrayType, arrs, 2)
+}
+
+func createAggregate(kind redisType, arrs []interface{}, proto int) (result string) {
+	result = fmt.Sprintf("%c%d\r\n", kind, len(arrs))
 	for _, ar := range arrs {
-		switch varr := ar.(type) {
-		case int:
-			result += createNumRepr(varr)
-		case string:
-			if strings.Contains(varr, "\n") || strings.Contains(varr, "\x00") {
-				result += createBulkString(varr)
-			} else {
-				result += createSimpleString(varr)
-			}
-		case []interface{}:
-			result += createArrayRepr(varr)
-		}
+		result += createReply(ar, proto)
 	}
 	return
 }
 
+// CreateReply encodes arg as a RESP2 reply.
 func CreateReply(arg interface{}) (result string) {
+	return createReply(arg, 2)
+}
+
+// createReply encodes arg for the protocol version proto. RESP3 only
+// types are downgraded to their RESP2 counterpart when proto is 2.
+func createReply(arg interface{}, proto int) (result string) {
 	switch v := arg.(type) {
 	case string:
-		if strings.Contains(v, "\n") || strings.Contains(v, "\x00") {
+		// simple strings are kept for RESP2 compatibility, RESP3 clients
+		// always get values as blob strings.
+		if proto >= 3 || strings.Contains(v, "\n") || strings.Contains(v, "\x00") {
 			result = createBulkString(v)
 		} else {
 			result = createSimpleString(v)
 		}
 	case int:
 		result = createNumRepr(v)
+	case int64:
+		result = createNumRepr(int(v))
 	case []interface{}:
-		result = createArrayRepr(v)
+		result = createAggregate(arrayType, v, proto)
+	case nil:
+		if proto >= 3 {
+			result = string(nullType) + terminal
+		} else {
+			result = "$-1" + terminal
+		}
+	case error:
+		result = fmt.Sprintf("-%s\r\n", v.Error())
+	default:
+		result = createResp3Reply(arg, proto)
 	}
 	return
 }
 
+// Close stops the default server.
 func Close() error {
-	if defaultClient.listener != nil {
-		return defaultClient.listener.Close()
+	return defaultClient.Close()
+}
+
+// Close stops accepting connections and detaches the replicas.
+func (s *Client) Close() error {
+	s.mu.Lock()
+	defer s.unlock()
+	s.stopSentinel()
+	for _, r := range s.replicas {
+		r.close()
+	}
+	s.replicas = nil
+	if s.replica != nil {
+		s.replica.close()
+		s.replica = nil
 	}
-	return nil
+	return s.closeListeners()
 }
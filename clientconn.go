@@ -0,0 +1,569 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type replyMode int
+
+const (
+	replyOn replyMode = iota
+	replyOff
+	replySkip
+)
+
+// ClientConn is the per-connection state that is passed as the net.Conn
+// to every CommandExecutioner. Handlers that need the selected database,
+// client name or protocol version can get it back with clientOf.
+type ClientConn struct {
+	net.Conn
+	srv *Client
+
+	id      int64
+	name    string
+	libName string
+	libVer  string
+	db      int
+	proto   int
+	noEvict bool
+	// user is nil for the internal clients, e.g. the link to the master,
+	// which are not subject to the ACL
+	user          *aclUser
+	authenticated bool
+	reply         replyMode
+	failed        bool
+	replPort      int
+	replica       bool
+	master        bool
+	monitoring    bool
+	channels      map[string]bool
+	patterns      map[string]bool
+	asking        bool
+	created       time.Time
+	lastCmd       string
+	lastTouch     int64
+
+	// pushed are the messages sent by the other clients, written once
+	// the server lock is released. writeMu keeps them in order with the
+	// replies.
+	pushMu  sync.Mutex
+	pushed  []byte
+	writeMu sync.Mutex
+}
+
+func newClientConn(srv *Client, c net.Conn) *ClientConn {
+	cc := &ClientConn{
+		Conn:    c,
+		srv:     srv,
+		proto:   2,
+		created: time.Now(),
+	}
+	cc.lastTouch = cc.created.UnixNano()
+	return cc
+}
+
+// clientOf returns the connection state of c. Connections not created by
+// the server, e.g. ConnOverride in tests, get a fresh default state.
+func clientOf(c net.Conn) *ClientConn {
+	if cc, ok := c.(*ClientConn); ok {
+		return cc
+	}
+	return newClientConn(defaultClient, c)
+}
+
+func (cc *ClientConn) Write(b []byte) (int, error) {
+	// the RESP2 nil of SendNil is not an error
+	if len(b) > 0 && b[0] == byte(errorType) && string(b) != "-1\r\n" {
+		cc.failed = true
+	}
+	if cc.reply != replyOn {
+		return len(b), nil
+	}
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	cc.writePushed()
+	return cc.Conn.Write(b)
+}
+
+// flushPushed writes the queued messages unless another goroutine is
+// writing to the client, which then writes them too. The client being
+// slow only blocks that goroutine.
+func (cc *ClientConn) flushPushed() {
+	for cc.hasPushed() && cc.writeMu.TryLock() {
+		cc.writePushed()
+		cc.writeMu.Unlock()
+	}
+}
+
+func (cc *ClientConn) hasPushed() bool {
+	cc.pushMu.Lock()
+	defer cc.pushMu.Unlock()
+	return len(cc.pushed) > 0
+}
+
+// writePushed writes the queued messages, writeMu must be held.
+func (cc *ClientConn) writePushed() {
+	cc.pushMu.Lock()
+	data := cc.pushed
+	cc.pushed = nil
+	cc.pushMu.Unlock()
+	if len(data) > 0 {
+		cc.Conn.Write(data)
+	}
+}
+
+// userName is the name of the user of the client, as ACL WHOAMI replies.
+func (cc *ClientConn) userName() string {
+	if cc.user == nil {
+		return "default"
+	}
+	return cc.user.name
+}
+
+func (cc *ClientConn) ID() int64 {
+	return cc.id
+}
+
+func (cc *ClientConn) Name() string {
+	return cc.name
+}
+
+// touch records cmd as the last command of the client, the server lock
+// must be held as CLIENT LIST reads it.
+func (cc *ClientConn) touch(cmd string) {
+	cc.lastCmd = cmd
+	atomic.StoreInt64(&cc.lastTouch, time.Now().UnixNano())
+}
+
+func (cc *ClientConn) flags() string {
+	flags := ""
+	if cc.noEvict {
+		flags += "e"
+	}
+	if cc.replica {
+		flags += "S"
+	}
+	if cc.monitoring {
+		flags += "O"
+	}
+	if cc.subscriptions() > 0 {
+		flags += "P"
+	}
+	if la := cc.LocalAddr(); la != nil && la.Network() == "unix" {
+		flags += "U"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	return flags
+}
+
+// clientType is the class of the client matched by the TYPE filter of
+// CLIENT LIST and CLIENT KILL.
+func (cc *ClientConn) clientType() string {
+	switch {
+	case cc.master:
+		return "master"
+	case cc.replica:
+		return "replica"
+	case cc.subscriptions() > 0:
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// parseClientType checks the TYPE argument, slave is the old name of
+// replica.
+func parseClientType(arg interface{}) (string, error) {
+	switch typ := strings.ToLower(argString(arg)); typ {
+	case "normal", "master", "replica", "pubsub":
+		return typ, nil
+	case "slave":
+		return "replica", nil
+	}
+	return "", fmt.Errorf("ERR Unknown client type '%s'", argString(arg))
+}
+
+func (cc *ClientConn) info() string {
+	now := time.Now()
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&cc.lastTouch)))
+	laddr := ""
+	if la := cc.LocalAddr(); la != nil {
+		laddr = la.String()
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=-1 cmd=%s user=%s resp=%d lib-name=%s lib-ver=%s",
+		cc.id, cc.RemoteAddr().String(), laddr, cc.name,
+		int(now.Sub(cc.created).Seconds()), int(idle.Seconds()),
+		cc.flags(), cc.db, len(cc.channels), len(cc.patterns), cc.lastCmd, cc.userName(), cc.proto, cc.libName, cc.libVer)
+}
+
+func (s *Client) addClient(c net.Conn) *ClientConn {
+	cc := newClientConn(s, c)
+	s.mu.Lock()
+	cc.user = s.users["default"]
+	cc.authenticated = cc.user.enabled && cc.user.nopass
+	s.unlock()
+	s.clientsMu.Lock()
+	s.lastClientID++
+	cc.id = s.lastClientID
+	s.clients[cc.id] = cc
+	s.clientsMu.Unlock()
+	return cc
+}
+
+func (s *Client) removeClient(cc *ClientConn) {
+	s.clientsMu.Lock()
+	delete(s.clients, cc.id)
+	s.clientsMu.Unlock()
+}
+
+func (s *Client) listClients() []*ClientConn {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	list := make([]*ClientConn, 0, len(s.clients))
+	for _, cc := range s.clients {
+		list = append(list, cc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// waitPause blocks while the server is paused by CLIENT PAUSE for the
+// command cmd.
+func (s *Client) waitPause(cmd string) {
+	for {
+		s.clientsMu.Lock()
+		until, all := s.pausedUntil, s.pauseAll
+		s.clientsMu.Unlock()
+		left := time.Until(until)
+		if left <= 0 || (!all && !writeCommands[cmd]) {
+			return
+		}
+		if left > 10*time.Millisecond {
+			left = 10 * time.Millisecond
+		}
+		time.Sleep(left)
+	}
+}
+
+var clientSubcommands = map[string]CommandExecutioner{
+	"id":       clientID,
+	"setname":  clientSetname,
+	"getname":  clientGetname,
+	"setinfo":  clientSetinfo,
+	"list":     clientList,
+	"info":     clientInfo,
+	"kill":     clientKill,
+	"pause":    clientPause,
+	"unpause":  clientUnpause,
+	"no-evict": clientNoEvict,
+	"reply":    clientReply,
+}
+
+func clientCommand(c net.Conn, args []interface{}) {
+	if len(args) < 1 {
+		SendError(c, "ERR wrong number of arguments for 'client' command")
+		return
+	}
+	sub := strings.ToLower(argString(args[0]))
+	cmd, ok := clientSubcommands[sub]
+	if !ok {
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", argString(args[0])))
+		return
+	}
+	cmd(c, args[1:])
+}
+
+func clientID(c net.Conn, args []interface{}) {
+	SendValue(c, int(clientOf(c).id))
+}
+
+func clientSetname(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'client|setname' command")
+		return
+	}
+	name := argString(args[0])
+	if strings.ContainsAny(name, " \n\r") {
+		SendError(c, "ERR Client names cannot contain spaces, newlines or special characters.")
+		return
+	}
+	clientOf(c).name = name
+	SendOk(c)
+}
+
+func clientGetname(c net.Conn, args []interface{}) {
+	cc := clientOf(c)
+	if cc.name == "" {
+		SendNil(c)
+		return
+	}
+	SendBulk(c, cc.name)
+}
+
+func clientSetinfo(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'client|setinfo' command")
+		return
+	}
+	cc := clientOf(c)
+	switch attr := strings.ToLower(argString(args[0])); attr {
+	case "lib-name":
+		cc.libName = argString(args[1])
+	case "lib-ver":
+		cc.libVer = argString(args[1])
+	default:
+		SendError(c, fmt.Sprintf("ERR Unrecognized option '%s'", argString(args[0])))
+		return
+	}
+	SendOk(c)
+}
+
+func clientList(c net.Conn, args []interface{}) {
+	var (
+		ids map[int64]bool
+		typ string
+	)
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(argString(args[i])) {
+		case "type":
+			if i+1 >= len(args) {
+				SendError(c, "ERR syntax error")
+				return
+			}
+			i++
+			var err error
+			if typ, err = parseClientType(args[i]); err != nil {
+				SendError(c, err.Error())
+				return
+			}
+		case "id":
+			ids = map[int64]bool{}
+			for _, v := range args[i+1:] {
+				id, err := argInt(v)
+				if err != nil {
+					SendError(c, "ERR Invalid client ID")
+					return
+				}
+				ids[int64(id)] = true
+			}
+			i = len(args)
+		default:
+			SendError(c, "ERR syntax error")
+			return
+		}
+	}
+	var sb strings.Builder
+	for _, cc := range clientOf(c).srv.listClients() {
+		if ids != nil && !ids[cc.id] || typ != "" && cc.clientType() != typ {
+			continue
+		}
+		sb.WriteString(cc.info())
+		sb.WriteString("\n")
+	}
+	SendBulk(c, sb.String())
+}
+
+func clientInfo(c net.Conn, args []interface{}) {
+	SendBulk(c, clientOf(c).info()+"\n")
+}
+
+// clientKill supports both the old `CLIENT KILL addr:port` form and the
+// filter form, e.g. `CLIENT KILL ID 5 SKIPME no`.
+func clientKill(c net.Conn, args []interface{}) {
+	self := clientOf(c)
+	if len(args) == 1 {
+		addr := argString(args[0])
+		for _, cc := range self.srv.listClients() {
+			if cc.RemoteAddr().String() == addr {
+				self.srv.kill(cc)
+				SendOk(c)
+				return
+			}
+		}
+		SendError(c, "ERR No such client")
+		return
+	}
+	if len(args)%2 != 0 {
+		SendError(c, "ERR syntax error")
+		return
+	}
+	type filter func(*ClientConn) bool
+	filters := []filter{}
+	skipme := true
+	for i := 0; i < len(args); i += 2 {
+		val := argString(args[i+1])
+		switch strings.ToLower(argString(args[i])) {
+		case "id":
+			id, err := argInt(args[i+1])
+			if err != nil {
+				SendError(c, "ERR client-id should be greater than 0")
+				return
+			}
+			filters = append(filters, func(cc *ClientConn) bool { return cc.id == int64(id) })
+		case "addr":
+			filters = append(filters, func(cc *ClientConn) bool { return cc.RemoteAddr().String() == val })
+		case "laddr":
+			filters = append(filters, func(cc *ClientConn) bool {
+				return cc.LocalAddr() != nil && cc.LocalAddr().String() == val
+			})
+		case "user":
+			filters = append(filters, func(cc *ClientConn) bool { return cc.userName() == val })
+		case "type":
+			typ, err := parseClientType(val)
+			if err != nil {
+				SendError(c, err.Error())
+				return
+			}
+			filters = append(filters, func(cc *ClientConn) bool { return cc.clientType() == typ })
+		case "maxage":
+			age, err := argInt(args[i+1])
+			if err != nil {
+				SendError(c, "ERR syntax error")
+				return
+			}
+			filters = append(filters, func(cc *ClientConn) bool {
+				return time.Since(cc.created) >= time.Duration(age)*time.Second
+			})
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			default:
+				SendError(c, "ERR syntax error")
+				return
+			}
+		default:
+			SendError(c, "ERR syntax error")
+			return
+		}
+	}
+	killed := 0
+	for _, cc := range self.srv.listClients() {
+		if skipme && cc.id == self.id {
+			continue
+		}
+		match := true
+		for _, f := range filters {
+			if !f(cc) {
+				match = false
+				break
+			}
+		}
+		if match {
+			self.srv.kill(cc)
+			killed++
+		}
+	}
+	SendValue(c, killed)
+}
+
+func (s *Client) kill(cc *ClientConn) {
+	s.removeClient(cc)
+	cc.Conn.Close()
+}
+
+func clientPause(c net.Conn, args []interface{}) {
+	if len(args) < 1 || len(args) > 2 {
+		SendError(c, "ERR wrong number of arguments for 'client|pause' command")
+		return
+	}
+	ms, err := argInt(args[0])
+	if err != nil || ms < 0 {
+		SendError(c, "ERR timeout is not an integer or out of range")
+		return
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToLower(argString(args[1])) {
+		case "all":
+		case "write":
+			all = false
+		default:
+			SendError(c, "ERR syntax error")
+			return
+		}
+	}
+	s := clientOf(c).srv
+	s.clientsMu.Lock()
+	s.pausedUntil = time.Now().Add(time.Duration(ms) * time.Millisecond)
+	s.pauseAll = all
+	s.clientsMu.Unlock()
+	SendOk(c)
+}
+
+func clientUnpause(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	s.clientsMu.Lock()
+	s.pausedUntil = time.Time{}
+	s.clientsMu.Unlock()
+	SendOk(c)
+}
+
+func clientNoEvict(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'client|no-evict' command")
+		return
+	}
+	switch strings.ToLower(argString(args[0])) {
+	case "on":
+		clientOf(c).noEvict = true
+	case "off":
+		clientOf(c).noEvict = false
+	default:
+		SendError(c, "ERR syntax error")
+		return
+	}
+	SendOk(c)
+}
+
+func clientReply(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'client|reply' command")
+		return
+	}
+	cc := clientOf(c)
+	switch strings.ToLower(argString(args[0])) {
+	case "on":
+		cc.reply = replyOn
+		SendOk(c)
+	case "off":
+		cc.reply = replyOff
+	case "skip":
+		// runCommand turns the replies back on after the next command.
+		cc.reply = replySkip
+	default:
+		SendError(c, "ERR syntax error")
+	}
+}
+
+func argString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case int:
+		return strconv.Itoa(val)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func argInt(v interface{}) (int, error) {
+	switch val := v.(type) {
+	case int:
+		return val, nil
+	case string:
+		return strconv.Atoi(val)
+	}
+	return 0, fmt.Errorf("invalid integer %v", v)
+}
@@ -0,0 +1,156 @@
+package localredis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readReply(t *testing.T, conn *ConnOverride) string {
+	t.Helper()
+	buff := make([]byte, 4096)
+	nread, err := conn.Read(buff)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	return string(buff[:nread])
+}
+
+// useCommand dispatches name to exec during the test, e.g. the real set
+// which TestCommandOverriding leaves overridden, then puts back the
+// previous command.
+func useCommand(t *testing.T, name string, exec CommandExecutioner) {
+	t.Helper()
+	prev := commandMap[name]
+	CommandOverride(name, exec)
+	t.Cleanup(func() { CommandOverride(name, prev) })
+}
+
+func TestClientSetnameGetname(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	defer srv.removeClient(cc)
+
+	runCommand(cc, []interface{}{"client", "getname"})
+	if reply := readReply(t, mconn); reply != "-1\r\n" {
+		t.Errorf("invalid reply, expected nil, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"client", "setname", "worker 1"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("invalid reply, expected error for name with space, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"CLIENT", "SETNAME", "worker-1"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Errorf("invalid reply, expected OK, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"client", "getname"})
+	if reply := readReply(t, mconn); reply != createBulkString("worker-1") {
+		t.Errorf("invalid reply, expected worker-1, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"client", "id"})
+	if reply := readReply(t, mconn); reply != createNumRepr(int(cc.ID())) {
+		t.Errorf("invalid reply, expected id %d, got %q", cc.ID(), reply)
+	}
+	runCommand(cc, []interface{}{"client", "list"})
+	if reply := readReply(t, mconn); !strings.Contains(reply, "name=worker-1") {
+		t.Errorf("client list does not contain the client name: %q", reply)
+	}
+}
+
+func TestClientListConcurrent(t *testing.T) {
+	srv := NewClient()
+	mconn, lconn := NewConnOverride(), NewConnOverride()
+	cc, lc := srv.addClient(mconn), srv.addClient(lconn)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			runCommand(cc, []interface{}{"ping"})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		runCommand(lc, []interface{}{"client", "list"})
+	}
+	<-done
+	lconn.Reset()
+	runCommand(lc, []interface{}{"client", "list"})
+	if reply := readReply(t, lconn); !strings.Contains(reply, "cmd=ping") {
+		t.Errorf("last command of the client missing in %q", reply)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	srv := NewClient()
+	self := srv.addClient(NewConnOverride())
+	other := srv.addClient(NewConnOverride())
+	mconn := self.Conn.(*ConnOverride)
+
+	runCommand(self, []interface{}{"client", "kill", "id", "9999"})
+	if reply := readReply(t, mconn); reply != ":0\r\n" {
+		t.Errorf("invalid reply, expected 0 killed, got %q", reply)
+	}
+	runCommand(self, []interface{}{"client", "kill", "type", "normal"})
+	if reply := readReply(t, mconn); reply != ":1\r\n" {
+		t.Errorf("invalid reply, expected 1 killed, got %q", reply)
+	}
+	clients := srv.listClients()
+	if len(clients) != 1 || clients[0] != self {
+		t.Errorf("expected only the calling client left, got %d clients", len(clients))
+	}
+	if _, ok := srv.clients[other.ID()]; ok {
+		t.Error("killed client still registered")
+	}
+}
+
+func TestClientType(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	self := srv.addClient(mconn)
+	normal := srv.addClient(NewConnOverride())
+	replica := srv.addClient(NewConnOverride())
+	replica.replica = true
+	subscriber := srv.addClient(NewConnOverride())
+	runCommand(subscriber, []interface{}{"subscribe", "news"})
+
+	runCommand(self, []interface{}{"client", "list", "type", "pubsub"})
+	if reply := readReply(t, mconn); !strings.Contains(reply, fmt.Sprintf("id=%d ", subscriber.ID())) || strings.Count(reply, "id=") != 1 {
+		t.Errorf("invalid pubsub clients %q", reply)
+	}
+	runCommand(self, []interface{}{"client", "list", "type", "bogus"})
+	runCommand(self, []interface{}{"client", "kill", "type", "normal"})
+	runCommand(self, []interface{}{"client", "kill", "type", "slave"})
+	runCommand(self, []interface{}{"client", "kill", "type", "master"})
+	expected := "-ERR Unknown client type 'bogus'\r\n:1\r\n:1\r\n:0\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+	clients := srv.listClients()
+	if len(clients) != 2 || clients[0] != self || clients[1] != subscriber {
+		t.Errorf("expected the calling client and the subscriber left, got %d clients", len(clients))
+	}
+	if _, ok := srv.clients[normal.ID()]; ok {
+		t.Error("normal client still registered")
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"client", "reply", "skip"})
+	runCommand(cc, []interface{}{"ping"})
+	runCommand(cc, []interface{}{"ping"})
+	if reply := readReply(t, mconn); reply != "+PONG\r\n" {
+		t.Errorf("expected only the second PONG, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"client", "reply", "off"})
+	runCommand(cc, []interface{}{"ping"})
+	runCommand(cc, []interface{}{"client", "reply", "on"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Errorf("expected only OK after turning replies on, got %q", reply)
+	}
+}
@@ -0,0 +1,570 @@
+package localredis
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterSlots is the number of hash slots the keys are split into.
+const clusterSlots = 16384
+
+// crc16 is the CRC16-CCITT (XMODEM) used by redis cluster to hash keys.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key. Only the part between the first
+// `{` and the next `}` is hashed when not empty, so keys sharing a
+// `{hashtag}` are in the same slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key))) % clusterSlots
+}
+
+// keySpec locates the keys in the arguments of a command like the key
+// specs of redis: from the argument first to last, negative counting
+// from the end, every step arguments.
+type keySpec struct {
+	first, last, step int
+}
+
+// commandKeySpecs are the keys of the commands, checked against the
+// slots served by a cluster node.
+var commandKeySpecs = map[string]keySpec{
+	"set":     {1, 1, 1},
+	"get":     {1, 1, 1},
+	"getex":   {1, 1, 1},
+	"persist": {1, 1, 1},
+	"ttl":     {1, 1, 1},
+	"pptl":    {1, 1, 1},
+	"type":    {1, 1, 1},
+	"dump":    {1, 1, 1},
+	"restore": {1, 1, 1},
+	"exists":  {1, -1, 1},
+	"del":     {1, -1, 1},
+	"move":    {1, 1, 1},
+	"object":  {2, 2, 1},
+	"memory":  {2, 2, 1},
+}
+
+// commandKeys returns the keys of a command, the scripts declare theirs
+// after numkeys.
+func commandKeys(name string, args []interface{}) []string {
+	switch name {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		keys, _, err := parseKeysArgs(args)
+		if err != nil {
+			return nil
+		}
+		return argStrings(keys)
+	}
+	spec, ok := commandKeySpecs[name]
+	if !ok || len(args) < spec.first {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args) + 1
+	}
+	var keys []string
+	for i := spec.first; i <= last && i <= len(args); i += spec.step {
+		keys = append(keys, argString(args[i-1]))
+	}
+	return keys
+}
+
+// Cluster is a set of servers in cluster mode sharing the hash slots, a
+// key is only served by the node owning its slot and the others redirect
+// the clients to it.
+type Cluster struct {
+	// mu guards the slots and the migrations, it is taken after the lock
+	// of a server.
+	mu           sync.Mutex
+	nodes        []*clusterNode
+	slots        [clusterSlots]*clusterNode
+	migrating    map[int]*clusterNode
+	currentEpoch int
+
+	// migrateMu serializes the key moves, taken before the server locks.
+	migrateMu sync.Mutex
+}
+
+type clusterNode struct {
+	id          string
+	srv         *Client
+	host        string
+	port        int
+	configEpoch int
+	cluster     *Cluster
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+// StartCluster starts a server in cluster mode on each address, e.g.
+// 127.0.0.1:0 for a random port, and splits the slots evenly between
+// them in order like redis-cli --cluster create.
+func StartCluster(addrs ...string) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to start the cluster on")
+	}
+	c := &Cluster{migrating: map[int]*clusterNode{}, currentEpoch: len(addrs)}
+	for i, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		tcpAddr := l.Addr().(*net.TCPAddr)
+		node := &clusterNode{
+			id:          newReplID(),
+			srv:         NewClient(),
+			host:        tcpAddr.IP.String(),
+			port:        tcpAddr.Port,
+			configEpoch: i + 1,
+			cluster:     c,
+		}
+		node.srv.cluster = node
+		node.srv.addListener(l)
+		c.nodes = append(c.nodes, node)
+		go node.srv.Serve(l)
+	}
+	perNode := float64(clusterSlots) / float64(len(c.nodes))
+	first, cursor := 0, 0.0
+	for i, node := range c.nodes {
+		last := int(math.Round(cursor + perNode - 1))
+		if last >= clusterSlots || i == len(c.nodes)-1 {
+			last = clusterSlots - 1
+		}
+		for slot := first; slot <= last; slot++ {
+			c.slots[slot] = node
+		}
+		cursor += perNode
+		first = last + 1
+	}
+	return c, nil
+}
+
+// Servers returns the nodes of the cluster in the order of their
+// addresses.
+func (c *Cluster) Servers() []*Client {
+	servers := make([]*Client, len(c.nodes))
+	for i, node := range c.nodes {
+		servers[i] = node.srv
+	}
+	return servers
+}
+
+// Addrs returns the addresses the nodes listen on.
+func (c *Cluster) Addrs() []string {
+	addrs := make([]string, len(c.nodes))
+	for i, node := range c.nodes {
+		addrs[i] = node.addr()
+	}
+	return addrs
+}
+
+// SlotOwner returns the node serving the slot.
+func (c *Cluster) SlotOwner(slot int) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slots[slot].srv
+}
+
+// Close stops all the nodes.
+func (c *Cluster) Close() error {
+	var firstErr error
+	for _, node := range c.nodes {
+		if err := node.srv.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *Cluster) nodeOf(srv *Client) *clusterNode {
+	for _, node := range c.nodes {
+		if node.srv == srv {
+			return node
+		}
+	}
+	return nil
+}
+
+// MigrateSlot starts moving slot to the node to, like CLUSTER SETSLOT
+// MIGRATING and IMPORTING. Until FinishMigration, the owner keeps serving
+// the keys it still has and answers ASK for the others, which are served
+// by to after ASKING.
+func (c *Cluster) MigrateSlot(slot int, to *Client) error {
+	if slot < 0 || slot >= clusterSlots {
+		return errors.New("ERR Invalid or out of range slot")
+	}
+	target := c.nodeOf(to)
+	if target == nil {
+		return errors.New("ERR Unknown node")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots[slot] == target {
+		return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+	}
+	if _, ok := c.migrating[slot]; ok {
+		return fmt.Errorf("ERR Slot %d is already being migrated", slot)
+	}
+	c.migrating[slot] = target
+	return nil
+}
+
+// MigrateKeys moves keys of a slot being migrated to its new node, like
+// MIGRATE does.
+func (c *Cluster) MigrateKeys(slot int, keys ...string) error {
+	c.migrateMu.Lock()
+	defer c.migrateMu.Unlock()
+	c.mu.Lock()
+	source, target := c.slots[slot], c.migrating[slot]
+	c.mu.Unlock()
+	if target == nil {
+		return fmt.Errorf("ERR Slot %d is not being migrated", slot)
+	}
+	for _, key := range keys {
+		if KeySlot(key) != slot {
+			return fmt.Errorf("ERR Key %s is not in slot %d", key, slot)
+		}
+	}
+	c.moveKeys(source, target, slot, keys, false)
+	return nil
+}
+
+// FinishMigration moves the remaining keys of the slot and gives it to
+// its new node, the old one answers MOVED from then on.
+func (c *Cluster) FinishMigration(slot int) error {
+	c.migrateMu.Lock()
+	defer c.migrateMu.Unlock()
+	c.mu.Lock()
+	source, target := c.slots[slot], c.migrating[slot]
+	c.mu.Unlock()
+	if target == nil {
+		return fmt.Errorf("ERR Slot %d is not being migrated", slot)
+	}
+	c.moveKeys(source, target, slot, nil, true)
+	return nil
+}
+
+// moveKeys moves keys of the slot from the database 0 of source to the
+// one of target with their expiration, all the keys of the slot when
+// finishing the migration, which then gives the slot to target.
+func (c *Cluster) moveKeys(source, target *clusterNode, slot int, keys []string, finish bool) {
+	src, dst := source.srv, target.srv
+	src.mu.Lock()
+	defer src.unlock()
+	dst.mu.Lock()
+	defer dst.unlock()
+	from, to := src.dbs[0], dst.dbs[0]
+	if finish {
+		keys = keysInSlot(from, slot, -1)
+		defer func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.slots[slot] = target
+			delete(c.migrating, slot)
+			c.currentEpoch++
+			target.configEpoch = c.currentEpoch
+		}()
+	}
+	for _, key := range keys {
+		value, ok := from.load(key)
+		if !ok {
+			continue
+		}
+		until, volatile := from.timeout[key]
+		to.remove(key)
+		to.store(key, value)
+		ttl := "0"
+		if volatile {
+			to.timeout[key] = until
+			go dst.expireAfter(to, key, time.Until(until))
+			ttl = strconv.FormatInt(until.UnixMilli(), 10)
+		}
+		from.remove(key)
+		dst.propagate(0, "RESTORE", key, ttl, dumpPayload(value), "REPLACE", "ABSTTL")
+		src.propagate(0, "DEL", key)
+	}
+}
+
+// keysInSlot returns up to count keys of db in the slot, all of them
+// when count is negative.
+func keysInSlot(db *database, slot, count int) []string {
+	var keys []string
+	for _, key := range db.keys() {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		if KeySlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// clusterCheck returns the error redirecting a command sent to the wrong
+// node, or an empty string when the node serves it. The lock of the
+// server must be held.
+func (node *clusterNode) clusterCheck(cc *ClientConn, name string, args []interface{}) string {
+	switch name {
+	case "select":
+		if len(args) == 1 && argString(args[0]) != "0" {
+			return "ERR SELECT is not allowed in cluster mode"
+		}
+	case "move", "swapdb":
+		return fmt.Sprintf("ERR %s is not allowed in cluster mode", strings.ToUpper(name))
+	}
+	keys := commandKeys(name, args)
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+	c := node.cluster
+	c.mu.Lock()
+	owner, target := c.slots[slot], c.migrating[slot]
+	c.mu.Unlock()
+	switch {
+	case owner == node && target != nil:
+		db := node.srv.dbs[cc.db]
+		for _, key := range keys {
+			if _, ok := db.load(key); !ok {
+				return fmt.Sprintf("ASK %d %s", slot, target.addr())
+			}
+		}
+	case owner == node:
+	case target == node && cc.asking:
+	default:
+		return fmt.Sprintf("MOVED %d %s", slot, owner.addr())
+	}
+	return ""
+}
+
+func asking(c net.Conn, args []interface{}) {
+	cc := clientOf(c)
+	if cc.srv.cluster == nil {
+		SendError(c, "ERR This instance has cluster support disabled")
+		return
+	}
+	cc.asking = true
+	SendOk(c)
+}
+
+// readonlyCommand handles READONLY and READWRITE, the nodes have no
+// replicas so they only check the cluster mode.
+func readonlyCommand(c net.Conn, args []interface{}) {
+	if clientOf(c).srv.cluster == nil {
+		SendError(c, "ERR This instance has cluster support disabled")
+		return
+	}
+	SendOk(c)
+}
+
+// slotRanges returns the contiguous ranges of slots owned by node.
+func (c *Cluster) slotRanges(node *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+func (c *Cluster) nodesLine(node, self *clusterNode) string {
+	flags := "master"
+	if node == self {
+		flags = "myself,master"
+	}
+	line := fmt.Sprintf("%s %s@%d %s - 0 %d %d connected",
+		node.id, node.addr(), node.port+10000, flags, time.Now().UnixMilli(), node.configEpoch)
+	for _, r := range c.slotRanges(node) {
+		if r[0] == r[1] {
+			line += fmt.Sprintf(" %d", r[0])
+		} else {
+			line += fmt.Sprintf(" %d-%d", r[0], r[1])
+		}
+	}
+	if node == self {
+		slots := make([]int, 0, len(c.migrating))
+		for slot := range c.migrating {
+			slots = append(slots, slot)
+		}
+		sort.Ints(slots)
+		for _, slot := range slots {
+			target := c.migrating[slot]
+			if c.slots[slot] == self {
+				line += fmt.Sprintf(" [%d->-%s]", slot, target.id)
+			} else if target == self {
+				line += fmt.Sprintf(" [%d-<-%s]", slot, c.slots[slot].id)
+			}
+		}
+	}
+	return line
+}
+
+// clusterCommand handles the CLUSTER subcommands.
+func clusterCommand(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'cluster' command")
+		return
+	}
+	sub := strings.ToLower(argString(args[0]))
+	if sub == "keyslot" {
+		if len(args) != 2 {
+			SendError(c, "ERR wrong number of arguments for 'cluster|keyslot' command")
+			return
+		}
+		SendValue(c, KeySlot(argString(args[1])))
+		return
+	}
+	self := s.cluster
+	if self == nil {
+		SendError(c, "ERR This instance has cluster support disabled")
+		return
+	}
+	cl := self.cluster
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	slotArg := func() (int, bool) {
+		slot, err := strconv.Atoi(argString(args[1]))
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			SendError(c, "ERR Invalid or out of range slot")
+			return 0, false
+		}
+		return slot, true
+	}
+	switch sub {
+	case "myid":
+		SendBulk(c, self.id)
+	case "info":
+		fields := []string{
+			"cluster_state:ok",
+			fmt.Sprintf("cluster_slots_assigned:%d", clusterSlots),
+			fmt.Sprintf("cluster_slots_ok:%d", clusterSlots),
+			"cluster_slots_pfail:0",
+			"cluster_slots_fail:0",
+			fmt.Sprintf("cluster_known_nodes:%d", len(cl.nodes)),
+			fmt.Sprintf("cluster_size:%d", len(cl.nodes)),
+			fmt.Sprintf("cluster_current_epoch:%d", cl.currentEpoch),
+			fmt.Sprintf("cluster_my_epoch:%d", self.configEpoch),
+			"cluster_stats_messages_sent:0",
+			"cluster_stats_messages_received:0",
+			"total_cluster_links_buffer_limit_exceeded:0",
+		}
+		SendValue(c, RespVerbatim{Format: "txt", Text: strings.Join(fields, "\r\n") + "\r\n"})
+	case "nodes":
+		var b strings.Builder
+		for _, node := range cl.nodes {
+			b.WriteString(cl.nodesLine(node, self) + "\n")
+		}
+		SendValue(c, RespVerbatim{Format: "txt", Text: b.String()})
+	case "slots":
+		slots := []interface{}{}
+		for _, node := range cl.nodes {
+			for _, r := range cl.slotRanges(node) {
+				slots = append(slots, []interface{}{r[0], r[1],
+					[]interface{}{node.host, node.port, node.id, RespMap{}}})
+			}
+		}
+		SendValue(c, slots)
+	case "shards":
+		shards := []interface{}{}
+		for _, node := range cl.nodes {
+			ranges := []interface{}{}
+			for _, r := range cl.slotRanges(node) {
+				ranges = append(ranges, r[0], r[1])
+			}
+			// the locks of the other nodes can't be taken here
+			offset := int64(0)
+			if node == self {
+				offset = s.replOffset
+			}
+			shards = append(shards, RespMap{
+				"slots", ranges,
+				"nodes", []interface{}{RespMap{
+					"id", node.id,
+					"port", node.port,
+					"ip", node.host,
+					"endpoint", node.host,
+					"role", "master",
+					"replication-offset", int(offset),
+					"health", "online",
+				}},
+			})
+		}
+		SendValue(c, shards)
+	case "countkeysinslot":
+		if len(args) != 2 {
+			SendError(c, "ERR wrong number of arguments for 'cluster|countkeysinslot' command")
+			return
+		}
+		if slot, ok := slotArg(); ok {
+			SendValue(c, len(keysInSlot(s.dbs[0], slot, -1)))
+		}
+	case "getkeysinslot":
+		if len(args) != 3 {
+			SendError(c, "ERR wrong number of arguments for 'cluster|getkeysinslot' command")
+			return
+		}
+		slot, ok := slotArg()
+		if !ok {
+			return
+		}
+		count, err := strconv.Atoi(argString(args[2]))
+		if err != nil || count < 0 {
+			SendError(c, "ERR Invalid number of keys")
+			return
+		}
+		SendValue(c, stringValues(keysInSlot(s.dbs[0], slot, count)))
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", argString(args[0])))
+	}
+}
+
+func clusterInfo(s *Client) []string {
+	if s.sentinel != nil {
+		return nil
+	}
+	if s.cluster != nil {
+		return []string{"cluster_enabled:1"}
+	}
+	return []string{"cluster_enabled:0"}
+}
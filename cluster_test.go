@@ -0,0 +1,121 @@
+package localredis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	if sum := crc16([]byte("123456789")); sum != 0x31c3 {
+		t.Errorf("invalid crc16, got %#x", sum)
+	}
+	for key, slot := range map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": KeySlot("user1000"),
+		"{user1000}.followers": KeySlot("user1000"),
+		"foo{}{bar}":           int(crc16([]byte("foo{}{bar}"))) % clusterSlots,
+		"foo{{bar}}zap":        KeySlot("{bar"),
+	} {
+		if got := KeySlot(key); got != slot {
+			t.Errorf("invalid slot of %s, got %d expected %d", key, got, slot)
+		}
+	}
+}
+
+func TestClusterRedirects(t *testing.T) {
+	useCommand(t, "set", setmap)
+	cluster, err := StartCluster("127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	servers, addrs := cluster.Servers(), cluster.Addrs()
+	conns := make([]*ConnOverride, len(servers))
+	clients := make([]*ClientConn, len(servers))
+	for i, srv := range servers {
+		conns[i] = NewConnOverride()
+		clients[i] = srv.addClient(conns[i])
+	}
+	send := func(node int, cmd ...interface{}) string {
+		runCommand(clients[node], cmd)
+		return readReply(t, conns[node])
+	}
+
+	reply := send(0, "cluster", "slots")
+	for i, r := range [][2]int{{0, 5460}, {5461, 10922}, {10923, 16383}} {
+		port := addrs[i][strings.LastIndexByte(addrs[i], ':')+1:]
+		if entry := fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*4\r\n+127.0.0.1\r\n:%s\r\n", r[0], r[1], port); !strings.Contains(reply, entry) {
+			t.Errorf("range %v of node %d missing from %q", r, i, reply)
+		}
+	}
+	if reply := send(1, "cluster", "info"); !strings.Contains(reply, "cluster_state:ok\r\n") || !strings.Contains(reply, "cluster_known_nodes:3\r\n") {
+		t.Errorf("invalid cluster info %q", reply)
+	}
+	if reply := send(1, "cluster", "keyslot", "foo"); reply != ":12182\r\n" {
+		t.Errorf("invalid keyslot reply, got %q", reply)
+	}
+
+	if reply := send(0, "set", "foo", "1"); reply != "-MOVED 12182 "+addrs[2]+"\r\n" {
+		t.Errorf("invalid redirect, got %q", reply)
+	}
+	if reply := send(0, "object", "idletime", "foo"); reply != "-MOVED 12182 "+addrs[2]+"\r\n" {
+		t.Errorf("invalid object redirect, got %q", reply)
+	}
+	if reply := send(0, "memory", "usage", "foo"); reply != "-MOVED 12182 "+addrs[2]+"\r\n" {
+		t.Errorf("invalid memory redirect, got %q", reply)
+	}
+	if reply := send(2, "set", "foo", "1"); reply != "+OK\r\n" {
+		t.Errorf("key refused by its node, got %q", reply)
+	}
+	if reply := send(2, "del", "foo", "bar"); reply != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+		t.Errorf("invalid multi-key reply, got %q", reply)
+	}
+	if reply := send(2, "select", "1"); reply != "-ERR SELECT is not allowed in cluster mode\r\n" {
+		t.Errorf("invalid select reply, got %q", reply)
+	}
+
+	// {tag} hashes to 8338, owned by node 1 and moved to node 0
+	slot := KeySlot("{tag}")
+	for _, key := range []string{"{tag}a", "{tag}b"} {
+		if reply := send(1, "set", key, key[len(key)-1:]); reply != "+OK\r\n" {
+			t.Fatalf("key %s refused by its node, got %q", key, reply)
+		}
+	}
+	if err := cluster.MigrateSlot(slot, servers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.MigrateKeys(slot, "{tag}a"); err != nil {
+		t.Fatal(err)
+	}
+	if reply := send(1, "cluster", "nodes"); !strings.Contains(reply, fmt.Sprintf("[%d->-", slot)) {
+		t.Errorf("migration missing from cluster nodes %q", reply)
+	}
+	if reply, expected := send(1, "get", "{tag}a"), fmt.Sprintf("-ASK %d %s\r\n", slot, addrs[0]); reply != expected {
+		t.Errorf("invalid reply for a migrated key, got %q expected %q", reply, expected)
+	}
+	if reply := send(1, "get", "{tag}b"); reply != "+b\r\n" {
+		t.Errorf("key not migrated yet not served, got %q", reply)
+	}
+	if reply := send(0, "get", "{tag}a"); !strings.HasPrefix(reply, "-MOVED") {
+		t.Errorf("importing slot served without ASKING, got %q", reply)
+	}
+	send(0, "asking")
+	if reply := send(0, "get", "{tag}a"); reply != "+a\r\n" {
+		t.Errorf("importing slot not served after ASKING, got %q", reply)
+	}
+
+	if err := cluster.FinishMigration(slot); err != nil {
+		t.Fatal(err)
+	}
+	if reply, expected := send(1, "get", "{tag}b"), fmt.Sprintf("-MOVED %d %s\r\n", slot, addrs[0]); reply != expected {
+		t.Errorf("invalid reply after the migration, got %q expected %q", reply, expected)
+	}
+	if reply := send(0, "get", "{tag}b"); reply != "+b\r\n" {
+		t.Errorf("key lost by the migration, got %q", reply)
+	}
+	if owner := cluster.SlotOwner(slot); owner != servers[0] {
+		t.Error("slot not given to the new node")
+	}
+}
@@ -1,16 +1,151 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"log"
+	"net"
+	"os"
+	"strconv"
 
 	"github.com/mashingan/localredis"
 )
 
-var raddr = flag.String("addr", redisListenAddr, "set address to listen")
+var (
+	raddr    = flag.String("addr", redisListenAddr, "set address to listen")
+	config   = flag.String("config", "", "configuration file in the redis.conf format")
+	loglevel = flag.String("loglevel", "info", "level of the messages logged: debug, info, warn, error or none")
+	metrics  = flag.String("metrics", "", "address of the HTTP listener serving the Prometheus metrics on /metrics")
+
+	unixsocket     = flag.String("unixsocket", "", "unix socket to listen on as well, @name for an abstract socket")
+	unixsocketperm = flag.String("unixsocketperm", "0", "permissions of the unix socket file in octal, 0 leaves them as created")
+	tlsAddr        = flag.String("tls-addr", "", "address to listen on over TLS as well")
+	tlsCertFile    = flag.String("tls-cert-file", "", "certificate of the TLS listener")
+	tlsKeyFile     = flag.String("tls-key-file", "", "private key of the TLS listener")
+	tlsCACertFile  = flag.String("tls-ca-cert-file", "", "CA certificates verifying the client certificates")
+	tlsAuthClients = flag.Bool("tls-auth-clients", true, "require the TLS clients to present a certificate signed by -tls-ca-cert-file")
+
+	// the flags given on the command line override the configuration file
+	configFlags = map[string]*string{
+		"dir":            flag.String("dir", ".", "directory of the RDB snapshot and the append only file"),
+		"dbfilename":     flag.String("dbfilename", "dump.rdb", "RDB snapshot loaded at startup and written by SAVE"),
+		"appendfilename": flag.String("appendfilename", "appendonly.aof", "name of the append only file"),
+		"appendfsync":    flag.String("appendfsync", localredis.FsyncEverySec, "fsync policy of the append only file: always, everysec or no"),
+	}
+	appendonly = flag.Bool("appendonly", false, "log every write command to the append only file")
+)
+
+var logLevels = map[string]int{
+	"debug": localredis.LevelDebug,
+	"info":  localredis.LevelInfo,
+	"warn":  localredis.LevelWarn,
+	"error": localredis.LevelError,
+}
 
 func main() {
 	flag.Parse()
-	localredis.ListenAndServe(*raddr)
+	if level, ok := logLevels[*loglevel]; ok {
+		localredis.SetLogger(localredis.NewTextLogger(os.Stderr, level))
+	} else if *loglevel != "none" {
+		log.Fatalf("invalid log level %q", *loglevel)
+	}
+	var options []string
+	flag.Visit(func(f *flag.Flag) {
+		if value, ok := configFlags[f.Name]; ok {
+			options = append(options, f.Name+" "+strconv.Quote(*value))
+		} else if f.Name == "appendonly" && *appendonly {
+			options = append(options, "appendonly yes")
+		} else if f.Name == "appendonly" {
+			options = append(options, "appendonly no")
+		}
+	})
+	if err := localredis.LoadConfig(*config, options...); err != nil {
+		log.Fatalf("loading the configuration: %v", err)
+	}
+	// the append only file has the most recent data, the snapshot is
+	// only loaded when it's not used.
+	if err := localredis.Load(); err != nil {
+		log.Fatalf("loading the dataset: %v", err)
+	}
+	if *metrics != "" {
+		go func() {
+			log.Fatalf("serving the metrics: %v", localredis.ListenAndServeMetrics(*metrics))
+		}()
+	}
+	listeners, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := localredis.ServeListeners(listeners...); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listen opens the TCP listener, and the TLS and unix socket ones when
+// they are configured.
+func listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	if *raddr != "" {
+		l, err := net.Listen("tcp", *raddr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if *tlsAddr != "" {
+		config, err := tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		l, err := tls.Listen("tcp", *tlsAddr, config)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if *unixsocket != "" {
+		perm, err := strconv.ParseUint(*unixsocketperm, 8, 32)
+		if err != nil {
+			return nil, errors.New("invalid -unixsocketperm " + *unixsocketperm)
+		}
+		l, err := localredis.ListenUnix(*unixsocket, os.FileMode(perm))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+	return listeners, nil
+}
+
+func tlsConfig() (*tls.Config, error) {
+	if *tlsCertFile == "" || *tlsKeyFile == "" {
+		return nil, errors.New("-tls-addr needs -tls-cert-file and -tls-key-file")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if *tlsCACertFile != "" {
+		data, err := os.ReadFile(*tlsCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate in " + *tlsCACertFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if *tlsAuthClients {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
 }
 
 const (
@@ -2,23 +2,77 @@ package localredis
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"strings"
 	"time"
 )
 
 var commandMap = map[string]CommandExecutioner{
-	"set":     setmap,
-	"get":     getmap,
-	"ping":    pong,
-	"quit":    quit,
-	"getex":   getex,
-	"persist": persist,
-	"ttl":     ttl,
-	"pptl":    pttl,
-	"exists":  existsKeys,
-	"hello":   hello,
+	"set":      setmap,
+	"get":      getmap,
+	"ping":     pong,
+	"quit":     quit,
+	"getex":    getex,
+	"persist":  persist,
+	"ttl":      ttl,
+	"pptl":     pttl,
+	"exists":   existsKeys,
+	"del":      delKeys,
+	"hello":    hello,
+	"client":   clientCommand,
+	"select":   selectDB,
+	"swapdb":   swapDB,
+	"move":     moveKey,
+	"dbsize":   dbsize,
+	"flushdb":  flushDB,
+	"flushall": flushAll,
+	"type":     typeCommand,
+	"save":     save,
+	"bgsave":   bgsave,
+	"lastsave": lastsave,
+	"dump":     dumpKey,
+	"restore":  restoreKey,
+
+	"bgrewriteaof": bgrewriteaof,
+	"role":         role,
+	"info":         info,
+	"replconf":     replconf,
+	"psync":        psync,
+	"sync":         syncCommand,
+	"wait":         wait,
+	"subscribe":    subscribe,
+	"unsubscribe":  unsubscribe,
+	"psubscribe":   psubscribe,
+	"punsubscribe": punsubscribe,
+	"publish":      publishCommand,
+	"pubsub":       pubsubCommand,
+	"sentinel":     sentinelCommand,
+	"cluster":      clusterCommand,
+	"asking":       asking,
+	"readonly":     readonlyCommand,
+	"readwrite":    readonlyCommand,
+	"config":       configCommand,
+	"monitor":      monitor,
+	"slowlog":      slowlogCommand,
+	"latency":      latencyCommand,
+	"object":       objectCommand,
+	"memory":       memoryCommand,
+}
+
+// writeCommands lists the commands that modify the keyspace.
+var writeCommands = map[string]bool{
+	"set":      true,
+	"getex":    true,
+	"persist":  true,
+	"del":      true,
+	"swapdb":   true,
+	"move":     true,
+	"flushdb":  true,
+	"flushall": true,
+	"eval":     true,
+	"evalsha":  true,
+	"fcall":    true,
+	"restore":  true,
 }
 
 type CommandExecutioner func(net.Conn, []interface{})
@@ -28,6 +82,9 @@ func SendError(c net.Conn, msg string) (int, error) {
 }
 
 func SendNil(c net.Conn) (int, error) {
+	if clientOf(c).proto >= 3 {
+		return c.Write([]byte(string(nullType) + terminal))
+	}
 	return c.Write([]byte("-1\r\n"))
 }
 
@@ -35,9 +92,12 @@ func SendOk(c net.Conn) (int, error) {
 	return c.Write([]byte("+OK\r\n"))
 }
 
-func SendValue(c net.Conn, value interface{}) (int, error) {
-	return c.Write([]byte(CreateReply(value)))
+func SendBulk(c net.Conn, value string) (int, error) {
+	return c.Write([]byte(createBulkString(value)))
+}
 
+func SendValue(c net.Conn, value interface{}) (int, error) {
+	return c.Write([]byte(createReply(value, clientOf(c).proto)))
 }
 
 func runCommand(c net.Conn, vals []interface{}) {
@@ -50,13 +110,117 @@ func runCommand(c net.Conn, vals []interface{}) {
 		SendError(c, "invalid command type")
 		return
 	}
-	cmd, ok := commandMap[strings.ToLower(command)]
+	name := strings.ToLower(command)
+	cmd, ok := commandMap[name]
 	if !ok {
-		log.Printf("no command strings.ToLower(%s)\n", command)
+		clientOf(c).srv.log().Warn("unknown command", "conn", clientOf(c).id, "cmd", name)
 		SendOk(c)
 		return
 	}
-	cmd(c, vals[1:])
+	cc := clientOf(c)
+	cc.srv.log().Debug("command", "conn", cc.id, "cmd", name, "db", cc.db)
+	if cc.srv.sentinel != nil && !sentinelCommands[name] {
+		SendError(c, fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", command, quotedArgs(vals[1:])))
+		return
+	}
+	if cc.proto == 2 && cc.subscriptions() > 0 && !subscribedCommands[name] {
+		SendError(c, fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", name))
+		return
+	}
+	if name != "client" {
+		cc.srv.waitPause(name)
+	}
+	if cc.srv.scriptBusy(cc, name, vals[1:]) {
+		return
+	}
+	skipping := cc.reply == replySkip
+	cc.srv.mu.Lock()
+	cc.touch(name)
+	if err := cc.srv.aclCheck(cc, name, vals[1:], "toplevel"); err != "" {
+		cc.srv.rejectCommand(name)
+		cc.srv.unlock()
+		SendError(cc, err)
+		return
+	}
+	if cc.srv.replica != nil && cc.srv.replicaReadOnly && writeCommands[name] {
+		cc.srv.rejectCommand(name)
+		cc.srv.unlock()
+		SendError(cc, errReadOnlyReplica.Error())
+		return
+	}
+	if node := cc.srv.cluster; node != nil {
+		if redirect := node.clusterCheck(cc, name, vals[1:]); redirect != "" {
+			cc.srv.rejectCommand(name)
+			cc.asking = false
+			cc.srv.unlock()
+			SendError(cc, redirect)
+			return
+		}
+	}
+	if cc.srv.maxmemory > 0 && !cc.srv.evict() && oomCommands[name] {
+		cc.srv.rejectCommand(name)
+		cc.srv.unlock()
+		SendError(cc, errOOM.Error())
+		return
+	}
+	db := cc.db
+	cc.srv.feedMonitors(cc, db, cc.RemoteAddr().String(), vals)
+	cc.failed = false
+	start := time.Now()
+	cmd(cc, vals[1:])
+	elapsed := time.Since(start)
+	cc.srv.countCommand(cc, name, elapsed)
+	cc.srv.recordCommand(cc, name, vals, elapsed)
+	if !cc.failed && propagatedCommand(name, vals[1:]) {
+		if args := propagationArgs(cc.srv.dbs[db], name, vals); args != nil {
+			cc.srv.dirty++
+			cc.srv.propagate(db, args...)
+		}
+	}
+	if name != "asking" {
+		cc.asking = false
+	}
+	cc.srv.unlock()
+	if skipping && cc.reply == replySkip {
+		cc.reply = replyOn
+	}
+}
+
+// countCommand counts the execution of the command name in the stats,
+// the server lock must be held.
+func (s *Client) countCommand(cc *ClientConn, name string, elapsed time.Duration) {
+	s.stats.commandsProcessed++
+	stat := s.stats.command(name)
+	stat.calls++
+	stat.usec += elapsed.Microseconds()
+	if cc.failed {
+		stat.failed++
+		s.stats.errorReplies++
+	}
+}
+
+// lookupKeyRead loads key for a read command, counting the keyspace hits
+// and misses and recording the access for the eviction.
+func lookupKeyRead(c net.Conn, key string) (interface{}, bool) {
+	s, db := clientOf(c).srv, dbOf(c)
+	val, ok := db.load(key)
+	if ok {
+		s.stats.keyspaceHits++
+		s.touchKey(db, key)
+	} else {
+		s.stats.keyspaceMisses++
+		notify(c, notifyKeyMiss, "keymiss", key)
+	}
+	return val, ok
+}
+
+// quotedArgs formats the arguments of an unknown command for its error.
+func quotedArgs(args []interface{}) string {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "'%s' ", argString(arg))
+	}
+	return b.String()
 }
 
 func setmap(c net.Conn, args []interface{}) {
@@ -69,38 +233,71 @@ func setmap(c net.Conn, args []interface{}) {
 		SendError(c, fmt.Sprintf("invalid key format, expected string got %T", args[0]))
 		return
 	}
-	if len(args[1:]) > 1 {
-		setExpiration(c, args)
+	// the expiration is validated first, a failed SET writes nothing
+	expires := len(args[2:]) > 1
+	var dur time.Duration
+	if expires {
+		var err error
+		if dur, err = parseExpiration(args[2:]); err != nil {
+			SendError(c, err.Error())
+			return
+		}
+	}
+	db := dbOf(c)
+	_, existed := db.load(v)
+	db.store(v, args[1])
+	delete(db.timeout, v)
+	if expires {
+		clientOf(c).srv.setExpiration(db, v, dur)
+	}
+	if !existed {
+		notify(c, notifyNew, "new", v)
+	}
+	notify(c, notifyString, "set", v)
+	if expires {
+		notify(c, notifyGeneric, "expire", v)
 	}
-	defaultClient.storage.Store(v, args[1])
 	SendOk(c)
 }
 
 func getmap(c net.Conn, args []interface{}) {
 	if len(args) < 1 {
 		SendError(c, "invalid set command, need minimum 1 args, sent 0 arg")
+		return
 	}
 	switch v := args[0].(type) {
 	case string:
-		val, ok := defaultClient.storage.Load(v)
+		val, ok := lookupKeyRead(c, v)
 		if !ok {
 			SendNil(c)
+			return
+		}
+		if typeName(val) != "string" {
+			SendError(c, wrongTypeError)
+			return
 		}
-		c.Write([]byte(CreateReply(val)))
+		SendValue(c, val)
 		return
 	}
 	SendNil(c)
 }
 
 func pong(c net.Conn, args []interface{}) {
+	if cc := clientOf(c); cc.proto == 2 && cc.subscriptions() > 0 {
+		// subscribed RESP2 clients only expect arrays
+		message := ""
+		if len(args) > 0 {
+			message = argString(args[0])
+		}
+		SendValue(c, []interface{}{"pong", message})
+		return
+	}
 	c.Write([]byte(createSimpleString("PONG")))
 }
 
 func quit(c net.Conn, args []interface{}) {
 	SendOk(c)
-	if defaultClient.listener != nil {
-		defaultClient.listener.Close()
-	}
+	clientOf(c).srv.closeListeners()
 }
 
 var expireSettingOpt = []string{"ex", "px", "exat", "pxat"}
@@ -119,14 +316,30 @@ func getex(c net.Conn, args []interface{}) {
 		return
 	}
 	rest := args[1:]
-	key := args[0]
-	val, ok := defaultClient.storage.Load(key)
+	key := argString(args[0])
+	db := dbOf(c)
+	val, ok := lookupKeyRead(c, key)
 	if !ok {
 		SendNil(c)
 		return
 	}
+	if typeName(val) != "string" {
+		SendError(c, wrongTypeError)
+		return
+	}
 	if len(rest) > 1 {
-		setExpiration(c, args)
+		dur, err := parseExpiration(rest)
+		if err != nil {
+			SendError(c, err.Error())
+			return
+		}
+		clientOf(c).srv.setExpiration(db, key, dur)
+		notify(c, notifyGeneric, "expire", key)
+	} else if strings.ToLower(argString(rest[0])) == "persist" {
+		if _, ok := db.timeout[key]; ok {
+			delete(db.timeout, key)
+			notify(c, notifyGeneric, "persist", key)
+		}
 	}
 	SendValue(c, val)
 }
@@ -141,19 +354,16 @@ func persist(c net.Conn, args []interface{}) {
 		SendError(c, "invalid key type, need string")
 		return
 	}
-	_, avail := defaultClient.storage.Load(key)
-	_, persisted := defaultClient.persist[key]
-	if avail && !persisted {
-		defaultClient.persist[key] = true
+	db := dbOf(c)
+	_, avail := db.load(key)
+	_, hasTimeout := db.timeout[key]
+	if avail && hasTimeout {
+		delete(db.timeout, key)
+		notify(c, notifyGeneric, "persist", key)
 		SendValue(c, 1)
 		return
 	}
-	if !avail && !persisted {
-		SendValue(c, 0)
-		return
-	}
 	SendValue(c, 0)
-
 }
 
 func durationCalc(num int, timesetter string) (dur time.Duration) {
@@ -165,53 +375,41 @@ func durationCalc(num int, timesetter string) (dur time.Duration) {
 	case "exat":
 		dur = time.Until(time.Unix(int64(num), 0))
 	case "pxat":
-		secnum := int64(num / 1000)
-		milnum := (int64(num) % secnum) * 1e6
-		dur = time.Until(time.Unix(secnum, milnum))
+		dur = time.Until(time.UnixMilli(int64(num)))
 	}
 	return
 }
 
-func timeout(arg interface{}, dur time.Duration) {
+// expireAfter removes key from db once its timeout passed, unless the
+// timeout was removed or extended in the meantime.
+func (s *Client) expireAfter(db *database, key string, dur time.Duration) {
 	time.Sleep(dur)
-	keystr := arg.(string)
-	persist, ok := defaultClient.persist[keystr]
-	timeout, hasTo := defaultClient.timeout[keystr]
-	if !ok {
-		defaultClient.storage.Delete(arg)
-		delete(defaultClient.persist, keystr)
-		delete(defaultClient.timeout, keystr)
-	} else if persist || (hasTo && timeout.Before(time.Now())) {
-		delete(defaultClient.persist, keystr)
-		defaultClient.timeout[keystr] = time.Unix(0, 0)
-
+	s.mu.Lock()
+	defer s.unlock()
+	if until, ok := db.timeout[key]; ok && !until.After(time.Now()) {
+		db.expire(key)
 	}
 }
 
-func setExpiration(c net.Conn, args []interface{}) {
-	key := args[0]
-	rest := args[1:]
-	timesetter, ok := rest[0].(string)
-	if !ok {
-		SendError(c, "invalid expiration option")
-		return
-	}
-	timesetter = strings.ToLower(timesetter)
+// parseExpiration returns the time to live set by the EX, PX, EXAT or
+// PXAT option opts.
+func parseExpiration(opts []interface{}) (time.Duration, error) {
+	timesetter := strings.ToLower(argString(opts[0]))
 	if !validopt(timesetter) {
-		SendError(c, fmt.Sprintf(
-			"invalid expiration option, sent %s expected one of ex, px, eaxt, pxat", timesetter))
-		return
+		return 0, fmt.Errorf(
+			"invalid expiration option, sent %s expected one of ex, px, eaxt, pxat", timesetter)
 	}
-	num, ok := rest[1].(int)
-	if !ok {
-		SendError(c, fmt.Sprintf("invalid numeric expiration, got %#v", rest[1]))
-		return
+	num, err := argInt(opts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid numeric expiration, got %#v", opts[1])
 	}
-	dur := durationCalc(num, timesetter)
-	log.Println("dur:", dur)
-	keystr := key.(string)
-	defaultClient.timeout[keystr] = time.Now().Add(dur)
-	go timeout(key, dur)
+	return durationCalc(num, timesetter), nil
+}
+
+// setExpiration makes key of db expire after dur.
+func (s *Client) setExpiration(db *database, key string, dur time.Duration) {
+	db.timeout[key] = time.Now().Add(dur)
+	go s.expireAfter(db, key, dur)
 }
 
 type ttlKind string
@@ -231,18 +429,14 @@ func ttlimp(c net.Conn, args []interface{}, kind ttlKind) {
 		SendError(c, "invalid key type, need string")
 		return
 	}
-	_, avail := defaultClient.storage.Load(key)
-	_, persisted := defaultClient.persist[key]
-	until, hasTimeout := defaultClient.timeout[key]
+	db := dbOf(c)
+	_, avail := db.load(key)
+	until, hasTimeout := db.timeout[key]
 	if !avail {
 		SendNil(c)
 		return
 	}
-	if !persisted && !hasTimeout {
-		SendValue(c, -1)
-		return
-	}
-	if until.Before(time.Now()) {
+	if !hasTimeout {
 		SendValue(c, -1)
 		return
 	}
@@ -269,9 +463,10 @@ func existsKeys(c net.Conn, args []interface{}) {
 		SendValue(c, 0)
 		return
 	}
+	db := dbOf(c)
 	totalKeys := 0
 	for _, key := range args {
-		_, ok := defaultClient.storage.Load(key)
+		_, ok := db.load(argString(key))
 		if ok {
 			totalKeys++
 		}
@@ -279,23 +474,18 @@ func existsKeys(c net.Conn, args []interface{}) {
 	SendValue(c, totalKeys)
 }
 
-func hello(c net.Conn, args []any) {
-	if len(args) <= 0 {
-		SendError(c, "invalid version number")
-		return
-	}
-	v, ok := args[0].(int)
-	if !ok {
-		SendError(c, "proto version is not number")
+func delKeys(c net.Conn, args []interface{}) {
+	if len(args) < 1 {
+		SendError(c, "ERR wrong number of arguments for 'del' command")
 		return
 	}
-	if v > 2 {
-		SendError(c, "unknown command 'hello'")
+	db := dbOf(c)
+	deleted := 0
+	for _, key := range args {
+		if _, ok := db.load(argString(key)); ok && db.remove(argString(key)) {
+			notify(c, notifyGeneric, "del", argString(key))
+			deleted++
+		}
 	}
-	// const reply = `server: "localredis"
-	// version: 0.1
-	// proto: 3`
-
-	// _ = v
-	// c.Write([]byte(CreateReply(reply)))
+	SendValue(c, deleted)
 }
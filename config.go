@@ -0,0 +1,755 @@
+package localredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// configParam is a parameter of CONFIG GET and CONFIG SET, get and set
+// are called with the server lock held. def is the value of a new
+// server, and what CONFIG REWRITE leaves out of the file. An immutable
+// parameter is only set by the configuration file, apply is called
+// after set when the parameter changes at runtime.
+type configParam struct {
+	def       string
+	immutable bool
+	// sensitive values are redacted from the monitors and the slowlog
+	sensitive bool
+	get       func(s *Client) string
+	set       func(s *Client, value string) error
+	apply     func(s *Client) error
+}
+
+// The maxmemory policies of redis.
+const (
+	policyVolatileLRU    = "volatile-lru"
+	policyAllKeysLRU     = "allkeys-lru"
+	policyVolatileLFU    = "volatile-lfu"
+	policyAllKeysLFU     = "allkeys-lfu"
+	policyVolatileRandom = "volatile-random"
+	policyAllKeysRandom  = "allkeys-random"
+	policyVolatileTTL    = "volatile-ttl"
+	policyNoEviction     = "noeviction"
+)
+
+// configParams are the parameters by name.
+var configParams = map[string]configParam{
+	"databases": func() configParam {
+		p := intParam(defaultDatabases, 1, math.MaxInt32, func(s *Client) *int { return &s.databases })
+		p.immutable = true
+		set := p.set
+		p.set = func(s *Client, value string) error {
+			if err := set(s, value); err != nil {
+				return err
+			}
+			s.setDatabases(s.databases)
+			return nil
+		}
+		return p
+	}(),
+	"maxmemory": func() configParam {
+		p := memoryParam(0, func(s *Client) *int64 { return &s.maxmemory })
+		p.apply = func(s *Client) error {
+			// like redis a lower limit evicts right away, reaching it or not
+			s.evict()
+			return nil
+		}
+		return p
+	}(),
+	"maxmemory-policy": enumParam(policyNoEviction, []string{
+		policyVolatileLRU, policyVolatileLFU, policyVolatileRandom, policyVolatileTTL,
+		policyAllKeysLRU, policyAllKeysLFU, policyAllKeysRandom, policyNoEviction,
+	}, func(s *Client) *string { return &s.maxmemoryPolicy }),
+	"maxmemory-samples":         intParam(5, 1, 64, func(s *Client) *int { return &s.maxmemorySamples }),
+	"lfu-log-factor":            intParam(10, 0, math.MaxInt32, func(s *Client) *int { return &s.lfuLogFactor }),
+	"lfu-decay-time":            intParam(1, 0, math.MaxInt32, func(s *Client) *int { return &s.lfuDecayTime }),
+	"hash-max-listpack-entries": intParam(128, 0, math.MaxInt32, func(s *Client) *int { return &s.hashMaxListpackEntries }),
+	"hash-max-listpack-value":   intParam(64, 0, math.MaxInt32, func(s *Client) *int { return &s.hashMaxListpackValue }),
+	"set-max-intset-entries":    intParam(512, 0, math.MaxInt32, func(s *Client) *int { return &s.setMaxIntsetEntries }),
+	"set-max-listpack-entries":  intParam(128, 0, math.MaxInt32, func(s *Client) *int { return &s.setMaxListpackEntries }),
+	"set-max-listpack-value":    intParam(64, 0, math.MaxInt32, func(s *Client) *int { return &s.setMaxListpackValue }),
+	"zset-max-listpack-entries": intParam(128, 0, math.MaxInt32, func(s *Client) *int { return &s.zsetMaxListpackEntries }),
+	"zset-max-listpack-value":   intParam(64, 0, math.MaxInt32, func(s *Client) *int { return &s.zsetMaxListpackValue }),
+	"list-max-listpack-size":    intParam(-2, -5, math.MaxInt32, func(s *Client) *int { return &s.listMaxListpackSize }),
+	"busy-reply-threshold":      intParam(5000, 0, math.MaxInt32, func(s *Client) *int { return &s.busyReplyThreshold }),
+	"maxclients":                intParam(10000, 1, math.MaxInt32, func(s *Client) *int { return &s.maxclients }),
+	"timeout": {
+		def: "0",
+		get: func(s *Client) string { return strconv.FormatInt(atomic.LoadInt64(&s.timeout), 10) },
+		set: func(s *Client, value string) error {
+			n, err := parseConfigInt(value, 0, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			// read by the connections without the server lock
+			atomic.StoreInt64(&s.timeout, int64(n))
+			return nil
+		},
+	},
+	"hz": intParam(10, 1, 500, func(s *Client) *int { return &s.hz }),
+	"requirepass": func() configParam {
+		p := stringParam("", func(s *Client) *string { return &s.requirepass })
+		set := p.set
+		// the password of the default user also from the configuration file
+		p.set = func(s *Client, value string) error {
+			if err := set(s, value); err != nil {
+				return err
+			}
+			s.setRequirepass(s.requirepass)
+			return nil
+		}
+		p.sensitive = true
+		return p
+	}(),
+	"acllog-max-len": func() configParam {
+		p := intParam(128, 0, math.MaxInt32, func(s *Client) *int { return &s.aclLogMaxLen })
+		p.apply = func(s *Client) error {
+			s.trimACLLog()
+			return nil
+		}
+		return p
+	}(),
+	"dir": {
+		def: defaultDir,
+		get: func(s *Client) string { return s.dir },
+		set: func(s *Client, value string) error {
+			if info, err := os.Stat(value); err != nil {
+				return err
+			} else if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", value)
+			}
+			s.dir = value
+			return nil
+		},
+	},
+	"dbfilename": fileNameParam(defaultDBFilename, func(s *Client) *string { return &s.dbFilename }),
+	"appendonly": func() configParam {
+		p := boolParam(false, func(s *Client) *bool { return &s.appendonly })
+		p.apply = func(s *Client) error {
+			switch {
+			case s.appendonly && s.aof == nil:
+				return s.createAOF(filepath.Join(s.dir, s.aofFilename), s.aofFsync)
+			case !s.appendonly && s.aof != nil:
+				err := s.aof.close()
+				s.aof = nil
+				return err
+			}
+			return nil
+		}
+		return p
+	}(),
+	"appendfilename": func() configParam {
+		p := fileNameParam(defaultAOFFilename, func(s *Client) *string { return &s.aofFilename })
+		p.immutable = true
+		return p
+	}(),
+	"appendfsync": func() configParam {
+		p := enumParam(FsyncEverySec, []string{FsyncAlways, FsyncEverySec, FsyncNo},
+			func(s *Client) *string { return &s.aofFsync })
+		p.apply = func(s *Client) error {
+			if a := s.aof; a != nil {
+				a.mu.Lock()
+				a.fsync = s.aofFsync
+				a.mu.Unlock()
+			}
+			return nil
+		}
+		return p
+	}(),
+	"replica-read-only": boolParam(true, func(s *Client) *bool { return &s.replicaReadOnly }),
+	"repl-backlog-size": func() configParam {
+		p := memoryParam(defaultBacklogSize, func(s *Client) *int64 { return &s.backlogSize })
+		p.apply = func(s *Client) error {
+			if s.backlog != nil {
+				s.backlog.size = int(s.backlogSize)
+			}
+			return nil
+		}
+		return p
+	}(),
+	"slowlog-log-slower-than": intParam(10000, -1, math.MaxInt, func(s *Client) *int { return &s.slowlogSlowerThan }),
+	"slowlog-max-len": func() configParam {
+		p := intParam(128, 0, math.MaxInt32, func(s *Client) *int { return &s.slowlogMaxLen })
+		p.apply = func(s *Client) error {
+			s.trimSlowlog()
+			return nil
+		}
+		return p
+	}(),
+	"latency-monitor-threshold": intParam(0, 0, math.MaxInt, func(s *Client) *int { return &s.latencyThreshold }),
+	"notify-keyspace-events": {
+		def: "",
+		get: func(s *Client) string { return notifyFlagsString(s.notifyFlags) },
+		set: func(s *Client, value string) error {
+			flags, err := parseNotifyFlags(value)
+			if err != nil {
+				return err
+			}
+			s.notifyFlags = flags
+			return nil
+		},
+	},
+}
+
+// configAliases are the old names of the parameters.
+var configAliases = map[string]string{
+	"slave-read-only":          "replica-read-only",
+	"lua-time-limit":           "busy-reply-threshold",
+	"hash-max-ziplist-entries": "hash-max-listpack-entries",
+	"hash-max-ziplist-value":   "hash-max-listpack-value",
+	"zset-max-ziplist-entries": "zset-max-listpack-entries",
+	"zset-max-ziplist-value":   "zset-max-listpack-value",
+	"list-max-ziplist-size":    "list-max-listpack-size",
+}
+
+func lookupConfigParam(name string) (string, configParam, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := configAliases[name]; ok {
+		name = alias
+	}
+	param, ok := configParams[name]
+	return name, param, ok
+}
+
+func boolParam(def bool, field func(s *Client) *bool) configParam {
+	return configParam{
+		def: formatConfigBool(def),
+		get: func(s *Client) string { return formatConfigBool(*field(s)) },
+		set: func(s *Client, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				*field(s) = true
+			case "no":
+				*field(s) = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+func formatConfigBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func intParam(def, min, max int, field func(s *Client) *int) configParam {
+	return configParam{
+		def: strconv.Itoa(def),
+		get: func(s *Client) string { return strconv.Itoa(*field(s)) },
+		set: func(s *Client, value string) error {
+			n, err := parseConfigInt(value, min, max)
+			if err != nil {
+				return err
+			}
+			*field(s) = n
+			return nil
+		},
+	}
+}
+
+func parseConfigInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("argument couldn't be parsed into an integer")
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+	}
+	return n, nil
+}
+
+func memoryParam(def int64, field func(s *Client) *int64) configParam {
+	return configParam{
+		def: strconv.FormatInt(def, 10),
+		get: func(s *Client) string { return strconv.FormatInt(*field(s), 10) },
+		set: func(s *Client, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			*field(s) = n
+			return nil
+		},
+	}
+}
+
+// memoryUnits are the units of the memory values, like redis 1k is 1000
+// bytes while 1kb is 1024 bytes.
+var memoryUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1 << 10,
+	"m":  1000 * 1000,
+	"mb": 1 << 20,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1 << 30,
+}
+
+// parseMemory parses a memory value like 100mb to bytes.
+func parseMemory(value string) (int64, error) {
+	value = strings.ToLower(value)
+	i := len(value)
+	for i > 0 && (value[i-1] < '0' || value[i-1] > '9') {
+		i--
+	}
+	unit, ok := memoryUnits[value[i:]]
+	n, err := strconv.ParseInt(value[:i], 10, 64)
+	if !ok || err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * unit, nil
+}
+
+func enumParam(def string, values []string, field func(s *Client) *string) configParam {
+	return configParam{
+		def: def,
+		get: func(s *Client) string { return *field(s) },
+		set: func(s *Client, value string) error {
+			for _, v := range values {
+				if strings.EqualFold(v, value) {
+					*field(s) = v
+					return nil
+				}
+			}
+			return fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(values, ", "))
+		},
+	}
+}
+
+func stringParam(def string, field func(s *Client) *string) configParam {
+	return configParam{
+		def: def,
+		get: func(s *Client) string { return *field(s) },
+		set: func(s *Client, value string) error {
+			*field(s) = value
+			return nil
+		},
+	}
+}
+
+// fileNameParam is a file name in the dir parameter.
+func fileNameParam(def string, field func(s *Client) *string) configParam {
+	p := stringParam(def, field)
+	set := p.set
+	p.set = func(s *Client, value string) error {
+		if value == "" || value != filepath.Base(value) {
+			return errors.New("must be a file name, not a path")
+		}
+		return set(s, value)
+	}
+	return p
+}
+
+// setConfigDefaults sets every parameter to its default value.
+func (s *Client) setConfigDefaults() {
+	for _, name := range sortedKeys(configParams) {
+		if err := configParams[name].set(s, configParams[name].def); err != nil {
+			panic(fmt.Sprintf("default of %s: %v", name, err))
+		}
+	}
+}
+
+// ConfigSet sets a parameter like CONFIG SET.
+func (s *Client) ConfigSet(name, value string) error {
+	s.mu.Lock()
+	defer s.unlock()
+	return s.configSet([]string{name, value})
+}
+
+// ConfigGet returns the value of a parameter like CONFIG GET.
+func (s *Client) ConfigGet(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.unlock()
+	_, param, ok := lookupConfigParam(name)
+	if !ok {
+		return "", false
+	}
+	return param.get(s), true
+}
+
+// configSet sets the parameters of name value pairs, all of them or none
+// like redis: the parameters already set are restored when one fails.
+func (s *Client) configSet(pairs []string) error {
+	type change struct {
+		name  string
+		param configParam
+		old   string
+	}
+	var changes []change
+	seen := map[string]bool{}
+	for i := 0; i < len(pairs); i += 2 {
+		name, param, ok := lookupConfigParam(pairs[i])
+		if !ok {
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", pairs[i])
+		}
+		if param.immutable {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", pairs[i])
+		}
+		if seen[name] {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", pairs[i])
+		}
+		seen[name] = true
+		changes = append(changes, change{name, param, param.get(s)})
+	}
+	restore := func(n int) {
+		for _, ch := range changes[:n] {
+			ch.param.set(s, ch.old)
+			if ch.param.apply != nil {
+				ch.param.apply(s)
+			}
+		}
+	}
+	for i, ch := range changes {
+		err := ch.param.set(s, pairs[2*i+1])
+		if err == nil && ch.param.apply != nil {
+			err = ch.param.apply(s)
+		}
+		if err != nil {
+			restore(i + 1)
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", pairs[2*i], err)
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads a configuration file in the format of redis.conf,
+// followed by the directives of options like the command line arguments
+// of redis-server, e.g. "port 6380". The path can be empty to only load
+// the options. The parameters take effect like when the server starts,
+// the dataset is loaded afterwards by Load.
+func (s *Client) LoadConfig(path string, options ...string) error {
+	var lines []configLine
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if lines, err = readConfigFile(abs, 0); err != nil {
+			return err
+		}
+		path = abs
+	}
+	for i, option := range options {
+		lines = append(lines, configLine{file: "options", num: i + 1, text: option})
+	}
+	s.mu.Lock()
+	defer s.unlock()
+	for _, line := range lines {
+		args, err := splitConfigArgs(line.text)
+		if err == nil && len(args) > 0 {
+			err = s.loadConfigDirective(args)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %q: %v", line.file, line.num, line.text, err)
+		}
+	}
+	s.configFile = path
+	return nil
+}
+
+// LoadConfig loads a configuration file in the default server.
+func LoadConfig(path string, options ...string) error {
+	return defaultClient.LoadConfig(path, options...)
+}
+
+func (s *Client) loadConfigDirective(args []string) error {
+	name, param, ok := lookupConfigParam(args[0])
+	if !ok {
+		// redis.conf has many directives with no meaning here
+		s.log().Warn("ignoring an unknown configuration directive", "directive", args[0])
+		return nil
+	}
+	if len(args) < 2 {
+		return errors.New("wrong number of arguments")
+	}
+	if err := param.set(s, strings.Join(args[1:], " ")); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+type configLine struct {
+	file string
+	num  int
+	text string
+}
+
+// readConfigFile returns the lines of a configuration file with its
+// include directives expanded.
+func readConfigFile(path string, depth int) ([]configLine, error) {
+	if depth > 10 {
+		return nil, fmt.Errorf("too many nested includes in %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []configLine
+	scanner := bufio.NewScanner(f)
+	for num := 1; scanner.Scan(); num++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		args, err := splitConfigArgs(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %q: %v", path, num, text, err)
+		}
+		if strings.ToLower(args[0]) != "include" {
+			lines = append(lines, configLine{file: path, num: num, text: text})
+			continue
+		}
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s:%d: wrong number of arguments for include", path, num)
+		}
+		included := args[1]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(path), included)
+		}
+		more, err := readConfigFile(included, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, more...)
+	}
+	return lines, scanner.Err()
+}
+
+var errUnbalancedQuotes = errors.New("unbalanced quotes in configuration line")
+
+// splitConfigArgs splits a line of a configuration file in arguments
+// separated by spaces, like sdssplitargs of redis. Double quoted
+// arguments can have escapes like "\n" and "\x00", single quoted
+// arguments only "\'".
+func splitConfigArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				if line[i] == '"' {
+					break
+				}
+				if line[i] != '\\' || i+1 == len(line) {
+					arg = append(arg, line[i])
+					continue
+				}
+				i++
+				switch line[i] {
+				case 'n':
+					arg = append(arg, '\n')
+				case 'r':
+					arg = append(arg, '\r')
+				case 't':
+					arg = append(arg, '\t')
+				case 'b':
+					arg = append(arg, '\b')
+				case 'a':
+					arg = append(arg, '\a')
+				case 'x':
+					if i+2 < len(line) {
+						if b, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+							arg = append(arg, byte(b))
+							i += 2
+							continue
+						}
+					}
+					arg = append(arg, 'x')
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			i++
+		case '\'':
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				if line[i] == '\'' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg = append(arg, line[i])
+			}
+			i++
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg = append(arg, line[i])
+				i++
+			}
+		}
+		// a closing quote must be followed by a space
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, errUnbalancedQuotes
+		}
+		args = append(args, string(arg))
+	}
+}
+
+// quoteConfigArg quotes an argument for the configuration file when
+// splitConfigArgs would not read it back as is.
+func quoteConfigArg(arg string) string {
+	plain := arg != ""
+	for i := 0; i < len(arg) && plain; i++ {
+		c := arg[i]
+		plain = c > ' ' && c < 0x7f && c != '"' && c != '\'' && c != '\\'
+	}
+	if plain {
+		return arg
+	}
+	return repr(arg)
+}
+
+// rewriteConfig writes the current parameters to the configuration file:
+// the lines of the parameters are updated in place and the parameters
+// changed from their default not in the file are appended, the other
+// lines are kept.
+func (s *Client) rewriteConfig() error {
+	if s.configFile == "" {
+		return errors.New("ERR The server is running without a config file")
+	}
+	data, err := os.ReadFile(s.configFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ERR Rewriting config file: %v", err)
+	}
+	var out []string
+	written := map[string]bool{}
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			args, err := splitConfigArgs(strings.TrimSpace(line))
+			if err != nil || len(args) == 0 || strings.HasPrefix(args[0], "#") {
+				out = append(out, line)
+				continue
+			}
+			name, param, ok := lookupConfigParam(args[0])
+			switch {
+			case !ok:
+				out = append(out, line)
+			case !written[name]:
+				// the parameters of multiple arguments are written as one
+				out = append(out, name+" "+quoteConfigArg(param.get(s)))
+				written[name] = true
+			}
+		}
+	}
+	generated := false
+	for _, name := range sortedKeys(configParams) {
+		param := configParams[name]
+		if written[name] || param.get(s) == param.def {
+			continue
+		}
+		if !generated {
+			out = append(out, "# Generated by CONFIG REWRITE")
+			generated = true
+		}
+		out = append(out, name+" "+quoteConfigArg(param.get(s)))
+	}
+	tmp := s.configFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(out, "\n")+"\n"), 0o644); err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %v", err)
+	}
+	if err := os.Rename(tmp, s.configFile); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("ERR Rewriting config file: %v", err)
+	}
+	return nil
+}
+
+// configCommand handles `CONFIG GET pattern [pattern ...]`,
+// `CONFIG SET parameter value [parameter value ...]`, `CONFIG RESETSTAT`
+// and `CONFIG REWRITE`.
+func configCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'config' command")
+		return
+	}
+	s := clientOf(c).srv
+	switch strings.ToLower(argString(args[0])) {
+	case "get":
+		if len(args) < 2 {
+			SendError(c, "ERR wrong number of arguments for 'config|get' command")
+			return
+		}
+		reply := RespMap{}
+		for _, name := range configNames() {
+			for _, pattern := range args[1:] {
+				if globMatch(strings.ToLower(argString(pattern)), name) {
+					_, param, _ := lookupConfigParam(name)
+					reply = append(reply, name, param.get(s))
+					break
+				}
+			}
+		}
+		SendValue(c, reply)
+	case "set":
+		if len(args) < 3 || len(args)%2 == 0 {
+			SendError(c, "ERR wrong number of arguments for 'config|set' command")
+			return
+		}
+		if err := s.configSet(argStrings(args[1:])); err != nil {
+			SendError(c, err.Error())
+			return
+		}
+		SendOk(c)
+	case "resetstat":
+		if len(args) != 1 {
+			SendError(c, "ERR wrong number of arguments for 'config|resetstat' command")
+			return
+		}
+		s.stats = serverStats{}
+		SendOk(c)
+	case "rewrite":
+		if len(args) != 1 {
+			SendError(c, "ERR wrong number of arguments for 'config|rewrite' command")
+			return
+		}
+		if err := s.rewriteConfig(); err != nil {
+			SendError(c, err.Error())
+			return
+		}
+		SendOk(c)
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", argString(args[0])))
+	}
+}
+
+// configNames are the names of the parameters and of their aliases, as
+// CONFIG GET matches them.
+func configNames() []string {
+	names := sortedKeys(configParams)
+	for alias := range configAliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,283 @@
+package localredis
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMemory(t *testing.T) {
+	for in, expected := range map[string]int64{
+		"0":      0,
+		"100":    100,
+		"1k":     1000,
+		"1kb":    1024,
+		"2MB":    2 << 20,
+		"1g":     1000 * 1000 * 1000,
+		"3gb":    3 << 30,
+		"100b":   100,
+		"512Mb":  512 << 20,
+		"123456": 123456,
+	} {
+		n, err := parseMemory(in)
+		if err != nil || n != expected {
+			t.Errorf("%q parsed as %d, %v, expected %d", in, n, err, expected)
+		}
+	}
+	for _, in := range []string{"", "mb", "-1", "1tb", "1.5gb", "99999999999gb"} {
+		if _, err := parseMemory(in); err == nil {
+			t.Errorf("invalid memory value %q accepted", in)
+		}
+	}
+}
+
+func TestSplitConfigArgs(t *testing.T) {
+	for in, expected := range map[string][]string{
+		"maxmemory 100mb":                   {"maxmemory", "100mb"},
+		"  save 900 1\t300 10 ":             {"save", "900", "1", "300", "10"},
+		`requirepass "with space"`:          {"requirepass", "with space"},
+		`requirepass "a\"b\\c\n\x41"`:       {"requirepass", "a\"b\\c\nA"},
+		`requirepass 'it\'s'`:               {"requirepass", "it's"},
+		`notify-keyspace-events ""`:         {"notify-keyspace-events", ""},
+		`dir "/tmp/a dir" dbfilename 'x y'`: {"dir", "/tmp/a dir", "dbfilename", "x y"},
+	} {
+		args, err := splitConfigArgs(in)
+		if err != nil || !reflect.DeepEqual(args, expected) {
+			t.Errorf("%q split as %q, %v, expected %q", in, args, err, expected)
+		}
+	}
+	for _, in := range []string{`dir "/tmp`, `dir '/tmp`, `dir "a"b`} {
+		if _, err := splitConfigArgs(in); err == nil {
+			t.Errorf("unbalanced quotes accepted in %q", in)
+		}
+	}
+	for _, arg := range []string{"plain", "", "with space", "quo\"te", "new\nline\x00", "it's"} {
+		args, err := splitConfigArgs("requirepass " + quoteConfigArg(arg))
+		if err != nil || len(args) != 2 || args[1] != arg {
+			t.Errorf("%q quoted as %q, read back as %q, %v", arg, quoteConfigArg(arg), args, err)
+		}
+	}
+}
+
+func TestConfigSetGet(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"config", "get", "maxmemory*", "hz"})
+	expected := "*8\r\n+hz\r\n+10\r\n+maxmemory\r\n+0\r\n+maxmemory-policy\r\n+noeviction\r\n" +
+		"+maxmemory-samples\r\n+5\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("invalid config get reply, got %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "maxmemory", "10mb", "maxmemory-policy", "ALLKEYS-LRU", "hz", "100"})
+	runCommand(cc, []interface{}{"config", "get", "maxmemory", "maxmemory-policy", "hz"})
+	expected = "+OK\r\n*6\r\n+hz\r\n+100\r\n+maxmemory\r\n+10485760\r\n+maxmemory-policy\r\n+allkeys-lru\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("invalid config set reply, got %q", reply)
+	}
+
+	for _, tc := range []struct {
+		args  []interface{}
+		reply string
+	}{
+		{[]interface{}{"hz", "0"}, "-ERR CONFIG SET failed (possibly related to argument 'hz') - argument must be between 1 and 500 inclusive\r\n"},
+		{[]interface{}{"timeout", "x"}, "-ERR CONFIG SET failed (possibly related to argument 'timeout') - argument couldn't be parsed into an integer\r\n"},
+		{[]interface{}{"appendonly", "maybe"}, "-ERR CONFIG SET failed (possibly related to argument 'appendonly') - argument must be 'yes' or 'no'\r\n"},
+		{[]interface{}{"databases", "4"}, "-ERR CONFIG SET failed (possibly related to argument 'databases') - can't set immutable config\r\n"},
+		{[]interface{}{"dbfilename", "../x.rdb"}, "-ERR CONFIG SET failed (possibly related to argument 'dbfilename') - must be a file name, not a path\r\n"},
+		{[]interface{}{"no-such-option", "1"}, "-ERR Unknown option or number of arguments for CONFIG SET - 'no-such-option'\r\n"},
+		{[]interface{}{"hz", "20", "hz", "30"}, "-ERR CONFIG SET failed (possibly related to argument 'hz') - duplicate parameter\r\n"},
+		{[]interface{}{"hz", "20", "maxmemory", "lots"}, "-ERR CONFIG SET failed (possibly related to argument 'maxmemory') - argument must be a memory value\r\n"},
+	} {
+		runCommand(cc, append([]interface{}{"config", "set"}, tc.args...))
+		if reply := readReply(t, mconn); reply != tc.reply {
+			t.Errorf("config set %v replied %q, expected %q", tc.args, reply, tc.reply)
+		}
+	}
+	if hz, _ := srv.ConfigGet("hz"); hz != "100" {
+		t.Errorf("failed config set not rolled back, hz is %s", hz)
+	}
+
+	if err := srv.ConfigSet("slave-read-only", "no"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := srv.ConfigGet("replica-read-only"); v != "no" {
+		t.Errorf("alias not set, got %s", v)
+	}
+	runCommand(cc, []interface{}{"config", "get", "*read-only"})
+	if reply := readReply(t, mconn); reply != "*4\r\n+replica-read-only\r\n+no\r\n+slave-read-only\r\n+no\r\n" {
+		t.Errorf("invalid aliases reply, got %q", reply)
+	}
+
+	srv.stats.syncFull = 3
+	runCommand(cc, []interface{}{"config", "resetstat"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" || srv.stats.syncFull != 0 {
+		t.Errorf("stats not reset, got %q and %d", reply, srv.stats.syncFull)
+	}
+	runCommand(cc, []interface{}{"config", "rewrite"})
+	if reply := readReply(t, mconn); reply != "-ERR The server is running without a config file\r\n" {
+		t.Errorf("rewrite without a config file, got %q", reply)
+	}
+}
+
+func TestLoadConfigAndRewrite(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "redis.conf")
+	extra := filepath.Join(dir, "extra.conf")
+	if err := os.WriteFile(extra, []byte("hz 50\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join([]string{
+		"# a redis.conf",
+		"protected-mode yes",
+		"databases 4",
+		"maxmemory 1gb",
+		"MAXMEMORY-POLICY volatile-ttl",
+		"notify-keyspace-events \"Ex\"",
+		"dir " + quoteConfigArg(dir),
+		"include extra.conf",
+		"maxmemory 2gb",
+		"",
+	}, "\n")
+	if err := os.WriteFile(conf, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewClient()
+	if err := srv.LoadConfig(conf, "requirepass \"s3cret pass\""); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"databases":              "4",
+		"maxmemory":              strconv.Itoa(2 << 30),
+		"maxmemory-policy":       "volatile-ttl",
+		"notify-keyspace-events": "xE",
+		"hz":                     "50",
+		"requirepass":            "s3cret pass",
+		"dir":                    dir,
+	} {
+		if v, _ := srv.ConfigGet(name); v != expected {
+			t.Errorf("%s loaded as %q, expected %q", name, v, expected)
+		}
+	}
+	if len(srv.dbs) != 4 {
+		t.Errorf("expected 4 databases, got %d", len(srv.dbs))
+	}
+	if err := srv.LoadConfig(conf, "hz 1000"); err == nil || !strings.Contains(err.Error(), "between 1 and 500") {
+		t.Errorf("invalid option loaded, got %v", err)
+	}
+
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"auth", "s3cret pass"})
+	runCommand(cc, []interface{}{"config", "set", "maxmemory", "100mb", "timeout", "30"})
+	runCommand(cc, []interface{}{"config", "rewrite"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n+OK\r\n+OK\r\n" {
+		t.Fatalf("invalid rewrite reply, got %q", reply)
+	}
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := string(data)
+	for _, line := range []string{"# a redis.conf\n", "protected-mode yes\n", "maxmemory 104857600\n",
+		"include extra.conf\n", "# Generated by CONFIG REWRITE\n", "requirepass \"s3cret pass\"\n", "timeout 30\n"} {
+		if !strings.Contains(rewritten, line) {
+			t.Errorf("%q missing in the rewritten file:\n%s", line, rewritten)
+		}
+	}
+	if strings.Count(rewritten, "maxmemory ") != 1 {
+		t.Errorf("maxmemory repeated in the rewritten file:\n%s", rewritten)
+	}
+
+	reloaded := NewClient()
+	if err := reloaded.LoadConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"maxmemory", "timeout", "requirepass", "databases", "notify-keyspace-events"} {
+		v1, _ := srv.ConfigGet(name)
+		v2, _ := reloaded.ConfigGet(name)
+		if v1 != v2 {
+			t.Errorf("%s reloaded as %q, expected %q", name, v2, v1)
+		}
+	}
+}
+
+func TestConfigAppendOnlyAndTimeout(t *testing.T) {
+	useCommand(t, "set", setmap)
+	dir := t.TempDir()
+	srv := NewClient()
+	if err := srv.ConfigSet("dir", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ConfigSet("dir", filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing dir accepted")
+	}
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"set", "k", "v"})
+	if err := srv.ConfigSet("appendonly", "yes"); err != nil {
+		t.Fatal(err)
+	}
+	runCommand(cc, []interface{}{"set", "k2", "v2"})
+	if err := srv.ConfigSet("appendonly", "no"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewClient()
+	if err := loaded.LoadConfig("", "dir "+quoteConfigArg(dir), "appendonly yes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.CloseAOF()
+	for k, expected := range map[string]string{"k": "v", "k2": "v2"} {
+		if v, _ := loaded.dbs[0].load(k); v != expected {
+			t.Errorf("%s loaded from the AOF as %v", k, v)
+		}
+	}
+
+	if err := srv.ConfigSet("timeout", "1"); err != nil {
+		t.Fatal(err)
+	}
+	port := serveLocal(t, srv)
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("idle client not closed")
+	} else if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 4*time.Second {
+		t.Errorf("idle client closed after %v", elapsed)
+	}
+
+	if err := srv.ConfigSet("maxclients", "1"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waitFor(t, "the first client", func() bool { return len(srv.listClients()) == 1 })
+	second, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	buf := make([]byte, 64)
+	n, _ := second.Read(buf)
+	if reply := string(buf[:n]); reply != "-ERR max number of clients reached\r\n" {
+		t.Errorf("invalid reply over maxclients, got %q", reply)
+	}
+}
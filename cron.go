@@ -0,0 +1,50 @@
+package localredis
+
+import "time"
+
+// activeExpireKeysPerLoop is the number of keys with a timeout sampled by
+// database at each cycle, like ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP.
+const activeExpireKeysPerLoop = 20
+
+// serverCron runs the periodic tasks of the server hz times per second,
+// like redis, until stop is closed. It runs while the server listens.
+func (s *Client) serverCron(stop chan struct{}) {
+	for {
+		s.mu.Lock()
+		period := time.Second / time.Duration(s.hz)
+		s.unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(period):
+		}
+		s.mu.Lock()
+		s.activeExpireCycle()
+		s.unlock()
+	}
+}
+
+// activeExpireCycle removes the expired keys found by sampling the keys
+// with a timeout of each database, sampling again while more than a
+// quarter of the sample expired. The server lock must be held.
+func (s *Client) activeExpireCycle() {
+	now := time.Now()
+	for _, db := range s.dbs {
+		for {
+			sampled, expired := 0, 0
+			for key, until := range db.timeout {
+				if sampled == activeExpireKeysPerLoop {
+					break
+				}
+				sampled++
+				if !until.After(now) {
+					db.expire(key)
+					expired++
+				}
+			}
+			if expired*4 <= sampled {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestActiveExpireCycle(t *testing.T) {
+	srv := NewClient()
+	db := srv.dbs[0]
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		db.store(key, "v")
+		db.timeout[key] = time.Now().Add(-time.Second)
+	}
+	db.store("later", "v")
+	db.timeout["later"] = time.Now().Add(time.Hour)
+	srv.mu.Lock()
+	srv.activeExpireCycle()
+	srv.unlock()
+	if len(db.timeout) != 1 {
+		t.Errorf("%d keys with a timeout left, expected only the one not expired", len(db.timeout))
+	}
+	if _, ok := db.storage.Load("later"); !ok {
+		t.Error("key not expired yet removed")
+	}
+}
+
+func TestServerCron(t *testing.T) {
+	srv := NewClient()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	if err := srv.ConfigSet("hz", "100"); err != nil {
+		t.Fatal(err)
+	}
+	// a timeout with no expiring goroutine, only the cron removes the key
+	srv.mu.Lock()
+	srv.dbs[0].store("stale", "v")
+	srv.dbs[0].timeout["stale"] = time.Now().Add(-time.Second)
+	srv.unlock()
+	waitFor(t, "the active expiration", func() bool {
+		srv.mu.Lock()
+		defer srv.unlock()
+		_, ok := srv.dbs[0].storage.Load("stale")
+		return !ok
+	})
+}
@@ -0,0 +1,265 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDatabases = 16
+
+// database is one logical keyspace selected with SELECT.
+type database struct {
+	storage sync.Map
+	timeout map[string]time.Time
+	access  map[string]keyAccess
+	// used is the estimated memory of the keys and their values.
+	used int64
+
+	// expired is called for the keys removed once expired.
+	expired func(db *database, key string)
+}
+
+// keyAccess is the access time and the logarithmic access frequency of a
+// key, the information the eviction policies of redis rely on.
+type keyAccess struct {
+	lastAccess time.Time
+	freq       uint8
+}
+
+func newDatabase() *database {
+	return &database{timeout: map[string]time.Time{}, access: map[string]keyAccess{}}
+}
+
+// load returns the value of key, removing it first when it is expired.
+func (db *database) load(key string) (interface{}, bool) {
+	if until, ok := db.timeout[key]; ok && !until.After(time.Now()) {
+		db.expire(key)
+		return nil, false
+	}
+	return db.storage.Load(key)
+}
+
+// expire removes key once its timeout passed.
+func (db *database) expire(key string) {
+	if db.remove(key) && db.expired != nil {
+		db.expired(db, key)
+	}
+}
+
+// store sets the value of key, the access of the key is reset like for a
+// new object of redis.
+func (db *database) store(key string, value interface{}) {
+	if old, ok := db.storage.Load(key); ok {
+		db.used -= entrySize(key, old)
+	}
+	db.storage.Store(key, value)
+	db.used += entrySize(key, value)
+	db.access[key] = keyAccess{lastAccess: time.Now(), freq: lfuInitVal}
+}
+
+func (db *database) remove(key string) bool {
+	old, ok := db.storage.LoadAndDelete(key)
+	if ok {
+		db.used -= entrySize(key, old)
+	}
+	delete(db.timeout, key)
+	delete(db.access, key)
+	return ok
+}
+
+func (db *database) size() int {
+	n := 0
+	db.storage.Range(func(key, _ interface{}) bool {
+		if _, ok := db.load(key.(string)); ok {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// keys returns the keys that are not expired, sorted.
+func (db *database) keys() []string {
+	var keys []string
+	db.storage.Range(func(key, _ interface{}) bool {
+		if _, ok := db.load(key.(string)); ok {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *database) flush() {
+	db.storage.Range(func(key, _ interface{}) bool {
+		db.storage.Delete(key)
+		return true
+	})
+	db.timeout = map[string]time.Time{}
+	db.access = map[string]keyAccess{}
+	db.used = 0
+}
+
+// dbOf returns the database currently selected by the connection c.
+func dbOf(c net.Conn) *database {
+	cc := clientOf(c)
+	return cc.srv.dbs[cc.db]
+}
+
+// SetDatabases changes the number of logical databases of the server.
+// Databases beyond the new count are dropped with their keys, and the
+// clients which selected one of them are moved back to the database 0.
+func (s *Client) SetDatabases(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.mu.Lock()
+	defer s.unlock()
+	s.databases = n
+	s.setDatabases(n)
+}
+
+func (s *Client) setDatabases(n int) {
+	for len(s.dbs) < n {
+		db := newDatabase()
+		db.expired = s.keyExpired
+		s.dbs = append(s.dbs, db)
+	}
+	s.dbs = s.dbs[:n]
+	for _, cc := range s.listClients() {
+		if cc.db >= n {
+			cc.db = 0
+		}
+	}
+}
+
+// SetDatabases changes the number of logical databases of the default server.
+func SetDatabases(n int) {
+	defaultClient.SetDatabases(n)
+}
+
+func (s *Client) dbIndex(arg interface{}) (int, error) {
+	idx, err := argInt(arg)
+	if err != nil {
+		return 0, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if idx < 0 || idx >= len(s.dbs) {
+		return 0, fmt.Errorf("ERR DB index is out of range")
+	}
+	return idx, nil
+}
+
+func selectDB(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'select' command")
+		return
+	}
+	cc := clientOf(c)
+	idx, err := cc.srv.dbIndex(args[0])
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	cc.db = idx
+	SendOk(c)
+}
+
+func swapDB(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'swapdb' command")
+		return
+	}
+	s := clientOf(c).srv
+	first, err := s.dbIndex(args[0])
+	if err != nil {
+		SendError(c, strings.Replace(err.Error(), "DB index", "invalid first DB index", 1))
+		return
+	}
+	second, err := s.dbIndex(args[1])
+	if err != nil {
+		SendError(c, strings.Replace(err.Error(), "DB index", "invalid second DB index", 1))
+		return
+	}
+	s.dbs[first], s.dbs[second] = s.dbs[second], s.dbs[first]
+	SendOk(c)
+}
+
+func moveKey(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'move' command")
+		return
+	}
+	cc := clientOf(c)
+	idx, err := cc.srv.dbIndex(args[1])
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	if idx == cc.db {
+		SendError(c, "ERR source and destination objects are the same")
+		return
+	}
+	key := argString(args[0])
+	src, dst := cc.srv.dbs[cc.db], cc.srv.dbs[idx]
+	val, ok := src.load(key)
+	if !ok {
+		SendValue(c, 0)
+		return
+	}
+	if _, exists := dst.load(key); exists {
+		SendValue(c, 0)
+		return
+	}
+	dst.store(key, val)
+	if until, ok := src.timeout[key]; ok {
+		dst.timeout[key] = until
+		go cc.srv.expireAfter(dst, key, time.Until(until))
+	}
+	src.remove(key)
+	cc.srv.notifyKeyspaceEvent(notifyGeneric, "move_from", key, cc.db)
+	cc.srv.notifyKeyspaceEvent(notifyGeneric, "move_to", key, idx)
+	SendValue(c, 1)
+}
+
+func dbsize(c net.Conn, args []interface{}) {
+	SendValue(c, dbOf(c).size())
+}
+
+func flushOpt(c net.Conn, args []interface{}) bool {
+	if len(args) > 1 {
+		SendError(c, "ERR syntax error")
+		return false
+	}
+	if len(args) == 1 {
+		switch strings.ToLower(argString(args[0])) {
+		case "sync", "async":
+		default:
+			SendError(c, "ERR syntax error")
+			return false
+		}
+	}
+	return true
+}
+
+func flushDB(c net.Conn, args []interface{}) {
+	if !flushOpt(c, args) {
+		return
+	}
+	dbOf(c).flush()
+	SendOk(c)
+}
+
+func flushAll(c net.Conn, args []interface{}) {
+	if !flushOpt(c, args) {
+		return
+	}
+	for _, db := range clientOf(c).srv.dbs {
+		db.flush()
+	}
+	SendOk(c)
+}
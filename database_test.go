@@ -0,0 +1,77 @@
+package localredis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectIsolation(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"select", "1"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Fatalf("invalid reply, expected OK, got %q", reply)
+	}
+	setmap(cc, []interface{}{"tenant", "one"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"select", "0"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"get", "tenant"})
+	if reply := readReply(t, mconn); reply != "-1\r\n" {
+		t.Errorf("key leaked to db 0, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"select", "16"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR DB index is out of range") {
+		t.Errorf("invalid reply, expected out of range error, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"set", "e1", "a", "ex", "abc"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-invalid numeric expiration") {
+		t.Errorf("invalid reply, expected expiration error, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"dbsize"})
+	if reply := readReply(t, mconn); reply != ":0\r\n" {
+		t.Errorf("invalid dbsize for db 0, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"select", "9"})
+	readReply(t, mconn)
+	srv.SetDatabases(2)
+	if len(srv.dbs) != 2 {
+		t.Errorf("expected 2 databases, got %d", len(srv.dbs))
+	}
+	runCommand(cc, []interface{}{"get", "tenant"})
+	if reply := readReply(t, mconn); reply != "-1\r\n" || cc.db != 0 {
+		t.Errorf("the client of a dropped database is not back on db 0, got %q on db %d", reply, cc.db)
+	}
+}
+
+func TestMoveAndSwapDB(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	setmap(cc, []interface{}{"hello", "world"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"move", "hello", "1"})
+	if reply := readReply(t, mconn); reply != ":1\r\n" {
+		t.Fatalf("invalid reply, expected 1, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"exists", "hello"})
+	if reply := readReply(t, mconn); reply != ":0\r\n" {
+		t.Errorf("key still in source db, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"swapdb", "0", "1"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"get", "hello"})
+	if reply := readReply(t, mconn); reply != "+world\r\n" {
+		t.Errorf("invalid reply after swapdb, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"flushdb"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"dbsize"})
+	if reply := readReply(t, mconn); reply != ":0\r\n" {
+		t.Errorf("invalid dbsize after flushdb, got %q", reply)
+	}
+}
@@ -0,0 +1,147 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpPayload serializes value like DUMP does, the RDB encoding of the
+// value followed by the RDB version and the CRC64 of the payload.
+func dumpPayload(value interface{}) string {
+	return string(appendDumpFooter(appendRDBObject(nil, value)))
+}
+
+// parseDumpPayload is the reverse of dumpPayload.
+func parseDumpPayload(payload string) (interface{}, error) {
+	body, err := verifyDumpPayload([]byte(payload))
+	if err != nil {
+		return nil, err
+	}
+	r := &rdbReader{buf: body}
+	kind, err := r.byte()
+	if err != nil {
+		return nil, fmt.Errorf("ERR Bad data format")
+	}
+	value, err := r.object(kind)
+	if err != nil || !r.done() {
+		return nil, fmt.Errorf("ERR Bad data format")
+	}
+	return value, nil
+}
+
+func dumpKey(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'dump' command")
+		return
+	}
+	val, ok := dbOf(c).load(argString(args[0]))
+	if !ok {
+		SendNil(c)
+		return
+	}
+	SendBulk(c, dumpPayload(val))
+}
+
+// restoreKey handles
+// `RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]`.
+func restoreKey(c net.Conn, args []interface{}) {
+	if len(args) < 3 {
+		SendError(c, "ERR wrong number of arguments for 'restore' command")
+		return
+	}
+	key := argString(args[0])
+	ttl, err := strconv.ParseInt(argString(args[1]), 10, 64)
+	if err != nil {
+		SendError(c, "ERR value is not an integer or out of range")
+		return
+	}
+	if ttl < 0 {
+		SendError(c, "ERR Invalid TTL value, must be >= 0")
+		return
+	}
+	var (
+		replace, absTTL bool
+		idle            int64 = -1
+		freq            int64 = -1
+	)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(argString(args[i])); {
+		case opt == "replace":
+			replace = true
+		case opt == "absttl":
+			absTTL = true
+		case opt == "idletime" && i+1 < len(args) && freq < 0:
+			i++
+			idle, err = strconv.ParseInt(argString(args[i]), 10, 64)
+			if err != nil {
+				SendError(c, "ERR value is not an integer or out of range")
+				return
+			}
+			if idle < 0 {
+				SendError(c, "ERR Invalid IDLETIME value, must be >= 0")
+				return
+			}
+		case opt == "freq" && i+1 < len(args) && idle < 0:
+			i++
+			freq, err = strconv.ParseInt(argString(args[i]), 10, 64)
+			if err != nil {
+				SendError(c, "ERR value is not an integer or out of range")
+				return
+			}
+			if freq < 0 || freq > 255 {
+				SendError(c, "ERR Invalid FREQ value, must be >= 0 and <= 255")
+				return
+			}
+		default:
+			SendError(c, "ERR syntax error")
+			return
+		}
+	}
+	db := dbOf(c)
+	if _, exists := db.load(key); exists && !replace {
+		SendError(c, "BUSYKEY Target key name already exists.")
+		return
+	}
+	value, err := parseDumpPayload(argString(args[2]))
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	var until time.Time
+	if ttl > 0 {
+		if absTTL {
+			until = time.UnixMilli(ttl)
+		} else {
+			until = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if !until.After(time.Now()) {
+			// already expired, the key is just removed
+			db.remove(key)
+			SendOk(c)
+			return
+		}
+	}
+	_, existed := db.load(key)
+	db.remove(key)
+	db.store(key, value)
+	if !existed {
+		notify(c, notifyNew, "new", key)
+	}
+	if !until.IsZero() {
+		db.timeout[key] = until
+		go clientOf(c).srv.expireAfter(db, key, time.Until(until))
+	}
+	access := db.access[key]
+	if idle >= 0 {
+		access.lastAccess = access.lastAccess.Add(-time.Duration(idle) * time.Second)
+	}
+	if freq >= 0 {
+		access.freq = uint8(freq)
+	}
+	db.access[key] = access
+	notify(c, notifyGeneric, "restore", key)
+	SendOk(c)
+}
@@ -0,0 +1,93 @@
+package localredis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpRestore(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	db := srv.dbs[0]
+
+	// payload of `SET mykey 10` dumped by redis
+	runCommand(cc, []interface{}{"restore", "mykey", "0", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Fatalf("invalid restore reply, got %q", reply)
+	}
+	if v, _ := db.load("mykey"); v != "10" {
+		t.Errorf("invalid restored value, got %#v", v)
+	}
+
+	values := map[string]interface{}{
+		"str":  "value",
+		"list": List{"a", "b", "1"},
+		"hash": Hash{"f": "v"},
+		"set":  Set{"m": {}},
+		"zset": SortedSet{"m": 2.5},
+	}
+	for k, v := range values {
+		db.store(k, v)
+		runCommand(cc, []interface{}{"dump", k})
+		dumped, _ := parseReply([]byte(readReply(t, mconn)))
+		payload, _ := dumped.(string)
+		runCommand(cc, []interface{}{"restore", k, "0", payload})
+		if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-BUSYKEY") {
+			t.Errorf("expected busy key error, got %q", reply)
+		}
+		runCommand(cc, []interface{}{"restore", k + "-copy", "5000", payload, "IDLETIME", "60"})
+		if reply := readReply(t, mconn); reply != "+OK\r\n" {
+			t.Errorf("invalid restore reply, got %q", reply)
+		}
+		if got, _ := db.load(k + "-copy"); !reflect.DeepEqual(got, v) {
+			t.Errorf("key %s restored as %#v, expected %#v", k, got, v)
+		}
+		if ttl := time.Until(db.timeout[k+"-copy"]); ttl <= 0 || ttl > 5*time.Second {
+			t.Errorf("invalid restored ttl %v", ttl)
+		}
+		if idle := time.Since(db.access[k+"-copy"].lastAccess); idle < time.Minute {
+			t.Errorf("idle time not restored, got %v", idle)
+		}
+	}
+
+	runCommand(cc, []interface{}{"dump", "missing"})
+	if reply := readReply(t, mconn); reply != "$-1\r\n" && reply != "-1\r\n" {
+		t.Errorf("expected nil dump of missing key, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"dump", "str"})
+	dumped, _ := parseReply([]byte(readReply(t, mconn)))
+	payload := dumped.(string)
+	// a string of type 0 compressed with LZF to the literal run "ab"
+	lzf := func(ulen uint64) string {
+		buf := appendRDBLength(appendRDBLength([]byte{0, 0xc0 | rdbEncLZF}, 3), ulen)
+		return string(appendDumpFooter(append(buf, "\x01ab"...)))
+	}
+	cases := []struct {
+		args  []interface{}
+		reply string
+	}{
+		{[]interface{}{"restore", "str", "0", payload[:len(payload)-1] + "!", "replace"}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{[]interface{}{"restore", "x", "-1", payload}, "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{[]interface{}{"restore", "x", "0", payload, "freq", "256"}, "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n"},
+		{[]interface{}{"restore", "x", "0", payload, "idletime", "1", "freq", "1"}, "-ERR syntax error\r\n"},
+		{[]interface{}{"restore", "str", "1000", payload, "replace", "absttl"}, "+OK\r\n"},
+		{[]interface{}{"restore", "x", "0", payload, "freq", "7"}, "+OK\r\n"},
+		{[]interface{}{"restore", "lzf", "0", lzf(1 << 62)}, "-ERR Bad data format\r\n"},
+		{[]interface{}{"restore", "lzf", "0", lzf(2)}, "+OK\r\n"},
+	}
+	for _, tc := range cases {
+		runCommand(cc, tc.args)
+		if reply := readReply(t, mconn); reply != tc.reply {
+			t.Errorf("%v: expected %q, got %q", tc.args[:3], tc.reply, reply)
+		}
+	}
+	if _, ok := db.load("str"); ok {
+		t.Error("key restored with an expired absolute ttl")
+	}
+	if freq := db.access["x"].freq; freq != 7 {
+		t.Errorf("invalid restored frequency %d", freq)
+	}
+}
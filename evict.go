@@ -0,0 +1,214 @@
+package localredis
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// lfuInitVal is the frequency of a new key, so that it is not evicted
+	// before it had a chance to be accessed.
+	lfuInitVal = 5
+	// evictionPoolSize is the number of best candidates kept between the
+	// evictions, like the eviction pool of redis.
+	evictionPoolSize = 16
+)
+
+// errOOM is replied to the commands that would use more memory when the
+// used memory is over maxmemory and nothing can be evicted.
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// oomCommands are refused over maxmemory, the commands flagged deny-oom
+// by redis.
+var oomCommands = map[string]bool{
+	"set":     true,
+	"restore": true,
+	"eval":    true,
+	"evalsha": true,
+	"fcall":   true,
+}
+
+// evictionCandidate is a key sampled for eviction, the higher the score
+// the better the candidate.
+type evictionCandidate struct {
+	score int64
+	db    int
+	key   string
+}
+
+// touchKey records an access to key, updating its access time and its
+// logarithmic access frequency. The server lock must be held.
+func (s *Client) touchKey(db *database, key string) {
+	now := time.Now()
+	access := db.access[key]
+	access.freq = s.lfuIncr(s.lfuDecay(access, now))
+	access.lastAccess = now
+	db.access[key] = access
+}
+
+// lfuDecay is the frequency of access decremented by the periods of
+// lfu-decay-time minutes elapsed since the last access.
+func (s *Client) lfuDecay(access keyAccess, now time.Time) uint8 {
+	if s.lfuDecayTime == 0 {
+		return access.freq
+	}
+	periods := int(now.Sub(access.lastAccess)/time.Minute) / s.lfuDecayTime
+	if periods >= int(access.freq) {
+		return 0
+	}
+	return access.freq - uint8(periods)
+}
+
+// lfuIncr increments the frequency counter with a probability decreasing
+// as the counter grows, by lfu-log-factor.
+func (s *Client) lfuIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*float64(s.lfuLogFactor)+1) {
+		counter++
+	}
+	return counter
+}
+
+// evict removes keys by maxmemory-policy until the used memory is under
+// maxmemory, it returns false when the memory is still over. Replicas
+// leave the eviction to their master. The server lock must be held.
+func (s *Client) evict() bool {
+	if s.maxmemory <= 0 || s.replica != nil {
+		return true
+	}
+	for s.usedMemory() > s.maxmemory {
+		if s.maxmemoryPolicy == policyNoEviction {
+			return false
+		}
+		idx, key, ok := s.evictionVictim()
+		if !ok {
+			return false
+		}
+		s.dbs[idx].remove(key)
+		s.stats.evictedKeys++
+		s.notifyKeyspaceEvent(notifyEvicted, "evicted", key, idx)
+		s.propagate(idx, "DEL", key)
+	}
+	return true
+}
+
+// evictionVictim chooses the key to evict by the policy, sampling
+// maxmemory-samples keys of each database rather than looking at all
+// the keys, like redis approximates LRU, LFU and TTL.
+func (s *Client) evictionVictim() (int, string, bool) {
+	volatile := strings.HasPrefix(s.maxmemoryPolicy, "volatile-")
+	if strings.HasSuffix(s.maxmemoryPolicy, "-random") {
+		start := rand.Intn(len(s.dbs))
+		for i := range s.dbs {
+			idx := (start + i) % len(s.dbs)
+			if keys := sampleKeys(s.dbs[idx], volatile, 1); len(keys) > 0 {
+				return idx, keys[0], true
+			}
+		}
+		return 0, "", false
+	}
+	for {
+		sampled := 0
+		now := time.Now()
+		for idx, db := range s.dbs {
+			for _, key := range sampleKeys(db, volatile, s.maxmemorySamples) {
+				s.addEvictionCandidate(evictionCandidate{s.evictionScore(db, key, now), idx, key})
+				sampled++
+			}
+		}
+		if sampled == 0 {
+			return 0, "", false
+		}
+		// the best candidates are last, they may be gone since sampled
+		for len(s.evictionPool) > 0 {
+			best := s.evictionPool[len(s.evictionPool)-1]
+			s.evictionPool = s.evictionPool[:len(s.evictionPool)-1]
+			if best.db >= len(s.dbs) {
+				continue
+			}
+			db := s.dbs[best.db]
+			if _, ok := db.load(best.key); !ok {
+				continue
+			}
+			if _, ok := db.timeout[best.key]; volatile && !ok {
+				continue
+			}
+			return best.db, best.key, true
+		}
+	}
+}
+
+// evictionScore is the idle time for the LRU policies, the inverse of the
+// frequency for LFU and the inverse of the expire time for volatile-ttl.
+func (s *Client) evictionScore(db *database, key string, now time.Time) int64 {
+	switch s.maxmemoryPolicy {
+	case policyVolatileLRU, policyAllKeysLRU:
+		return int64(now.Sub(db.access[key].lastAccess))
+	case policyVolatileLFU, policyAllKeysLFU:
+		return 255 - int64(s.lfuDecay(db.access[key], now))
+	default:
+		return -db.timeout[key].UnixNano()
+	}
+}
+
+// addEvictionCandidate inserts c in the pool sorted by score, dropping
+// the worst candidate when the pool is full.
+func (s *Client) addEvictionCandidate(c evictionCandidate) {
+	pool := s.evictionPool
+	for i, other := range pool {
+		if other.db == c.db && other.key == c.key {
+			pool = append(pool[:i], pool[i+1:]...)
+			break
+		}
+	}
+	i := sort.Search(len(pool), func(i int) bool { return pool[i].score > c.score })
+	if len(pool) == evictionPoolSize {
+		if i == 0 {
+			return
+		}
+		copy(pool, pool[1:i])
+		pool[i-1] = c
+	} else {
+		pool = append(pool, evictionCandidate{})
+		copy(pool[i+1:], pool[i:])
+		pool[i] = c
+	}
+	s.evictionPool = pool
+}
+
+// sampleKeys returns up to n keys of db that are not expired, only the
+// keys with a timeout when volatile. The random order of the maps makes
+// the sample.
+func sampleKeys(db *database, volatile bool, n int) []string {
+	keys := make([]string, 0, n)
+	if volatile {
+		for key := range db.timeout {
+			if keys = append(keys, key); len(keys) == n {
+				break
+			}
+		}
+	} else {
+		for key := range db.access {
+			if keys = append(keys, key); len(keys) == n {
+				break
+			}
+		}
+	}
+	// the expired keys are removed on the way
+	valid := keys[:0]
+	for _, key := range keys {
+		if _, ok := db.load(key); ok {
+			valid = append(valid, key)
+		}
+	}
+	return valid
+}
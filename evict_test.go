@@ -0,0 +1,108 @@
+package localredis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	cc := srv.addClient(NewConnOverride())
+	runCommand(cc, []interface{}{"set", "key", "value"})
+	if used, expected := srv.usedMemory(), entrySize("key", "value"); used != expected {
+		t.Errorf("used %d after a set, expected %d", used, expected)
+	}
+	runCommand(cc, []interface{}{"set", "key", "longer value"})
+	if used, expected := srv.usedMemory(), entrySize("key", "longer value"); used != expected {
+		t.Errorf("used %d after an overwrite, expected %d", used, expected)
+	}
+	runCommand(cc, []interface{}{"del", "key"})
+	if used := srv.usedMemory(); used != 0 {
+		t.Errorf("used %d after a del", used)
+	}
+	if valueSize(List{"a", "b"}) <= valueSize(List{"a"}) {
+		t.Error("a longer list is not bigger")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	for i := 0; i < 10; i++ {
+		runCommand(cc, []interface{}{"set", fmt.Sprintf("k%02d", i), "0123456789"})
+	}
+	limit := fmt.Sprint(srv.usedMemory())
+	runCommand(cc, []interface{}{"config", "set", "maxmemory", limit})
+	runCommand(cc, []interface{}{"set", "k10", "0123456789"})
+	mconn.Reset()
+
+	runCommand(cc, []interface{}{"set", "k11", "0123456789"})
+	runCommand(cc, []interface{}{"get", "k00"})
+	expected := "-" + errOOM.Error() + "\r\n+0123456789\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("under noeviction got %q, expected %q", reply, expected)
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "maxmemory-policy", "volatile-lru"})
+	runCommand(cc, []interface{}{"set", "k11", "0123456789"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n-"+errOOM.Error()+"\r\n" {
+		t.Errorf("evicted without volatile keys, got %q", reply)
+	}
+
+	// sampling all the keys makes the approximated LRU exact
+	runCommand(cc, []interface{}{"config", "set", "maxmemory-policy", "allkeys-lru", "maxmemory-samples", "64"})
+	runCommand(cc, []interface{}{"dbsize"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n:10\r\n" {
+		t.Errorf("expected a key evicted, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"exists", "k00"})
+	runCommand(cc, []interface{}{"exists", "k01"})
+	if reply := readReply(t, mconn); reply != ":1\r\n:0\r\n" {
+		t.Errorf("expected the least recently used key evicted, got %q", reply)
+	}
+	if srv.stats.evictedKeys != 1 {
+		t.Errorf("%d evicted keys", srv.stats.evictedKeys)
+	}
+	if used := srv.usedMemory(); used > srv.maxmemory {
+		t.Errorf("used %d over maxmemory %d", used, srv.maxmemory)
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "maxmemory", "1"})
+	runCommand(cc, []interface{}{"dbsize"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n:0\r\n" {
+		t.Errorf("expected all the keys evicted, got %q", reply)
+	}
+}
+
+func TestObjectAccess(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"restore", "old", "0", dumpPayload("v"), "idletime", "100"})
+	runCommand(cc, []interface{}{"set", "k", "v"})
+	mconn.Reset()
+
+	runCommand(cc, []interface{}{"object", "idletime", "old"})
+	runCommand(cc, []interface{}{"object", "idletime", "missing"})
+	runCommand(cc, []interface{}{"object", "freq", "k"})
+	expected := ":100\r\n-1\r\n-" + errLFUNotSelected + "\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "maxmemory-policy", "allkeys-lfu", "lfu-log-factor", "0"})
+	runCommand(cc, []interface{}{"get", "k"})
+	runCommand(cc, []interface{}{"get", "k"})
+	mconn.Reset()
+	runCommand(cc, []interface{}{"object", "freq", "k"})
+	runCommand(cc, []interface{}{"object", "idletime", "k"})
+	runCommand(cc, []interface{}{"object", "nosuch", "k"})
+	expected = fmt.Sprintf(":%d\r\n-%s\r\n-ERR unknown subcommand 'nosuch'. Try OBJECT HELP.\r\n", lfuInitVal+2, errLFUSelected)
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+}
@@ -0,0 +1,550 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mashingan/localredis/internal/lua"
+)
+
+// functionFlags are the flags accepted by redis.register_function.
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+// function is a callback registered by a library with
+// redis.register_function.
+type function struct {
+	name        string
+	description string
+	flags       []string
+	callback    lua.Value
+	lib         *library
+}
+
+func (f *function) noWrites() bool {
+	for _, flag := range f.flags {
+		if flag == "no-writes" {
+			return true
+		}
+	}
+	return false
+}
+
+// library is a loaded function library, it keeps its own Lua state so
+// the locals shared by its functions live across calls.
+type library struct {
+	name      string
+	code      string
+	functions []*function
+	state     *lua.State
+	env       *scriptEnv
+}
+
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// register implements redis.register_function, called either with the
+// name and the callback or with a single table of named arguments.
+func (lib *library) register(l *lua.State, args []lua.Value) {
+	fn := &function{lib: lib}
+	if len(args) == 1 {
+		table, ok := args[0].(*lua.Table)
+		if !ok {
+			l.Errorf("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+		}
+		for k, v, _ := table.Next(nil); k != nil; k, v, _ = table.Next(k) {
+			switch k {
+			case "function_name":
+				fn.name, _ = v.(string)
+			case "callback":
+				fn.callback = v
+			case "description":
+				fn.description, _ = v.(string)
+			case "flags":
+				flags, ok := v.(*lua.Table)
+				if !ok {
+					l.Errorf("flags argument to redis.register_function must be a table representing function flags")
+				}
+				for i := 1; i <= flags.Len(); i++ {
+					flag, _ := flags.Get(float64(i)).(string)
+					if !functionFlags[flag] {
+						l.Errorf("unknown flag given")
+					}
+					fn.flags = append(fn.flags, flag)
+				}
+			default:
+				l.Errorf("unknown argument given to redis.register_function")
+			}
+		}
+	} else {
+		if len(args) != 2 {
+			l.Errorf("wrong number of arguments to redis.register_function")
+		}
+		fn.name, _ = args[0].(string)
+		fn.callback = args[1]
+	}
+	if !validFunctionName(fn.name) {
+		l.Errorf("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	switch fn.callback.(type) {
+	case *lua.Function, *lua.GoFunction:
+	default:
+		l.Errorf("callback argument given to redis.register_function must be a function")
+	}
+	for _, other := range lib.functions {
+		if other.name == fn.name {
+			l.Errorf("Function already exists in the library")
+		}
+	}
+	lib.functions = append(lib.functions, fn)
+}
+
+// parseLibraryHeader reads the library name from the `#!lua name=<name>`
+// first line of code.
+func parseLibraryHeader(code string) (string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", fmt.Errorf("ERR Missing library metadata")
+	}
+	header := code[2:]
+	if i := strings.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+	fields := strings.Fields(header)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("ERR Missing library metadata")
+	}
+	if fields[0] != "lua" {
+		return "", fmt.Errorf("ERR Engine '%s' not found", fields[0])
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "name=") {
+			return "", fmt.Errorf("ERR Invalid metadata value given: %s", field)
+		}
+		name = strings.TrimPrefix(field, "name=")
+	}
+	if name == "" {
+		return "", fmt.Errorf("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", fmt.Errorf("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// compileLibrary runs code in a fresh Lua state and collects the
+// functions it registers, without installing the library.
+func compileLibrary(code string) (*library, error) {
+	name, err := parseLibraryHeader(code)
+	if err != nil {
+		return nil, err
+	}
+	lib := &library{name: name, code: code}
+	lib.env = &scriptEnv{lib: lib}
+	lib.state = newScriptState(lib.env)
+	lib.state.Chunk = "user_function"
+	lib.state.StrictGlobals = true
+	fn, err := lib.state.Load(code)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling function: %s", err.Error())
+	}
+	if _, err := lib.state.PCall(fn); err != nil {
+		return nil, fmt.Errorf("ERR Error registering functions: %s", err.Error())
+	}
+	lib.env.lib = nil
+	if len(lib.functions) == 0 {
+		return nil, fmt.Errorf("ERR No functions registered")
+	}
+	return lib, nil
+}
+
+// installLibraries adds libs to the server, replacing the libraries with
+// the same name only when replace is set. Nothing is installed if any of
+// the libraries conflicts.
+func (s *Client) installLibraries(libs []*library, replace bool) error {
+	replaced := map[string]bool{}
+	incoming := map[string]bool{}
+	for _, lib := range libs {
+		if _, ok := s.libraries[lib.name]; ok {
+			if !replace {
+				return fmt.Errorf("ERR Library '%s' already exists", lib.name)
+			}
+			replaced[lib.name] = true
+		}
+	}
+	for _, lib := range libs {
+		for _, fn := range lib.functions {
+			if existing, ok := s.functions[fn.name]; ok && !replaced[existing.lib.name] || incoming[fn.name] {
+				return fmt.Errorf("ERR Function %s already exists", fn.name)
+			}
+			incoming[fn.name] = true
+		}
+	}
+	for name := range replaced {
+		s.deleteLibrary(name)
+	}
+	for _, lib := range libs {
+		s.libraries[lib.name] = lib
+		for _, fn := range lib.functions {
+			s.functions[fn.name] = fn
+		}
+	}
+	return nil
+}
+
+func (s *Client) deleteLibrary(name string) bool {
+	lib, ok := s.libraries[name]
+	if !ok {
+		return false
+	}
+	for _, fn := range lib.functions {
+		delete(s.functions, fn.name)
+	}
+	delete(s.libraries, name)
+	return true
+}
+
+func (s *Client) sortedLibraries() []*library {
+	libs := make([]*library, 0, len(s.libraries))
+	for _, lib := range s.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// runFunction calls fn with `numkeys key [key ...] arg [arg ...]`, the
+// server lock is already held by runCommand.
+func runFunction(c net.Conn, args []interface{}, readOnly bool) {
+	if len(args) < 2 {
+		SendError(c, "ERR wrong number of arguments for 'fcall' command")
+		return
+	}
+	cc := clientOf(c)
+	fn, ok := cc.srv.functions[argString(args[0])]
+	if !ok {
+		SendError(c, "ERR Function not found")
+		return
+	}
+	if readOnly && !fn.noWrites() {
+		SendError(c, "ERR Can not execute a script with write flag using *_ro command.")
+		return
+	}
+	keys, argv, err := parseKeysArgs(args[1:])
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	lib := fn.lib
+	lib.env.runner = newScriptRunner(cc, readOnly || fn.noWrites())
+	run := cc.srv.startScript(true)
+	lib.state.Hook, lib.state.HookCount = cc.srv.scriptHook(run), scriptHookCount
+	defer func() {
+		lib.env.runner, lib.state.Hook = nil, nil
+		cc.srv.endScript(run)
+	}()
+	rets, err := lib.state.PCall(fn.callback, stringTable(keys), stringTable(argv))
+	if err != nil {
+		c.Write([]byte(scriptErrorReply(err, fn.name, lib.state.Chunk, lib.state.Line())))
+		return
+	}
+	var ret lua.Value
+	if len(rets) > 0 {
+		ret = rets[0]
+	}
+	c.Write([]byte(luaToReply(ret, cc.proto)))
+}
+
+func fcall(c net.Conn, args []interface{}) {
+	runFunction(c, args, false)
+}
+
+func fcallRO(c net.Conn, args []interface{}) {
+	runFunction(c, args, true)
+}
+
+var functionSubcommands = map[string]CommandExecutioner{
+	"load":    functionLoad,
+	"list":    functionList,
+	"delete":  functionDelete,
+	"flush":   functionFlush,
+	"dump":    functionDump,
+	"restore": functionRestore,
+	"stats":   functionStats,
+	"kill":    functionKill,
+}
+
+func functionCommand(c net.Conn, args []interface{}) {
+	if len(args) < 1 {
+		SendError(c, "ERR wrong number of arguments for 'function' command")
+		return
+	}
+	sub, ok := functionSubcommands[strings.ToLower(argString(args[0]))]
+	if !ok {
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try FUNCTION HELP.", argString(args[0])))
+		return
+	}
+	sub(c, args[1:])
+}
+
+// functionLoad handles `FUNCTION LOAD [REPLACE] function-code`.
+func functionLoad(c net.Conn, args []interface{}) {
+	replace := false
+	if len(args) == 2 && strings.ToLower(argString(args[0])) == "replace" {
+		replace = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'function|load' command")
+		return
+	}
+	lib, err := compileLibrary(argString(args[0]))
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	if err := clientOf(c).srv.installLibraries([]*library{lib}, replace); err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	SendBulk(c, lib.name)
+}
+
+// functionList handles `FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]`.
+func functionList(c net.Conn, args []interface{}) {
+	pattern := ""
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(argString(args[i])) {
+		case "withcode":
+			withCode = true
+		case "libraryname":
+			if i+1 >= len(args) {
+				SendError(c, "ERR library name argument was not given")
+				return
+			}
+			i++
+			pattern = argString(args[i])
+		default:
+			SendError(c, fmt.Sprintf("ERR Unknown argument %s", argString(args[i])))
+			return
+		}
+	}
+	result := []interface{}{}
+	for _, lib := range clientOf(c).srv.sortedLibraries() {
+		if pattern != "" && !globMatch(pattern, lib.name) {
+			continue
+		}
+		fns := make([]interface{}, len(lib.functions))
+		for i, fn := range lib.functions {
+			flags := make(RespSet, len(fn.flags))
+			for j, flag := range fn.flags {
+				flags[j] = flag
+			}
+			var description interface{}
+			if fn.description != "" {
+				description = fn.description
+			}
+			fns[i] = RespMap{"name", fn.name, "description", description, "flags", flags}
+		}
+		entry := RespMap{"library_name", lib.name, "engine", "LUA", "functions", fns}
+		if withCode {
+			entry = append(entry, "library_code", lib.code)
+		}
+		result = append(result, entry)
+	}
+	SendValue(c, result)
+}
+
+func functionDelete(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'function|delete' command")
+		return
+	}
+	if !clientOf(c).srv.deleteLibrary(argString(args[0])) {
+		SendError(c, "ERR Library not found")
+		return
+	}
+	SendOk(c)
+}
+
+func functionFlush(c net.Conn, args []interface{}) {
+	if !flushOpt(c, args) {
+		return
+	}
+	s := clientOf(c).srv
+	s.libraries = map[string]*library{}
+	s.functions = map[string]*function{}
+	SendOk(c)
+}
+
+// functionDump serializes all the libraries the same way as redis, each
+// library code follows a FUNCTION2 opcode and the payload ends with the
+// DUMP footer.
+func functionDump(c net.Conn, args []interface{}) {
+	if len(args) != 0 {
+		SendError(c, "ERR wrong number of arguments for 'function|dump' command")
+		return
+	}
+	var payload []byte
+	for _, lib := range clientOf(c).srv.sortedLibraries() {
+		payload = append(payload, rdbOpcodeFunction2)
+		payload = appendRDBString(payload, lib.code)
+	}
+	SendBulk(c, string(appendDumpFooter(payload)))
+}
+
+// functionRestore handles `FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]`.
+func functionRestore(c net.Conn, args []interface{}) {
+	if len(args) < 1 || len(args) > 2 {
+		SendError(c, "ERR wrong number of arguments for 'function|restore' command")
+		return
+	}
+	policy := "append"
+	if len(args) == 2 {
+		policy = strings.ToLower(argString(args[1]))
+		if policy != "append" && policy != "replace" && policy != "flush" {
+			SendError(c, "ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			return
+		}
+	}
+	body, err := verifyDumpPayload([]byte(argString(args[0])))
+	if err != nil {
+		SendError(c, "ERR payload version or checksum are wrong")
+		return
+	}
+	var libs []*library
+	r := &rdbReader{buf: body}
+	for !r.done() {
+		opcode, _ := r.byte()
+		if opcode != rdbOpcodeFunction2 {
+			SendError(c, "ERR given type is not a function")
+			return
+		}
+		code, err := r.string()
+		if err != nil {
+			SendError(c, "ERR payload version or checksum are wrong")
+			return
+		}
+		lib, err := compileLibrary(code)
+		if err != nil {
+			SendError(c, err.Error())
+			return
+		}
+		libs = append(libs, lib)
+	}
+	s := clientOf(c).srv
+	if policy == "flush" {
+		s.libraries = map[string]*library{}
+		s.functions = map[string]*function{}
+	}
+	if err := s.installLibraries(libs, policy == "replace"); err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	SendOk(c)
+}
+
+func functionStats(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	engines := RespMap{"LUA", RespMap{
+		"libraries_count", len(s.libraries),
+		"functions_count", len(s.functions),
+	}}
+	SendValue(c, RespMap{"running_script", nil, "engines", engines})
+}
+
+// functionKill only runs with no function running, a running one is
+// killed by scriptBusy without the lock.
+func functionKill(c net.Conn, args []interface{}) {
+	SendError(c, errNotBusy)
+}
+
+// globMatch reports whether s matches the glob-style pattern supported
+// by redis, with `*`, `?`, `[...]` classes and `\` escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			pattern = pattern[end+2:]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if s[0] >= lo && s[0] <= hi {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,178 @@
+package localredis
+
+import (
+	"strings"
+	"testing"
+)
+
+const counterLibrary = `#!lua name=counter
+local function incr(keys, args)
+	local current = tonumber(redis.call('get', keys[1])) or 0
+	redis.call('set', keys[1], current + tonumber(args[1]))
+	return current + tonumber(args[1])
+end
+local function peek(keys, args)
+	return redis.call('get', keys[1])
+end
+redis.register_function('counter_incr', incr)
+redis.register_function{function_name='counter_peek', callback=peek, flags={'no-writes'}, description='read the counter'}
+`
+
+func TestFunctionLoadAndCall(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"function", "load", counterLibrary})
+	if reply := readReply(t, mconn); reply != createBulkString("counter") {
+		t.Fatalf("invalid function load reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"function", "load", counterLibrary})
+	if reply := readReply(t, mconn); reply != "-ERR Library 'counter' already exists\r\n" {
+		t.Errorf("expected existing library error, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"function", "load", "replace", counterLibrary})
+	if reply := readReply(t, mconn); reply != createBulkString("counter") {
+		t.Errorf("invalid function load replace reply, got %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"fcall", "counter_incr", "1", "hits", "5"})
+	if reply := readReply(t, mconn); reply != ":5\r\n" {
+		t.Errorf("invalid fcall reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"fcall_ro", "counter_peek", "1", "hits"})
+	if reply := readReply(t, mconn); reply != "$1\r\n5\r\n" {
+		t.Errorf("invalid fcall_ro reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"fcall_ro", "counter_incr", "1", "hits", "1"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR Can not execute a script with write flag") {
+		t.Errorf("expected write flag error, got %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"function", "list", "libraryname", "count*"})
+	expected := "*1\r\n*6\r\n+library_name\r\n+counter\r\n+engine\r\n+LUA\r\n+functions\r\n*2\r\n" +
+		"*6\r\n+name\r\n+counter_incr\r\n+description\r\n$-1\r\n+flags\r\n*0\r\n" +
+		"*6\r\n+name\r\n+counter_peek\r\n+description\r\n+read the counter\r\n+flags\r\n*1\r\n+no-writes\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("invalid function list reply, expected %q, got %q", expected, reply)
+	}
+
+	runCommand(cc, []interface{}{"function", "dump"})
+	dump, _ := parseReply([]byte(readReply(t, mconn)))
+	payload, ok := dump.(string)
+	if !ok {
+		t.Fatalf("invalid function dump reply, got %#v", dump)
+	}
+	runCommand(cc, []interface{}{"function", "delete", "counter"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"fcall", "counter_incr", "1", "hits", "5"})
+	if reply := readReply(t, mconn); reply != "-ERR Function not found\r\n" {
+		t.Errorf("expected deleted function, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"function", "restore", payload})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Fatalf("invalid function restore reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"fcall", "counter_incr", "1", "hits", "5"})
+	if reply := readReply(t, mconn); reply != ":10\r\n" {
+		t.Errorf("invalid fcall reply after restore, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"function", "restore", payload[:len(payload)-1] + "x"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR payload version or checksum are wrong") {
+		t.Errorf("expected checksum error, got %q", reply)
+	}
+}
+
+func TestFunctionLoadErrors(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	cases := []struct {
+		code   string
+		prefix string
+	}{
+		{"redis.register_function('f', function() end)", "-ERR Missing library metadata"},
+		{"#!js name=lib\n", "-ERR Engine 'js' not found"},
+		{"#!lua\n", "-ERR Library name was not given"},
+		{"#!lua name=empty\nlocal x = 1", "-ERR No functions registered"},
+		{"#!lua name=flags\nredis.register_function{function_name='f', callback=function() end, flags={'bogus'}}", "-ERR Error registering functions"},
+		{"#!lua name=calls\nredis.call('ping')", "-ERR Error registering functions"},
+	}
+	for _, tc := range cases {
+		runCommand(cc, []interface{}{"function", "load", tc.code})
+		if reply := readReply(t, mconn); !strings.HasPrefix(reply, tc.prefix) {
+			t.Errorf("%q: expected prefix %q, got %q", tc.code, tc.prefix, reply)
+		}
+	}
+
+	runCommand(cc, []interface{}{"function", "load", "#!lua name=ro\nredis.register_function{function_name='ro_del', callback=function(keys) return redis.call('del', keys[1]) end, flags={'no-writes'}}"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"fcall", "ro_del", "1", "x"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR Write commands are not allowed from read-only scripts.") {
+		t.Errorf("expected write rejection in no-writes function, got %q", reply)
+	}
+}
+
+func TestFunctionKill(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	other := NewConnOverride()
+	oc := srv.addClient(other)
+
+	runCommand(cc, []interface{}{"config", "set", "busy-reply-threshold", "20"})
+	runCommand(cc, []interface{}{"function", "load", "#!lua name=spin\nredis.register_function('spin', function() while true do end end)\nredis.register_function('one', function() return 1 end)"})
+	runCommand(cc, []interface{}{"function", "kill"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n$4\r\nspin\r\n-"+errNotBusy+"\r\n" {
+		t.Fatalf("got %q", reply)
+	}
+	done := make(chan struct{})
+	go func() {
+		runCommand(cc, []interface{}{"fcall", "spin", "0"})
+		close(done)
+	}()
+	for busy := false; !busy; {
+		srv.busyMu.Lock()
+		busy = srv.busy != nil
+		srv.busyMu.Unlock()
+	}
+	runCommand(oc, []interface{}{"ping"})
+	runCommand(oc, []interface{}{"script", "kill"})
+	runCommand(oc, []interface{}{"function", "kill"})
+	expected := "-" + errBusyFunction + "\r\n-" + errBusyFunction + "\r\n+OK\r\n"
+	if reply := readReply(t, other); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+	<-done
+	if reply := readReply(t, mconn); reply != "-ERR Script killed by user with FUNCTION KILL...\r\n" {
+		t.Errorf("the killed function replied %q", reply)
+	}
+	runCommand(cc, []interface{}{"fcall", "one", "0"})
+	if reply := readReply(t, mconn); reply != ":1\r\n" {
+		t.Errorf("the library is not usable after the kill, got %q", reply)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"lib?", "lib1", true},
+		{"lib?", "lib", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*b", "a*b", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	}
+	for _, tc := range cases {
+		if got := globMatch(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", tc.pattern, tc.s, got, tc.match)
+		}
+	}
+}
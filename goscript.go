@@ -0,0 +1,165 @@
+package localredis
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ScriptFunc is a script implemented in Go. It receives the KEYS and ARGV
+// of the EVAL or EVALSHA call and its return value is sent as the reply,
+// a returned error is sent as an error reply with its message as is.
+type ScriptFunc func(tx *ScriptTx, keys, args []string) (interface{}, error)
+
+// scriptOverrides are the Go scripts registered with ScriptOverride,
+// indexed by the SHA1 of the Lua script they replace.
+var scriptOverrides = map[string]ScriptFunc{}
+
+// ScriptOverride registers fn to run instead of the Lua script with the
+// given sha, either with EVALSHA or with EVAL of the matching body.
+func ScriptOverride(sha string, fn ScriptFunc) {
+	scriptOverrides[strings.ToLower(sha)] = fn
+}
+
+// ScriptSHA returns the SHA1 of a script body, the same digest as
+// SCRIPT LOAD replies with.
+func ScriptSHA(body string) string {
+	return sha1hex(body)
+}
+
+var errReadOnlyScript = errors.New("ERR Write commands are not allowed from read-only scripts.")
+
+// ScriptTx is the view of the selected database given to a ScriptFunc.
+// Writes are buffered and only applied when the script returns without
+// error, and the whole script runs atomically with respect to the other
+// commands.
+type ScriptTx struct {
+	srv      *Client
+	dbIndex  int
+	db       *database
+	readOnly bool
+	writes   map[string]interface{}
+	deleted  map[string]bool
+	order    []string
+	err      error
+}
+
+func newScriptTx(cc *ClientConn, readOnly bool) *ScriptTx {
+	return &ScriptTx{
+		srv:      cc.srv,
+		dbIndex:  cc.db,
+		db:       cc.srv.dbs[cc.db],
+		readOnly: readOnly,
+		writes:   map[string]interface{}{},
+		deleted:  map[string]bool{},
+	}
+}
+
+// Get returns the value of key as seen by the script so far.
+func (tx *ScriptTx) Get(key string) (interface{}, bool) {
+	if tx.deleted[key] {
+		return nil, false
+	}
+	if v, ok := tx.writes[key]; ok {
+		return v, true
+	}
+	return tx.db.load(key)
+}
+
+// GetString returns the value of key when it holds a string.
+func (tx *ScriptTx) GetString(key string) (string, bool) {
+	v, ok := tx.Get(key)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// Set stores value at key, removing its expiration like SET does.
+func (tx *ScriptTx) Set(key string, value interface{}) {
+	if tx.readOnly {
+		tx.err = errReadOnlyScript
+		return
+	}
+	tx.touch(key)
+	delete(tx.deleted, key)
+	tx.writes[key] = value
+}
+
+// Del removes keys and returns how many of them existed.
+func (tx *ScriptTx) Del(keys ...string) int {
+	if tx.readOnly {
+		tx.err = errReadOnlyScript
+		return 0
+	}
+	n := 0
+	for _, key := range keys {
+		if _, ok := tx.Get(key); ok {
+			n++
+		}
+		tx.touch(key)
+		delete(tx.writes, key)
+		tx.deleted[key] = true
+	}
+	return n
+}
+
+// touch records the first write to key, commit applies the last one.
+func (tx *ScriptTx) touch(key string) {
+	if _, ok := tx.writes[key]; !ok && !tx.deleted[key] {
+		tx.order = append(tx.order, key)
+	}
+}
+
+func (tx *ScriptTx) commit() {
+	for _, key := range tx.order {
+		if tx.deleted[key] {
+			if tx.db.remove(key) {
+				tx.srv.notifyKeyspaceEvent(notifyGeneric, "del", key, tx.dbIndex)
+				tx.srv.propagate(tx.dbIndex, "DEL", key)
+			}
+		} else if v, ok := tx.writes[key]; ok {
+			if _, existed := tx.db.load(key); !existed {
+				tx.srv.notifyKeyspaceEvent(notifyNew, "new", key, tx.dbIndex)
+			}
+			tx.db.store(key, v)
+			delete(tx.db.timeout, key)
+			if typeName(v) == "string" {
+				tx.srv.notifyKeyspaceEvent(notifyString, "set", key, tx.dbIndex)
+				tx.srv.propagate(tx.dbIndex, "SET", key, argString(v))
+			} else {
+				tx.srv.notifyKeyspaceEvent(notifyGeneric, "restore", key, tx.dbIndex)
+				tx.srv.propagate(tx.dbIndex, "RESTORE", key, "0", dumpPayload(v), "REPLACE")
+			}
+		}
+	}
+}
+
+// runGoScript runs fn the same way as runScript does a Lua body.
+func runGoScript(c net.Conn, fn ScriptFunc, args []interface{}, readOnly bool) {
+	keys, argv, err := parseKeysArgs(args)
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	tx := newScriptTx(clientOf(c), readOnly)
+	result, err := fn(tx, argStrings(keys), argStrings(argv))
+	if err == nil {
+		err = tx.err
+	}
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	tx.commit()
+	SendValue(c, result)
+}
+
+func argStrings(args []interface{}) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = argString(arg)
+	}
+	return strs
+}
@@ -0,0 +1,82 @@
+package localredis
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestScriptOverride(t *testing.T) {
+	const transfer = `local from = tonumber(redis.call('get', KEYS[1]))
+redis.call('set', KEYS[1], from - ARGV[1])
+redis.call('set', KEYS[2], (tonumber(redis.call('get', KEYS[2])) or 0) + ARGV[1])`
+	sha := ScriptSHA(transfer)
+	ScriptOverride(sha, func(tx *ScriptTx, keys, args []string) (interface{}, error) {
+		from, _ := tx.GetString(keys[0])
+		if from < args[0] {
+			tx.Set(keys[0], "drained")
+			return nil, errors.New("ERR insufficient balance")
+		}
+		tx.Set(keys[0], "0")
+		tx.Set(keys[1], args[0])
+		return tx.Del(keys[2:]...), nil
+	})
+	defer delete(scriptOverrides, sha)
+
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	setmap(cc, []interface{}{"from", "5"})
+	setmap(cc, []interface{}{"stale", "x"})
+	readReply(t, mconn)
+
+	runCommand(cc, []interface{}{"script", "exists", sha})
+	if reply := readReply(t, mconn); reply != "*1\r\n:1\r\n" {
+		t.Errorf("override not reported by script exists, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"evalsha", sha, "2", "from", "to", "7"})
+	if reply := readReply(t, mconn); reply != "-ERR insufficient balance\r\n" {
+		t.Errorf("invalid evalsha error reply, got %q", reply)
+	}
+	if v, _ := dbOf(cc).load("from"); v != "5" {
+		t.Errorf("failed script changed the store, from is %v", v)
+	}
+	runCommand(cc, []interface{}{"eval", transfer, "3", "from", "to", "stale", "5"})
+	if reply := readReply(t, mconn); reply != ":1\r\n" {
+		t.Errorf("invalid eval reply, got %q", reply)
+	}
+	if v, _ := dbOf(cc).load("to"); v != "5" {
+		t.Errorf("script writes not applied, to is %v", v)
+	}
+	if _, ok := dbOf(cc).load("stale"); ok {
+		t.Error("script delete not applied")
+	}
+	runCommand(cc, []interface{}{"evalsha_ro", sha, "2", "from", "to", "0"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR Write commands are not allowed") {
+		t.Errorf("expected read-only rejection, got %q", reply)
+	}
+}
+
+func TestScriptTxRewrites(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"config", "set", "notify-keyspace-events", "KEA"})
+	runCommand(cc, []interface{}{"subscribe", "__keyspace@0__:k"})
+	readReply(t, mconn)
+
+	srv.mu.Lock()
+	tx := newScriptTx(cc, false)
+	tx.Set("k", "1")
+	tx.Set("k", "2")
+	tx.Del("k")
+	tx.Set("k", "3")
+	tx.commit()
+	srv.unlock()
+	if v, _ := dbOf(cc).load("k"); v != "3" {
+		t.Errorf("the last write is not applied, k is %v", v)
+	}
+	if reply := readReply(t, mconn); reply != "*3\r\n+message\r\n+__keyspace@0__:k\r\n+set\r\n" {
+		t.Errorf("a key written several times is committed more than once, got %q", reply)
+	}
+}
@@ -0,0 +1,298 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverStats are the counters of INFO stats, reset by CONFIG
+// RESETSTAT.
+type serverStats struct {
+	connectionsReceived int
+	rejectedConnections int
+	commandsProcessed   int
+	errorReplies        int
+	expiredKeys         int
+	evictedKeys         int
+	keyspaceHits        int
+	keyspaceMisses      int
+	syncFull            int
+	syncPartialOK       int
+	syncPartialErr      int
+	commands            map[string]*commandStat
+}
+
+// commandStat are the counters of a command in INFO commandstats.
+type commandStat struct {
+	calls    int
+	usec     int64
+	rejected int
+	failed   int
+}
+
+// command returns the counters of the command name, the server lock must
+// be held.
+func (st *serverStats) command(name string) *commandStat {
+	if st.commands == nil {
+		st.commands = map[string]*commandStat{}
+	}
+	stat, ok := st.commands[name]
+	if !ok {
+		stat = &commandStat{}
+		st.commands[name] = stat
+	}
+	return stat
+}
+
+// rejectCommand counts a command refused before its execution, e.g. a
+// write on a read only replica.
+func (s *Client) rejectCommand(name string) {
+	s.stats.command(name).rejected++
+	s.stats.errorReplies++
+}
+
+// infoSection is a section of the INFO reply, e.g. `# Replication`. The
+// extra sections are only replied when asked, or with all and everything.
+type infoSection struct {
+	name   string
+	fields func(s *Client) []string
+	extra  bool
+}
+
+// infoSections are replied in this order by INFO without arguments, the
+// sections without fields are left out.
+var infoSections = []infoSection{
+	{name: "Server", fields: serverInfo},
+	{name: "Clients", fields: clientsInfo},
+	{name: "Memory", fields: memoryInfo},
+	{name: "Persistence", fields: persistenceInfo},
+	{name: "Stats", fields: statsInfo},
+	{name: "Replication", fields: replicationInfo},
+	{name: "Sentinel", fields: sentinelInfo},
+	{name: "Commandstats", fields: commandstatsInfo, extra: true},
+	{name: "Cluster", fields: clusterInfo},
+	{name: "Keyspace", fields: keyspaceInfo},
+}
+
+// info handles `INFO [section [section ...]]`, the reply is a verbatim
+// string for RESP3 clients.
+func info(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	wanted := map[string]bool{}
+	for _, arg := range args {
+		wanted[strings.ToLower(argString(arg))] = true
+	}
+	all := wanted["all"] || wanted["everything"]
+	byDefault := len(wanted) == 0 || wanted["default"]
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[strings.ToLower(section.name)] && (section.extra || !byDefault) {
+			continue
+		}
+		fields := section.fields(s)
+		if fields == nil {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + section.name + "\r\n")
+		for _, field := range fields {
+			b.WriteString(field + "\r\n")
+		}
+	}
+	SendValue(c, RespVerbatim{Format: "txt", Text: b.String()})
+}
+
+func serverInfo(s *Client) []string {
+	uptime := time.Since(s.started)
+	port := s.tcpPort()
+	executable, _ := os.Executable()
+	return []string{
+		"redis_version:" + redisVersion,
+		"redis_mode:" + s.mode(),
+		fmt.Sprintf("os:%s %s", runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("arch_bits:%d", strconv.IntSize),
+		"multiplexing_api:go",
+		"go_version:" + runtime.Version(),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		"run_id:" + s.runID,
+		fmt.Sprintf("tcp_port:%d", port),
+		fmt.Sprintf("server_time_usec:%d", time.Now().UnixNano()/1000),
+		fmt.Sprintf("uptime_in_seconds:%d", int(uptime.Seconds())),
+		fmt.Sprintf("uptime_in_days:%d", int(uptime.Hours()/24)),
+		fmt.Sprintf("hz:%d", s.hz),
+		fmt.Sprintf("configured_hz:%d", s.hz),
+		"executable:" + executable,
+		"config_file:" + s.configFile,
+	}
+}
+
+func clientsInfo(s *Client) []string {
+	connected, pubsub := 0, 0
+	for _, cc := range s.listClients() {
+		if cc.replica {
+			continue
+		}
+		connected++
+		if cc.subscriptions() > 0 {
+			pubsub++
+		}
+	}
+	return []string{
+		fmt.Sprintf("connected_clients:%d", connected),
+		fmt.Sprintf("maxclients:%d", s.maxclients),
+		fmt.Sprintf("blocked_clients:%d", s.blockedClients),
+		fmt.Sprintf("pubsub_clients:%d", pubsub),
+	}
+}
+
+func memoryInfo(s *Client) []string {
+	if s.sentinel != nil {
+		return nil
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	used := s.usedMemory()
+	return []string{
+		fmt.Sprintf("used_memory:%d", used),
+		"used_memory_human:" + humanBytes(used),
+		fmt.Sprintf("used_memory_rss:%d", mem.Sys),
+		"used_memory_rss_human:" + humanBytes(int64(mem.Sys)),
+		fmt.Sprintf("used_memory_peak:%d", s.memoryPeak),
+		"used_memory_peak_human:" + humanBytes(s.memoryPeak),
+		fmt.Sprintf("maxmemory:%d", s.maxmemory),
+		"maxmemory_human:" + humanBytes(s.maxmemory),
+		"maxmemory_policy:" + s.maxmemoryPolicy,
+		"mem_allocator:go",
+	}
+}
+
+// usedMemory is the memory used by the server as maxmemory counts it,
+// the estimate of the dataset. The server lock must be held.
+func (s *Client) usedMemory() int64 {
+	used := s.datasetMemory()
+	if used > s.memoryPeak {
+		s.memoryPeak = used
+	}
+	return used
+}
+
+// humanBytes formats a memory size like used_memory_human, e.g. 1.50M.
+func humanBytes(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= unit.size {
+			return fmt.Sprintf("%.2f%s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func persistenceInfo(s *Client) []string {
+	if s.sentinel != nil {
+		return nil
+	}
+	bgsaveStatus, aofEnabled, rewriting, rewriteStatus := "ok", 0, 0, "ok"
+	if s.lastBgsaveErr != nil {
+		bgsaveStatus = "err"
+	}
+	if a := s.aof; a != nil {
+		aofEnabled = 1
+		a.mu.Lock()
+		if a.rewriting {
+			rewriting = 1
+		}
+		if a.lastRewriteErr != nil {
+			rewriteStatus = "err"
+		}
+		a.mu.Unlock()
+	}
+	return []string{
+		"loading:0",
+		fmt.Sprintf("rdb_changes_since_last_save:%d", s.dirty),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolInt(s.bgsaveRunning)),
+		fmt.Sprintf("rdb_last_save_time:%d", s.lastSave.Unix()),
+		"rdb_last_bgsave_status:" + bgsaveStatus,
+		fmt.Sprintf("aof_enabled:%d", aofEnabled),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		"aof_last_bgrewrite_status:" + rewriteStatus,
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func statsInfo(s *Client) []string {
+	st := s.stats
+	return []string{
+		fmt.Sprintf("total_connections_received:%d", st.connectionsReceived),
+		fmt.Sprintf("total_commands_processed:%d", st.commandsProcessed),
+		fmt.Sprintf("rejected_connections:%d", st.rejectedConnections),
+		fmt.Sprintf("sync_full:%d", st.syncFull),
+		fmt.Sprintf("sync_partial_ok:%d", st.syncPartialOK),
+		fmt.Sprintf("sync_partial_err:%d", st.syncPartialErr),
+		fmt.Sprintf("expired_keys:%d", st.expiredKeys),
+		fmt.Sprintf("evicted_keys:%d", st.evictedKeys),
+		fmt.Sprintf("keyspace_hits:%d", st.keyspaceHits),
+		fmt.Sprintf("keyspace_misses:%d", st.keyspaceMisses),
+		fmt.Sprintf("pubsub_channels:%d", len(s.channels)),
+		fmt.Sprintf("pubsub_patterns:%d", len(s.patterns)),
+		fmt.Sprintf("total_error_replies:%d", st.errorReplies),
+	}
+}
+
+func commandstatsInfo(s *Client) []string {
+	names := make([]string, 0, len(s.stats.commands))
+	for name := range s.stats.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		stat := s.stats.commands[name]
+		perCall := 0.0
+		if stat.calls > 0 {
+			perCall = float64(stat.usec) / float64(stat.calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			name, stat.calls, stat.usec, perCall, stat.rejected, stat.failed))
+	}
+	return lines
+}
+
+func keyspaceInfo(s *Client) []string {
+	if s.sentinel != nil {
+		return nil
+	}
+	lines := []string{}
+	now := time.Now()
+	for i, db := range s.dbs {
+		keys := db.size()
+		if keys == 0 {
+			continue
+		}
+		var ttl time.Duration
+		for _, until := range db.timeout {
+			ttl += until.Sub(now)
+		}
+		avgTTL := int64(0)
+		if len(db.timeout) > 0 {
+			avgTTL = ttl.Milliseconds() / int64(len(db.timeout))
+		}
+		lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d", i, keys, len(db.timeout), avgTTL))
+	}
+	return lines
+}
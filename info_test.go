@@ -0,0 +1,93 @@
+package localredis
+
+import (
+	"strings"
+	"testing"
+)
+
+// infoFields runs INFO with args and returns its fields by name, with
+// the section headers under "#".
+func infoFields(t *testing.T, cc *ClientConn, mconn *ConnOverride, args ...interface{}) map[string]string {
+	t.Helper()
+	mconn.Reset()
+	runCommand(cc, append([]interface{}{"info"}, args...))
+	reply := readReply(t, mconn)
+	if !strings.HasPrefix(reply, "$") {
+		t.Fatalf("invalid info reply %q", reply)
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(reply, "\r\n")[1:] {
+		if strings.HasPrefix(line, "# ") {
+			fields["#"] += line[2:] + ","
+		} else if i := strings.IndexByte(line, ':'); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	return fields
+}
+
+func TestInfo(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"set", "k", "v"})
+	runCommand(cc, []interface{}{"set", "t", "v", "ex", "100"})
+	runCommand(cc, []interface{}{"get", "k"})
+	runCommand(cc, []interface{}{"get", "missing"})
+	runCommand(cc, []interface{}{"select", "2"})
+	runCommand(cc, []interface{}{"set", "k", "v"})
+	runCommand(cc, []interface{}{"get", "k", "extra"})
+	runCommand(cc, []interface{}{"select", "0"})
+
+	fields := infoFields(t, cc, mconn)
+	if fields["#"] != "Server,Clients,Memory,Persistence,Stats,Replication,Cluster,Keyspace," {
+		t.Errorf("invalid default sections %q", fields["#"])
+	}
+	for name, expected := range map[string]string{
+		"redis_version":               redisVersion,
+		"redis_mode":                  "standalone",
+		"connected_clients":           "1",
+		"maxclients":                  "10000",
+		"maxmemory_policy":            "noeviction",
+		"total_commands_processed":    "8",
+		"keyspace_hits":               "2",
+		"keyspace_misses":             "1",
+		"rdb_changes_since_last_save": "3",
+		"aof_enabled":                 "0",
+		"db0":                         "keys=2,expires=1,avg_ttl=",
+		"db2":                         "keys=1,expires=0,avg_ttl=0",
+		"run_id":                      srv.runID,
+	} {
+		if v := fields[name]; !strings.HasPrefix(v, expected) {
+			t.Errorf("%s is %q, expected %q", name, v, expected)
+		}
+	}
+	if _, ok := fields["db1"]; ok {
+		t.Error("empty database in the keyspace section")
+	}
+	if _, ok := fields["cmdstat_get"]; ok {
+		t.Error("commandstats in the default sections")
+	}
+
+	fields = infoFields(t, cc, mconn, "commandstats", "keyspace")
+	if fields["#"] != "Commandstats,Keyspace," {
+		t.Errorf("invalid sections %q", fields["#"])
+	}
+	if v := fields["cmdstat_get"]; !strings.HasPrefix(v, "calls=3,usec=") || !strings.HasSuffix(v, ",rejected_calls=0,failed_calls=0") {
+		t.Errorf("invalid get stats %q", v)
+	}
+	if v := fields["cmdstat_info"]; !strings.HasPrefix(v, "calls=1,") {
+		t.Errorf("invalid info stats %q", v)
+	}
+	if fields := infoFields(t, cc, mconn, "all"); fields["cmdstat_set"] == "" || fields["redis_mode"] == "" {
+		t.Errorf("missing sections in info all: %q", fields["#"])
+	}
+
+	runCommand(cc, []interface{}{"config", "resetstat"})
+	fields = infoFields(t, cc, mconn, "stats", "commandstats")
+	if fields["total_commands_processed"] != "1" || fields["keyspace_hits"] != "0" || fields["cmdstat_get"] != "" {
+		t.Errorf("stats not reset: %v", fields)
+	}
+}
@@ -0,0 +1,102 @@
+package lua
+
+type expr interface{}
+type stmt interface{}
+
+type (
+	nilExpr    struct{}
+	trueExpr   struct{}
+	falseExpr  struct{}
+	varargExpr struct{}
+	numberExpr struct{ value float64 }
+	stringExpr struct{ value string }
+	nameExpr   struct {
+		name string
+		line int
+	}
+	indexExpr struct {
+		obj, key expr
+		line     int
+	}
+	callExpr struct {
+		fn     expr
+		method string
+		args   []expr
+		line   int
+	}
+	functionExpr struct {
+		params   []string
+		isVararg bool
+		body     []stmt
+		name     string
+	}
+	binaryExpr struct {
+		op          string
+		left, right expr
+		line        int
+	}
+	unaryExpr struct {
+		op      string
+		operand expr
+		line    int
+	}
+	parenExpr struct{ inner expr }
+	tableExpr struct {
+		array  []expr
+		keys   []expr
+		values []expr
+	}
+)
+
+type (
+	localStmt struct {
+		names []string
+		exprs []expr
+		line  int
+	}
+	assignStmt struct {
+		targets []expr
+		exprs   []expr
+		line    int
+	}
+	callStmt struct {
+		call *callExpr
+	}
+	doStmt struct {
+		body []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+	repeatStmt struct {
+		body []stmt
+		cond expr
+	}
+	ifStmt struct {
+		conds  []expr
+		blocks [][]stmt
+		orelse []stmt
+	}
+	numForStmt struct {
+		name              string
+		start, stop, step expr
+		body              []stmt
+		line              int
+	}
+	genForStmt struct {
+		names []string
+		exprs []expr
+		body  []stmt
+		line  int
+	}
+	localFunctionStmt struct {
+		name string
+		fn   *functionExpr
+	}
+	returnStmt struct {
+		exprs []expr
+		line  int
+	}
+	breakStmt struct{}
+)
@@ -0,0 +1,662 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+)
+
+const maxCallDepth = 200
+
+// State is an interpreter instance with its own globals.
+type State struct {
+	Globals *Table
+	// StrictGlobals makes reading an undefined global or creating a new
+	// one an error, like the sandbox of redis scripts.
+	StrictGlobals bool
+	// Chunk is the name used in the error positions, e.g. user_script.
+	Chunk string
+	// Hook is called every HookCount statements and loop iterations, it
+	// may raise an error to stop a script which runs for too long.
+	Hook      func(*State)
+	HookCount int
+
+	stringMeta *Table
+	line       int
+	depth      int
+	steps      int
+}
+
+type scope struct {
+	vars   map[string]*Value
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: map[string]*Value{}, parent: parent}
+}
+
+func (s *scope) lookup(name string) *Value {
+	for sc := s; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *scope) define(name string, v Value) {
+	s.vars[name] = &v
+}
+
+type frame struct {
+	varargs []Value
+}
+
+type signal int
+
+const (
+	sigNone signal = iota
+	sigBreak
+	sigReturn
+)
+
+// NewState creates an interpreter with the base, string, table and math
+// libraries loaded.
+func NewState() *State {
+	l := &State{Globals: NewTable(), Chunk: "user_script"}
+	openBase(l)
+	openString(l)
+	openTable(l)
+	openMath(l)
+	return l
+}
+
+// Register sets the global name to the Go function fn.
+func (l *State) Register(name string, fn func(*State, []Value) []Value) {
+	l.Globals.Set(name, &GoFunction{Name: name, Fn: fn})
+}
+
+// Errorf raises a Lua error with the current position prepended.
+func (l *State) Errorf(format string, args ...interface{}) {
+	panic(&Error{Value: l.where() + fmt.Sprintf(format, args...)})
+}
+
+func (l *State) where() string {
+	return fmt.Sprintf("%s:%d: ", l.Chunk, l.line)
+}
+
+// Line returns the line currently executed.
+func (l *State) Line() int {
+	return l.line
+}
+
+// Load compiles src into a function without running it.
+func (l *State) Load(src string) (*Function, error) {
+	body, err := parse(src, l.Chunk)
+	if err != nil {
+		return nil, err
+	}
+	return &Function{proto: &functionExpr{isVararg: true, body: body, name: "main"}}, nil
+}
+
+// DoString compiles and runs src, returning its results.
+func (l *State) DoString(src string) ([]Value, error) {
+	fn, err := l.Load(src)
+	if err != nil {
+		return nil, err
+	}
+	return l.PCall(fn)
+}
+
+// PCall calls fn in protected mode, returning raised errors as *Error.
+func (l *State) PCall(fn Value, args ...Value) (rets []Value, err error) {
+	depth := l.depth
+	defer func() {
+		if r := recover(); r != nil {
+			l.depth = depth
+			err = toError(r)
+		}
+	}()
+	return l.Call(fn, args...), nil
+}
+
+func toError(r interface{}) *Error {
+	switch e := r.(type) {
+	case *Error:
+		return e
+	case error:
+		return &Error{Value: e.Error()}
+	}
+	return &Error{Value: fmt.Sprint(r)}
+}
+
+// Call calls fn with args, any error is raised as a panic of *Error.
+func (l *State) Call(fn Value, args ...Value) []Value {
+	switch f := fn.(type) {
+	case *GoFunction:
+		return f.Fn(l, args)
+	case *Function:
+		return l.callLua(f, args)
+	case *Table:
+		if call := l.metamethod(f, "__call"); call != nil {
+			return l.Call(call, append([]Value{f}, args...)...)
+		}
+	}
+	l.Errorf("attempt to call a %s value", TypeName(fn))
+	return nil
+}
+
+func (l *State) callLua(f *Function, args []Value) []Value {
+	l.depth++
+	if l.depth > maxCallDepth {
+		l.Errorf("stack overflow")
+	}
+	defer func() { l.depth-- }()
+	sc := newScope(f.env)
+	for i, name := range f.proto.params {
+		var v Value
+		if i < len(args) {
+			v = args[i]
+		}
+		sc.define(name, v)
+	}
+	fr := &frame{}
+	if f.proto.isVararg && len(args) > len(f.proto.params) {
+		fr.varargs = append([]Value{}, args[len(f.proto.params):]...)
+	}
+	sig, rets := l.execBlock(f.proto.body, sc, fr)
+	if sig == sigReturn {
+		return rets
+	}
+	return nil
+}
+
+func (l *State) execBlock(body []stmt, sc *scope, fr *frame) (signal, []Value) {
+	for _, s := range body {
+		if sig, rets := l.exec(s, sc, fr); sig != sigNone {
+			return sig, rets
+		}
+	}
+	return sigNone, nil
+}
+
+// step counts a statement or a loop iteration and calls the hook every
+// HookCount of them.
+func (l *State) step() {
+	if l.Hook == nil {
+		return
+	}
+	l.steps++
+	if l.steps >= l.HookCount {
+		l.steps = 0
+		l.Hook(l)
+	}
+}
+
+func (l *State) exec(s stmt, sc *scope, fr *frame) (signal, []Value) {
+	l.step()
+	switch st := s.(type) {
+	case *localStmt:
+		l.line = st.line
+		vals := l.evalList(st.exprs, sc, fr, len(st.names))
+		for i, name := range st.names {
+			sc.define(name, vals[i])
+		}
+	case *assignStmt:
+		l.line = st.line
+		vals := l.evalList(st.exprs, sc, fr, len(st.targets))
+		for i, target := range st.targets {
+			l.assign(target, vals[i], sc, fr)
+		}
+	case *callStmt:
+		l.call(st.call, sc, fr)
+	case *doStmt:
+		return l.execBlock(st.body, newScope(sc), fr)
+	case *whileStmt:
+		for Truthy(l.eval(st.cond, sc, fr)) {
+			l.step()
+			sig, rets := l.execBlock(st.body, newScope(sc), fr)
+			if sig == sigBreak {
+				break
+			}
+			if sig == sigReturn {
+				return sig, rets
+			}
+		}
+	case *repeatStmt:
+		for {
+			l.step()
+			inner := newScope(sc)
+			sig, rets := l.execBlock(st.body, inner, fr)
+			if sig == sigBreak {
+				break
+			}
+			if sig == sigReturn {
+				return sig, rets
+			}
+			if Truthy(l.eval(st.cond, inner, fr)) {
+				break
+			}
+		}
+	case *ifStmt:
+		for i, cond := range st.conds {
+			if Truthy(l.eval(cond, sc, fr)) {
+				return l.execBlock(st.blocks[i], newScope(sc), fr)
+			}
+		}
+		if st.orelse != nil {
+			return l.execBlock(st.orelse, newScope(sc), fr)
+		}
+	case *numForStmt:
+		l.line = st.line
+		start := l.forNumber(l.eval(st.start, sc, fr), "initial")
+		stop := l.forNumber(l.eval(st.stop, sc, fr), "limit")
+		step := 1.0
+		if st.step != nil {
+			step = l.forNumber(l.eval(st.step, sc, fr), "step")
+		}
+		for i := start; (step > 0 && i <= stop) || (step <= 0 && i >= stop); i += step {
+			l.step()
+			inner := newScope(sc)
+			inner.define(st.name, i)
+			sig, rets := l.execBlock(st.body, inner, fr)
+			if sig == sigBreak {
+				break
+			}
+			if sig == sigReturn {
+				return sig, rets
+			}
+		}
+	case *genForStmt:
+		l.line = st.line
+		init := l.evalList(st.exprs, sc, fr, 3)
+		fn, state, control := init[0], init[1], init[2]
+		for {
+			l.step()
+			rets := l.Call(fn, state, control)
+			if len(rets) == 0 || rets[0] == nil {
+				break
+			}
+			control = rets[0]
+			inner := newScope(sc)
+			for i, name := range st.names {
+				var v Value
+				if i < len(rets) {
+					v = rets[i]
+				}
+				inner.define(name, v)
+			}
+			sig, rets := l.execBlock(st.body, inner, fr)
+			if sig == sigBreak {
+				break
+			}
+			if sig == sigReturn {
+				return sig, rets
+			}
+		}
+	case *localFunctionStmt:
+		sc.define(st.name, nil)
+		*sc.vars[st.name] = &Function{proto: st.fn, env: sc}
+	case *returnStmt:
+		l.line = st.line
+		if len(st.exprs) == 1 {
+			if call, ok := st.exprs[0].(*callExpr); ok {
+				return sigReturn, l.call(call, sc, fr)
+			}
+		}
+		return sigReturn, l.evalList(st.exprs, sc, fr, -1)
+	case *breakStmt:
+		return sigBreak, nil
+	}
+	return sigNone, nil
+}
+
+func (l *State) forNumber(v Value, what string) float64 {
+	n, ok := ToNumber(v)
+	if !ok {
+		l.Errorf("'for' %s value must be a number", what)
+	}
+	return n
+}
+
+func (l *State) assign(target expr, v Value, sc *scope, fr *frame) {
+	switch t := target.(type) {
+	case *nameExpr:
+		if ref := sc.lookup(t.name); ref != nil {
+			*ref = v
+			return
+		}
+		if l.StrictGlobals && l.Globals.Get(t.name) == nil {
+			l.line = t.line
+			l.Errorf("Script attempted to create global variable '%s'", t.name)
+		}
+		l.Globals.Set(t.name, v)
+	case *indexExpr:
+		obj := l.eval(t.obj, sc, fr)
+		key := l.eval(t.key, sc, fr)
+		l.line = t.line
+		l.SetIndex(obj, key, v)
+	}
+}
+
+// SetIndex performs obj[key] = v honouring the __newindex metamethod.
+func (l *State) SetIndex(obj, key, v Value) {
+	tbl, ok := obj.(*Table)
+	if !ok {
+		l.Errorf("attempt to index a %s value", TypeName(obj))
+	}
+	if tbl.Get(key) == nil {
+		if h := l.metamethod(tbl, "__newindex"); h != nil {
+			if ht, ok := h.(*Table); ok {
+				l.SetIndex(ht, key, v)
+			} else {
+				l.Call(h, tbl, key, v)
+			}
+			return
+		}
+	}
+	if key == nil {
+		l.Errorf("table index is nil")
+	}
+	if f, ok := key.(float64); ok && math.IsNaN(f) {
+		l.Errorf("table index is NaN")
+	}
+	if tbl.readonly {
+		l.Errorf("Attempt to modify a readonly table")
+	}
+	tbl.Set(key, v)
+}
+
+// Index performs obj[key] honouring the __index metamethod.
+func (l *State) Index(obj, key Value) Value {
+	switch o := obj.(type) {
+	case *Table:
+		v := o.Get(key)
+		if v != nil {
+			return v
+		}
+		h := l.metamethod(o, "__index")
+		if h == nil {
+			return nil
+		}
+		if _, ok := h.(*Table); ok {
+			return l.Index(h, key)
+		}
+		rets := l.Call(h, o, key)
+		if len(rets) > 0 {
+			return rets[0]
+		}
+		return nil
+	case string:
+		if l.stringMeta != nil {
+			return l.stringMeta.Get(key)
+		}
+	}
+	l.Errorf("attempt to index a %s value", TypeName(obj))
+	return nil
+}
+
+func (l *State) metamethod(t *Table, event string) Value {
+	if t.meta == nil {
+		return nil
+	}
+	return t.meta.Get(event)
+}
+
+// evalList evaluates exprs expanding the last one when it returns multiple
+// values. The result is padded with nil to want values unless want < 0.
+func (l *State) evalList(exprs []expr, sc *scope, fr *frame, want int) []Value {
+	vals := make([]Value, 0, len(exprs))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			vals = append(vals, l.evalMulti(e, sc, fr)...)
+		} else {
+			vals = append(vals, l.eval(e, sc, fr))
+		}
+	}
+	for want >= 0 && len(vals) < want {
+		vals = append(vals, nil)
+	}
+	return vals
+}
+
+func (l *State) evalMulti(e expr, sc *scope, fr *frame) []Value {
+	switch ex := e.(type) {
+	case *callExpr:
+		return l.call(ex, sc, fr)
+	case *varargExpr:
+		return fr.varargs
+	}
+	return []Value{l.eval(e, sc, fr)}
+}
+
+func first(vals []Value) Value {
+	if len(vals) == 0 {
+		return nil
+	}
+	return vals[0]
+}
+
+func (l *State) eval(e expr, sc *scope, fr *frame) Value {
+	switch ex := e.(type) {
+	case *nilExpr:
+		return nil
+	case *trueExpr:
+		return true
+	case *falseExpr:
+		return false
+	case *numberExpr:
+		return ex.value
+	case *stringExpr:
+		return ex.value
+	case *varargExpr:
+		return first(fr.varargs)
+	case *nameExpr:
+		if ref := sc.lookup(ex.name); ref != nil {
+			return *ref
+		}
+		v := l.Globals.Get(ex.name)
+		if v == nil && l.StrictGlobals {
+			l.line = ex.line
+			l.Errorf("Script attempted to access nonexistent global variable '%s'", ex.name)
+		}
+		return v
+	case *indexExpr:
+		obj := l.eval(ex.obj, sc, fr)
+		key := l.eval(ex.key, sc, fr)
+		l.line = ex.line
+		return l.Index(obj, key)
+	case *callExpr:
+		return first(l.call(ex, sc, fr))
+	case *functionExpr:
+		return &Function{proto: ex, env: sc}
+	case *parenExpr:
+		return l.eval(ex.inner, sc, fr)
+	case *tableExpr:
+		t := NewTable()
+		for i, item := range ex.array {
+			if i == len(ex.array)-1 {
+				for _, v := range l.evalMulti(item, sc, fr) {
+					t.Append(v)
+				}
+				continue
+			}
+			t.Set(float64(i+1), l.eval(item, sc, fr))
+		}
+		for i, k := range ex.keys {
+			key := l.eval(k, sc, fr)
+			if key == nil {
+				l.Errorf("table index is nil")
+			}
+			t.Set(key, l.eval(ex.values[i], sc, fr))
+		}
+		return t
+	case *unaryExpr:
+		v := l.eval(ex.operand, sc, fr)
+		l.line = ex.line
+		switch ex.op {
+		case "not":
+			return !Truthy(v)
+		case "-":
+			n, ok := ToNumber(v)
+			if !ok {
+				l.Errorf("attempt to perform arithmetic on a %s value", TypeName(v))
+			}
+			return -n
+		case "#":
+			switch val := v.(type) {
+			case string:
+				return float64(len(val))
+			case *Table:
+				return float64(val.Len())
+			}
+			l.Errorf("attempt to get length of a %s value", TypeName(v))
+		}
+	case *binaryExpr:
+		switch ex.op {
+		case "and":
+			left := l.eval(ex.left, sc, fr)
+			if !Truthy(left) {
+				return left
+			}
+			return l.eval(ex.right, sc, fr)
+		case "or":
+			left := l.eval(ex.left, sc, fr)
+			if Truthy(left) {
+				return left
+			}
+			return l.eval(ex.right, sc, fr)
+		}
+		left := l.eval(ex.left, sc, fr)
+		right := l.eval(ex.right, sc, fr)
+		l.line = ex.line
+		return l.Arith(ex.op, left, right)
+	}
+	return nil
+}
+
+// Arith applies the binary operator op to a and b.
+func (l *State) Arith(op string, a, b Value) Value {
+	switch op {
+	case "==":
+		return rawEqual(a, b)
+	case "~=":
+		return !rawEqual(a, b)
+	case "<":
+		return l.less(a, b, false)
+	case "<=":
+		return l.less(a, b, true)
+	case ">":
+		return l.less(b, a, false)
+	case ">=":
+		return l.less(b, a, true)
+	case "..":
+		as, aok := concatString(a)
+		bs, bok := concatString(b)
+		if !aok || !bok {
+			bad := a
+			if aok {
+				bad = b
+			}
+			l.Errorf("attempt to concatenate a %s value", TypeName(bad))
+		}
+		return as + bs
+	}
+	x, xok := ToNumber(a)
+	y, yok := ToNumber(b)
+	if !xok || !yok {
+		bad := a
+		if xok {
+			bad = b
+		}
+		l.Errorf("attempt to perform arithmetic on a %s value", TypeName(bad))
+	}
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		return x / y
+	case "%":
+		return x - math.Floor(x/y)*y
+	case "^":
+		return math.Pow(x, y)
+	}
+	l.Errorf("unknown operator %s", op)
+	return nil
+}
+
+func concatString(v Value) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case float64:
+		return FormatNumber(val), true
+	}
+	return "", false
+}
+
+func rawEqual(a, b Value) bool {
+	return a == b
+}
+
+func (l *State) less(a, b Value, orEqual bool) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			if orEqual {
+				return x <= y
+			}
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			if orEqual {
+				return x <= y
+			}
+			return x < y
+		}
+	}
+	if TypeName(a) == TypeName(b) {
+		l.Errorf("attempt to compare two %s values", TypeName(a))
+	}
+	l.Errorf("attempt to compare %s with %s", TypeName(a), TypeName(b))
+	return false
+}
+
+func (l *State) call(ex *callExpr, sc *scope, fr *frame) []Value {
+	fn := l.eval(ex.fn, sc, fr)
+	var args []Value
+	if ex.method != "" {
+		l.line = ex.line
+		self := fn
+		fn = l.Index(self, ex.method)
+		args = append(args, self)
+	}
+	args = append(args, l.evalList(ex.args, sc, fr, -1)...)
+	l.line = ex.line
+	if fn == nil {
+		l.Errorf("attempt to call %s (a nil value)", describe(ex))
+	}
+	rets := l.Call(fn, args...)
+	l.line = ex.line
+	return rets
+}
+
+func describe(ex *callExpr) string {
+	if ex.method != "" {
+		return fmt.Sprintf("method '%s'", ex.method)
+	}
+	switch f := ex.fn.(type) {
+	case *nameExpr:
+		return fmt.Sprintf("global '%s'", f.name)
+	case *indexExpr:
+		if k, ok := f.key.(*stringExpr); ok {
+			return fmt.Sprintf("field '%s'", k.value)
+		}
+	}
+	return "value"
+}
@@ -0,0 +1,289 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokOp
+	tokKeyword
+)
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+type lexer struct {
+	src   string
+	pos   int
+	line  int
+	chunk string
+}
+
+func (lx *lexer) errorf(format string, args ...interface{}) {
+	panic(&Error{Value: fmt.Sprintf("%s:%d: %s", lx.chunk, lx.line, fmt.Sprintf(format, args...))})
+}
+
+func (lx *lexer) peekByte(off int) byte {
+	if lx.pos+off < len(lx.src) {
+		return lx.src[lx.pos+off]
+	}
+	return 0
+}
+
+// longBracket returns the level of a long bracket `[==[` at the current
+// position, or -1 when there is none.
+func (lx *lexer) longBracket() int {
+	if lx.peekByte(0) != '[' {
+		return -1
+	}
+	level := 0
+	for lx.peekByte(1+level) == '=' {
+		level++
+	}
+	if lx.peekByte(1+level) != '[' {
+		return -1
+	}
+	return level
+}
+
+func (lx *lexer) readLong(level int) string {
+	lx.pos += level + 2
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf("unfinished long string")
+	}
+	text := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(text, "\n")
+	lx.pos += end + len(closing)
+	return text
+}
+
+func (lx *lexer) skipSpaces() {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case c == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if level := lx.longBracket(); level >= 0 {
+				lx.readLong(level)
+				continue
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+var operators = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+func (lx *lexer) next() token {
+	lx.skipSpaces()
+	if lx.pos >= len(lx.src) {
+		return token{kind: tokEOF, line: lx.line}
+	}
+	c := lx.src[lx.pos]
+	start := lx.pos
+	switch {
+	case isAlpha(c):
+		for lx.pos < len(lx.src) && (isAlpha(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		word := lx.src[start:lx.pos]
+		if keywords[word] {
+			return token{kind: tokKeyword, text: word, line: lx.line}
+		}
+		return token{kind: tokName, text: word, line: lx.line}
+	case isDigit(c) || (c == '.' && isDigit(lx.peekByte(1))):
+		return lx.readNumber()
+	case c == '"' || c == '\'':
+		return token{kind: tokString, text: lx.readString(c), line: lx.line}
+	case c == '[':
+		if level := lx.longBracket(); level >= 0 {
+			line := lx.line
+			return token{kind: tokString, text: lx.readLong(level), line: line}
+		}
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			return token{kind: tokOp, text: op, line: lx.line}
+		}
+	}
+	lx.errorf("unexpected symbol near '%c'", c)
+	return token{}
+}
+
+func (lx *lexer) readNumber() token {
+	start := lx.pos
+	if lx.src[lx.pos] == '0' && (lx.peekByte(1) == 'x' || lx.peekByte(1) == 'X') {
+		lx.pos += 2
+	}
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if (c == '+' || c == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') &&
+			!strings.HasPrefix(strings.ToLower(lx.src[start:]), "0x") {
+			lx.pos++
+			continue
+		}
+		if !(isDigit(c) || isAlpha(c) || c == '.') {
+			break
+		}
+		lx.pos++
+	}
+	text := lx.src[start:lx.pos]
+	num, ok := parseNumber(text)
+	if !ok {
+		lx.errorf("malformed number near '%s'", text)
+	}
+	return token{kind: tokNumber, text: text, num: num, line: lx.line}
+}
+
+func (lx *lexer) readString(quote byte) string {
+	lx.pos++
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			lx.errorf("unfinished string")
+		}
+		c := lx.src[lx.pos]
+		switch c {
+		case quote:
+			lx.pos++
+			return sb.String()
+		case '\n':
+			lx.errorf("unfinished string")
+		case '\\':
+			lx.pos++
+			e := lx.peekByte(0)
+			lx.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'a':
+				sb.WriteByte('\a')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'v':
+				sb.WriteByte('\v')
+			case '\n':
+				lx.line++
+				sb.WriteByte('\n')
+			case '\\', '"', '\'':
+				sb.WriteByte(e)
+			default:
+				if !isDigit(e) {
+					lx.errorf("invalid escape sequence '\\%c'", e)
+				}
+				n := int(e - '0')
+				for i := 0; i < 2 && isDigit(lx.peekByte(0)); i++ {
+					n = n*10 + int(lx.peekByte(0)-'0')
+					lx.pos++
+				}
+				if n > 255 {
+					lx.errorf("escape sequence too large")
+				}
+				sb.WriteByte(byte(n))
+			}
+		default:
+			sb.WriteByte(c)
+			lx.pos++
+		}
+	}
+}
+
+// parseNumber converts a Lua numeric literal or numeric string.
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	body := s
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if !(isDigit(c) || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-') {
+			return 0, false
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
@@ -0,0 +1,162 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// OpenBit loads the LuaBitOp compatible `bit` library.
+func OpenBit(l *State) {
+	lib := NewTable()
+	tobit := func(l *State, args []Value, i int, fname string) int32 {
+		return int32(int64(l.CheckNumber(args, i, fname)))
+	}
+	fold := func(name string, op func(a, b int32) int32) {
+		lib.Set(name, &GoFunction{Name: name, Fn: func(l *State, args []Value) []Value {
+			acc := tobit(l, args, 0, name)
+			for i := 1; i < len(args); i++ {
+				acc = op(acc, tobit(l, args, i, name))
+			}
+			return []Value{float64(acc)}
+		}})
+	}
+	fold("band", func(a, b int32) int32 { return a & b })
+	fold("bor", func(a, b int32) int32 { return a | b })
+	fold("bxor", func(a, b int32) int32 { return a ^ b })
+	shift := func(name string, op func(a int32, n uint) int32) {
+		lib.Set(name, &GoFunction{Name: name, Fn: func(l *State, args []Value) []Value {
+			n := uint(tobit(l, args, 1, name)) & 31
+			return []Value{float64(op(tobit(l, args, 0, name), n))}
+		}})
+	}
+	shift("lshift", func(a int32, n uint) int32 { return a << n })
+	shift("rshift", func(a int32, n uint) int32 { return int32(uint32(a) >> n) })
+	shift("arshift", func(a int32, n uint) int32 { return a >> n })
+	lib.Set("tobit", &GoFunction{Name: "tobit", Fn: func(l *State, args []Value) []Value {
+		return []Value{float64(tobit(l, args, 0, "tobit"))}
+	}})
+	lib.Set("bnot", &GoFunction{Name: "bnot", Fn: func(l *State, args []Value) []Value {
+		return []Value{float64(^tobit(l, args, 0, "bnot"))}
+	}})
+	lib.Set("tohex", &GoFunction{Name: "tohex", Fn: func(l *State, args []Value) []Value {
+		n := uint32(tobit(l, args, 0, "tohex"))
+		s := strconv.FormatUint(uint64(n), 16)
+		for len(s) < 8 {
+			s = "0" + s
+		}
+		return []Value{s}
+	}})
+	l.Globals.Set("bit", lib)
+}
+
+// OpenCJSON loads the `cjson` library with encode and decode.
+func OpenCJSON(l *State) {
+	lib := NewTable()
+	lib.Set("encode", &GoFunction{Name: "encode", Fn: func(l *State, args []Value) []Value {
+		var buf bytes.Buffer
+		encodeJSON(l, &buf, arg(args, 0), 0)
+		return []Value{buf.String()}
+	}})
+	lib.Set("decode", &GoFunction{Name: "decode", Fn: func(l *State, args []Value) []Value {
+		s := l.CheckString(args, 0, "decode")
+		dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			l.Errorf("Expected value but found invalid token")
+		}
+		return []Value{fromJSON(v)}
+	}})
+	l.Globals.Set("cjson", lib)
+}
+
+func encodeJSON(l *State, buf *bytes.Buffer, v Value, depth int) {
+	if depth > 1000 {
+		l.Errorf("Cannot serialise, excessive nesting (1001)")
+	}
+	switch val := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(val))
+	case float64:
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			l.Errorf("Cannot serialise number: must not be NaN or Inf")
+		}
+		buf.WriteString(strconv.FormatFloat(val, 'g', 14, 64))
+	case string:
+		b, _ := json.Marshal(val)
+		buf.Write(b)
+	case *Table:
+		n := val.Len()
+		isArray := n > 0
+		count := 0
+		for k, _, _ := val.Next(nil); k != nil; k, _, _ = val.Next(k) {
+			count++
+		}
+		if count != n {
+			isArray = false
+		}
+		if isArray {
+			buf.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					buf.WriteByte(',')
+				}
+				encodeJSON(l, buf, val.Get(float64(i)), depth+1)
+			}
+			buf.WriteByte(']')
+			return
+		}
+		keys := []string{}
+		values := map[string]Value{}
+		for k, item, _ := val.Next(nil); k != nil; k, item, _ = val.Next(k) {
+			ks, ok := concatString(k)
+			if !ok {
+				l.Errorf("Cannot serialise %s: table key must be a number or string", TypeName(k))
+			}
+			keys = append(keys, ks)
+			values[ks] = item
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			kb, _ := json.Marshal(k)
+			buf.Write(kb)
+			buf.WriteByte(':')
+			encodeJSON(l, buf, values[k], depth+1)
+		}
+		buf.WriteByte('}')
+	default:
+		l.Errorf("Cannot serialise %s: type not supported", TypeName(v))
+	}
+}
+
+func fromJSON(v interface{}) Value {
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	case []interface{}:
+		t := NewTable()
+		for _, item := range val {
+			t.Append(fromJSON(item))
+		}
+		return t
+	case map[string]interface{}:
+		t := NewTable()
+		for k, item := range val {
+			t.Set(k, fromJSON(item))
+		}
+		return t
+	case nil:
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,133 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func run(t *testing.T, src string) []Value {
+	t.Helper()
+	l := NewState()
+	rets, err := l.DoString(src)
+	if err != nil {
+		t.Fatalf("running %q: %v", src, err)
+	}
+	return rets
+}
+
+func TestEvaluation(t *testing.T) {
+	cases := []struct {
+		src    string
+		expect Value
+	}{
+		{"return 1 + 2 * 3", 7.0},
+		{"return 2 ^ 3 ^ 2", 512.0},
+		{"return 'a' .. 1 .. 'b'", "a1b"},
+		{"return 10 % 3, 7 / 2", 1.0},
+		{"local t = {1, 2, 3, x = 'y'} return #t", 3.0},
+		{"local s = 0 for i = 1, 10 do s = s + i end return s", 55.0},
+		{"local s = 0 for i = 10, 1, -2 do s = s + i end return s", 30.0},
+		{"local t = {} for k, v in pairs({a = 1, b = 2}) do t[#t + 1] = k .. v end table.sort(t) return table.concat(t, ',')", "a1,b2"},
+		{"local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end return fib(15)", 610.0},
+		{"local n = 0 while true do n = n + 1 if n > 5 then break end end return n", 6.0},
+		{"local n = 0 repeat n = n + 1 until n == 3 return n", 3.0},
+		{"local function mk() local c = 0 return function() c = c + 1 return c end end local f = mk() f() return f()", 2.0},
+		{"return select('#', 1, nil, 3)", 3.0},
+		{"local function v(...) return select(2, ...) end return v('a', 'b')", "b"},
+		{"return tostring(nil) .. tostring(true) .. tostring(1.5)", "niltrue1.5"},
+		{"return tonumber('0x10') + tonumber('  12  ') + tonumber('ff', 16)", 283.0},
+		{"return string.format('%s-%d-%5.2f-%q', 'x', 3.7, 1.5, 'a\"b')", "x-3- 1.50-\"a\\\"b\""},
+		{"return ('hello'):upper()", "HELLO"},
+		{"return string.sub('hello', 2, -2)", "ell"},
+		{"return string.find('key:123', ':(%d+)')", 4.0},
+		{"return string.match('user:42:name', '^user:(%d+):')", "42"},
+		{"return (string.gsub('hello world', 'o', '0'))", "hell0 w0rld"},
+		{"return (string.gsub('abc', '%w', '%0%0'))", "aabbcc"},
+		{"local t = {} for w in string.gmatch('one two three', '%a+') do t[#t+1] = w end return t[3]", "three"},
+		{"local ok, err = pcall(error, {code = 1}) return err.code", 1.0},
+		{"local ok, err = pcall(function() error('boom') end) return err", "user_script:1: boom"},
+		{"local t = setmetatable({}, {__index = function(t, k) return k .. '!' end}) return t.x", "x!"},
+		{"return math.max(1, 5, 3) + math.floor(2.7)", 7.0},
+		{"local t = {3, 1, 2} table.insert(t, 1, 0) return table.remove(t) + t[1]", 2.0},
+		{"return unpack({1, 2, 3}, 2)", 2.0},
+		{"return not nil and 'yes' or 'no'", "yes"},
+		{"--[[ long\ncomment ]] return [[raw\nstring]]", "raw\nstring"},
+	}
+	for _, tc := range cases {
+		rets := run(t, tc.src)
+		if len(rets) == 0 || rets[0] != tc.expect {
+			t.Errorf("%q: expected %#v, got %#v", tc.src, tc.expect, rets)
+		}
+	}
+}
+
+func TestStrictGlobals(t *testing.T) {
+	l := NewState()
+	l.StrictGlobals = true
+	_, err := l.DoString("x = 1")
+	if err == nil || !strings.Contains(err.Error(), "Script attempted to create global variable 'x'") {
+		t.Errorf("expected global creation error, got %v", err)
+	}
+	_, err = l.DoString("return y")
+	if err == nil || !strings.Contains(err.Error(), "nonexistent global variable 'y'") {
+		t.Errorf("expected nonexistent global error, got %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	l := NewState()
+	if _, err := l.DoString("local x = = 1"); err == nil {
+		t.Error("expected syntax error")
+	}
+	_, err := l.DoString("local t = nil\nreturn t.x")
+	if err == nil || err.Error() != "user_script:2: attempt to index a nil value" {
+		t.Errorf("unexpected runtime error: %v", err)
+	}
+	_, err = l.DoString("local function f() return f() + 1 end return f()")
+	if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("expected stack overflow, got %v", err)
+	}
+}
+
+func TestHook(t *testing.T) {
+	l := NewState()
+	calls := 0
+	l.HookCount = 100
+	l.Hook = func(l *State) {
+		calls++
+		if calls == 50 {
+			l.Errorf("interrupted")
+		}
+	}
+	_, err := l.DoString("while true do end")
+	if err == nil || err.Error() != "user_script:0: interrupted" {
+		t.Errorf("expected the hook to stop the loop, got %v", err)
+	}
+	l.Hook = func(l *State) { panic(&Error{Value: "killed", Fatal: true}) }
+	_, err = l.DoString("while true do pcall(function() while true do end end) end")
+	if err == nil || err.Error() != "killed" {
+		t.Errorf("expected pcall to let the fatal error through, got %v", err)
+	}
+	l.Hook = nil
+	if _, err := l.DoString("for i = 1, 10000 do end"); err != nil || calls != 50 {
+		t.Errorf("hook called %d times without being set, error %v", calls, err)
+	}
+}
+
+func TestLibraries(t *testing.T) {
+	l := NewState()
+	OpenBit(l)
+	OpenCJSON(l)
+	rets, err := l.DoString(`
+local decoded = cjson.decode('{"a": [1, 2, {"b": "c"}]}')
+return bit.band(12, 10), cjson.encode({1, 2, 3}), cjson.encode({x = 1}), decoded.a[3].b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Value{8.0, "[1,2,3]", `{"x":1}`, "c"}
+	for i, v := range expected {
+		if rets[i] != v {
+			t.Errorf("result %d: expected %#v, got %#v", i, v, rets[i])
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package lua
+
+import "fmt"
+
+type parser struct {
+	lx    *lexer
+	tok   token
+	ahead *token
+}
+
+func parse(src, chunk string) (body []stmt, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			lerr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = lerr
+		}
+	}()
+	p := &parser{lx: &lexer{src: src, line: 1, chunk: chunk}}
+	if len(src) > 0 && src[0] == '#' {
+		// skip the shebang line, e.g. `#!lua name=mylib` of function libraries
+		for p.lx.pos < len(src) && src[p.lx.pos] != '\n' {
+			p.lx.pos++
+		}
+	}
+	p.advance()
+	body = p.block()
+	if p.tok.kind != tokEOF {
+		p.errorf("'<eof>' expected near '%s'", p.tok)
+	}
+	return body, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) {
+	panic(&Error{Value: fmt.Sprintf("%s:%d: %s", p.lx.chunk, p.tok.line, fmt.Sprintf(format, args...))})
+}
+
+func (p *parser) advance() {
+	if p.ahead != nil {
+		p.tok = *p.ahead
+		p.ahead = nil
+		return
+	}
+	p.tok = p.lx.next()
+}
+
+func (p *parser) peek() token {
+	if p.ahead == nil {
+		t := p.lx.next()
+		p.ahead = &t
+	}
+	return *p.ahead
+}
+
+func (p *parser) is(text string) bool {
+	return (p.tok.kind == tokOp || p.tok.kind == tokKeyword) && p.tok.text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) {
+	if !p.accept(text) {
+		p.errorf("'%s' expected near '%s'", text, p.tok)
+	}
+}
+
+func (p *parser) name() string {
+	if p.tok.kind != tokName {
+		p.errorf("<name> expected near '%s'", p.tok)
+	}
+	n := p.tok.text
+	p.advance()
+	return n
+}
+
+func (p *parser) blockEnd() bool {
+	if p.tok.kind == tokEOF {
+		return true
+	}
+	if p.tok.kind != tokKeyword {
+		return false
+	}
+	switch p.tok.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *parser) block() []stmt {
+	body := []stmt{}
+	for !p.blockEnd() {
+		if p.is("return") {
+			line := p.tok.line
+			p.advance()
+			ret := &returnStmt{line: line}
+			if !p.blockEnd() && !p.is(";") {
+				ret.exprs = p.exprList()
+			}
+			p.accept(";")
+			body = append(body, ret)
+			if !p.blockEnd() {
+				p.errorf("'end' expected near '%s'", p.tok)
+			}
+			break
+		}
+		if p.is("break") {
+			p.advance()
+			p.accept(";")
+			body = append(body, &breakStmt{})
+			continue
+		}
+		s := p.statement()
+		if s != nil {
+			body = append(body, s)
+		}
+		p.accept(";")
+	}
+	return body
+}
+
+func (p *parser) statement() stmt {
+	line := p.tok.line
+	switch {
+	case p.accept(";"):
+		return nil
+	case p.accept("do"):
+		body := p.block()
+		p.expect("end")
+		return &doStmt{body: body}
+	case p.accept("while"):
+		cond := p.expr()
+		p.expect("do")
+		body := p.block()
+		p.expect("end")
+		return &whileStmt{cond: cond, body: body}
+	case p.accept("repeat"):
+		body := p.block()
+		p.expect("until")
+		return &repeatStmt{body: body, cond: p.expr()}
+	case p.accept("if"):
+		s := &ifStmt{}
+		s.conds = append(s.conds, p.expr())
+		p.expect("then")
+		s.blocks = append(s.blocks, p.block())
+		for p.accept("elseif") {
+			s.conds = append(s.conds, p.expr())
+			p.expect("then")
+			s.blocks = append(s.blocks, p.block())
+		}
+		if p.accept("else") {
+			s.orelse = p.block()
+		}
+		p.expect("end")
+		return s
+	case p.accept("for"):
+		first := p.name()
+		if p.accept("=") {
+			s := &numForStmt{name: first, line: line}
+			s.start = p.expr()
+			p.expect(",")
+			s.stop = p.expr()
+			if p.accept(",") {
+				s.step = p.expr()
+			}
+			p.expect("do")
+			s.body = p.block()
+			p.expect("end")
+			return s
+		}
+		s := &genForStmt{names: []string{first}, line: line}
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+		p.expect("in")
+		s.exprs = p.exprList()
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+	case p.accept("function"):
+		n := p.name()
+		var target expr = &nameExpr{name: n, line: line}
+		fullname := n
+		method := false
+		for p.is(".") || p.is(":") {
+			method = p.is(":")
+			p.advance()
+			key := p.name()
+			fullname += "." + key
+			target = &indexExpr{obj: target, key: &stringExpr{value: key}, line: line}
+			if method {
+				break
+			}
+		}
+		fn := p.funcBody(method, fullname)
+		return &assignStmt{targets: []expr{target}, exprs: []expr{fn}, line: line}
+	case p.accept("local"):
+		if p.accept("function") {
+			n := p.name()
+			return &localFunctionStmt{name: n, fn: p.funcBody(false, n)}
+		}
+		s := &localStmt{line: line}
+		s.names = append(s.names, p.name())
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+		if p.accept("=") {
+			s.exprs = p.exprList()
+		}
+		return s
+	}
+	e := p.suffixedExpr()
+	if p.is("=") || p.is(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.expect("=")
+		for _, t := range targets {
+			switch t.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				p.errorf("syntax error near '%s'", p.tok)
+			}
+		}
+		return &assignStmt{targets: targets, exprs: p.exprList(), line: line}
+	}
+	call, ok := e.(*callExpr)
+	if !ok {
+		p.errorf("syntax error near '%s'", p.tok)
+	}
+	return &callStmt{call: call}
+}
+
+func (p *parser) funcBody(method bool, name string) *functionExpr {
+	fn := &functionExpr{name: name}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				fn.isVararg = true
+				break
+			}
+			fn.params = append(fn.params, p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	fn.body = p.block()
+	p.expect("end")
+	return fn
+}
+
+func (p *parser) exprList() []expr {
+	list := []expr{p.expr()}
+	for p.accept(",") {
+		list = append(list, p.expr())
+	}
+	return list
+}
+
+func (p *parser) primaryExpr() expr {
+	line := p.tok.line
+	if p.tok.kind == tokName {
+		return &nameExpr{name: p.name(), line: line}
+	}
+	if p.accept("(") {
+		e := p.expr()
+		p.expect(")")
+		return &parenExpr{inner: e}
+	}
+	p.errorf("unexpected symbol near '%s'", p.tok)
+	return nil
+}
+
+func (p *parser) suffixedExpr() expr {
+	e := p.primaryExpr()
+	for {
+		line := p.tok.line
+		switch {
+		case p.accept("."):
+			e = &indexExpr{obj: e, key: &stringExpr{value: p.name()}, line: line}
+		case p.accept("["):
+			key := p.expr()
+			p.expect("]")
+			e = &indexExpr{obj: e, key: key, line: line}
+		case p.accept(":"):
+			method := p.name()
+			e = &callExpr{fn: e, method: method, args: p.callArgs(), line: line}
+		case p.is("(") || p.is("{") || p.tok.kind == tokString:
+			e = &callExpr{fn: e, args: p.callArgs(), line: line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) callArgs() []expr {
+	if p.tok.kind == tokString {
+		s := p.tok.text
+		p.advance()
+		return []expr{&stringExpr{value: s}}
+	}
+	if p.is("{") {
+		return []expr{p.tableConstructor()}
+	}
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	args := p.exprList()
+	p.expect(")")
+	return args
+}
+
+func (p *parser) tableConstructor() expr {
+	p.expect("{")
+	t := &tableExpr{}
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.advance()
+			k := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.keys = append(t.keys, k)
+			t.values = append(t.values, p.expr())
+		case p.tok.kind == tokName && p.peek().kind == tokOp && p.peek().text == "=":
+			k := p.name()
+			p.advance()
+			t.keys = append(t.keys, &stringExpr{value: k})
+			t.values = append(t.values, p.expr())
+		default:
+			t.array = append(t.array, p.expr())
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	return t
+}
+
+func (p *parser) simpleExpr() expr {
+	switch {
+	case p.tok.kind == tokNumber:
+		n := p.tok.num
+		p.advance()
+		return &numberExpr{value: n}
+	case p.tok.kind == tokString:
+		s := p.tok.text
+		p.advance()
+		return &stringExpr{value: s}
+	case p.accept("nil"):
+		return &nilExpr{}
+	case p.accept("true"):
+		return &trueExpr{}
+	case p.accept("false"):
+		return &falseExpr{}
+	case p.accept("..."):
+		return &varargExpr{}
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.accept("function"):
+		return p.funcBody(false, "anonymous")
+	}
+	return p.suffixedExpr()
+}
+
+var binaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPriority = 8
+
+func (p *parser) expr() expr {
+	return p.subExpr(0)
+}
+
+func (p *parser) subExpr(limit int) expr {
+	var e expr
+	line := p.tok.line
+	if p.is("not") || p.is("-") || p.is("#") {
+		op := p.tok.text
+		p.advance()
+		e = &unaryExpr{op: op, operand: p.subExpr(unaryPriority), line: line}
+	} else {
+		e = p.simpleExpr()
+	}
+	for {
+		if p.tok.kind != tokOp && p.tok.kind != tokKeyword {
+			return e
+		}
+		prio, ok := binaryPriority[p.tok.text]
+		if !ok || prio[0] <= limit {
+			return e
+		}
+		op := p.tok.text
+		line := p.tok.line
+		p.advance()
+		right := p.subExpr(prio[1])
+		e = &binaryExpr{op: op, left: e, right: right, line: line}
+	}
+}
@@ -0,0 +1,369 @@
+package lua
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// CheckString returns the i-th argument as string, numbers are converted.
+func (l *State) CheckString(args []Value, i int, fname string) string {
+	switch v := arg(args, i).(type) {
+	case string:
+		return v
+	case float64:
+		return FormatNumber(v)
+	}
+	l.Errorf("bad argument #%d to '%s' (string expected, got %s)", i+1, fname, typeOrNoValue(args, i))
+	return ""
+}
+
+// CheckNumber returns the i-th argument as number, numeric strings are
+// converted.
+func (l *State) CheckNumber(args []Value, i int, fname string) float64 {
+	n, ok := ToNumber(arg(args, i))
+	if !ok {
+		l.Errorf("bad argument #%d to '%s' (number expected, got %s)", i+1, fname, typeOrNoValue(args, i))
+	}
+	return n
+}
+
+// CheckTable returns the i-th argument as table.
+func (l *State) CheckTable(args []Value, i int, fname string) *Table {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		l.Errorf("bad argument #%d to '%s' (table expected, got %s)", i+1, fname, typeOrNoValue(args, i))
+	}
+	return t
+}
+
+func (l *State) optNumber(args []Value, i int, fname string, def float64) float64 {
+	if arg(args, i) == nil {
+		return def
+	}
+	return l.CheckNumber(args, i, fname)
+}
+
+func typeOrNoValue(args []Value, i int) string {
+	if i >= len(args) {
+		return "no value"
+	}
+	return TypeName(args[i])
+}
+
+// Tostring converts v honouring the __tostring metamethod.
+func (l *State) Tostring(v Value) string {
+	if t, ok := v.(*Table); ok {
+		if h := l.metamethod(t, "__tostring"); h != nil {
+			return ToString(first(l.Call(h, t)))
+		}
+	}
+	return ToString(v)
+}
+
+func openBase(l *State) {
+	l.Register("assert", func(l *State, args []Value) []Value {
+		if !Truthy(arg(args, 0)) {
+			if len(args) > 1 {
+				panic(&Error{Value: args[1]})
+			}
+			l.Errorf("assertion failed!")
+		}
+		return args
+	})
+	l.Register("error", func(l *State, args []Value) []Value {
+		msg := arg(args, 0)
+		level := l.optNumber(args, 1, "error", 1)
+		if s, ok := msg.(string); ok && level > 0 {
+			msg = l.where() + s
+		}
+		panic(&Error{Value: msg})
+	})
+	l.Register("pcall", func(l *State, args []Value) []Value {
+		if len(args) == 0 {
+			l.Errorf("bad argument #1 to 'pcall' (value expected)")
+		}
+		line := l.line
+		rets, err := l.PCall(args[0], args[1:]...)
+		l.line = line
+		if err != nil {
+			if err.(*Error).Fatal {
+				panic(err)
+			}
+			return []Value{false, err.(*Error).Value}
+		}
+		return append([]Value{true}, rets...)
+	})
+	l.Register("type", func(l *State, args []Value) []Value {
+		if len(args) == 0 {
+			l.Errorf("bad argument #1 to 'type' (value expected)")
+		}
+		return []Value{TypeName(args[0])}
+	})
+	l.Register("tostring", func(l *State, args []Value) []Value {
+		return []Value{l.Tostring(arg(args, 0))}
+	})
+	l.Register("tonumber", func(l *State, args []Value) []Value {
+		base := int(l.optNumber(args, 1, "tonumber", 10))
+		if base == 10 {
+			if n, ok := ToNumber(arg(args, 0)); ok {
+				return []Value{n}
+			}
+			return []Value{nil}
+		}
+		s := strings.ToLower(strings.TrimSpace(l.CheckString(args, 0, "tonumber")))
+		n, err := strconv.ParseInt(s, base, 64)
+		if err != nil {
+			return []Value{nil}
+		}
+		return []Value{float64(n)}
+	})
+	next := &GoFunction{Name: "next", Fn: func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "next")
+		k, v, ok := t.Next(arg(args, 1))
+		if !ok {
+			l.Errorf("invalid key to 'next'")
+		}
+		if k == nil {
+			return []Value{nil}
+		}
+		return []Value{k, v}
+	}}
+	l.Globals.Set("next", next)
+	l.Register("pairs", func(l *State, args []Value) []Value {
+		return []Value{next, l.CheckTable(args, 0, "pairs"), nil}
+	})
+	inext := &GoFunction{Name: "inext", Fn: func(l *State, args []Value) []Value {
+		t := args[0].(*Table)
+		i := args[1].(float64) + 1
+		v := t.Get(i)
+		if v == nil {
+			return []Value{nil}
+		}
+		return []Value{i, v}
+	}}
+	l.Register("ipairs", func(l *State, args []Value) []Value {
+		return []Value{inext, l.CheckTable(args, 0, "ipairs"), float64(0)}
+	})
+	l.Register("select", func(l *State, args []Value) []Value {
+		if s, ok := arg(args, 0).(string); ok && s == "#" {
+			return []Value{float64(len(args) - 1)}
+		}
+		n := int(l.CheckNumber(args, 0, "select"))
+		if n < 0 {
+			n = len(args) + n
+		} else if n == 0 {
+			l.Errorf("bad argument #1 to 'select' (index out of range)")
+		}
+		if n >= len(args) {
+			return nil
+		}
+		return args[n:]
+	})
+	unpack := func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "unpack")
+		i := int(l.optNumber(args, 1, "unpack", 1))
+		j := int(l.optNumber(args, 2, "unpack", float64(t.Len())))
+		var rets []Value
+		for ; i <= j; i++ {
+			rets = append(rets, t.Get(float64(i)))
+		}
+		return rets
+	}
+	l.Register("unpack", unpack)
+	l.Register("rawget", func(l *State, args []Value) []Value {
+		return []Value{l.CheckTable(args, 0, "rawget").Get(arg(args, 1))}
+	})
+	l.Register("rawset", func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "rawset")
+		t.Set(arg(args, 1), arg(args, 2))
+		return []Value{t}
+	})
+	l.Register("rawequal", func(l *State, args []Value) []Value {
+		return []Value{rawEqual(arg(args, 0), arg(args, 1))}
+	})
+	l.Register("setmetatable", func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "setmetatable")
+		switch m := arg(args, 1).(type) {
+		case nil:
+			t.meta = nil
+		case *Table:
+			t.meta = m
+		default:
+			l.Errorf("bad argument #2 to 'setmetatable' (nil or table expected)")
+		}
+		return []Value{t}
+	})
+	l.Register("getmetatable", func(l *State, args []Value) []Value {
+		if t, ok := arg(args, 0).(*Table); ok && t.meta != nil {
+			return []Value{t.meta}
+		}
+		if _, ok := arg(args, 0).(string); ok && l.stringMeta != nil {
+			return []Value{l.stringMeta}
+		}
+		return []Value{nil}
+	})
+}
+
+func openTable(l *State) {
+	lib := NewTable()
+	reg := func(name string, fn func(*State, []Value) []Value) {
+		lib.Set(name, &GoFunction{Name: name, Fn: fn})
+	}
+	reg("insert", func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "insert")
+		switch len(args) {
+		case 2:
+			t.Append(args[1])
+		case 3:
+			pos := int(l.CheckNumber(args, 1, "insert"))
+			n := t.Len()
+			if pos > n+1 || pos < 1 {
+				pos = n + 1
+			}
+			for i := n; i >= pos; i-- {
+				t.Set(float64(i+1), t.Get(float64(i)))
+			}
+			t.Set(float64(pos), args[2])
+		default:
+			l.Errorf("wrong number of arguments to 'insert'")
+		}
+		return nil
+	})
+	reg("remove", func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "remove")
+		n := t.Len()
+		if n == 0 {
+			return []Value{nil}
+		}
+		pos := int(l.optNumber(args, 1, "remove", float64(n)))
+		v := t.Get(float64(pos))
+		for i := pos; i < n; i++ {
+			t.Set(float64(i), t.Get(float64(i+1)))
+		}
+		t.Set(float64(n), nil)
+		return []Value{v}
+	})
+	reg("concat", func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "concat")
+		sep := ""
+		if arg(args, 1) != nil {
+			sep = l.CheckString(args, 1, "concat")
+		}
+		i := int(l.optNumber(args, 2, "concat", 1))
+		j := int(l.optNumber(args, 3, "concat", float64(t.Len())))
+		parts := []string{}
+		for ; i <= j; i++ {
+			s, ok := concatString(t.Get(float64(i)))
+			if !ok {
+				l.Errorf("invalid value (at index %d) in table for 'concat'", i)
+			}
+			parts = append(parts, s)
+		}
+		return []Value{strings.Join(parts, sep)}
+	})
+	reg("getn", func(l *State, args []Value) []Value {
+		return []Value{float64(l.CheckTable(args, 0, "getn").Len())}
+	})
+	reg("sort", func(l *State, args []Value) []Value {
+		t := l.CheckTable(args, 0, "sort")
+		comp := arg(args, 1)
+		items := make([]Value, t.Len())
+		for i := range items {
+			items[i] = t.Get(float64(i + 1))
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			if comp != nil {
+				return Truthy(first(l.Call(comp, items[i], items[j])))
+			}
+			return l.less(items[i], items[j], false)
+		})
+		for i, v := range items {
+			t.Set(float64(i+1), v)
+		}
+		return nil
+	})
+	reg("unpack", l.Globals.Get("unpack").(*GoFunction).Fn)
+	l.Globals.Set("table", lib)
+}
+
+func openMath(l *State) {
+	lib := NewTable()
+	unary := func(name string, fn func(float64) float64) {
+		lib.Set(name, &GoFunction{Name: name, Fn: func(l *State, args []Value) []Value {
+			return []Value{fn(l.CheckNumber(args, 0, name))}
+		}})
+	}
+	unary("abs", math.Abs)
+	unary("ceil", math.Ceil)
+	unary("floor", math.Floor)
+	unary("sqrt", math.Sqrt)
+	unary("exp", math.Exp)
+	unary("log10", math.Log10)
+	unary("sin", math.Sin)
+	unary("cos", math.Cos)
+	unary("tan", math.Tan)
+	lib.Set("log", &GoFunction{Name: "log", Fn: func(l *State, args []Value) []Value {
+		return []Value{math.Log(l.CheckNumber(args, 0, "log"))}
+	}})
+	lib.Set("pow", &GoFunction{Name: "pow", Fn: func(l *State, args []Value) []Value {
+		return []Value{math.Pow(l.CheckNumber(args, 0, "pow"), l.CheckNumber(args, 1, "pow"))}
+	}})
+	lib.Set("fmod", &GoFunction{Name: "fmod", Fn: func(l *State, args []Value) []Value {
+		return []Value{math.Mod(l.CheckNumber(args, 0, "fmod"), l.CheckNumber(args, 1, "fmod"))}
+	}})
+	lib.Set("modf", &GoFunction{Name: "modf", Fn: func(l *State, args []Value) []Value {
+		i, f := math.Modf(l.CheckNumber(args, 0, "modf"))
+		return []Value{i, f}
+	}})
+	minmax := func(name string, pick func(a, b float64) bool) {
+		lib.Set(name, &GoFunction{Name: name, Fn: func(l *State, args []Value) []Value {
+			best := l.CheckNumber(args, 0, name)
+			for i := 1; i < len(args); i++ {
+				if n := l.CheckNumber(args, i, name); pick(n, best) {
+					best = n
+				}
+			}
+			return []Value{best}
+		}})
+	}
+	minmax("max", func(a, b float64) bool { return a > b })
+	minmax("min", func(a, b float64) bool { return a < b })
+	// scripts must be deterministic, so the generator is always seeded
+	// with the same value unless the script calls randomseed itself.
+	rng := rand.New(rand.NewSource(0))
+	lib.Set("random", &GoFunction{Name: "random", Fn: func(l *State, args []Value) []Value {
+		switch len(args) {
+		case 0:
+			return []Value{rng.Float64()}
+		case 1:
+			m := int64(l.CheckNumber(args, 0, "random"))
+			if m < 1 {
+				l.Errorf("bad argument #1 to 'random' (interval is empty)")
+			}
+			return []Value{float64(rng.Int63n(m) + 1)}
+		}
+		lo := int64(l.CheckNumber(args, 0, "random"))
+		hi := int64(l.CheckNumber(args, 1, "random"))
+		if lo > hi {
+			l.Errorf("bad argument #2 to 'random' (interval is empty)")
+		}
+		return []Value{float64(lo + rng.Int63n(hi-lo+1))}
+	}})
+	lib.Set("randomseed", &GoFunction{Name: "randomseed", Fn: func(l *State, args []Value) []Value {
+		rng.Seed(int64(l.CheckNumber(args, 0, "randomseed")))
+		return nil
+	}})
+	lib.Set("pi", math.Pi)
+	lib.Set("huge", math.Inf(1))
+	l.Globals.Set("math", lib)
+}
@@ -0,0 +1,659 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+func openString(l *State) {
+	lib := NewTable()
+	reg := func(name string, fn func(*State, []Value) []Value) {
+		lib.Set(name, &GoFunction{Name: name, Fn: fn})
+	}
+	reg("len", func(l *State, args []Value) []Value {
+		return []Value{float64(len(l.CheckString(args, 0, "len")))}
+	})
+	reg("upper", func(l *State, args []Value) []Value {
+		return []Value{strings.ToUpper(l.CheckString(args, 0, "upper"))}
+	})
+	reg("lower", func(l *State, args []Value) []Value {
+		return []Value{strings.ToLower(l.CheckString(args, 0, "lower"))}
+	})
+	reg("rep", func(l *State, args []Value) []Value {
+		s := l.CheckString(args, 0, "rep")
+		n := int(l.CheckNumber(args, 1, "rep"))
+		if n <= 0 {
+			return []Value{""}
+		}
+		return []Value{strings.Repeat(s, n)}
+	})
+	reg("reverse", func(l *State, args []Value) []Value {
+		s := []byte(l.CheckString(args, 0, "reverse"))
+		for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+			s[i], s[j] = s[j], s[i]
+		}
+		return []Value{string(s)}
+	})
+	reg("sub", func(l *State, args []Value) []Value {
+		s := l.CheckString(args, 0, "sub")
+		i, j := strRange(len(s), int(l.optNumber(args, 1, "sub", 1)), int(l.optNumber(args, 2, "sub", -1)))
+		if i > j {
+			return []Value{""}
+		}
+		return []Value{s[i-1 : j]}
+	})
+	reg("byte", func(l *State, args []Value) []Value {
+		s := l.CheckString(args, 0, "byte")
+		start := int(l.optNumber(args, 1, "byte", 1))
+		i, j := strRange(len(s), start, int(l.optNumber(args, 2, "byte", float64(start))))
+		var rets []Value
+		for ; i <= j; i++ {
+			rets = append(rets, float64(s[i-1]))
+		}
+		return rets
+	})
+	reg("char", func(l *State, args []Value) []Value {
+		b := make([]byte, len(args))
+		for i := range args {
+			c := int(l.CheckNumber(args, i, "char"))
+			if c < 0 || c > 255 {
+				l.Errorf("bad argument #%d to 'char' (invalid value)", i+1)
+			}
+			b[i] = byte(c)
+		}
+		return []Value{string(b)}
+	})
+	reg("format", strFormat)
+	reg("find", func(l *State, args []Value) []Value {
+		return strFind(l, args, true)
+	})
+	reg("match", func(l *State, args []Value) []Value {
+		return strFind(l, args, false)
+	})
+	reg("gmatch", strGmatch)
+	reg("gsub", strGsub)
+	l.Globals.Set("string", lib)
+	l.stringMeta = lib
+}
+
+// strRange converts the Lua string indices i and j, which may be negative,
+// into the 1-based inclusive range clamped to a string of length n.
+func strRange(n, i, j int) (int, int) {
+	if i < 0 {
+		i = n + i + 1
+	}
+	if j < 0 {
+		j = n + j + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > n {
+		j = n
+	}
+	return i, j
+}
+
+func strFormat(l *State, args []Value) []Value {
+	format := l.CheckString(args, 0, "format")
+	var sb strings.Builder
+	argn := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			l.Errorf("invalid option '%%' to 'format'")
+		}
+		if format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			l.Errorf("invalid option '%%%s' to 'format'", format[start:])
+		}
+		spec := format[start:i]
+		verb := format[i]
+		switch verb {
+		case 'd', 'i', 'u':
+			n := l.CheckNumber(args, argn, "format")
+			sb.WriteString(fmt.Sprintf("%"+spec+"d", int64(n)))
+		case 'c':
+			sb.WriteByte(byte(l.CheckNumber(args, argn, "format")))
+		case 'x', 'X', 'o':
+			n := l.CheckNumber(args, argn, "format")
+			sb.WriteString(fmt.Sprintf("%"+spec+string(verb), int64(n)))
+		case 'e', 'E', 'f', 'g', 'G':
+			n := l.CheckNumber(args, argn, "format")
+			sb.WriteString(fmt.Sprintf("%"+spec+string(verb), n))
+		case 'q':
+			sb.WriteString(quoteString(l.CheckString(args, argn, "format")))
+		case 's':
+			s := l.Tostring(arg(args, argn))
+			if argn >= len(args) {
+				l.Errorf("bad argument #%d to 'format' (string expected, got no value)", argn+1)
+			}
+			sb.WriteString(fmt.Sprintf("%"+spec+"s", s))
+		default:
+			l.Errorf("invalid option '%%%c' to 'format'", verb)
+		}
+		argn++
+	}
+	return []Value{sb.String()}
+}
+
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '\n':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\r':
+			sb.WriteString("\\r")
+		case 0:
+			sb.WriteString("\\000")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+const specials = "^$*+?.([%-"
+
+func strFind(l *State, args []Value, find bool) []Value {
+	fname := "match"
+	if find {
+		fname = "find"
+	}
+	s := l.CheckString(args, 0, fname)
+	pat := l.CheckString(args, 1, fname)
+	init, _ := strRange(len(s), int(l.optNumber(args, 2, fname, 1)), len(s))
+	if init > len(s)+1 {
+		return []Value{nil}
+	}
+	if find && (Truthy(arg(args, 3)) || !strings.ContainsAny(pat, specials)) {
+		idx := strings.Index(s[init-1:], pat)
+		if idx < 0 {
+			return []Value{nil}
+		}
+		return []Value{float64(init + idx), float64(init + idx + len(pat) - 1)}
+	}
+	anchor := len(pat) > 0 && pat[0] == '^'
+	p := pat
+	if anchor {
+		p = pat[1:]
+	}
+	for si := init - 1; si <= len(s); si++ {
+		ms := &matchState{l: l, src: s, pat: p}
+		if end := ms.match(si, 0); end >= 0 {
+			if find {
+				return append([]Value{float64(si + 1), float64(end)}, ms.captures(si, end, false)...)
+			}
+			return ms.captures(si, end, true)
+		}
+		if anchor {
+			break
+		}
+	}
+	return []Value{nil}
+}
+
+func strGmatch(l *State, args []Value) []Value {
+	s := l.CheckString(args, 0, "gmatch")
+	pat := l.CheckString(args, 1, "gmatch")
+	pos := 0
+	iter := &GoFunction{Name: "gmatch_iter", Fn: func(l *State, _ []Value) []Value {
+		for ; pos <= len(s); pos++ {
+			ms := &matchState{l: l, src: s, pat: pat}
+			if end := ms.match(pos, 0); end >= 0 {
+				start := pos
+				if end == pos {
+					pos++
+				} else {
+					pos = end
+				}
+				return ms.captures(start, end, true)
+			}
+		}
+		return []Value{nil}
+	}}
+	return []Value{iter}
+}
+
+func strGsub(l *State, args []Value) []Value {
+	s := l.CheckString(args, 0, "gsub")
+	pat := l.CheckString(args, 1, "gsub")
+	repl := arg(args, 2)
+	switch repl.(type) {
+	case string, float64, *Table, *Function, *GoFunction:
+	default:
+		l.Errorf("bad argument #3 to 'gsub' (string/function/table expected)")
+	}
+	maxN := int(l.optNumber(args, 3, "gsub", float64(len(s)+1)))
+	anchor := len(pat) > 0 && pat[0] == '^'
+	if anchor {
+		pat = pat[1:]
+	}
+	var sb strings.Builder
+	count := 0
+	pos := 0
+	for count < maxN {
+		ms := &matchState{l: l, src: s, pat: pat}
+		end := ms.match(pos, 0)
+		if end >= 0 {
+			count++
+			sb.WriteString(ms.replace(repl, pos, end))
+		}
+		if end >= 0 && end > pos {
+			pos = end
+		} else if pos < len(s) {
+			sb.WriteByte(s[pos])
+			pos++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	if pos < len(s) {
+		sb.WriteString(s[pos:])
+	}
+	return []Value{sb.String(), float64(count)}
+}
+
+const (
+	capUnfinished = -1
+	capPosition   = -2
+	maxCaptures   = 32
+)
+
+type capture struct {
+	init, len int
+}
+
+type matchState struct {
+	l        *State
+	src, pat string
+	level    int
+	capture  [maxCaptures]capture
+	depth    int
+}
+
+func (ms *matchState) replace(repl Value, start, end int) string {
+	whole := ms.src[start:end]
+	var v Value
+	switch r := repl.(type) {
+	case float64:
+		return FormatNumber(r)
+	case string:
+		var sb strings.Builder
+		for i := 0; i < len(r); i++ {
+			if r[i] != '%' || i+1 >= len(r) {
+				sb.WriteByte(r[i])
+				continue
+			}
+			i++
+			c := r[i]
+			switch {
+			case c == '0':
+				sb.WriteString(whole)
+			case c >= '1' && c <= '9':
+				caps := ms.captures(start, end, true)
+				idx := int(c - '1')
+				if idx >= len(caps) {
+					ms.l.Errorf("invalid capture index")
+				}
+				sb.WriteString(ToString(caps[idx]))
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return sb.String()
+	case *Table:
+		v = ms.l.Index(r, first(ms.captures(start, end, true)))
+	default:
+		v = first(ms.l.Call(repl, ms.captures(start, end, true)...))
+	}
+	if !Truthy(v) {
+		return whole
+	}
+	s, ok := concatString(v)
+	if !ok {
+		ms.l.Errorf("invalid replacement value (a %s)", TypeName(v))
+	}
+	return s
+}
+
+// captures returns the captured values, or the whole match when there
+// are no captures and wholeIfNone is set.
+func (ms *matchState) captures(start, end int, wholeIfNone bool) []Value {
+	if ms.level == 0 {
+		if wholeIfNone {
+			return []Value{ms.src[start:end]}
+		}
+		return nil
+	}
+	vals := make([]Value, ms.level)
+	for i := 0; i < ms.level; i++ {
+		c := ms.capture[i]
+		if c.len == capPosition {
+			vals[i] = float64(c.init + 1)
+		} else {
+			vals[i] = ms.src[c.init : c.init+c.len]
+		}
+	}
+	return vals
+}
+
+func (ms *matchState) classEnd(p int) int {
+	if p >= len(ms.pat) {
+		ms.l.Errorf("malformed pattern (ends with '%%')")
+	}
+	c := ms.pat[p]
+	p++
+	if c == '%' {
+		if p >= len(ms.pat) {
+			ms.l.Errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.l.Errorf("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+			if p >= len(ms.pat) {
+				ms.l.Errorf("malformed pattern (missing ']')")
+			}
+		}
+	}
+	return p
+}
+
+func matchClass(c byte, class byte) bool {
+	var res bool
+	lower := class | 0x20
+	switch lower {
+	case 'a':
+		res = (c|0x20) >= 'a' && (c|0x20) <= 'z'
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = c >= '0' && c <= '9'
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = (c >= 33 && c <= 47) || (c >= 58 && c <= 64) || (c >= 91 && c <= 96) || (c >= 123 && c <= 126)
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = (c >= '0' && c <= '9') || ((c|0x20) >= 'a' && (c|0x20) <= 'z')
+	case 'x':
+		res = (c >= '0' && c <= '9') || ((c|0x20) >= 'a' && (c|0x20) <= 'f')
+	case 'z':
+		res = c == 0
+	default:
+		return class == c
+	}
+	if class >= 'A' && class <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+func (ms *matchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	p++
+	if ms.pat[p] == '^' {
+		sig = false
+		p++
+	}
+	for ; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case p+2 < ec && ms.pat[p+1] == '-':
+			if ms.pat[p] <= c && c <= ms.pat[p+2] {
+				return sig
+			}
+			p += 2
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match returns the end of the match of the pattern from p against the
+// source from s, or -1.
+func (ms *matchState) match(s, p int) int {
+	ms.depth++
+	if ms.depth > 200 {
+		ms.l.Errorf("pattern too complex")
+	}
+	defer func() { ms.depth-- }()
+	for {
+		if p >= len(ms.pat) {
+			return s
+		}
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 < len(ms.pat) {
+				switch ms.pat[p+1] {
+				case 'b':
+					s = ms.matchBalance(s, p+2)
+					if s < 0 {
+						return -1
+					}
+					p += 4
+					continue
+				case 'f':
+					p += 2
+					if p >= len(ms.pat) || ms.pat[p] != '[' {
+						ms.l.Errorf("missing '[' after '%%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if !ms.matchBracketClass(prev, p, ep-1) && ms.matchBracketClass(cur, p, ep-1) {
+						p = ep
+						continue
+					}
+					return -1
+				}
+				if d := ms.pat[p+1]; d >= '0' && d <= '9' {
+					s = ms.matchCapture(s, int(d-'0'))
+					if s < 0 {
+						return -1
+					}
+					p += 2
+					continue
+				}
+			}
+		}
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if res := ms.match(s+1, ep+1); res >= 0 {
+						return res
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+}
+
+func (ms *matchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res >= 0 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res >= 0 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s, p, what int) int {
+	if ms.level >= maxCaptures {
+		ms.l.Errorf("too many captures")
+	}
+	ms.capture[ms.level] = capture{init: s, len: what}
+	ms.level++
+	res := ms.match(s, p)
+	if res < 0 {
+		ms.level--
+	}
+	return res
+}
+
+func (ms *matchState) endCapture(s, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.l.Errorf("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].init
+	res := ms.match(s, p)
+	if res < 0 {
+		ms.capture[l].len = capUnfinished
+	}
+	return res
+}
+
+func (ms *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.l.Errorf("missing arguments to '%%b'")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		switch ms.src[i] {
+		case e:
+			cont--
+			if cont == 0 {
+				return i + 1
+			}
+		case b:
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) matchCapture(s, idx int) int {
+	idx--
+	if idx < 0 || idx >= ms.level || ms.capture[idx].len == capUnfinished {
+		ms.l.Errorf("invalid capture index")
+	}
+	c := ms.capture[idx]
+	capStr := ms.src[c.init : c.init+c.len]
+	if strings.HasPrefix(ms.src[s:], capStr) {
+		return s + len(capStr)
+	}
+	return -1
+}
@@ -0,0 +1,254 @@
+// Package lua is a small Lua 5.1 interpreter, enough to run the scripts
+// and function libraries that are usually sent to redis.
+package lua
+
+import (
+	"fmt"
+	"math"
+)
+
+// Value is any Lua value: nil, bool, float64, string, *Table, *Function or
+// *GoFunction.
+type Value interface{}
+
+// GoFunction is a function implemented in Go and callable from Lua.
+type GoFunction struct {
+	Name string
+	Fn   func(l *State, args []Value) []Value
+}
+
+// Function is a Lua closure.
+type Function struct {
+	proto *functionExpr
+	env   *scope
+}
+
+// Error is raised by error() or a runtime failure. Value is the error
+// object which can be any Lua value, usually a string or a table.
+type Error struct {
+	Value Value
+	// Fatal errors are not caught by pcall, they stop the script.
+	Fatal bool
+}
+
+func (e *Error) Error() string {
+	if t, ok := e.Value.(*Table); ok {
+		if msg, ok := t.Get("err").(string); ok {
+			return msg
+		}
+	}
+	return ToString(e.Value)
+}
+
+type entry struct {
+	key, value Value
+}
+
+// Table is a Lua table with an array part for the keys 1..n and an
+// insertion ordered hash part for the rest.
+type Table struct {
+	arr      []Value
+	entries  []entry
+	index    map[Value]int
+	meta     *Table
+	readonly bool
+}
+
+func NewTable() *Table {
+	return &Table{index: map[Value]int{}}
+}
+
+func normKey(k Value) Value {
+	if f, ok := k.(float64); ok && f == 0 {
+		return float64(0)
+	}
+	return k
+}
+
+func arrayIndex(k Value) (int, bool) {
+	f, ok := k.(float64)
+	if !ok || f != math.Trunc(f) || f < 1 || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// Get returns the raw value of key k.
+func (t *Table) Get(k Value) Value {
+	if i, ok := arrayIndex(k); ok && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if pos, ok := t.index[normKey(k)]; ok {
+		return t.entries[pos].value
+	}
+	return nil
+}
+
+// Set assigns the raw value of key k, nil removes the key.
+func (t *Table) Set(k, v Value) {
+	if i, ok := arrayIndex(k); ok {
+		if i <= len(t.arr) {
+			t.arr[i-1] = v
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+			return
+		}
+		if i == len(t.arr)+1 && v != nil {
+			t.removeHash(k)
+			t.arr = append(t.arr, v)
+			// move the following keys from the hash part to the array part
+			for {
+				next := float64(len(t.arr) + 1)
+				pos, ok := t.index[next]
+				if !ok || t.entries[pos].value == nil {
+					break
+				}
+				t.arr = append(t.arr, t.entries[pos].value)
+				t.removeHash(next)
+			}
+			return
+		}
+	}
+	k = normKey(k)
+	if pos, ok := t.index[k]; ok {
+		t.entries[pos].value = v
+		return
+	}
+	if v == nil {
+		return
+	}
+	t.index[k] = len(t.entries)
+	t.entries = append(t.entries, entry{k, v})
+}
+
+func (t *Table) removeHash(k Value) {
+	if pos, ok := t.index[k]; ok {
+		t.entries[pos].value = nil
+	}
+}
+
+// SetReadOnly makes assignments to t from Lua code raise an error.
+func (t *Table) SetReadOnly() {
+	t.readonly = true
+}
+
+// Len returns the border of the array part, like the # operator.
+func (t *Table) Len() int {
+	return len(t.arr)
+}
+
+// Append sets t[#t+1] = v.
+func (t *Table) Append(v Value) {
+	t.Set(float64(len(t.arr)+1), v)
+}
+
+// Next returns the key and value following k in a traversal, starting
+// with k == nil. A nil key is returned at the end.
+func (t *Table) Next(k Value) (Value, Value, bool) {
+	start := 0
+	if k != nil {
+		if i, ok := arrayIndex(k); ok && i <= len(t.arr) {
+			start = i
+		} else {
+			pos, ok := t.index[normKey(k)]
+			if !ok {
+				return nil, nil, false
+			}
+			start = len(t.arr) + pos + 1
+		}
+	}
+	for i := start; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	hstart := start - len(t.arr)
+	if hstart < 0 {
+		hstart = 0
+	}
+	for i := hstart; i < len(t.entries); i++ {
+		if t.entries[i].value != nil {
+			return t.entries[i].key, t.entries[i].value, true
+		}
+	}
+	return nil, nil, true
+}
+
+// TypeName returns the Lua type name of v.
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function, *GoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+// FormatNumber formats f the way Lua's tostring does.
+func FormatNumber(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return fmt.Sprintf("%.14g", f)
+}
+
+// ToString converts v like Lua's tostring without metamethods.
+func ToString(v Value) string {
+	switch val := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if val {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return FormatNumber(val)
+	case string:
+		return val
+	case *Table:
+		return fmt.Sprintf("table: %p", val)
+	case *Function:
+		return fmt.Sprintf("function: %p", val)
+	case *GoFunction:
+		return fmt.Sprintf("function: builtin: %p", val)
+	}
+	return fmt.Sprint(v)
+}
+
+// ToNumber converts numbers and numeric strings to float64.
+func ToNumber(v Value) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case string:
+		return parseNumber(val)
+	}
+	return 0, false
+}
+
+// Truthy reports whether v is neither nil nor false.
+func Truthy(v Value) bool {
+	switch val := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package localredis
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+func (s *Client) addListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.unlock()
+	for _, other := range s.listeners {
+		if other == l {
+			return
+		}
+	}
+	if len(s.listeners) == 0 {
+		s.cronStop = make(chan struct{})
+		go s.serverCron(s.cronStop)
+	}
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *Client) removeListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.unlock()
+	for i, other := range s.listeners {
+		if other == l {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			if len(s.listeners) == 0 {
+				close(s.cronStop)
+			}
+			return
+		}
+	}
+}
+
+// closeListeners closes all the listeners, returning the first error.
+// The server lock must be held.
+func (s *Client) closeListeners() error {
+	var first error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// tcpPort is the port of the first TCP listener, the port of the server
+// in INFO and announced to a master. The server lock must be held.
+func (s *Client) tcpPort() int {
+	for _, l := range s.listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return 0
+}
+
+// ListenUnix listens on the unix socket path, a path starting with @ is
+// an abstract socket of Linux with no file. Like redis the stale socket
+// file of a previous run is replaced, and the file gets the permissions
+// perm, like unixsocketperm, unless it is 0.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if !abstract && perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ListenAndServeUnix listens on the unix socket path with ListenUnix and
+// serves the connections until the listener is closed.
+func (s *Client) ListenAndServeUnix(path string, perm os.FileMode) error {
+	l, err := ListenUnix(path, perm)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeUnix serves the default server on the unix socket path.
+func ListenAndServeUnix(path string, perm os.FileMode) error {
+	return defaultClient.ListenAndServeUnix(path, perm)
+}
+
+// ServeListeners serves the listeners concurrently, e.g. a TCP, a TLS
+// and a unix socket listener. It returns once they are all closed, with
+// the first error other than the closing of a listener.
+func (s *Client) ServeListeners(listeners ...net.Listener) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(listeners))
+	for i, l := range listeners {
+		// known before Serve starts, e.g. for INFO
+		s.addListener(l)
+		wg.Add(1)
+		go func(i int, l net.Listener) {
+			defer wg.Done()
+			errs[i] = s.Serve(l)
+		}(i, l)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeListeners serves the listeners with the default server.
+func ServeListeners(listeners ...net.Listener) error {
+	return defaultClient.ServeListeners(listeners...)
+}
@@ -0,0 +1,97 @@
+package localredis
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeListeners(t *testing.T) {
+	useCommand(t, "set", setmap)
+	sock := filepath.Join(t.TempDir(), "redis.sock")
+	// a stale socket file of a previous run is replaced
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	unix, err := ListenUnix(sock, 0o770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(sock); err != nil || info.Mode().Perm() != 0o770 {
+		t.Errorf("socket file %v (%v), expected the permissions 0770", info.Mode(), err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := []net.Listener{tcp, unix}
+	if runtime.GOOS == "linux" {
+		abstract, err := ListenUnix("@localredis-test-"+filepath.Base(filepath.Dir(sock)), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, abstract)
+	}
+
+	srv := NewClient()
+	done := make(chan error)
+	go func() { done <- srv.ServeListeners(listeners...) }()
+
+	send := func(l net.Listener, request, expected string) {
+		t.Helper()
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(request))
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || reply != expected {
+			t.Errorf("%s replied %q (%v), expected %q", l.Addr(), reply, err, expected)
+		}
+	}
+	send(tcp, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n", "+OK\r\n")
+	for _, l := range listeners[1:] {
+		send(l, "*2\r\n$3\r\nget\r\n$1\r\nk\r\n", "+v\r\n")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("*2\r\n$6\r\nclient\r\n$4\r\ninfo\r\n"))
+	r := bufio.NewReader(conn)
+	r.ReadString('\n')
+	if info, _ := r.ReadString('\n'); !strings.Contains(info, " flags=U ") {
+		t.Errorf("unix socket client without the U flag: %q", info)
+	}
+	conn.Close()
+
+	srv.mu.Lock()
+	port := srv.tcpPort()
+	srv.mu.Unlock()
+	if port != tcp.Addr().(*net.TCPAddr).Port {
+		t.Errorf("port %d, expected the TCP listener", port)
+	}
+	srv.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serving stopped with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listeners are still served")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("the socket file is left: %v", err)
+	}
+}
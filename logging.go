@@ -0,0 +1,100 @@
+package localredis
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the messages of the server at their level, args are
+// alternating keys and values like "conn", 3, "cmd", "get". A
+// *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// The levels of NewTextLogger.
+const (
+	LevelDebug = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// loggerBox keeps the same concrete type in the atomic value whatever
+// the logger is.
+type loggerBox struct{ Logger }
+
+// SetLogger sets the logger of the server, nil makes it silent like a
+// new server.
+func (s *Client) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	s.logger.Store(loggerBox{l})
+}
+
+// SetLogger sets the logger of the default server.
+func SetLogger(l Logger) {
+	defaultClient.SetLogger(l)
+}
+
+func (s *Client) log() Logger {
+	if box, ok := s.logger.Load().(loggerBox); ok {
+		return box.Logger
+	}
+	return nopLogger{}
+}
+
+// textLogger writes a line by message, e.g.
+// `2024-01-02T15:04:05.000Z07:00 WARN unknown command conn=3 cmd=foo`.
+type textLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int
+}
+
+// NewTextLogger returns a logger writing the messages from level on to w.
+func NewTextLogger(w io.Writer, level int) Logger {
+	return &textLogger{w: w, level: level}
+}
+
+func (l *textLogger) Debug(msg string, args ...interface{}) { l.write(LevelDebug, "DEBUG", msg, args) }
+func (l *textLogger) Info(msg string, args ...interface{})  { l.write(LevelInfo, "INFO", msg, args) }
+func (l *textLogger) Warn(msg string, args ...interface{})  { l.write(LevelWarn, "WARN", msg, args) }
+func (l *textLogger) Error(msg string, args ...interface{}) { l.write(LevelError, "ERROR", msg, args) }
+
+func (l *textLogger) write(level int, name, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(time.Now().Format("2006-01-02T15:04:05.000Z07:00") + " " + name + " " + msg)
+	for i := 0; i < len(args); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(args) {
+			value = args[i+1]
+		}
+		text := fmt.Sprint(value)
+		if strings.ContainsAny(text, " =\"") || text == "" {
+			text = fmt.Sprintf("%q", text)
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], text)
+	}
+	b.WriteByte('\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
@@ -0,0 +1,76 @@
+package localredis
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger keeps the messages as "LEVEL msg key=value ...".
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line := level + " " + msg
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.messages = append(l.messages, line)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("ERROR", msg, args) }
+
+func TestLogger(t *testing.T) {
+	srv := NewClient()
+	if _, ok := srv.log().(nopLogger); !ok {
+		t.Errorf("a new server logs with %T", srv.log())
+	}
+	logger := &recordingLogger{}
+	srv.SetLogger(logger)
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"set", "k", "v"})
+	runCommand(cc, []interface{}{"nosuchcommand", "arg"})
+	expected := []string{
+		fmt.Sprintf("DEBUG command conn=%d cmd=set db=0", cc.id),
+		fmt.Sprintf("WARN unknown command conn=%d cmd=nosuchcommand", cc.id),
+	}
+	if strings.Join(logger.messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("logged %q, expected %q", logger.messages, expected)
+	}
+
+	srv.SetLogger(nil)
+	runCommand(cc, []interface{}{"get", "k"})
+	if len(logger.messages) != 2 {
+		t.Errorf("logged after the logger was removed: %q", logger.messages)
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelInfo)
+	logger.Debug("hidden", "conn", 1)
+	logger.Info("client connected", "conn", 1, "addr", "127.0.0.1:1234")
+	logger.Warn("protocol error", "err", `bad "frame"`, "odd")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	for i, suffix := range []string{
+		" INFO client connected conn=1 addr=127.0.0.1:1234",
+		` WARN protocol error err="bad \"frame\"" odd=!MISSING`,
+	} {
+		if !strings.HasSuffix(lines[i], suffix) {
+			t.Errorf("line %q, expected the suffix %q", lines[i], suffix)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The memory model estimates what a key and its value would take in
+// redis: a dictionary entry with its object header, the sds strings and
+// the nodes of the collections. It is not the memory of the Go heap, but
+// it is stable and it follows the size of the dataset, which is what
+// maxmemory needs.
+const (
+	// entryOverhead is the dictionary entry, the object header and the
+	// sds header of the key.
+	entryOverhead = 56
+	// stringOverhead is the sds header and the allocator rounding of a
+	// string element.
+	stringOverhead = 8
+	// collectionOverhead is the header of a collection value.
+	collectionOverhead = 64
+	// nodeOverhead is a node of a list, or an entry of a hash, a set or a
+	// sorted set.
+	nodeOverhead = 24
+	// expireOverhead is the entry of a key in the dictionary of the
+	// timeouts.
+	expireOverhead = 32
+)
+
+// entrySize is the estimated memory of key set to value.
+func entrySize(key string, value interface{}) int64 {
+	return entryOverhead + int64(len(key)) + valueSize(value)
+}
+
+// valueSize is the estimated memory of a value.
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return stringOverhead + int64(len(v))
+	case List:
+		n := int64(collectionOverhead)
+		for _, elem := range v {
+			n += nodeOverhead + stringOverhead + int64(len(elem))
+		}
+		return n
+	case Hash:
+		n := int64(collectionOverhead)
+		for field, val := range v {
+			n += nodeOverhead + 2*stringOverhead + int64(len(field)+len(val))
+		}
+		return n
+	case Set:
+		n := int64(collectionOverhead)
+		for member := range v {
+			n += nodeOverhead + stringOverhead + int64(len(member))
+		}
+		return n
+	case SortedSet:
+		// the member is in the dictionary and in the skiplist node
+		n := int64(collectionOverhead)
+		for member := range v {
+			n += 2*nodeOverhead + stringOverhead + 8 + int64(len(member))
+		}
+		return n
+	case *Stream:
+		n := int64(collectionOverhead)
+		for _, entry := range v.Entries {
+			n += nodeOverhead
+			for _, field := range entry.Fields {
+				n += stringOverhead + int64(len(field))
+			}
+		}
+		return n
+	default:
+		return stringOverhead + int64(len(argString(value)))
+	}
+}
+
+// datasetMemory is the estimated memory of the keys of all the databases
+// with their timeouts, the server lock must be held.
+func (s *Client) datasetMemory() int64 {
+	var used int64
+	for _, db := range s.dbs {
+		used += db.used + int64(len(db.timeout))*expireOverhead
+	}
+	return used
+}
+
+// memoryHelp is replied to MEMORY HELP.
+var memoryHelp = []interface{}{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"DOCTOR",
+	"    Return memory problems reports.",
+	"STATS",
+	"    Return information about the memory usage of the server.",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. Nested values are",
+	"    sampled up to <count> times (default: 5, 0 means sample all).",
+	"HELP",
+	"    Print this help.",
+}
+
+// memoryCommand handles `MEMORY USAGE key [SAMPLES count]`, `MEMORY
+// STATS`, `MEMORY DOCTOR` and `MEMORY HELP`, on the estimates of the
+// memory model.
+func memoryCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'memory' command")
+		return
+	}
+	s := clientOf(c).srv
+	switch sub := strings.ToLower(argString(args[0])); {
+	case sub == "usage" && len(args) >= 2:
+		// the sizes are exact here, the samples are only checked
+		rest := args[2:]
+		for len(rest) > 0 {
+			if !strings.EqualFold(argString(rest[0]), "samples") || len(rest) < 2 {
+				SendError(c, "ERR syntax error")
+				return
+			}
+			n, err := strconv.Atoi(argString(rest[1]))
+			if err != nil {
+				SendError(c, "ERR value is not an integer or out of range")
+				return
+			}
+			if n < 0 {
+				SendError(c, "ERR syntax error")
+				return
+			}
+			rest = rest[2:]
+		}
+		key := argString(args[1])
+		value, ok := dbOf(c).load(key)
+		if !ok {
+			SendNil(c)
+			return
+		}
+		SendValue(c, entrySize(key, value))
+	case sub == "stats" && len(args) == 1:
+		SendValue(c, s.memoryStats())
+	case sub == "doctor" && len(args) == 1:
+		SendValue(c, RespVerbatim{Format: "txt", Text: s.memoryDoctor()})
+	case sub == "help" && len(args) == 1:
+		SendValue(c, memoryHelp)
+	case sub == "usage" || sub == "stats" || sub == "doctor" || sub == "help":
+		SendError(c, fmt.Sprintf("ERR wrong number of arguments for 'memory|%s' command", sub))
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", argString(args[0])))
+	}
+}
+
+// memoryStats is the reply of MEMORY STATS, the overhead is the memory of
+// the dictionaries of the keys and of the timeouts, the dataset the rest.
+func (s *Client) memoryStats() RespMap {
+	total := s.usedMemory()
+	stats := RespMap{
+		"peak.allocated", s.memoryPeak,
+		"total.allocated", total,
+		"startup.allocated", 0,
+	}
+	var overhead int64
+	keys := 0
+	for i, db := range s.dbs {
+		n := db.size()
+		if n == 0 {
+			continue
+		}
+		keys += n
+		var main int64
+		for key := range db.access {
+			main += entryOverhead + int64(len(key))
+		}
+		expires := int64(len(db.timeout)) * expireOverhead
+		overhead += main + expires
+		stats = append(stats, "db."+strconv.Itoa(i), RespMap{
+			"overhead.hashtable.main", main,
+			"overhead.hashtable.expires", expires,
+		})
+	}
+	bytesPerKey := int64(0)
+	if keys > 0 {
+		bytesPerKey = total / int64(keys)
+	}
+	datasetPercentage, peakPercentage := 0.0, 0.0
+	if total > 0 {
+		datasetPercentage = float64(total-overhead) * 100 / float64(total)
+	}
+	if s.memoryPeak > 0 {
+		peakPercentage = float64(total) * 100 / float64(s.memoryPeak)
+	}
+	return append(stats,
+		"overhead.total", overhead,
+		"keys.count", keys,
+		"keys.bytes-per-key", bytesPerKey,
+		"dataset.bytes", total-overhead,
+		"dataset.percentage", datasetPercentage,
+		"peak.percentage", peakPercentage,
+	)
+}
+
+// memoryDoctor reports the memory issues like MEMORY DOCTOR of redis,
+// which only looks at an instance using at least 5 MB.
+func (s *Client) memoryDoctor() string {
+	used := s.usedMemory()
+	if used < 5<<20 {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. Please, leave for your mission on Earth and fill it with some data. The new Sam and I will be back to our programming as soon as I finished rebooting."
+	}
+	var issues []string
+	if float64(s.memoryPeak) > float64(used)*1.5 {
+		issues = append(issues, " * Peak memory: In the past this instance used more than 150% the memory that is currently using. This is harmless and only due to the memory peak, the memory will be used again as soon as you fill the instance with more data.")
+	}
+	if s.maxmemory > 0 && used > s.maxmemory {
+		issues = append(issues, " * Maxmemory: The used memory is over maxmemory, the keys could not be evicted by the '"+s.maxmemoryPolicy+"' policy and the writes are refused with an OOM error.")
+	}
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base."
+	}
+	return "Sam, I detected a few issues in this Redis instance memory implants:\n\n" +
+		strings.Join(issues, "\n\n") +
+		"\n\nI'm here to keep you safe, Sam. I want to help you.\n"
+}
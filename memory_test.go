@@ -0,0 +1,110 @@
+package localredis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestObjectEncoding(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	db := srv.dbs[0]
+	bigHash, bigZset := Hash{}, SortedSet{}
+	for i := 0; i < 129; i++ {
+		bigHash[fmt.Sprint(i)] = "v"
+		bigZset[fmt.Sprint(i)] = float64(i)
+	}
+	for _, tc := range []struct {
+		value    interface{}
+		encoding string
+	}{
+		{"12345", "int"},
+		{"012345", "embstr"},
+		{strings.Repeat("x", 44), "embstr"},
+		{strings.Repeat("x", 45), "raw"},
+		{List{"a", "b"}, "listpack"},
+		{List{strings.Repeat("x", 9000)}, "quicklist"},
+		{Hash{"f": "v"}, "listpack"},
+		{Hash{"f": strings.Repeat("x", 65)}, "hashtable"},
+		{bigHash, "hashtable"},
+		{Set{"1": {}, "2": {}}, "intset"},
+		{Set{"1": {}, "a": {}}, "listpack"},
+		{Set{strings.Repeat("x", 65): {}}, "hashtable"},
+		{SortedSet{"a": 1}, "listpack"},
+		{bigZset, "skiplist"},
+		{&Stream{}, "stream"},
+	} {
+		db.store("key", tc.value)
+		runCommand(cc, []interface{}{"object", "encoding", "key"})
+		if reply := readReply(t, mconn); reply != "+"+tc.encoding+"\r\n" {
+			t.Errorf("encoding of %T %.20v is %q, expected %s", tc.value, tc.value, reply, tc.encoding)
+		}
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "hash-max-ziplist-entries", "1000"})
+	db.store("key", bigHash)
+	runCommand(cc, []interface{}{"object", "encoding", "key"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n+listpack\r\n" {
+		t.Errorf("encoding over a raised threshold %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"set", "shared", "100"})
+	runCommand(cc, []interface{}{"set", "own", "100000"})
+	mconn.Reset()
+	runCommand(cc, []interface{}{"object", "refcount", "shared"})
+	runCommand(cc, []interface{}{"object", "refcount", "own"})
+	runCommand(cc, []interface{}{"object", "encoding", "missing"})
+	runCommand(cc, []interface{}{"object", "encoding"})
+	if reply := readReply(t, mconn); reply != ":2147483647\r\n:1\r\n-1\r\n-ERR wrong number of arguments for 'object|encoding' command\r\n" {
+		t.Errorf("got %q", reply)
+	}
+	runCommand(cc, []interface{}{"object", "help"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "*15\r\n+OBJECT <subcommand>") {
+		t.Errorf("invalid help %q", reply)
+	}
+}
+
+func TestMemoryCommand(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"set", "key", "value", "ex", "100"})
+	mconn.Reset()
+
+	runCommand(cc, []interface{}{"memory", "usage", "key"})
+	runCommand(cc, []interface{}{"memory", "usage", "key", "samples", "0"})
+	runCommand(cc, []interface{}{"memory", "usage", "missing"})
+	runCommand(cc, []interface{}{"memory", "usage", "key", "samples"})
+	size := entrySize("key", "value")
+	expected := fmt.Sprintf(":%d\r\n:%d\r\n-1\r\n-ERR syntax error\r\n", size, size)
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+
+	runCommand(cc, []interface{}{"memory", "stats"})
+	reply := readReply(t, mconn)
+	main := entryOverhead + len("key")
+	for _, field := range []string{
+		fmt.Sprintf("+total.allocated\r\n:%d\r\n", size+expireOverhead),
+		fmt.Sprintf("+db.0\r\n*4\r\n+overhead.hashtable.main\r\n:%d\r\n+overhead.hashtable.expires\r\n:%d\r\n", main, expireOverhead),
+		"+keys.count\r\n:1\r\n",
+		fmt.Sprintf("+dataset.bytes\r\n:%d\r\n", int(size)-main),
+	} {
+		if !strings.Contains(reply, field) {
+			t.Errorf("%q missing in %q", field, reply)
+		}
+	}
+
+	runCommand(cc, []interface{}{"memory", "doctor"})
+	if reply := readReply(t, mconn); !strings.Contains(reply, "this instance is empty or is using very little memory") {
+		t.Errorf("invalid doctor report %q", reply)
+	}
+	runCommand(cc, []interface{}{"memory", "nosuch"})
+	if reply := readReply(t, mconn); reply != "-ERR unknown subcommand 'nosuch'. Try MEMORY HELP.\r\n" {
+		t.Errorf("got %q", reply)
+	}
+}
@@ -0,0 +1,141 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metric is a metric in the Prometheus text format, with a sample by
+// set of labels.
+type metric struct {
+	name    string
+	kind    string // counter or gauge
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+func newMetric(name, kind, help string, value float64) metric {
+	return metric{name: name, kind: kind, help: help, samples: []metricSample{{value: value}}}
+}
+
+func (m metric) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, sample := range m.samples {
+		b.WriteString(m.name)
+		if len(sample.labels) > 0 {
+			b.WriteByte('{')
+			for i := 0; i < len(sample.labels); i += 2 {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(b, "%s=%q", sample.labels[i], sample.labels[i+1])
+			}
+			b.WriteByte('}')
+		}
+		b.WriteString(" " + strconv.FormatFloat(sample.value, 'g', -1, 64) + "\n")
+	}
+}
+
+// metrics collects the metrics of the server, the server lock must be
+// held.
+func (s *Client) metrics() []metric {
+	st := s.stats
+	connected := 0
+	for _, cc := range s.listClients() {
+		if !cc.replica {
+			connected++
+		}
+	}
+	metrics := []metric{
+		newMetric("redis_uptime_in_seconds", "gauge", "Seconds since the server started.", time.Since(s.started).Seconds()),
+		newMetric("redis_connected_clients", "gauge", "Connected clients, without the replicas.", float64(connected)),
+		newMetric("redis_blocked_clients", "gauge", "Clients blocked by a command like WAIT.", float64(s.blockedClients)),
+		newMetric("redis_connected_slaves", "gauge", "Connected replicas.", float64(len(s.replicas))),
+		newMetric("redis_connections_received_total", "counter", "Connections accepted.", float64(st.connectionsReceived)),
+		newMetric("redis_rejected_connections_total", "counter", "Connections rejected over maxclients.", float64(st.rejectedConnections)),
+		newMetric("redis_commands_processed_total", "counter", "Commands processed.", float64(st.commandsProcessed)),
+		newMetric("redis_errors_total", "counter", "Error replies.", float64(st.errorReplies)),
+		newMetric("redis_memory_used_bytes", "gauge", "Memory used by the server.", float64(s.usedMemory())),
+		newMetric("redis_memory_max_bytes", "gauge", "The maxmemory configuration, 0 without limit.", float64(s.maxmemory)),
+		newMetric("redis_expired_keys_total", "counter", "Keys removed once expired.", float64(st.expiredKeys)),
+		newMetric("redis_evicted_keys_total", "counter", "Keys evicted under maxmemory.", float64(st.evictedKeys)),
+		newMetric("redis_keyspace_hits_total", "counter", "Keys found by read commands.", float64(st.keyspaceHits)),
+		newMetric("redis_keyspace_misses_total", "counter", "Keys missed by read commands.", float64(st.keyspaceMisses)),
+		newMetric("redis_pubsub_channels", "gauge", "Channels with subscribers.", float64(len(s.channels))),
+		newMetric("redis_pubsub_patterns", "gauge", "Patterns with subscribers.", float64(len(s.patterns))),
+	}
+
+	keys := metric{name: "redis_db_keys", kind: "gauge", help: "Keys by database."}
+	expiring := metric{name: "redis_db_keys_expiring", kind: "gauge", help: "Keys with a timeout by database."}
+	for i, db := range s.dbs {
+		n := db.size()
+		if n == 0 {
+			continue
+		}
+		label := []string{"db", "db" + strconv.Itoa(i)}
+		keys.samples = append(keys.samples, metricSample{label, float64(n)})
+		expiring.samples = append(expiring.samples, metricSample{label, float64(len(db.timeout))})
+	}
+
+	calls := metric{name: "redis_commands_total", kind: "counter", help: "Calls by command."}
+	duration := metric{name: "redis_commands_duration_seconds_total", kind: "counter", help: "Execution time by command."}
+	failed := metric{name: "redis_commands_failed_calls_total", kind: "counter", help: "Calls replied with an error by command."}
+	rejected := metric{name: "redis_commands_rejected_calls_total", kind: "counter", help: "Calls refused before their execution by command."}
+	names := make([]string, 0, len(st.commands))
+	for name := range st.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stat, label := st.commands[name], []string{"cmd", name}
+		calls.samples = append(calls.samples, metricSample{label, float64(stat.calls)})
+		duration.samples = append(duration.samples, metricSample{label, float64(stat.usec) / 1e6})
+		failed.samples = append(failed.samples, metricSample{label, float64(stat.failed)})
+		rejected.samples = append(rejected.samples, metricSample{label, float64(stat.rejected)})
+	}
+	return append(metrics, keys, expiring, calls, duration, failed, rejected)
+}
+
+// MetricsHandler serves the metrics of the server in the Prometheus text
+// format.
+func (s *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		metrics := s.metrics()
+		s.unlock()
+		var b strings.Builder
+		for _, m := range metrics {
+			m.write(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	})
+}
+
+// ServeMetrics serves the metrics on /metrics of the HTTP listener l
+// until it is closed.
+func (s *Client) ServeMetrics(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	return http.Serve(l, mux)
+}
+
+// ListenAndServeMetrics serves the metrics of the default server on
+// http://addr/metrics.
+func ListenAndServeMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return defaultClient.ServeMetrics(l)
+}
@@ -0,0 +1,53 @@
+package localredis
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"set", "k", "v", "ex", "100"})
+	runCommand(cc, []interface{}{"get", "k"})
+	runCommand(cc, []interface{}{"get", "missing"})
+	runCommand(cc, []interface{}{"select", "1"})
+	runCommand(cc, []interface{}{"set", "k", "v"})
+	runCommand(cc, []interface{}{"getex", "k", "bogus", "1"})
+
+	server := httptest.NewServer(srv.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("invalid content type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE redis_commands_processed_total counter\nredis_commands_processed_total 6\n",
+		"# TYPE redis_connected_clients gauge\nredis_connected_clients 1\n",
+		"redis_keyspace_hits_total 2\n",
+		"redis_keyspace_misses_total 1\n",
+		"redis_blocked_clients 0\n",
+		"redis_evicted_keys_total 0\n",
+		"redis_db_keys{db=\"db0\"} 1\nredis_db_keys{db=\"db1\"} 1\n",
+		"redis_db_keys_expiring{db=\"db0\"} 1\nredis_db_keys_expiring{db=\"db1\"} 0\n",
+		"redis_commands_total{cmd=\"get\"} 2\n",
+		"redis_commands_total{cmd=\"set\"} 2\n",
+		"redis_commands_failed_calls_total{cmd=\"getex\"} 1\n",
+		"# HELP redis_memory_used_bytes ",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("%q missing in the metrics:\n%s", line, text)
+		}
+	}
+}
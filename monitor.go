@@ -0,0 +1,111 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// unmonitoredCommands are not streamed to the monitors as they carry
+// passwords or only concern the connection.
+var unmonitoredCommands = map[string]bool{
+	"auth":  true,
+	"hello": true,
+	"quit":  true,
+}
+
+// redactedArg replaces the arguments carrying secrets in the monitor
+// output and in the slowlog.
+const redactedArg = "(redacted)"
+
+// redactArgs returns the arguments of a command with the rules of ACL
+// SETUSER and the sensitive values of CONFIG SET redacted like redis,
+// vals itself is left untouched.
+func redactArgs(vals []interface{}) []interface{} {
+	if len(vals) < 3 {
+		return vals
+	}
+	switch strings.ToLower(argString(vals[0])) + "|" + strings.ToLower(argString(vals[1])) {
+	case "acl|setuser":
+		args := append([]interface{}{}, vals[:2]...)
+		for range vals[2:] {
+			args = append(args, redactedArg)
+		}
+		return args
+	case "config|set":
+		args := append([]interface{}{}, vals...)
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, param, ok := lookupConfigParam(argString(args[i])); ok && param.sensitive {
+				args[i+1] = redactedArg
+			}
+		}
+		return args
+	}
+	return vals
+}
+
+// monitor handles `MONITOR`, the connection then receives every command
+// processed by the other clients.
+func monitor(c net.Conn, args []interface{}) {
+	if len(args) != 0 {
+		SendError(c, "ERR wrong number of arguments for 'monitor' command")
+		return
+	}
+	cc := clientOf(c)
+	cc.monitoring = true
+	cc.srv.monitors[cc] = true
+	SendOk(c)
+}
+
+// feedMonitors queues a command executed on the database db for the
+// monitors other than the client running it, the server lock must be
+// held. source is the address of the client, or lua for the commands of
+// a script.
+func (s *Client) feedMonitors(from *ClientConn, db int, source string, vals []interface{}) {
+	if len(s.monitors) == 0 || len(vals) == 0 || unmonitoredCommands[strings.ToLower(argString(vals[0]))] {
+		return
+	}
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "+%d.%06d [%d %s]", now.Unix(), now.Nanosecond()/1000, db, source)
+	for _, val := range redactArgs(vals) {
+		b.WriteString(" " + repr(argString(val)))
+	}
+	b.WriteString(terminal)
+	line := []byte(b.String())
+	for cc := range s.monitors {
+		if cc != from {
+			s.push(cc, line)
+		}
+	}
+}
+
+// repr quotes a string like sdscatrepr of redis, escaping the bytes that
+// are not printable.
+func repr(arg string) string {
+	b := []byte{'"'}
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; c {
+		case '\\', '"':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, `\n`...)
+		case '\r':
+			b = append(b, `\r`...)
+		case '\t':
+			b = append(b, `\t`...)
+		case '\a':
+			b = append(b, `\a`...)
+		case '\b':
+			b = append(b, `\b`...)
+		default:
+			if c < ' ' || c >= 0x7f {
+				b = append(b, fmt.Sprintf(`\x%02x`, c)...)
+			} else {
+				b = append(b, c)
+			}
+		}
+	}
+	return string(append(b, '"'))
+}
@@ -0,0 +1,91 @@
+package localredis
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	srv := NewClient()
+	monConn, mconn := NewConnOverride(), NewConnOverride()
+	mon, cc := srv.addClient(monConn), srv.addClient(mconn)
+	runCommand(mon, []interface{}{"monitor"})
+	if reply := readReply(t, monConn); reply != "+OK\r\n" {
+		t.Fatalf("invalid monitor reply %q", reply)
+	}
+	if !strings.Contains(mon.flags(), "O") {
+		t.Errorf("monitor flag missing in %q", mon.flags())
+	}
+
+	addr := regexp.QuoteMeta(cc.RemoteAddr().String())
+	runCommand(cc, []interface{}{"set", "k", "a \"quoted\"\nvalue"})
+	runCommand(cc, []interface{}{"select", "3"})
+	runCommand(cc, []interface{}{"get", "k"})
+	runCommand(cc, []interface{}{"config", "set", "hz", "20", "requirepass", "secret"})
+	runCommand(cc, []interface{}{"acl", "setuser", "bob", "on", ">secret"})
+	runCommand(cc, []interface{}{"hello", "3", "auth", "default", "secret"})
+	runCommand(cc, []interface{}{"eval", "return redis.call('get', KEYS[1])", "1", "k"})
+	runCommand(mon, []interface{}{"ping"})
+
+	lines := strings.SplitAfter(readReply(t, monConn), "\r\n")
+	expected := []string{
+		`\[0 ` + addr + `\] "set" "k" "a \\"quoted\\"\\nvalue"`,
+		`\[0 ` + addr + `\] "select" "3"`,
+		`\[3 ` + addr + `\] "get" "k"`,
+		`\[3 ` + addr + `\] "config" "set" "hz" "20" "requirepass" "\(redacted\)"`,
+		`\[3 ` + addr + `\] "acl" "setuser" "\(redacted\)" "\(redacted\)" "\(redacted\)"`,
+		`\[3 ` + addr + `\] "eval" "return redis.call\('get', KEYS\[1\]\)" "1" "k"`,
+		`\[3 lua\] "get" "k"`,
+	}
+	if len(lines) != len(expected)+2 || lines[len(lines)-2] != "+PONG\r\n" {
+		t.Fatalf("expected %d monitored commands, got %q", len(expected), lines)
+	}
+	for i, pattern := range expected {
+		if !regexp.MustCompile(`^\+\d+\.\d{6} ` + pattern + "\r\n$").MatchString(lines[i]) {
+			t.Errorf("line %d is %q, expected %s", i, lines[i], pattern)
+		}
+	}
+}
+
+func TestStalledMonitor(t *testing.T) {
+	srv := NewClient()
+	stalled, peer := net.Pipe()
+	defer peer.Close()
+	mon := srv.addClient(stalled)
+	go peer.Read(make([]byte, 64))
+	runCommand(mon, []interface{}{"monitor"})
+
+	firstConn, secondConn := NewConnOverride(), NewConnOverride()
+	first, second := srv.addClient(firstConn), srv.addClient(secondConn)
+	fed := make(chan struct{})
+	go func() {
+		// blocked until the monitor reads the command
+		runCommand(first, []interface{}{"ping"})
+		close(fed)
+	}()
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		runCommand(second, []interface{}{"dbsize"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server is blocked by a monitor which does not read")
+	}
+	buf := make([]byte, 256)
+	n, _ := peer.Read(buf)
+	go io.Copy(io.Discard, peer)
+	<-fed
+	if line := string(buf[:n]); !strings.Contains(line, `] "ping"`) {
+		t.Errorf("got the monitored line %q", line)
+	}
+	if reply := readReply(t, firstConn); reply != "+PONG\r\n" {
+		t.Errorf("got %q", reply)
+	}
+}
@@ -0,0 +1,136 @@
+package localredis
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// The classes of keyspace events, enabled with the characters of the
+// notify-keyspace-events configuration.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyModule               // d
+	notifyNew                  // n
+
+	// notifyAll is the A alias, it doesn't include the key miss and new
+	// key events.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+var notifyClassChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'d', notifyModule},
+}
+
+var errNotifyClass = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+// parseNotifyFlags parses a notify-keyspace-events string like redis.
+func parseNotifyFlags(classes string) (int, error) {
+	flags := 0
+	for i := 0; i < len(classes); i++ {
+		switch c := classes[i]; c {
+		case 'A':
+			flags |= notifyAll
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 'm':
+			flags |= notifyKeyMiss
+		case 'n':
+			flags |= notifyNew
+		default:
+			found := false
+			for _, cc := range notifyClassChars {
+				if cc.char == c {
+					flags |= cc.class
+					found = true
+				}
+			}
+			if !found {
+				return 0, errNotifyClass
+			}
+		}
+	}
+	return flags, nil
+}
+
+// notifyFlagsString is the reverse of parseNotifyFlags, as CONFIG GET
+// replies it.
+func notifyFlagsString(flags int) string {
+	var b []byte
+	if flags&notifyAll == notifyAll {
+		b = append(b, 'A')
+	} else {
+		for _, cc := range notifyClassChars {
+			if flags&cc.class != 0 {
+				b = append(b, cc.char)
+			}
+		}
+	}
+	for _, cc := range []struct {
+		char  byte
+		class int
+	}{{'K', notifyKeyspace}, {'E', notifyKeyevent}, {'m', notifyKeyMiss}, {'n', notifyNew}} {
+		if flags&cc.class != 0 {
+			b = append(b, cc.char)
+		}
+	}
+	return string(b)
+}
+
+// notifyKeyspaceEvent publishes event on key of the database db to
+// __keyspace@<db>__:<key> and __keyevent@<db>__:<event>, when the class
+// of the event is enabled. The server lock must be held.
+func (s *Client) notifyKeyspaceEvent(class int, event, key string, db int) {
+	flags := s.notifyFlags
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		s.publish("__keyspace@"+strconv.Itoa(db)+"__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		s.publish("__keyevent@"+strconv.Itoa(db)+"__:"+event, key)
+	}
+}
+
+// notify publishes event on key of the database selected by c.
+func notify(c net.Conn, class int, event, key string) {
+	cc := clientOf(c)
+	cc.srv.notifyKeyspaceEvent(class, event, key, cc.db)
+}
+
+// keyExpired counts and notifies the expiration of key in db.
+func (s *Client) keyExpired(db *database, key string) {
+	s.stats.expiredKeys++
+	for i, d := range s.dbs {
+		if d == db {
+			s.notifyKeyspaceEvent(notifyExpired, "expired", key, i)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package localredis
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyFlags(t *testing.T) {
+	for _, tc := range []struct{ in, out string }{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Ex", "xE"},
+		{"Kg$lshzxetd", "AK"},
+		{"Kgm", "gKm"},
+		{"En$", "$En"},
+	} {
+		flags, err := parseNotifyFlags(tc.in)
+		if err != nil {
+			t.Errorf("%q not parsed: %v", tc.in, err)
+			continue
+		}
+		if got := notifyFlagsString(flags); got != tc.out {
+			t.Errorf("flags %q formatted as %q, expected %q", tc.in, got, tc.out)
+		}
+	}
+	if _, err := parseNotifyFlags("KEq"); err == nil {
+		t.Error("invalid class accepted")
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	useCommand(t, "set", setmap)
+	srv := NewClient()
+	subConn, mconn := NewConnOverride(), NewConnOverride()
+	sub, cc := srv.addClient(subConn), srv.addClient(mconn)
+	runCommand(sub, []interface{}{"psubscribe", "__key*__:*"})
+	subConn.Reset()
+
+	runCommand(cc, []interface{}{"set", "quiet", "1"})
+	if reply := readReply(t, subConn); reply != "" {
+		t.Errorf("notification sent while disabled, got %q", reply)
+	}
+	mconn.Reset()
+	runCommand(cc, []interface{}{"config", "set", "notify-keyspace-events", "Kq"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events')") {
+		t.Errorf("invalid flags accepted, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"config", "set", "notify-keyspace-events", "KEA"})
+	runCommand(cc, []interface{}{"config", "get", "notify-keyspace-events"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n*2\r\n+notify-keyspace-events\r\n+AKE\r\n" {
+		t.Errorf("invalid config replies, got %q", reply)
+	}
+
+	message := func(channel, payload string) string {
+		return fmt.Sprintf("*4\r\n+pmessage\r\n+__key*__:*\r\n+%s\r\n+%s\r\n", channel, payload)
+	}
+	runCommand(cc, []interface{}{"set", "k", "v", "ex", "100"})
+	runCommand(cc, []interface{}{"del", "k", "missing"})
+	expected := message("__keyspace@0__:k", "set") + message("__keyevent@0__:set", "k") +
+		message("__keyspace@0__:k", "expire") + message("__keyevent@0__:expire", "k") +
+		message("__keyspace@0__:k", "del") + message("__keyevent@0__:del", "k")
+	if reply := readReply(t, subConn); reply != expected {
+		t.Errorf("invalid notifications, got %q expected %q", reply, expected)
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "notify-keyspace-events", "Ex"})
+	mconn.Reset()
+	runCommand(cc, []interface{}{"set", "short", "v", "px", "10"})
+	time.Sleep(50 * time.Millisecond)
+	// the notification is written after the expiration releases the lock
+	srv.mu.Lock()
+	sub.writeMu.Lock()
+	reply := readReply(t, subConn)
+	sub.writeMu.Unlock()
+	srv.mu.Unlock()
+	if reply != message("__keyevent@0__:expired", "short") {
+		t.Errorf("invalid expired notification, got %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"config", "set", "notify-keyspace-events", "En$"})
+	runCommand(cc, []interface{}{"set", "bad", "v", "ex", "abc"})
+	if reply := readReply(t, subConn); reply != "" {
+		t.Errorf("notified a failed SET, got %q", reply)
+	}
+}
+
+func TestExpiredNotificationOutsideCommands(t *testing.T) {
+	srv := NewClient()
+	subConn := NewConnOverride()
+	sub := srv.addClient(subConn)
+	srv.ConfigSet("notify-keyspace-events", "Ex")
+	runCommand(sub, []interface{}{"subscribe", "__keyevent@0__:expired"})
+	subConn.Reset()
+
+	srv.mu.Lock()
+	srv.dbs[0].store("stale", "v")
+	srv.dbs[0].timeout["stale"] = time.Now().Add(-time.Second)
+	srv.unlock()
+	// SAVE expires the key while writing the snapshot
+	if err := srv.SaveRDB(filepath.Join(t.TempDir(), "dump.rdb")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readReply(t, subConn); reply != "*3\r\n+message\r\n+__keyevent@0__:expired\r\n+stale\r\n" {
+		t.Errorf("expired notification not written on SAVE, got %q", reply)
+	}
+}
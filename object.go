@@ -0,0 +1,209 @@
+package localredis
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errLFUNotSelected = "ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+	errLFUSelected    = "ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+)
+
+// lfuPolicy tells whether the access frequency rather than the idle time
+// is tracked, like redis tracks only one of them.
+func (s *Client) lfuPolicy() bool {
+	return s.maxmemoryPolicy == policyVolatileLFU || s.maxmemoryPolicy == policyAllKeysLFU
+}
+
+// objectHelp is replied to OBJECT HELP.
+var objectHelp = []interface{}{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+const (
+	// sharedIntegers are the integers shared by all the keys in redis,
+	// their references are not counted.
+	sharedIntegers = 10000
+	// sharedRefcount is the reference count of a shared object.
+	sharedRefcount = math.MaxInt32
+	// embstrSizeLimit is the longest string embedded in its object.
+	embstrSizeLimit = 44
+)
+
+// listpackSizeLimits are the bytes of a listpack by negative
+// list-max-listpack-size, from -1 to -5.
+var listpackSizeLimits = []int{4096, 8192, 16384, 32768, 65536}
+
+// objectCommand handles `OBJECT ENCODING|REFCOUNT|IDLETIME|FREQ key` and
+// `OBJECT HELP`, the lookup of the key does not count as an access.
+func objectCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'object' command")
+		return
+	}
+	s := clientOf(c).srv
+	sub := strings.ToLower(argString(args[0]))
+	switch sub {
+	case "help":
+		if len(args) != 1 {
+			SendError(c, "ERR wrong number of arguments for 'object|help' command")
+			return
+		}
+		SendValue(c, objectHelp)
+		return
+	case "encoding", "refcount", "idletime", "freq":
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", argString(args[0])))
+		return
+	}
+	if len(args) != 2 {
+		SendError(c, fmt.Sprintf("ERR wrong number of arguments for 'object|%s' command", sub))
+		return
+	}
+	db, key := dbOf(c), argString(args[1])
+	value, ok := db.load(key)
+	if !ok {
+		SendNil(c)
+		return
+	}
+	access := db.access[key]
+	switch sub {
+	case "encoding":
+		SendValue(c, s.encoding(value))
+	case "refcount":
+		refcount := 1
+		if s.sharedInteger(value) {
+			refcount = sharedRefcount
+		}
+		SendValue(c, refcount)
+	case "idletime":
+		if s.lfuPolicy() {
+			SendError(c, errLFUSelected)
+			return
+		}
+		SendValue(c, int(time.Since(access.lastAccess).Seconds()))
+	case "freq":
+		if !s.lfuPolicy() {
+			SendError(c, errLFUNotSelected)
+			return
+		}
+		SendValue(c, int(s.lfuDecay(access, time.Now())))
+	}
+}
+
+// encoding is the encoding redis would use for value, the compact ones
+// up to the thresholds of the configuration.
+func (s *Client) encoding(value interface{}) string {
+	switch v := value.(type) {
+	case List:
+		if s.listFitsListpack(v) {
+			return "listpack"
+		}
+		return "quicklist"
+	case Hash:
+		if len(v) > s.hashMaxListpackEntries {
+			return "hashtable"
+		}
+		for field, val := range v {
+			if len(field) > s.hashMaxListpackValue || len(val) > s.hashMaxListpackValue {
+				return "hashtable"
+			}
+		}
+		return "listpack"
+	case Set:
+		ints := len(v) <= s.setMaxIntsetEntries
+		small := len(v) <= s.setMaxListpackEntries
+		for member := range v {
+			ints = ints && isInteger(member)
+			small = small && len(member) <= s.setMaxListpackValue
+		}
+		switch {
+		case ints:
+			return "intset"
+		case small:
+			return "listpack"
+		}
+		return "hashtable"
+	case SortedSet:
+		if len(v) > s.zsetMaxListpackEntries {
+			return "skiplist"
+		}
+		for member := range v {
+			if len(member) > s.zsetMaxListpackValue {
+				return "skiplist"
+			}
+		}
+		return "listpack"
+	case *Stream:
+		return "stream"
+	default:
+		str := argString(value)
+		switch {
+		case isInteger(str):
+			return "int"
+		case len(str) <= embstrSizeLimit:
+			return "embstr"
+		}
+		return "raw"
+	}
+}
+
+// listFitsListpack tells whether the list is small enough for a single
+// listpack, by count for a positive list-max-listpack-size and by bytes
+// for a negative one.
+func (s *Client) listFitsListpack(list List) bool {
+	if s.listMaxListpackSize >= 0 {
+		return len(list) <= s.listMaxListpackSize
+	}
+	// the listpack header and end, then the entries with their length
+	// and backlen bytes
+	size, limit := 7, listpackSizeLimits[-s.listMaxListpackSize-1]
+	for _, elem := range list {
+		size += len(elem) + 2
+	}
+	return size <= limit
+}
+
+// sharedInteger tells whether value is one of the integers shared by
+// redis, which are not shared when the eviction needs the access of each
+// key.
+func (s *Client) sharedInteger(value interface{}) bool {
+	str, ok := value.(string)
+	if !ok || !isInteger(str) {
+		return false
+	}
+	if s.maxmemory > 0 && (s.lfuPolicy() || strings.HasSuffix(s.maxmemoryPolicy, "-lru")) {
+		return false
+	}
+	n, _ := strconv.ParseInt(str, 10, 64)
+	return n >= 0 && n < sharedIntegers
+}
+
+// isInteger tells whether str is the canonical form of a 64 bits integer,
+// the strings redis encodes as integers.
+func isInteger(str string) bool {
+	if len(str) == 0 || len(str) > 20 {
+		return false
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == str
+}
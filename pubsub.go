@@ -0,0 +1,215 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// subscribedCommands are the only commands a RESP2 client can send while
+// subscribed to a channel or a pattern.
+var subscribedCommands = map[string]bool{
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+	"reset":        true,
+}
+
+func (cc *ClientConn) subscriptions() int {
+	return len(cc.channels) + len(cc.patterns)
+}
+
+// push queues data for cc, the server lock must be held. It is written by
+// unlock, so that a client which does not read only blocks the clients
+// sending to it and not the whole server.
+func (s *Client) push(cc *ClientConn, data []byte) {
+	cc.pushMu.Lock()
+	cc.pushed = append(cc.pushed, data...)
+	cc.pushMu.Unlock()
+	if s.pushTargets == nil {
+		s.pushTargets = map[*ClientConn]bool{}
+	}
+	s.pushTargets[cc] = true
+}
+
+// unlock releases the server lock, then writes the messages queued by
+// push while it was held. The server lock is always released with it, as
+// any section reading keys may expire or evict some and queue events.
+func (s *Client) unlock() {
+	targets := s.pushTargets
+	s.pushTargets = nil
+	s.mu.Unlock()
+	for cc := range targets {
+		cc.flushPushed()
+	}
+}
+
+// publish sends message to the subscribers of channel and returns how
+// many clients received it, the server lock must be held.
+func (s *Client) publish(channel, message string) int {
+	n := 0
+	for cc := range s.channels[channel] {
+		s.push(cc, []byte(createReply(RespPush{"message", channel, message}, cc.proto)))
+		n++
+	}
+	for pattern, clients := range s.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for cc := range clients {
+			s.push(cc, []byte(createReply(RespPush{"pmessage", pattern, channel, message}, cc.proto)))
+			n++
+		}
+	}
+	return n
+}
+
+// Publish sends message to the subscribers of channel on the server.
+func (s *Client) Publish(channel, message string) int {
+	s.mu.Lock()
+	defer s.unlock()
+	return s.publish(channel, message)
+}
+
+func subscribeTo(subs map[string]map[*ClientConn]bool, name string, cc *ClientConn) {
+	clients, ok := subs[name]
+	if !ok {
+		clients = map[*ClientConn]bool{}
+		subs[name] = clients
+	}
+	clients[cc] = true
+}
+
+func unsubscribeFrom(subs map[string]map[*ClientConn]bool, name string, cc *ClientConn) {
+	delete(subs[name], cc)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+}
+
+// unsubscribeAll removes the subscriptions of a disconnected client, the
+// server lock must be held.
+func (s *Client) unsubscribeAll(cc *ClientConn) {
+	for channel := range cc.channels {
+		unsubscribeFrom(s.channels, channel, cc)
+	}
+	for pattern := range cc.patterns {
+		unsubscribeFrom(s.patterns, pattern, cc)
+	}
+	cc.channels = nil
+	cc.patterns = nil
+}
+
+func subscribe(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'subscribe' command")
+		return
+	}
+	cc := clientOf(c)
+	if cc.channels == nil {
+		cc.channels = map[string]bool{}
+	}
+	for _, arg := range args {
+		channel := argString(arg)
+		cc.channels[channel] = true
+		subscribeTo(cc.srv.channels, channel, cc)
+		SendPush(c, "subscribe", channel, cc.subscriptions())
+	}
+}
+
+func psubscribe(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'psubscribe' command")
+		return
+	}
+	cc := clientOf(c)
+	if cc.patterns == nil {
+		cc.patterns = map[string]bool{}
+	}
+	for _, arg := range args {
+		pattern := argString(arg)
+		cc.patterns[pattern] = true
+		subscribeTo(cc.srv.patterns, pattern, cc)
+		SendPush(c, "psubscribe", pattern, cc.subscriptions())
+	}
+}
+
+func unsubscribe(c net.Conn, args []interface{}) {
+	cc := clientOf(c)
+	names := argStrings(args)
+	if len(names) == 0 {
+		names = sortedKeys(cc.channels)
+	}
+	if len(names) == 0 {
+		SendPush(c, "unsubscribe", nil, cc.subscriptions())
+		return
+	}
+	for _, channel := range names {
+		delete(cc.channels, channel)
+		unsubscribeFrom(cc.srv.channels, channel, cc)
+		SendPush(c, "unsubscribe", channel, cc.subscriptions())
+	}
+}
+
+func punsubscribe(c net.Conn, args []interface{}) {
+	cc := clientOf(c)
+	names := argStrings(args)
+	if len(names) == 0 {
+		names = sortedKeys(cc.patterns)
+	}
+	if len(names) == 0 {
+		SendPush(c, "punsubscribe", nil, cc.subscriptions())
+		return
+	}
+	for _, pattern := range names {
+		delete(cc.patterns, pattern)
+		unsubscribeFrom(cc.srv.patterns, pattern, cc)
+		SendPush(c, "punsubscribe", pattern, cc.subscriptions())
+	}
+}
+
+func publishCommand(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'publish' command")
+		return
+	}
+	SendValue(c, clientOf(c).srv.publish(argString(args[0]), argString(args[1])))
+}
+
+// pubsubCommand handles `PUBSUB CHANNELS [pattern]`,
+// `PUBSUB NUMSUB [channel ...]` and `PUBSUB NUMPAT`.
+func pubsubCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'pubsub' command")
+		return
+	}
+	s := clientOf(c).srv
+	switch strings.ToLower(argString(args[0])) {
+	case "channels":
+		if len(args) > 2 {
+			SendError(c, "ERR wrong number of arguments for 'pubsub|channels' command")
+			return
+		}
+		channels := []interface{}{}
+		for _, channel := range sortedKeys(s.channels) {
+			if len(args) == 1 || globMatch(argString(args[1]), channel) {
+				channels = append(channels, channel)
+			}
+		}
+		SendValue(c, channels)
+	case "numsub":
+		counts := RespMap{}
+		for _, arg := range args[1:] {
+			channel := argString(arg)
+			counts = append(counts, channel, len(s.channels[channel]))
+		}
+		SendValue(c, counts)
+	case "numpat":
+		SendValue(c, len(s.patterns))
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", argString(args[0])))
+	}
+}
@@ -0,0 +1,102 @@
+package localredis
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	srv := NewClient()
+	subConn, patConn, pubConn := NewConnOverride(), NewConnOverride(), NewConnOverride()
+	sub, pat, pub := srv.addClient(subConn), srv.addClient(patConn), srv.addClient(pubConn)
+
+	runCommand(sub, []interface{}{"subscribe", "news", "sport"})
+	if reply := readReply(t, subConn); reply != "*3\r\n+subscribe\r\n+news\r\n:1\r\n*3\r\n+subscribe\r\n+sport\r\n:2\r\n" {
+		t.Errorf("invalid subscribe reply, got %q", reply)
+	}
+	runCommand(pat, []interface{}{"hello", "3"})
+	patConn.Reset()
+	runCommand(pat, []interface{}{"psubscribe", "n*"})
+	if reply := readReply(t, patConn); reply != ">3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:1\r\n" {
+		t.Errorf("invalid psubscribe reply, got %q", reply)
+	}
+
+	runCommand(pub, []interface{}{"publish", "news", "hello"})
+	if reply := readReply(t, pubConn); reply != ":2\r\n" {
+		t.Errorf("invalid publish reply, got %q", reply)
+	}
+	if reply := readReply(t, subConn); reply != "*3\r\n+message\r\n+news\r\n+hello\r\n" {
+		t.Errorf("invalid message, got %q", reply)
+	}
+	if reply := readReply(t, patConn); reply != ">4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n" {
+		t.Errorf("invalid pattern message, got %q", reply)
+	}
+
+	runCommand(pub, []interface{}{"pubsub", "channels"})
+	if reply := readReply(t, pubConn); reply != "*2\r\n+news\r\n+sport\r\n" {
+		t.Errorf("invalid pubsub channels reply, got %q", reply)
+	}
+	runCommand(pub, []interface{}{"pubsub", "numsub", "news", "none"})
+	if reply := readReply(t, pubConn); reply != "*4\r\n+news\r\n:1\r\n+none\r\n:0\r\n" {
+		t.Errorf("invalid pubsub numsub reply, got %q", reply)
+	}
+
+	runCommand(sub, []interface{}{"get", "k"})
+	if reply := readReply(t, subConn); reply != "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n" {
+		t.Errorf("command allowed while subscribed, got %q", reply)
+	}
+	runCommand(sub, []interface{}{"ping"})
+	if reply := readReply(t, subConn); reply != "*2\r\n+pong\r\n+\r\n" {
+		t.Errorf("invalid ping reply while subscribed, got %q", reply)
+	}
+	runCommand(sub, []interface{}{"unsubscribe"})
+	if reply := readReply(t, subConn); reply != "*3\r\n+unsubscribe\r\n+news\r\n:1\r\n*3\r\n+unsubscribe\r\n+sport\r\n:0\r\n" {
+		t.Errorf("invalid unsubscribe reply, got %q", reply)
+	}
+	runCommand(pub, []interface{}{"publish", "sport", "score"})
+	if reply := readReply(t, pubConn); reply != ":0\r\n" {
+		t.Errorf("message delivered after unsubscribe, got %q", reply)
+	}
+}
+
+func TestStalledSubscriber(t *testing.T) {
+	srv := NewClient()
+	stalled, peer := net.Pipe()
+	defer peer.Close()
+	sub := srv.addClient(stalled)
+	go peer.Read(make([]byte, 64))
+	runCommand(sub, []interface{}{"subscribe", "news"})
+
+	pubConn, otherConn := NewConnOverride(), NewConnOverride()
+	pub, other := srv.addClient(pubConn), srv.addClient(otherConn)
+	published := make(chan struct{})
+	go func() {
+		// blocked until the subscriber reads the message
+		runCommand(pub, []interface{}{"publish", "news", "hi"})
+		close(published)
+	}()
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		runCommand(other, []interface{}{"set", "k", "v"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server is blocked by a subscriber which does not read")
+	}
+	if reply := readReply(t, otherConn); reply != "+OK\r\n" {
+		t.Errorf("got %q", reply)
+	}
+	buf := make([]byte, 64)
+	n, _ := peer.Read(buf)
+	<-published
+	if msg := string(buf[:n]); msg != "*3\r\n+message\r\n+news\r\n+hi\r\n" {
+		t.Errorf("got the message %q", msg)
+	}
+	if reply := readReply(t, pubConn); reply != ":1\r\n" {
+		t.Errorf("got %q", reply)
+	}
+}
@@ -0,0 +1,277 @@
+package localredis
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// rdbVersion is the RDB format version written in snapshots and dump
+// payloads, the one of redis 7.2.
+const rdbVersion = 11
+
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZSet             = 3
+	rdbTypeHash             = 4
+	rdbTypeZSet2            = 5
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZSetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZSetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+)
+
+const (
+	rdbOpcodeSlotInfo       = 244
+	rdbOpcodeFunction2      = 245
+	rdbOpcodeFunctionPreGA  = 246
+	rdbOpcodeModuleAux      = 247
+	rdbOpcodeIdle           = 248
+	rdbOpcodeFreq           = 249
+	rdbOpcodeAux            = 250
+	rdbOpcodeResizeDB       = 251
+	rdbOpcodeExpireTimeMs   = 252
+	rdbOpcodeExpireTime     = 253
+	rdbOpcodeSelectDB       = 254
+	rdbOpcodeEOF            = 255
+	quicklistNodePlain      = 1
+	quicklistNodePacked     = 2
+	streamItemFlagDeleted   = 1
+	streamItemFlagSameField = 2
+)
+
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+var errBadPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// crc64Table is the reflected Jones polynomial table used by redis for
+// the RDB and DUMP checksums.
+var crc64Table = func() (table [256]uint64) {
+	const poly = 0x95ac9329ac4bc9b5
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+func appendRDBLength(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(n>>8)|0x40, byte(n))
+	case n <= 0xffffffff:
+		var b [5]byte
+		b[0] = 0x80
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return append(buf, b[:]...)
+	}
+	var b [9]byte
+	b[0] = 0x81
+	binary.BigEndian.PutUint64(b[1:], n)
+	return append(buf, b[:]...)
+}
+
+func appendRDBString(buf []byte, s string) []byte {
+	buf = appendRDBLength(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendDumpFooter appends the RDB version and the checksum of the whole
+// payload, as found at the end of DUMP and FUNCTION DUMP replies.
+func appendDumpFooter(buf []byte) []byte {
+	buf = append(buf, byte(rdbVersion), byte(rdbVersion>>8))
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], crc64(0, buf))
+	return append(buf, sum[:]...)
+}
+
+// verifyDumpPayload checks the footer of payload and returns its body.
+func verifyDumpPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 10 {
+		return nil, errBadPayload
+	}
+	footer := len(payload) - 10
+	if binary.LittleEndian.Uint16(payload[footer:]) > rdbVersion {
+		return nil, errBadPayload
+	}
+	if binary.LittleEndian.Uint64(payload[footer+2:]) != crc64(0, payload[:footer+2]) {
+		return nil, errBadPayload
+	}
+	return payload[:footer], nil
+}
+
+// rdbReader decodes the RDB primitives of a payload.
+type rdbReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *rdbReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *rdbReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errBadPayload
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *rdbReader) bytes(n uint64) ([]byte, error) {
+	if uint64(len(r.buf)-r.pos) < n {
+		return nil, errBadPayload
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// length reads a length, encoded reports the special integer encodings
+// of strings where the returned value is the encoding type.
+func (r *rdbReader) length() (n uint64, encoded bool, err error) {
+	first, err := r.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3f), false, nil
+	case 1:
+		next, err := r.byte()
+		return uint64(first&0x3f)<<8 | uint64(next), false, err
+	case 3:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case 0x80:
+		b, err := r.bytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case 0x81:
+		b, err := r.bytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+	return 0, false, errBadPayload
+}
+
+func (r *rdbReader) string() (string, error) {
+	n, encoded, err := r.length()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := r.bytes(n)
+		return string(b), err
+	}
+	if n == rdbEncLZF {
+		clen, _, err := r.length()
+		if err != nil {
+			return "", err
+		}
+		ulen, _, err := r.length()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := r.bytes(clen)
+		if err != nil {
+			return "", err
+		}
+		b, err := lzfDecompress(compressed, int(ulen))
+		return string(b), err
+	}
+	var size uint64
+	switch n {
+	case rdbEncInt8:
+		size = 1
+	case rdbEncInt16:
+		size = 2
+	case rdbEncInt32:
+		size = 4
+	default:
+		return "", errBadPayload
+	}
+	b, err := r.bytes(size)
+	if err != nil {
+		return "", err
+	}
+	var v int64
+	switch size {
+	case 1:
+		v = int64(int8(b[0]))
+	case 2:
+		v = int64(int16(binary.LittleEndian.Uint16(b)))
+	case 4:
+		v = int64(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return strconv.FormatInt(v, 10), nil
+}
+
+// millis reads the 8 bytes little endian milliseconds of expire and
+// stream times.
+func (r *rdbReader) millis() (int64, error) {
+	b, err := r.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+// streamID reads the 16 bytes big endian raw stream IDs.
+func (r *rdbReader) streamID() (StreamID, error) {
+	b, err := r.bytes(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+func appendRDBMillis(buf []byte, ms int64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(ms))
+	return append(buf, b[:]...)
+}
+
+func appendStreamID(buf []byte, id StreamID) []byte {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:], id.Ms)
+	binary.BigEndian.PutUint64(b[8:], id.Seq)
+	return append(buf, b[:]...)
+}
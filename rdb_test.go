@@ -0,0 +1,19 @@
+package localredis
+
+import "testing"
+
+func TestCRC64(t *testing.T) {
+	if sum := crc64(0, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Errorf("invalid crc64, got %x", sum)
+	}
+}
+
+func TestRDBLength(t *testing.T) {
+	for _, n := range []uint64{0, 63, 64, 16383, 16384, 1 << 32} {
+		r := &rdbReader{buf: appendRDBLength(nil, n)}
+		got, encoded, err := r.length()
+		if err != nil || encoded || got != n || !r.done() {
+			t.Errorf("length %d decoded as %d (encoded %v, err %v)", n, got, encoded, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package localredis
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+const (
+	// lzfMaxRatio is the largest expansion of LZF, a back reference of 3
+	// bytes copies up to 264 bytes.
+	lzfMaxRatio = 88
+	// protoMaxBulkLen is the default proto-max-bulk-len of redis, the
+	// longest string it accepts.
+	protoMaxBulkLen = 512 << 20
+)
+
+// lzfDecompress expands the LZF compressed strings of RDB files, outlen
+// comes from the payload and is checked against what in can expand to
+// before anything is allocated.
+func lzfDecompress(in []byte, outlen int) ([]byte, error) {
+	if outlen < 0 || outlen > len(in)*lzfMaxRatio || outlen > protoMaxBulkLen {
+		return nil, errBadPayload
+	}
+	out := make([]byte, 0, outlen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, errBadPayload
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errBadPayload
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errBadPayload
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errBadPayload
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outlen {
+		return nil, errBadPayload
+	}
+	return out, nil
+}
+
+// ziplistEntries decodes the ziplists of the RDB files written before
+// redis 7.
+func ziplistEntries(zl []byte) ([]string, error) {
+	if len(zl) < 11 {
+		return nil, errBadPayload
+	}
+	var entries []string
+	pos := 10
+	for pos < len(zl) && zl[pos] != 0xff {
+		if zl[pos] == 0xfe {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(zl) {
+			return nil, errBadPayload
+		}
+		enc := zl[pos]
+		var (
+			size  int
+			value string
+		)
+		switch {
+		case enc>>6 == 0:
+			size = int(enc & 0x3f)
+			pos++
+		case enc>>6 == 1:
+			if pos+1 >= len(zl) {
+				return nil, errBadPayload
+			}
+			size = int(enc&0x3f)<<8 | int(zl[pos+1])
+			pos += 2
+		case enc == 0x80:
+			if pos+5 > len(zl) {
+				return nil, errBadPayload
+			}
+			size = int(binary.BigEndian.Uint32(zl[pos+1:]))
+			pos += 5
+		default:
+			var n int64
+			width := map[byte]int{0xc0: 2, 0xd0: 4, 0xe0: 8, 0xf0: 3, 0xfe: 1}[enc]
+			if width == 0 {
+				if enc < 0xf1 || enc > 0xfd {
+					return nil, errBadPayload
+				}
+				n = int64(enc&0x0f) - 1
+			} else {
+				if pos+1+width > len(zl) {
+					return nil, errBadPayload
+				}
+				n = littleEndianInt(zl[pos+1 : pos+1+width])
+			}
+			pos += 1 + width
+			entries = append(entries, strconv.FormatInt(n, 10))
+			continue
+		}
+		if pos+size > len(zl) {
+			return nil, errBadPayload
+		}
+		value = string(zl[pos : pos+size])
+		pos += size
+		entries = append(entries, value)
+	}
+	return entries, nil
+}
+
+// littleEndianInt decodes a signed little endian integer of 1 to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*uint(len(b))
+	return int64(u<<shift) >> shift
+}
+
+// intsetEntries decodes an intset, the compact encoding of integer sets.
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errBadPayload
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if width != 2 && width != 4 && width != 8 || 8+n*width > len(is) {
+		return nil, errBadPayload
+	}
+	entries := make([]string, n)
+	for i := range entries {
+		start := 8 + i*width
+		entries[i] = strconv.FormatInt(littleEndianInt(is[start:start+width]), 10)
+	}
+	return entries, nil
+}
+
+func listpackBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpackEntries decodes a listpack, integers are returned in their
+// decimal form.
+func listpackEntries(lp []byte) ([]string, error) {
+	if len(lp) < 7 {
+		return nil, errBadPayload
+	}
+	var entries []string
+	pos := 6
+	for pos < len(lp) && lp[pos] != 0xff {
+		enc := lp[pos]
+		var (
+			header, size int
+			num          int64
+			isInt        bool
+		)
+		need := func(n int) bool { return pos+n <= len(lp) }
+		switch {
+		case enc&0x80 == 0:
+			header, isInt, num = 1, true, int64(enc&0x7f)
+		case enc&0xc0 == 0x80:
+			header, size = 1, int(enc&0x3f)
+		case enc&0xe0 == 0xc0:
+			if !need(2) {
+				return nil, errBadPayload
+			}
+			u := uint64(enc&0x1f)<<8 | uint64(lp[pos+1])
+			header, isInt, num = 2, true, int64(u<<51)>>51
+		case enc&0xf0 == 0xe0:
+			if !need(2) {
+				return nil, errBadPayload
+			}
+			header, size = 2, int(enc&0x0f)<<8|int(lp[pos+1])
+		case enc == 0xf0:
+			if !need(5) {
+				return nil, errBadPayload
+			}
+			header, size = 5, int(binary.LittleEndian.Uint32(lp[pos+1:]))
+		case enc >= 0xf1 && enc <= 0xf4:
+			width := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[enc]
+			if !need(1 + width) {
+				return nil, errBadPayload
+			}
+			header, isInt, num = 1+width, true, littleEndianInt(lp[pos+1:pos+1+width])
+		default:
+			return nil, errBadPayload
+		}
+		if !need(header + size) {
+			return nil, errBadPayload
+		}
+		if isInt {
+			entries = append(entries, strconv.FormatInt(num, 10))
+		} else {
+			entries = append(entries, string(lp[pos+header:pos+header+size]))
+		}
+		pos += header + size + listpackBacklenSize(header+size)
+	}
+	return entries, nil
+}
+
+// listpackBuilder writes listpacks, strings that are integers are
+// stored with the integer encodings like redis does.
+type listpackBuilder struct {
+	buf   []byte
+	count int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{buf: make([]byte, 6)}
+}
+
+func (b *listpackBuilder) appendInt(n int64) {
+	var entry []byte
+	switch {
+	case n >= 0 && n <= 127:
+		entry = []byte{byte(n)}
+	case n >= -4096 && n <= 4095:
+		u := uint16(n) & 0x1fff
+		entry = []byte{0xc0 | byte(u>>8), byte(u)}
+	case n >= -32768 && n <= 32767:
+		entry = []byte{0xf1, byte(n), byte(n >> 8)}
+	case n >= -8388608 && n <= 8388607:
+		entry = []byte{0xf2, byte(n), byte(n >> 8), byte(n >> 16)}
+	case n >= -2147483648 && n <= 2147483647:
+		entry = []byte{0xf3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(entry[1:], uint32(n))
+	default:
+		entry = []byte{0xf4, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(entry[1:], uint64(n))
+	}
+	b.appendEntry(entry)
+}
+
+func (b *listpackBuilder) appendString(s string) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+		b.appendInt(n)
+		return
+	}
+	var entry []byte
+	switch {
+	case len(s) < 64:
+		entry = []byte{0x80 | byte(len(s))}
+	case len(s) < 4096:
+		entry = []byte{0xe0 | byte(len(s)>>8), byte(len(s))}
+	default:
+		entry = []byte{0xf0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(entry[1:], uint32(len(s)))
+	}
+	b.appendEntry(append(entry, s...))
+}
+
+func (b *listpackBuilder) appendEntry(entry []byte) {
+	b.buf = append(b.buf, entry...)
+	l := len(entry)
+	switch listpackBacklenSize(l) {
+	case 1:
+		b.buf = append(b.buf, byte(l))
+	case 2:
+		b.buf = append(b.buf, byte(l>>7), byte(l&127)|128)
+	case 3:
+		b.buf = append(b.buf, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case 4:
+		b.buf = append(b.buf, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	default:
+		b.buf = append(b.buf, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128,
+			byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+	b.count++
+}
+
+// bytes terminates the listpack and fills its header.
+func (b *listpackBuilder) bytes() []byte {
+	out := append(b.buf, 0xff)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	count := b.count
+	if count > 65535 {
+		count = 65535
+	}
+	binary.LittleEndian.PutUint16(out[4:], uint16(count))
+	return out
+}
@@ -0,0 +1,573 @@
+package localredis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// streamNodeMaxEntries is the number of entries saved per listpack node
+// of a stream, the stream-node-max-entries default.
+const streamNodeMaxEntries = 100
+
+// appendRDBObject appends the type byte and the RDB encoding of value.
+// Lists and streams are written in the listpack based encodings of
+// redis 7, the other types in their plain encodings that every redis
+// version loads.
+func appendRDBObject(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case List:
+		buf = append(buf, rdbTypeListQuicklist2)
+		nodes := (len(v) + 127) / 128
+		buf = appendRDBLength(buf, uint64(nodes))
+		for start := 0; start < len(v); start += 128 {
+			end := start + 128
+			if end > len(v) {
+				end = len(v)
+			}
+			lp := newListpackBuilder()
+			for _, item := range v[start:end] {
+				lp.appendString(item)
+			}
+			buf = appendRDBLength(buf, quicklistNodePacked)
+			buf = appendRDBString(buf, string(lp.bytes()))
+		}
+		return buf
+	case Set:
+		buf = append(buf, rdbTypeSet)
+		buf = appendRDBLength(buf, uint64(len(v)))
+		for _, member := range sortedKeys(v) {
+			buf = appendRDBString(buf, member)
+		}
+		return buf
+	case SortedSet:
+		buf = append(buf, rdbTypeZSet2)
+		buf = appendRDBLength(buf, uint64(len(v)))
+		for _, member := range sortedKeys(v) {
+			buf = appendRDBString(buf, member)
+			var score [8]byte
+			binary.LittleEndian.PutUint64(score[:], math.Float64bits(v[member]))
+			buf = append(buf, score[:]...)
+		}
+		return buf
+	case Hash:
+		buf = append(buf, rdbTypeHash)
+		buf = appendRDBLength(buf, uint64(len(v)))
+		for _, field := range sortedKeys(v) {
+			buf = appendRDBString(buf, field)
+			buf = appendRDBString(buf, v[field])
+		}
+		return buf
+	case *Stream:
+		return appendRDBStream(append(buf, rdbTypeStreamListpacks3), v)
+	}
+	buf = append(buf, rdbTypeString)
+	return appendRDBString(buf, argString(value))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sameStreamFields(entry StreamEntry, fields []string) bool {
+	if len(entry.Fields) != len(fields)*2 {
+		return false
+	}
+	for i, field := range fields {
+		if entry.Fields[i*2] != field {
+			return false
+		}
+	}
+	return true
+}
+
+func appendRDBStream(buf []byte, s *Stream) []byte {
+	nodes := (len(s.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	buf = appendRDBLength(buf, uint64(nodes))
+	for start := 0; start < len(s.Entries); start += streamNodeMaxEntries {
+		end := start + streamNodeMaxEntries
+		if end > len(s.Entries) {
+			end = len(s.Entries)
+		}
+		entries := s.Entries[start:end]
+		master := entries[0]
+		var fields []string
+		for i := 0; i < len(master.Fields); i += 2 {
+			fields = append(fields, master.Fields[i])
+		}
+		lp := newListpackBuilder()
+		lp.appendInt(int64(len(entries)))
+		lp.appendInt(0)
+		lp.appendInt(int64(len(fields)))
+		for _, field := range fields {
+			lp.appendString(field)
+		}
+		lp.appendInt(0)
+		for _, entry := range entries {
+			same := sameStreamFields(entry, fields)
+			flags := 0
+			if same {
+				flags = streamItemFlagSameField
+			}
+			lp.appendInt(int64(flags))
+			lp.appendInt(int64(entry.ID.Ms - master.ID.Ms))
+			lp.appendInt(int64(entry.ID.Seq - master.ID.Seq))
+			numFields := len(entry.Fields) / 2
+			if same {
+				for i := 1; i < len(entry.Fields); i += 2 {
+					lp.appendString(entry.Fields[i])
+				}
+				lp.appendInt(int64(numFields + 3))
+				continue
+			}
+			lp.appendInt(int64(numFields))
+			for _, item := range entry.Fields {
+				lp.appendString(item)
+			}
+			lp.appendInt(int64(numFields*2 + 4))
+		}
+		buf = appendRDBString(buf, string(appendStreamID(nil, master.ID)))
+		buf = appendRDBString(buf, string(lp.bytes()))
+	}
+	var first StreamID
+	if len(s.Entries) > 0 {
+		first = s.Entries[0].ID
+	}
+	for _, n := range []uint64{
+		uint64(len(s.Entries)), s.LastID.Ms, s.LastID.Seq, first.Ms, first.Seq,
+		s.MaxDeletedID.Ms, s.MaxDeletedID.Seq, s.EntriesAdded, uint64(len(s.groups)),
+	} {
+		buf = appendRDBLength(buf, n)
+	}
+	for _, g := range s.groups {
+		buf = appendRDBString(buf, g.name)
+		buf = appendRDBLength(buf, g.lastID.Ms)
+		buf = appendRDBLength(buf, g.lastID.Seq)
+		buf = appendRDBLength(buf, g.entriesRead)
+		buf = appendRDBLength(buf, uint64(len(g.pending)))
+		for _, p := range g.pending {
+			buf = appendStreamID(buf, p.id)
+			buf = appendRDBMillis(buf, p.deliveryTime)
+			buf = appendRDBLength(buf, p.deliveryCount)
+		}
+		buf = appendRDBLength(buf, uint64(len(g.consumers)))
+		for _, consumer := range g.consumers {
+			buf = appendRDBString(buf, consumer.name)
+			buf = appendRDBMillis(buf, consumer.seenTime)
+			buf = appendRDBMillis(buf, consumer.activeTime)
+			buf = appendRDBLength(buf, uint64(len(consumer.pending)))
+			for _, id := range consumer.pending {
+				buf = appendStreamID(buf, id)
+			}
+		}
+	}
+	return buf
+}
+
+// count reads a length used as a number of elements.
+func (r *rdbReader) count() (int, error) {
+	n, _, err := r.length()
+	if err == nil && n > uint64(len(r.buf)) {
+		err = errBadPayload
+	}
+	return int(n), err
+}
+
+func (r *rdbReader) uint() (uint64, error) {
+	n, _, err := r.length()
+	return n, err
+}
+
+// strings reads n strings.
+func (r *rdbReader) strings(n int) ([]string, error) {
+	items := make([]string, n)
+	for i := range items {
+		s, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		items[i] = s
+	}
+	return items, nil
+}
+
+// packed reads a string holding a ziplist, listpack or intset and
+// decodes its entries with decode.
+func (r *rdbReader) packed(decode func([]byte) ([]string, error)) ([]string, error) {
+	s, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(s))
+}
+
+func (r *rdbReader) oldDouble() (float64, error) {
+	n, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.bytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func pairsToHash(items []string) (Hash, error) {
+	if len(items)%2 != 0 {
+		return nil, errBadPayload
+	}
+	h := Hash{}
+	for i := 0; i < len(items); i += 2 {
+		h[items[i]] = items[i+1]
+	}
+	return h, nil
+}
+
+func pairsToSortedSet(items []string) (SortedSet, error) {
+	if len(items)%2 != 0 {
+		return nil, errBadPayload
+	}
+	z := SortedSet{}
+	for i := 0; i < len(items); i += 2 {
+		score, err := strconv.ParseFloat(items[i+1], 64)
+		if err != nil {
+			return nil, errBadPayload
+		}
+		z[items[i]] = score
+	}
+	return z, nil
+}
+
+func membersToSet(items []string) Set {
+	set := Set{}
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+// object reads a value of the RDB type kind.
+func (r *rdbReader) object(kind byte) (interface{}, error) {
+	switch kind {
+	case rdbTypeString:
+		return r.string()
+	case rdbTypeList:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		items, err := r.strings(n)
+		return List(items), err
+	case rdbTypeListZiplist:
+		items, err := r.packed(ziplistEntries)
+		return List(items), err
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		nodes, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		list := List{}
+		for i := 0; i < nodes; i++ {
+			container := uint64(quicklistNodePacked)
+			if kind == rdbTypeListQuicklist2 {
+				if container, err = r.uint(); err != nil {
+					return nil, err
+				}
+			}
+			if container == quicklistNodePlain {
+				item, err := r.string()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+				continue
+			}
+			decode := ziplistEntries
+			if kind == rdbTypeListQuicklist2 {
+				decode = listpackEntries
+			}
+			items, err := r.packed(decode)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, items...)
+		}
+		return list, nil
+	case rdbTypeSet:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		items, err := r.strings(n)
+		return membersToSet(items), err
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		decode := intsetEntries
+		if kind == rdbTypeSetListpack {
+			decode = listpackEntries
+		}
+		items, err := r.packed(decode)
+		return membersToSet(items), err
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		z := SortedSet{}
+		for i := 0; i < n; i++ {
+			member, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if kind == rdbTypeZSet2 {
+				b, err := r.bytes(8)
+				if err != nil {
+					return nil, err
+				}
+				score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+			} else if score, err = r.oldDouble(); err != nil {
+				return nil, err
+			}
+			z[member] = score
+		}
+		return z, nil
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		decode := ziplistEntries
+		if kind == rdbTypeZSetListpack {
+			decode = listpackEntries
+		}
+		items, err := r.packed(decode)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToSortedSet(items)
+	case rdbTypeHash:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		items, err := r.strings(n * 2)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(items)
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		decode := ziplistEntries
+		if kind == rdbTypeHashListpack {
+			decode = listpackEntries
+		}
+		items, err := r.packed(decode)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(items)
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return r.stream(kind)
+	}
+	return nil, fmt.Errorf("unsupported RDB value type %d", kind)
+}
+
+func (r *rdbReader) stream(kind byte) (*Stream, error) {
+	s := &Stream{}
+	nodes, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nodes; i++ {
+		key, err := r.string()
+		if err != nil || len(key) != 16 {
+			return nil, errBadPayload
+		}
+		master := StreamID{binary.BigEndian.Uint64([]byte(key)), binary.BigEndian.Uint64([]byte(key[8:]))}
+		items, err := r.packed(listpackEntries)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := streamNodeEntries(master, items)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, entries...)
+	}
+	var fields []uint64
+	want := 3
+	if kind >= rdbTypeStreamListpacks2 {
+		want = 8
+	}
+	for i := 0; i < want; i++ {
+		n, err := r.uint()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, n)
+	}
+	s.LastID = StreamID{fields[1], fields[2]}
+	s.EntriesAdded = fields[0]
+	if kind >= rdbTypeStreamListpacks2 {
+		s.MaxDeletedID = StreamID{fields[5], fields[6]}
+		s.EntriesAdded = fields[7]
+	}
+	groups, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < groups; i++ {
+		g, err := r.streamGroup(kind)
+		if err != nil {
+			return nil, err
+		}
+		s.groups = append(s.groups, g)
+	}
+	return s, nil
+}
+
+// streamNodeEntries decodes the entries of a stream listpack node whose
+// first entry has the master ID.
+func streamNodeEntries(master StreamID, items []string) ([]StreamEntry, error) {
+	pos := 0
+	next := func() (int64, error) {
+		if pos >= len(items) {
+			return 0, errBadPayload
+		}
+		n, err := strconv.ParseInt(items[pos], 10, 64)
+		pos++
+		if err != nil {
+			return 0, errBadPayload
+		}
+		return n, nil
+	}
+	if _, err := next(); err != nil {
+		return nil, err
+	}
+	if _, err := next(); err != nil {
+		return nil, err
+	}
+	numFields, err := next()
+	if err != nil || numFields < 0 || pos+int(numFields) >= len(items) {
+		return nil, errBadPayload
+	}
+	fields := items[pos : pos+int(numFields)]
+	pos += int(numFields) + 1
+	var entries []StreamEntry
+	for pos < len(items) {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{ID: StreamID{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)}}
+		if flags&streamItemFlagSameField != 0 {
+			if pos+len(fields) > len(items) {
+				return nil, errBadPayload
+			}
+			for i, field := range fields {
+				entry.Fields = append(entry.Fields, field, items[pos+i])
+			}
+			pos += len(fields)
+		} else {
+			n, err := next()
+			if err != nil || n < 0 || pos+int(n)*2 > len(items) {
+				return nil, errBadPayload
+			}
+			entry.Fields = append(entry.Fields, items[pos:pos+int(n)*2]...)
+			pos += int(n) * 2
+		}
+		if _, err := next(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *rdbReader) streamGroup(kind byte) (*streamGroup, error) {
+	name, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	g := &streamGroup{name: name, entriesRead: math.MaxUint64}
+	if g.lastID.Ms, err = r.uint(); err != nil {
+		return nil, err
+	}
+	if g.lastID.Seq, err = r.uint(); err != nil {
+		return nil, err
+	}
+	if kind >= rdbTypeStreamListpacks2 {
+		if g.entriesRead, err = r.uint(); err != nil {
+			return nil, err
+		}
+	}
+	pending, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < pending; i++ {
+		var p streamPending
+		if p.id, err = r.streamID(); err != nil {
+			return nil, err
+		}
+		if p.deliveryTime, err = r.millis(); err != nil {
+			return nil, err
+		}
+		if p.deliveryCount, err = r.uint(); err != nil {
+			return nil, err
+		}
+		g.pending = append(g.pending, p)
+	}
+	consumers, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < consumers; i++ {
+		consumer := &streamConsumer{activeTime: -1}
+		if consumer.name, err = r.string(); err != nil {
+			return nil, err
+		}
+		if consumer.seenTime, err = r.millis(); err != nil {
+			return nil, err
+		}
+		if kind >= rdbTypeStreamListpacks3 {
+			if consumer.activeTime, err = r.millis(); err != nil {
+				return nil, err
+			}
+		}
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < n; j++ {
+			id, err := r.streamID()
+			if err != nil {
+				return nil, err
+			}
+			consumer.pending = append(consumer.pending, id)
+		}
+		g.consumers = append(g.consumers, consumer)
+	}
+	return g, nil
+}
@@ -0,0 +1,352 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBacklogSize is the size of the replication backlog, like the
+// repl-backlog-size default of redis.
+const defaultBacklogSize = 1 << 20
+
+// replBacklog keeps the tail of the replication stream so a replica that
+// reconnects can resume with a partial resynchronization.
+type replBacklog struct {
+	buf   []byte
+	start int64 // replication offset of buf[0]
+	size  int
+}
+
+func newReplBacklog(offset, size int64) *replBacklog {
+	return &replBacklog{start: offset + 1, size: int(size)}
+}
+
+func (b *replBacklog) feed(data []byte) {
+	b.buf = append(b.buf, data...)
+	// trimmed only once twice as big so the copy is amortized
+	if over := len(b.buf) - b.size; over > b.size {
+		b.buf = append([]byte(nil), b.buf[over:]...)
+		b.start += int64(over)
+	}
+}
+
+// since returns the stream from the replication offset on, false when
+// the offset is not in the backlog anymore.
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.start || offset > b.start+int64(len(b.buf)) {
+		return nil, false
+	}
+	return b.buf[offset-b.start:], true
+}
+
+// attachedReplica is a replica synchronized with the server, the stream
+// is written to its connection by a goroutine so a slow replica doesn't
+// block the commands.
+type attachedReplica struct {
+	cc        *ClientConn
+	port      int
+	ackOffset int64
+	ackTime   time.Time
+
+	mu      sync.Mutex
+	pending []byte
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newAttachedReplica(cc *ClientConn, port int) *attachedReplica {
+	cc.replica = true
+	r := &attachedReplica{
+		cc:      cc,
+		port:    port,
+		ackTime: time.Now(),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go r.writeLoop()
+	return r
+}
+
+func (r *attachedReplica) enqueue(data []byte) {
+	r.mu.Lock()
+	r.pending = append(r.pending, data...)
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *attachedReplica) writeLoop() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.wake:
+		}
+		r.mu.Lock()
+		data := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+		if _, err := r.cc.Conn.Write(data); err != nil {
+			r.cc.Conn.Close()
+			return
+		}
+	}
+}
+
+func (r *attachedReplica) close() {
+	r.once.Do(func() { close(r.done) })
+}
+
+func (r *attachedReplica) ip() string {
+	if addr, ok := r.cc.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// feedReplicas appends data to the replication stream: the backlog, the
+// offset and the attached replicas. The server lock must be held.
+func (s *Client) feedReplicas(data []byte) {
+	if s.backlog == nil {
+		return
+	}
+	s.backlog.feed(data)
+	s.replOffset += int64(len(data))
+	for _, r := range s.replicas {
+		r.enqueue(data)
+	}
+}
+
+// detachReplicas disconnects the replicas, e.g. when the server starts
+// following a new master. The server lock must be held.
+func (s *Client) detachReplicas() {
+	for _, r := range s.replicas {
+		r.close()
+		r.cc.Conn.Close()
+	}
+	s.replicas = nil
+}
+
+func (s *Client) removeReplica(cc *ClientConn) {
+	for i, r := range s.replicas {
+		if r.cc == cc {
+			r.close()
+			s.replicas = append(s.replicas[:i], s.replicas[i+1:]...)
+			s.replAcked.Broadcast()
+			return
+		}
+	}
+}
+
+// replconf handles the REPLCONF sent by the replicas during and after
+// the handshake, acknowledgements get no reply.
+func replconf(c net.Conn, args []interface{}) {
+	if len(args)%2 != 0 || len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'replconf' command")
+		return
+	}
+	cc := clientOf(c)
+	s := cc.srv
+	for i := 0; i < len(args); i += 2 {
+		value := argString(args[i+1])
+		switch strings.ToLower(argString(args[i])) {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				SendError(c, "ERR value is not an integer or out of range")
+				return
+			}
+			cc.replPort = port
+		case "ack":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return
+			}
+			for _, r := range s.replicas {
+				if r.cc == cc {
+					if offset > r.ackOffset {
+						r.ackOffset = offset
+					}
+					r.ackTime = time.Now()
+				}
+			}
+			s.replAcked.Broadcast()
+			return
+		case "getack":
+			return
+		case "capa", "ip-address", "rdb-only", "rdb-filter-only":
+		default:
+			SendError(c, fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", argString(args[i])))
+			return
+		}
+	}
+	SendOk(c)
+}
+
+// psync handles `PSYNC replicationid offset`, the replica resumes from
+// the backlog when possible, otherwise it gets the whole content as an
+// RDB followed by the stream of the writes.
+func psync(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'psync' command")
+		return
+	}
+	cc := clientOf(c)
+	s := cc.srv
+	if s.replica != nil && !s.replSynced {
+		SendError(c, "NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+	s.removeReplica(cc)
+	replID := argString(args[0])
+	offset, err := strconv.ParseInt(argString(args[1]), 10, 64)
+	if err != nil {
+		offset = -1
+	}
+	if s.backlog == nil {
+		s.backlog = newReplBacklog(s.replOffset, s.backlogSize)
+	}
+	r := newAttachedReplica(cc, cc.replPort)
+	continued := replID == s.replID || (replID == s.replID2 && offset <= s.secondReplOffset)
+	if stream, ok := s.backlog.since(offset); continued && ok {
+		r.enqueue([]byte(createSimpleString("CONTINUE " + s.replID)))
+		r.enqueue(stream)
+		s.stats.syncPartialOK++
+		s.log().Info("partial resynchronization of a replica", "conn", cc.id, "offset", offset)
+	} else {
+		rdb := s.rdbSnapshot()
+		r.enqueue([]byte(createSimpleString(fmt.Sprintf("FULLRESYNC %s %d", s.replID, s.replOffset))))
+		r.enqueue([]byte(fmt.Sprintf("$%d\r\n", len(rdb))))
+		r.enqueue(rdb)
+		// the replica starts on its database 0
+		s.replSelected = -1
+		s.stats.syncFull++
+		s.log().Info("full resynchronization of a replica", "conn", cc.id, "offset", s.replOffset)
+		if replID != "?" {
+			s.stats.syncPartialErr++
+		}
+	}
+	s.replicas = append(s.replicas, r)
+}
+
+// syncCommand handles the old SYNC, a full resynchronization without the
+// replication id and offset.
+func syncCommand(c net.Conn, args []interface{}) {
+	cc := clientOf(c)
+	s := cc.srv
+	s.removeReplica(cc)
+	if s.backlog == nil {
+		s.backlog = newReplBacklog(s.replOffset, s.backlogSize)
+	}
+	r := newAttachedReplica(cc, cc.replPort)
+	rdb := s.rdbSnapshot()
+	r.enqueue([]byte(fmt.Sprintf("$%d\r\n", len(rdb))))
+	r.enqueue(rdb)
+	s.replSelected = -1
+	s.stats.syncFull++
+	s.replicas = append(s.replicas, r)
+}
+
+// ackedReplicas returns how many replicas processed the stream up to the
+// offset.
+func (s *Client) ackedReplicas(offset int64) int {
+	n := 0
+	for _, r := range s.replicas {
+		if r.ackOffset >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// wait handles `WAIT numreplicas timeout`, it blocks until numreplicas
+// replicas acknowledged the writes done so far or the timeout in
+// milliseconds expires, 0 blocking forever. The server lock is released
+// while waiting.
+func wait(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'wait' command")
+		return
+	}
+	s := clientOf(c).srv
+	if s.replica != nil {
+		SendError(c, "ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+		return
+	}
+	numReplicas, err := strconv.Atoi(argString(args[0]))
+	if err != nil {
+		SendError(c, "ERR value is not an integer or out of range")
+		return
+	}
+	timeout, err := strconv.ParseInt(argString(args[1]), 10, 64)
+	if err != nil {
+		SendError(c, "ERR timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		SendError(c, "ERR timeout is negative")
+		return
+	}
+	offset := s.replOffset
+	if s.ackedReplicas(offset) >= numReplicas {
+		SendValue(c, s.ackedReplicas(offset))
+		return
+	}
+	s.feedReplicas(appendRESPCommand(nil, []string{"REPLCONF", "GETACK", "*"}))
+	expired := false
+	if timeout > 0 {
+		timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			s.mu.Lock()
+			expired = true
+			s.replAcked.Broadcast()
+			s.unlock()
+		})
+		defer timer.Stop()
+	}
+	s.blockedClients++
+	for !expired && s.ackedReplicas(offset) < numReplicas {
+		s.replAcked.Wait()
+	}
+	s.blockedClients--
+	SendValue(c, s.ackedReplicas(offset))
+}
+
+// replicaRoles returns the replicas as listed by ROLE.
+func (s *Client) replicaRoles() []interface{} {
+	roles := []interface{}{}
+	for _, r := range s.replicas {
+		roles = append(roles, []interface{}{r.ip(), strconv.Itoa(r.port), strconv.FormatInt(r.ackOffset, 10)})
+	}
+	return roles
+}
+
+// replicasInfo returns the replicas and backlog fields of INFO
+// replication.
+func (s *Client) replicasInfo() []string {
+	lines := []string{fmt.Sprintf("connected_slaves:%d", len(s.replicas))}
+	for i, r := range s.replicas {
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d",
+			i, r.ip(), r.port, r.ackOffset, int(time.Since(r.ackTime).Seconds())))
+	}
+	return lines
+}
+
+func backlogInfo(s *Client) []string {
+	active, size, first, histlen := 0, int(s.backlogSize), int64(0), 0
+	if b := s.backlog; b != nil {
+		active, size, first, histlen = 1, b.size, b.start, len(b.buf)
+	}
+	return []string{
+		fmt.Sprintf("repl_backlog_active:%d", active),
+		fmt.Sprintf("repl_backlog_size:%d", size),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", first),
+		fmt.Sprintf("repl_backlog_histlen:%d", histlen),
+	}
+}
@@ -0,0 +1,495 @@
+package localredis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	// registered here as the replication stream is run through commandMap
+	commandMap["replicaof"] = replicaof
+	commandMap["slaveof"] = replicaof
+}
+
+// The states of the link of a replica to its master, as replied by ROLE.
+const (
+	replStateConnect    = "connect"
+	replStateConnecting = "connecting"
+	replStateSync       = "sync"
+	replStateConnected  = "connected"
+)
+
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// respReader reads RESP frames and raw bytes from a connection.
+type respReader struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (r *respReader) fill() error {
+	tmp := make([]byte, bufferLength)
+	n, err := r.conn.Read(tmp)
+	r.buf = append(r.buf, tmp[:n]...)
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// line reads a line without its terminator.
+func (r *respReader) line() (string, error) {
+	for {
+		if i := strings.IndexByte(string(r.buf), '\n'); i >= 0 {
+			line := strings.TrimSuffix(string(r.buf[:i]), "\r")
+			r.buf = r.buf[i+1:]
+			return line, nil
+		}
+		if err := r.fill(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// read reads exactly n bytes.
+func (r *respReader) read(n int) ([]byte, error) {
+	for len(r.buf) < n {
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+// frame reads a complete RESP frame.
+func (r *respReader) frame() ([]byte, error) {
+	for {
+		if n := frameLength(r.buf); n >= 0 {
+			return r.read(n)
+		}
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replicaLink is the connection of a replica to its master.
+type replicaLink struct {
+	host     string
+	port     int
+	state    string
+	conn     net.Conn
+	lastIO   time.Time
+	stop     chan struct{}
+	writeMu  sync.Mutex
+	stopOnce sync.Once
+}
+
+func (link *replicaLink) addr() string {
+	return net.JoinHostPort(link.host, strconv.Itoa(link.port))
+}
+
+func (link *replicaLink) stopped() bool {
+	select {
+	case <-link.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the link, the server lock must be held.
+func (link *replicaLink) close() {
+	link.stopOnce.Do(func() {
+		close(link.stop)
+		if link.conn != nil {
+			link.conn.Close()
+		}
+	})
+}
+
+func (link *replicaLink) send(args ...string) error {
+	link.writeMu.Lock()
+	defer link.writeMu.Unlock()
+	_, err := link.conn.Write(appendRESPCommand(nil, args))
+	return err
+}
+
+// ReplicaOf makes the server a replica of the master at host:port, the
+// data is replaced by the one of the master once synchronized.
+func (s *Client) ReplicaOf(host string, port int) {
+	s.mu.Lock()
+	defer s.unlock()
+	s.replicaOf(host, port)
+}
+
+// PromoteToMaster stops the replication and makes the server a master
+// keeping its current data, like `REPLICAOF NO ONE`.
+func (s *Client) PromoteToMaster() {
+	s.mu.Lock()
+	defer s.unlock()
+	s.promote()
+}
+
+func (s *Client) replicaOf(host string, port int) {
+	if s.replica != nil {
+		s.replica.close()
+	}
+	link := &replicaLink{host: host, port: port, state: replStateConnect, stop: make(chan struct{})}
+	s.replica = link
+	go s.replicate(link)
+}
+
+func (s *Client) promote() {
+	if s.replica == nil {
+		return
+	}
+	s.replica.close()
+	s.replica = nil
+	s.replID2 = s.replID
+	s.secondReplOffset = s.replOffset + 1
+	s.replID = newReplID()
+	s.replSelected = -1
+}
+
+// replicate keeps the replica synchronized, reconnecting to the master
+// until the link is stopped.
+func (s *Client) replicate(link *replicaLink) {
+	for {
+		err := s.syncWithMaster(link)
+		if link.stopped() {
+			return
+		}
+		s.log().Warn("replication with the master failed", "master", link.addr(), "err", err)
+		s.mu.Lock()
+		link.state = replStateConnect
+		s.unlock()
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Client) listeningPort() string {
+	return strconv.Itoa(s.tcpPort())
+}
+
+// syncWithMaster performs the handshake and the synchronization, then
+// applies the command stream of the master until the connection fails.
+func (s *Client) syncWithMaster(link *replicaLink) error {
+	conn, err := net.DialTimeout("tcp", link.addr(), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if link.stopped() {
+		s.unlock()
+		conn.Close()
+		return nil
+	}
+	link.writeMu.Lock()
+	link.conn = conn
+	link.writeMu.Unlock()
+	link.state = replStateConnecting
+	replID, offset, synced := s.replID, s.replOffset, s.replSynced
+	port := s.listeningPort()
+	s.unlock()
+	defer conn.Close()
+
+	r := &respReader{conn: conn}
+	expect := func(args ...string) (string, error) {
+		if err := link.send(args...); err != nil {
+			return "", err
+		}
+		reply, err := r.line()
+		// the master sends newlines to keep the connection alive before
+		// answering PSYNC.
+		for err == nil && reply == "" {
+			reply, err = r.line()
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return "", fmt.Errorf("error reply to %s: %s", args[0], reply[1:])
+		}
+		return reply, nil
+	}
+	if _, err := expect("PING"); err != nil {
+		return err
+	}
+	if _, err := expect("REPLCONF", "listening-port", port); err != nil {
+		return err
+	}
+	if _, err := expect("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	}
+	psyncID, psyncOffset := "?", "-1"
+	if synced {
+		psyncID, psyncOffset = replID, strconv.FormatInt(offset+1, 10)
+	}
+	reply, err := expect("PSYNC", psyncID, psyncOffset)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	if len(fields) == 0 {
+		return fmt.Errorf("unexpected PSYNC reply %q", reply)
+	}
+	switch {
+	case fields[0] == "+FULLRESYNC" && len(fields) == 3:
+		s.mu.Lock()
+		link.state = replStateSync
+		s.unlock()
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC reply %q", reply)
+		}
+		data, err := readSyncPayload(r)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		_, err = s.loadRDB(data)
+		if err == nil {
+			s.replID, s.replOffset, s.replSynced = fields[1], offset, true
+			// the replicas of this server follow the new history too
+			s.detachReplicas()
+			s.backlog = newReplBacklog(offset, s.backlogSize)
+		}
+		s.unlock()
+		if err != nil {
+			return fmt.Errorf("loading the master RDB: %w", err)
+		}
+	case fields[0] == "+CONTINUE":
+		if len(fields) == 2 {
+			s.mu.Lock()
+			s.replID2, s.replID = s.replID, fields[1]
+			s.unlock()
+		}
+		s.mu.Lock()
+		if s.backlog == nil {
+			s.backlog = newReplBacklog(s.replOffset, s.backlogSize)
+		}
+		s.unlock()
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", reply)
+	}
+	s.mu.Lock()
+	link.state = replStateConnected
+	link.lastIO = time.Now()
+	s.unlock()
+	s.log().Info("synchronized with the master", "master", link.addr(), "psync", fields[0][1:])
+	go s.ackMaster(link, conn)
+	return s.applyStream(link, r)
+}
+
+// readSyncPayload reads the RDB of a full synchronization, sent either
+// as a bulk string of known length or, for diskless transfers, delimited
+// by a random EOF mark.
+func readSyncPayload(r *respReader) ([]byte, error) {
+	var header string
+	for header == "" {
+		line, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		// the master sends newlines to keep the connection alive while
+		// it prepares the payload.
+		header = line
+	}
+	if !strings.HasPrefix(header, "$") {
+		return nil, fmt.Errorf("unexpected payload header %q", header)
+	}
+	if mark := strings.TrimPrefix(header, "$EOF:"); mark != header {
+		var data []byte
+		for {
+			chunk, err := r.read(1)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, chunk...)
+			if len(data) >= len(mark) && string(data[len(data)-len(mark):]) == mark {
+				return data[:len(data)-len(mark)], nil
+			}
+		}
+	}
+	n, err := strconv.Atoi(header[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("unexpected payload header %q", header)
+	}
+	return r.read(n)
+}
+
+// applyStream executes the commands sent by the master, the offset grows
+// by the size of every command. The database selected by the stream is
+// kept for a partial resynchronization.
+func (s *Client) applyStream(link *replicaLink, r *respReader) error {
+	out := NewConnOverride()
+	master := newClientConn(s, out)
+	master.master = true
+	s.mu.Lock()
+	master.db = s.replStreamDB
+	s.unlock()
+	for {
+		frame, err := r.frame()
+		if err != nil {
+			return err
+		}
+		vals, _, err := fetchArray(frame)
+		if err != nil || len(vals) == 0 {
+			if frame[0] == '\n' {
+				continue
+			}
+			return fmt.Errorf("invalid command from master %q", frame)
+		}
+		name := strings.ToLower(argString(vals[0]))
+		s.mu.Lock()
+		if link.stopped() {
+			s.unlock()
+			return nil
+		}
+		link.lastIO = time.Now()
+		if name == "replconf" && len(vals) > 1 && strings.ToLower(argString(vals[1])) == "getack" {
+			offset := s.replOffset
+			s.feedReplicas(frame)
+			s.unlock()
+			link.send("REPLCONF", "ACK", strconv.FormatInt(offset, 10))
+			continue
+		}
+		if cmd, ok := commandMap[name]; ok && name != "ping" {
+			db := master.db
+			s.feedMonitors(nil, db, link.addr(), vals)
+			master.failed = false
+			cmd(master, vals[1:])
+			if !master.failed && propagatedCommand(name, vals[1:]) {
+				if args := propagationArgs(s.dbs[db], name, vals); args != nil {
+					s.propagate(db, args...)
+				}
+			}
+		}
+		out.Reset()
+		s.replStreamDB = master.db
+		s.feedReplicas(frame)
+		s.unlock()
+	}
+}
+
+// ackMaster reports the processed offset every second.
+func (s *Client) ackMaster(link *replicaLink, conn net.Conn) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-link.stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		offset, current := s.replOffset, link.conn == conn
+		s.unlock()
+		if !current {
+			return
+		}
+		if err := link.send("REPLCONF", "ACK", strconv.FormatInt(offset, 10)); err != nil {
+			return
+		}
+	}
+}
+
+// replicaof handles `REPLICAOF host port` and `REPLICAOF NO ONE`.
+func replicaof(c net.Conn, args []interface{}) {
+	if len(args) != 2 {
+		SendError(c, "ERR wrong number of arguments for 'replicaof' command")
+		return
+	}
+	s := clientOf(c).srv
+	host, portArg := argString(args[0]), argString(args[1])
+	if strings.ToLower(host) == "no" && strings.ToLower(portArg) == "one" {
+		s.promote()
+		SendOk(c)
+		return
+	}
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port < 0 || port > 65535 {
+		SendError(c, "ERR Invalid master port")
+		return
+	}
+	if s.replica != nil && s.replica.host == host && s.replica.port == port {
+		c.Write([]byte(createSimpleString("OK Already connected to specified master")))
+		return
+	}
+	s.replicaOf(host, port)
+	SendOk(c)
+}
+
+func role(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	if s.sentinel != nil {
+		SendValue(c, []interface{}{"sentinel", stringValues(sortedKeys(s.sentinel.masters))})
+		return
+	}
+	if link := s.replica; link != nil {
+		SendValue(c, []interface{}{"slave", link.host, link.port, link.state, s.replOffset})
+		return
+	}
+	SendValue(c, []interface{}{"master", s.replOffset, s.replicaRoles()})
+}
+
+// errReadOnlyReplica is replied to the write commands sent to a replica.
+var errReadOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+
+func replicationInfo(s *Client) []string {
+	if s.sentinel != nil {
+		return nil
+	}
+	var lines []string
+	if link := s.replica; link != nil {
+		linkStatus, lastIO, syncing := "down", -1, 0
+		if link.state == replStateConnected {
+			linkStatus, lastIO = "up", int(time.Since(link.lastIO).Seconds())
+		}
+		if link.state == replStateSync {
+			syncing = 1
+		}
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+link.host,
+			fmt.Sprintf("master_port:%d", link.port),
+			"master_link_status:"+linkStatus,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", syncing),
+			fmt.Sprintf("slave_read_repl_offset:%d", s.replOffset),
+			fmt.Sprintf("slave_repl_offset:%d", s.replOffset),
+			"slave_priority:100",
+			"slave_read_only:1",
+			"replica_announced:1",
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+	lines = append(lines, s.replicasInfo()...)
+	lines = append(lines,
+		"master_failover_state:no-failover",
+		"master_replid:"+s.replID,
+		"master_replid2:"+s.replID2,
+		fmt.Sprintf("master_repl_offset:%d", s.replOffset),
+		fmt.Sprintf("second_repl_offset:%d", s.secondReplOffset),
+	)
+	return append(lines, backlogInfo(s)...)
+}
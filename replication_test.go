@@ -0,0 +1,248 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeMaster accepts a replica, answers its handshake and sends the RDB
+// of a server holding snapshot, the connection is returned once synced.
+func fakeMaster(t *testing.T, ln net.Listener, replID string, snapshot map[string]string) (net.Conn, *respReader) {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &respReader{conn: conn}
+	var handshake []string
+	for len(handshake) < 4 {
+		frame, err := r.frame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals, _, err := fetchArray(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := strings.ToUpper(strings.Join(argStrings(vals), " "))
+		handshake = append(handshake, cmd)
+		switch {
+		case cmd == "PING":
+			conn.Write([]byte("+PONG\r\n"))
+		case strings.HasPrefix(cmd, "REPLCONF"):
+			conn.Write([]byte("+OK\r\n"))
+		case strings.HasPrefix(cmd, "PSYNC"):
+			src := NewClient()
+			for k, v := range snapshot {
+				src.dbs[0].store(k, v)
+			}
+			rdb := src.rdbSnapshot()
+			// keepalive newlines come before the reply and the payload
+			fmt.Fprintf(conn, "\n\n+FULLRESYNC %s 0\r\n\n$%d\r\n%s", replID, len(rdb), rdb)
+		}
+	}
+	expected := []string{"PING", "REPLCONF LISTENING-PORT 0", "REPLCONF CAPA EOF CAPA PSYNC2", "PSYNC ? -1"}
+	if !reflect.DeepEqual(handshake, expected) {
+		t.Fatalf("invalid handshake %q, expected %q", handshake, expected)
+	}
+	return conn, r
+}
+
+func TestReplicaOf(t *testing.T) {
+	useCommand(t, "set", setmap)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	srv := NewClient()
+	srv.dbs[0].store("stale", "replaced by the master data")
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	runCommand(cc, []interface{}{"replicaof", "127.0.0.1", argString(port)})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Fatalf("invalid replicaof reply, got %q", reply)
+	}
+
+	replID := strings.Repeat("ab", 20)
+	master, r := fakeMaster(t, ln, replID, map[string]string{"synced": "yes"})
+	defer master.Close()
+	stream := appendRESPCommand(nil, []string{"SELECT", "1"})
+	stream = appendRESPCommand(stream, []string{"SET", "streamed", "1"})
+	master.Write(stream)
+
+	load := func(db int, key string) interface{} {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		v, _ := srv.dbs[db].load(key)
+		return v
+	}
+	waitFor(t, "the replication stream", func() bool { return load(1, "streamed") == "1" })
+	if v := load(0, "synced"); v != "yes" {
+		t.Errorf("RDB of the master not loaded, got %v", v)
+	}
+	if v := load(0, "stale"); v != nil {
+		t.Errorf("data of the replica not replaced, got %v", v)
+	}
+
+	master.Write(appendRESPCommand(nil, []string{"REPLCONF", "GETACK", "*"}))
+	for {
+		frame, err := r.frame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals, _, _ := fetchArray(frame)
+		ack := argStrings(vals)
+		if len(ack) == 3 && ack[1] == "ACK" && ack[2] == argString(len(stream)) {
+			break
+		}
+	}
+
+	runCommand(cc, []interface{}{"role"})
+	expectedRole := fmt.Sprintf("*5\r\n+slave\r\n+127.0.0.1\r\n:%d\r\n+connected\r\n:%d\r\n", port, len(stream)+37)
+	if reply := readReply(t, mconn); reply != expectedRole {
+		t.Errorf("invalid role reply, got %q expected %q", reply, expectedRole)
+	}
+	runCommand(cc, []interface{}{"info", "replication"})
+	info := readReply(t, mconn)
+	for _, field := range []string{"role:slave", "master_link_status:up", "master_replid:" + replID} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Errorf("%s missing from the info reply %q", field, info)
+		}
+	}
+	runCommand(cc, []interface{}{"set", "local", "write"})
+	if reply := readReply(t, mconn); reply != "-"+errReadOnlyReplica.Error()+"\r\n" {
+		t.Errorf("write accepted by the replica, got %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"replicaof", "no", "one"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Fatalf("invalid replicaof no one reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"set", "local", "write"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Errorf("write refused after the promotion, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"info", "replication"})
+	info = readReply(t, mconn)
+	for _, field := range []string{"role:master", "master_replid2:" + replID} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Errorf("%s missing from the info reply %q", field, info)
+		}
+	}
+}
+
+func serveLocal(t *testing.T, srv *Client) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestMasterWithReplicas(t *testing.T) {
+	useCommand(t, "set", setmap)
+	master := NewClient()
+	port := serveLocal(t, master)
+	master.dbs[0].store("before", "sync")
+	replicas := []*Client{NewClient(), NewClient()}
+	for _, r := range replicas {
+		serveLocal(t, r)
+		r.ReplicaOf("127.0.0.1", port)
+	}
+	connected := func(srv *Client) bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.replica != nil && srv.replica.state == replStateConnected
+	}
+	waitFor(t, "the replicas to sync", func() bool { return connected(replicas[0]) && connected(replicas[1]) })
+
+	mconn := NewConnOverride()
+	cc := master.addClient(mconn)
+	for _, cmd := range [][]interface{}{
+		{"set", "a", "1"},
+		{"select", "2"},
+		{"set", "b", "2", "ex", "100"},
+	} {
+		runCommand(cc, cmd)
+	}
+	mconn.Reset()
+	runCommand(cc, []interface{}{"wait", "2", "0"})
+	if reply := readReply(t, mconn); reply != ":2\r\n" {
+		t.Fatalf("invalid wait reply, got %q", reply)
+	}
+	for i, r := range replicas {
+		r.mu.Lock()
+		for _, kv := range []struct {
+			db       int
+			key, val string
+		}{{0, "before", "sync"}, {0, "a", "1"}, {2, "b", "2"}} {
+			if v, _ := r.dbs[kv.db].load(kv.key); v != kv.val {
+				t.Errorf("replica %d has %v at %s, expected %s", i, v, kv.key, kv.val)
+			}
+		}
+		if _, ok := r.dbs[2].timeout["b"]; !ok {
+			t.Errorf("replica %d lost the expiration", i)
+		}
+		if r.replOffset != master.replOffset {
+			t.Errorf("replica %d at offset %d, master at %d", i, r.replOffset, master.replOffset)
+		}
+		r.mu.Unlock()
+	}
+
+	runCommand(cc, []interface{}{"role"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "*3\r\n+master\r\n") || !strings.Contains(reply, "*2\r\n*3\r\n") {
+		t.Errorf("invalid role reply %q", reply)
+	}
+	runCommand(cc, []interface{}{"info", "replication"})
+	if info := readReply(t, mconn); !strings.Contains(info, "connected_slaves:2\r\n") || !strings.Contains(info, "repl_backlog_active:1\r\n") {
+		t.Errorf("invalid info reply %q", info)
+	}
+
+	// a replica that loses its link resumes from the backlog
+	replicas[0].mu.Lock()
+	replicas[0].replica.conn.Close()
+	replicas[0].mu.Unlock()
+	runCommand(cc, []interface{}{"set", "c", "3"})
+	mconn.Reset()
+	runCommand(cc, []interface{}{"wait", "2", "5000"})
+	if reply := readReply(t, mconn); reply != ":2\r\n" {
+		t.Fatalf("invalid wait reply after the reconnection, got %q", reply)
+	}
+	replicas[0].mu.Lock()
+	if v, _ := replicas[0].dbs[2].load("c"); v != "3" {
+		t.Errorf("write missed by the reconnected replica, got %v", v)
+	}
+	replicas[0].mu.Unlock()
+	master.mu.Lock()
+	if master.stats.syncFull != 2 || master.stats.syncPartialOK != 1 {
+		t.Errorf("expected 2 full and 1 partial syncs, got %d and %d", master.stats.syncFull, master.stats.syncPartialOK)
+	}
+	master.mu.Unlock()
+
+	replicas[1].PromoteToMaster()
+	runCommand(cc, []interface{}{"wait", "2", "100"})
+	if reply := readReply(t, mconn); reply != ":1\r\n" {
+		t.Errorf("invalid wait reply with a replica gone, got %q", reply)
+	}
+}
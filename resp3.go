@@ -0,0 +1,182 @@
+package localredis
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const redisVersion = "7.2.0"
+
+// RespMap is replied as a RESP3 map of alternating keys and values, and
+// as a flat array for RESP2 clients.
+type RespMap []interface{}
+
+// RespSet is replied as a RESP3 set, and as an array for RESP2 clients.
+type RespSet []interface{}
+
+// RespPush is an out-of-band RESP3 push frame, e.g. pub/sub messages.
+// RESP2 clients receive it as a plain array.
+type RespPush []interface{}
+
+// RespVerbatim is a RESP3 verbatim string with its three letters format,
+// e.g. txt or mkd. RESP2 clients receive it as a bulk string.
+type RespVerbatim struct {
+	Format string
+	Text   string
+}
+
+func createDouble(f float64, proto int) string {
+	var repr string
+	switch {
+	case math.IsInf(f, 1):
+		repr = "inf"
+	case math.IsInf(f, -1):
+		repr = "-inf"
+	case math.IsNaN(f):
+		repr = "nan"
+	default:
+		repr = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if proto >= 3 {
+		return fmt.Sprintf("%c%s\r\n", doubleType, repr)
+	}
+	return createBulkString(repr)
+}
+
+func createResp3Reply(arg interface{}, proto int) string {
+	switch v := arg.(type) {
+	case RespMap:
+		if proto >= 3 {
+			result := fmt.Sprintf("%c%d\r\n", mapType, len(v)/2)
+			for _, elem := range v {
+				result += createReply(elem, proto)
+			}
+			return result
+		}
+		return createAggregate(arrayType, v, proto)
+	case RespSet:
+		if proto >= 3 {
+			return createAggregate(setType, v, proto)
+		}
+		return createAggregate(arrayType, v, proto)
+	case RespPush:
+		if proto >= 3 {
+			return createAggregate(pushType, v, proto)
+		}
+		return createAggregate(arrayType, v, proto)
+	case RespVerbatim:
+		if proto >= 3 {
+			return fmt.Sprintf("%c%d\r\n%s:%s\r\n", verbatimType, len(v.Text)+4, v.Format, v.Text)
+		}
+		return createBulkString(v.Text)
+	case float64:
+		return createDouble(v, proto)
+	case bool:
+		if proto >= 3 {
+			if v {
+				return "#t\r\n"
+			}
+			return "#f\r\n"
+		}
+		if v {
+			return createNumRepr(1)
+		}
+		return createNumRepr(0)
+	case *big.Int:
+		if proto >= 3 {
+			return fmt.Sprintf("%c%s\r\n", bigNumberType, v.String())
+		}
+		return createBulkString(v.String())
+	}
+	return ""
+}
+
+// SendPush sends a push frame, e.g. a pub/sub message, to c.
+func SendPush(c net.Conn, items ...interface{}) (int, error) {
+	return SendValue(c, RespPush(items))
+}
+
+// mode is how the server runs: standalone, sentinel or cluster.
+func (s *Client) mode() string {
+	switch {
+	case s.sentinel != nil:
+		return "sentinel"
+	case s.cluster != nil:
+		return "cluster"
+	}
+	return "standalone"
+}
+
+// hello negotiates the protocol version with
+// `HELLO [protover [AUTH username password] [SETNAME clientname]]`.
+func hello(c net.Conn, args []any) {
+	cc := clientOf(c)
+	proto := cc.proto
+	name := cc.name
+	var credentials []string
+	if len(args) > 0 {
+		v, err := argInt(args[0])
+		if err != nil {
+			SendError(c, "ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v < 2 || v > 3 {
+			SendError(c, "NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(argString(args[i])) {
+			case "auth":
+				if i+2 >= len(args) {
+					SendError(c, "ERR Syntax error in HELLO option 'auth'")
+					return
+				}
+				credentials = []string{argString(args[i+1]), argString(args[i+2])}
+				i += 2
+			case "setname":
+				if i+1 >= len(args) {
+					SendError(c, "ERR Syntax error in HELLO option 'setname'")
+					return
+				}
+				i++
+				name = argString(args[i])
+				if strings.ContainsAny(name, " \n\r") {
+					SendError(c, "ERR Client names cannot contain spaces, newlines or special characters.")
+					return
+				}
+			default:
+				SendError(c, fmt.Sprintf("ERR Syntax error in HELLO option '%s'", argString(args[i])))
+				return
+			}
+		}
+	}
+	if credentials != nil {
+		if !cc.srv.authenticate(cc, credentials[0], credentials[1]) {
+			SendError(c, errWrongPass)
+			return
+		}
+	} else if cc.user != nil && !cc.authenticated {
+		SendError(c, "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+	cc.proto = proto
+	cc.name = name
+	role := "master"
+	if cc.srv.replica != nil {
+		role = "replica"
+	}
+	SendValue(c, RespMap{
+		"server", "redis",
+		"version", redisVersion,
+		"proto", proto,
+		"id", int(cc.id),
+		"mode", cc.srv.mode(),
+		"role", role,
+		"modules", []interface{}{},
+	})
+}
@@ -0,0 +1,70 @@
+package localredis
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestHelloNegotiation(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"hello"})
+	reply := readReply(t, mconn)
+	if !strings.HasPrefix(reply, "*14\r\n+server\r\n+redis\r\n") {
+		t.Errorf("invalid RESP2 hello reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"hello", "4"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-NOPROTO") {
+		t.Errorf("invalid reply, expected NOPROTO, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"hello", "3", "setname", "resp3-client"})
+	reply = readReply(t, mconn)
+	if !strings.HasPrefix(reply, "%7\r\n") || !strings.Contains(reply, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("invalid RESP3 hello reply, got %q", reply)
+	}
+	if cc.proto != 3 || cc.name != "resp3-client" {
+		t.Errorf("hello did not update the connection, proto %d name %q", cc.proto, cc.name)
+	}
+	runCommand(cc, []interface{}{"get", "not-exists"})
+	if reply := readReply(t, mconn); reply != "_\r\n" {
+		t.Errorf("invalid RESP3 null, got %q", reply)
+	}
+}
+
+func TestResp3Encoding(t *testing.T) {
+	cases := []struct {
+		value        interface{}
+		resp2, resp3 string
+	}{
+		{RespMap{"a", 1}, "*2\r\n+a\r\n:1\r\n", "%1\r\n$1\r\na\r\n:1\r\n"},
+		{RespSet{"a"}, "*1\r\n+a\r\n", "~1\r\n$1\r\na\r\n"},
+		{RespPush{"message", "ch"}, "*2\r\n+message\r\n+ch\r\n", ">2\r\n$7\r\nmessage\r\n$2\r\nch\r\n"},
+		{3.5, "$3\r\n3.5\r\n", ",3.5\r\n"},
+		{true, ":1\r\n", "#t\r\n"},
+		{nil, "$-1\r\n", "_\r\n"},
+		{big.NewInt(12345), "$5\r\n12345\r\n", "(12345\r\n"},
+		{RespVerbatim{"txt", "hi"}, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+	}
+	for _, tc := range cases {
+		if got := createReply(tc.value, 2); got != tc.resp2 {
+			t.Errorf("RESP2 encoding of %#v: expected %q, got %q", tc.value, tc.resp2, got)
+		}
+		if got := createReply(tc.value, 3); got != tc.resp3 {
+			t.Errorf("RESP3 encoding of %#v: expected %q, got %q", tc.value, tc.resp3, got)
+		}
+	}
+}
+
+func TestFrameLength(t *testing.T) {
+	pipelined := CreateReply([]interface{}{"ping"}) + CreateReply([]interface{}{"get", "x"})
+	first := len(CreateReply([]interface{}{"ping"}))
+	if n := frameLength([]byte(pipelined)); n != first {
+		t.Errorf("expected first frame length %d, got %d", first, n)
+	}
+	if n := frameLength([]byte("*2\r\n$3\r\nget\r\n$5\r\nhel")); n != -1 {
+		t.Errorf("expected incomplete frame, got %d", n)
+	}
+}
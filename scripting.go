@@ -0,0 +1,725 @@
+package localredis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mashingan/localredis/internal/lua"
+)
+
+// noScriptCommands cannot be called with redis.call.
+var noScriptCommands = map[string]bool{
+	"eval":         true,
+	"evalsha":      true,
+	"eval_ro":      true,
+	"evalsha_ro":   true,
+	"script":       true,
+	"fcall":        true,
+	"fcall_ro":     true,
+	"function":     true,
+	"psync":        true,
+	"sync":         true,
+	"replconf":     true,
+	"wait":         true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"quit":         true,
+	"hello":        true,
+	"client":       true,
+}
+
+const (
+	errBusyScript   = "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."
+	errBusyFunction = "BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE."
+	errNotBusy      = "NOTBUSY No scripts in execution right now."
+	errUnkillable   = "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."
+)
+
+// scriptHookCount is the number of statements run by a script between
+// two checks of the kill flag.
+const scriptHookCount = 10000
+
+// scripting commands are registered in init as redis.call refers back to
+// commandMap.
+func init() {
+	commandMap["eval"] = eval
+	commandMap["evalsha"] = evalsha
+	commandMap["eval_ro"] = evalRO
+	commandMap["evalsha_ro"] = evalshaRO
+	commandMap["script"] = scriptCommand
+	commandMap["fcall"] = fcall
+	commandMap["fcall_ro"] = fcallRO
+	commandMap["function"] = functionCommand
+}
+
+// statusReply is a simple string reply received by a script, it's
+// converted to the {ok = status} table.
+type statusReply string
+
+// scriptRunner executes the redis.call of a single script invocation.
+type scriptRunner struct {
+	caller   *ClientConn
+	conn     *ClientConn
+	buf      *ConnOverride
+	readOnly bool
+	resp     int
+}
+
+// busyScript is a running script, the other clients get a BUSY error once
+// it ran for longer than busy-reply-threshold and may kill it until it
+// writes.
+type busyScript struct {
+	start     time.Time
+	threshold time.Duration
+	function  bool
+	done      chan struct{}
+
+	// written and killed are guarded by busyMu of the server
+	written bool
+	killed  bool
+}
+
+// startScript records the script being run, the lock of the server must
+// be held.
+func (s *Client) startScript(function bool) *busyScript {
+	run := &busyScript{
+		start:     time.Now(),
+		threshold: time.Duration(s.busyReplyThreshold) * time.Millisecond,
+		function:  function,
+		done:      make(chan struct{}),
+	}
+	s.busyMu.Lock()
+	s.busy = run
+	s.busyMu.Unlock()
+	return run
+}
+
+func (s *Client) endScript(run *busyScript) {
+	s.busyMu.Lock()
+	s.busy = nil
+	s.busyMu.Unlock()
+	close(run.done)
+}
+
+// scriptHook is the hook of the Lua state running run, it aborts the
+// script once killed.
+func (s *Client) scriptHook(run *busyScript) func(*lua.State) {
+	return func(l *lua.State) {
+		s.busyMu.Lock()
+		killed := run.killed
+		s.busyMu.Unlock()
+		if !killed {
+			return
+		}
+		t := lua.NewTable()
+		if run.function {
+			t.Set("err", "ERR Script killed by user with FUNCTION KILL...")
+		} else {
+			t.Set("err", "ERR Script killed by user with SCRIPT KILL...")
+		}
+		panic(&lua.Error{Value: t, Fatal: true})
+	}
+}
+
+// scriptBusy is called before the server lock is taken, it waits for the
+// running script up to busy-reply-threshold. Past it, SCRIPT KILL and
+// FUNCTION KILL are served without the lock and the other commands get a
+// BUSY error. It reports whether the command was answered.
+func (s *Client) scriptBusy(c net.Conn, name string, args []interface{}) bool {
+	for {
+		s.busyMu.Lock()
+		run := s.busy
+		s.busyMu.Unlock()
+		if run == nil {
+			return false
+		}
+		if left := run.threshold - time.Since(run.start); left > 0 {
+			select {
+			case <-run.done:
+			case <-time.After(left):
+			}
+			continue
+		}
+		sub := ""
+		if len(args) == 1 {
+			sub = strings.ToLower(argString(args[0]))
+		}
+		switch {
+		case name == "script" && sub == "kill":
+			s.killScript(c, run, false)
+		case name == "function" && sub == "kill":
+			s.killScript(c, run, true)
+		case run.function:
+			SendError(c, errBusyFunction)
+		default:
+			SendError(c, errBusyScript)
+		}
+		return true
+	}
+}
+
+// killScript stops run for SCRIPT KILL, or FUNCTION KILL when function is
+// set, unless it already wrote to the dataset.
+func (s *Client) killScript(c net.Conn, run *busyScript, function bool) {
+	s.busyMu.Lock()
+	defer s.busyMu.Unlock()
+	switch {
+	case run.written:
+		SendError(c, errUnkillable)
+	case run.function && !function:
+		SendError(c, errBusyFunction)
+	case !run.function && function:
+		SendError(c, errBusyScript)
+	default:
+		run.killed = true
+		SendOk(c)
+	}
+}
+
+func newScriptRunner(caller *ClientConn, readOnly bool) *scriptRunner {
+	buf := NewConnOverride()
+	conn := newClientConn(caller.srv, buf)
+	conn.id = caller.id
+	conn.name = caller.name
+	conn.db = caller.db
+	conn.proto = 3
+	return &scriptRunner{caller: caller, conn: conn, buf: buf, readOnly: readOnly, resp: 2}
+}
+
+// scriptEnv is the redis library of a Lua state, the runner is replaced
+// for each invocation. lib is only set while a function library is being
+// loaded.
+type scriptEnv struct {
+	runner *scriptRunner
+	lib    *library
+}
+
+func newScriptState(env *scriptEnv) *lua.State {
+	l := lua.NewState()
+	lua.OpenBit(l)
+	lua.OpenCJSON(l)
+	lib := lua.NewTable()
+	reg := func(name string, fn func(*lua.State, []lua.Value) []lua.Value) {
+		lib.Set(name, &lua.GoFunction{Name: name, Fn: fn})
+	}
+	reg("call", func(l *lua.State, args []lua.Value) []lua.Value {
+		if env.runner == nil {
+			l.Errorf("redis.call can only be called inside a script invocation")
+		}
+		return []lua.Value{env.runner.call(l, args, false)}
+	})
+	reg("pcall", func(l *lua.State, args []lua.Value) []lua.Value {
+		if env.runner == nil {
+			l.Errorf("redis.pcall can only be called inside a script invocation")
+		}
+		return []lua.Value{env.runner.call(l, args, true)}
+	})
+	reg("register_function", func(l *lua.State, args []lua.Value) []lua.Value {
+		if env.lib == nil {
+			l.Errorf("redis.register_function can only be called on FUNCTION LOAD command")
+		}
+		env.lib.register(l, args)
+		return nil
+	})
+	reg("error_reply", func(l *lua.State, args []lua.Value) []lua.Value {
+		t := lua.NewTable()
+		t.Set("err", l.CheckString(args, 0, "error_reply"))
+		return []lua.Value{t}
+	})
+	reg("status_reply", func(l *lua.State, args []lua.Value) []lua.Value {
+		t := lua.NewTable()
+		t.Set("ok", l.CheckString(args, 0, "status_reply"))
+		return []lua.Value{t}
+	})
+	reg("sha1hex", func(l *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{sha1hex(l.CheckString(args, 0, "sha1hex"))}
+	})
+	reg("setresp", func(l *lua.State, args []lua.Value) []lua.Value {
+		resp := int(l.CheckNumber(args, 0, "setresp"))
+		if resp != 2 && resp != 3 {
+			l.Errorf("RESP version must be 2 or 3.")
+		}
+		if env.runner != nil {
+			env.runner.resp = resp
+		}
+		return nil
+	})
+	reg("log", func(l *lua.State, args []lua.Value) []lua.Value {
+		return nil
+	})
+	reg("set_repl", func(l *lua.State, args []lua.Value) []lua.Value {
+		return nil
+	})
+	reg("replicate_commands", func(l *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{true}
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		lib.Set(level, float64(i))
+	}
+	for i, repl := range []string{"REPL_NONE", "REPL_AOF", "REPL_SLAVE", "REPL_ALL"} {
+		lib.Set(repl, float64(i))
+	}
+	lib.Set("REPL_REPLICA", float64(2))
+	lib.Set("REDIS_VERSION", redisVersion)
+	lib.Set("REDIS_VERSION_NUM", float64(0x070200))
+	lib.SetReadOnly()
+	l.Globals.Set("redis", lib)
+	return l
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// call runs a command for redis.call and redis.pcall through the same
+// command table as runCommand.
+func (r *scriptRunner) call(l *lua.State, args []lua.Value, protected bool) lua.Value {
+	fail := func(msg string) lua.Value {
+		t := lua.NewTable()
+		t.Set("err", msg)
+		if protected {
+			return t
+		}
+		panic(&lua.Error{Value: t})
+	}
+	if len(args) == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	cmdargs := make([]interface{}, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case string:
+			cmdargs[i] = v
+		case float64:
+			cmdargs[i] = strconv.FormatFloat(v, 'g', 17, 64)
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	name := strings.ToLower(cmdargs[0].(string))
+	cmd, ok := commandMap[name]
+	if !ok {
+		return fail("ERR Unknown Redis command called from script")
+	}
+	if noScriptCommands[name] {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	if r.readOnly && writeCommands[name] {
+		return fail("ERR Write commands are not allowed from read-only scripts.")
+	}
+	if err := r.conn.srv.aclCheck(r.caller, name, cmdargs[1:], "lua"); err != "" {
+		return fail(err)
+	}
+	r.buf.Reset()
+	db := r.conn.db
+	r.conn.srv.feedMonitors(r.caller, db, "lua", cmdargs)
+	cmd(r.conn, cmdargs[1:])
+	reply, _ := parseReply(r.buf.Bytes())
+	if err, ok := reply.(error); ok {
+		return fail(err.Error())
+	}
+	if writeCommands[name] {
+		s := r.conn.srv
+		s.busyMu.Lock()
+		if s.busy != nil {
+			s.busy.written = true
+		}
+		s.busyMu.Unlock()
+	}
+	if propagatedCommand(name, cmdargs[1:]) {
+		if args := propagationArgs(r.conn.srv.dbs[db], name, cmdargs); args != nil {
+			r.conn.srv.propagate(db, args...)
+		}
+	}
+	return replyToLua(reply, r.resp)
+}
+
+// parseReply decodes a single reply of any RESP version.
+func parseReply(buf []byte) (interface{}, int) {
+	if len(buf) == 0 {
+		return nil, 0
+	}
+	line := strings.Index(string(buf), terminal)
+	if line < 0 {
+		return nil, len(buf)
+	}
+	head := string(buf[1:line])
+	next := line + 2
+	switch redisType(buf[0]) {
+	case simpleStringType:
+		return statusReply(head), next
+	case errorType:
+		return fmt.Errorf("%s", head), next
+	case integerType:
+		n, _ := strconv.ParseInt(head, 10, 64)
+		return n, next
+	case nullType:
+		return nil, next
+	case booleanType:
+		return head == "t", next
+	case doubleType:
+		f, _ := strconv.ParseFloat(head, 64)
+		switch head {
+		case "inf":
+			f = math.Inf(1)
+		case "-inf":
+			f = math.Inf(-1)
+		}
+		return f, next
+	case bigNumberType:
+		n, _ := new(big.Int).SetString(head, 10)
+		return n, next
+	case bulkStringType, verbatimType:
+		n, _ := strconv.Atoi(head)
+		if n < 0 {
+			return nil, next
+		}
+		end := next + n
+		if end > len(buf) {
+			end = len(buf)
+		}
+		s := string(buf[next:end])
+		if buf[0] == byte(verbatimType) && len(s) >= 4 {
+			s = s[4:]
+		}
+		return s, end + 2
+	case arrayType, setType, pushType, mapType:
+		n, _ := strconv.Atoi(head)
+		if n < 0 {
+			return nil, next
+		}
+		if buf[0] == byte(mapType) {
+			n *= 2
+		}
+		items := make([]interface{}, n)
+		for i := 0; i < n && next < len(buf); i++ {
+			item, size := parseReply(buf[next:])
+			items[i] = item
+			next += size
+		}
+		switch redisType(buf[0]) {
+		case mapType:
+			return RespMap(items), next
+		case setType:
+			return RespSet(items), next
+		}
+		return items, next
+	}
+	return nil, len(buf)
+}
+
+// replyToLua converts a reply with the redis to Lua conversion rules of
+// the RESP version resp selected with redis.setresp.
+func replyToLua(reply interface{}, resp int) lua.Value {
+	switch v := reply.(type) {
+	case nil:
+		if resp >= 3 {
+			return nil
+		}
+		return false
+	case statusReply:
+		t := lua.NewTable()
+		t.Set("ok", string(v))
+		return t
+	case error:
+		t := lua.NewTable()
+		t.Set("err", v.Error())
+		return t
+	case int64:
+		return float64(v)
+	case string:
+		return v
+	case bool:
+		if resp >= 3 {
+			return v
+		}
+		if v {
+			return float64(1)
+		}
+		return false
+	case float64:
+		if resp >= 3 {
+			t := lua.NewTable()
+			t.Set("double", v)
+			return t
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case *big.Int:
+		if resp >= 3 {
+			t := lua.NewTable()
+			t.Set("big_number", v.String())
+			return t
+		}
+		return v.String()
+	case RespMap:
+		if resp >= 3 {
+			m := lua.NewTable()
+			for i := 0; i+1 < len(v); i += 2 {
+				m.Set(replyToLua(v[i], resp), replyToLua(v[i+1], resp))
+			}
+			t := lua.NewTable()
+			t.Set("map", m)
+			return t
+		}
+		return replyToLua([]interface{}(v), resp)
+	case RespSet:
+		if resp >= 3 {
+			m := lua.NewTable()
+			for _, item := range v {
+				m.Set(replyToLua(item, resp), true)
+			}
+			t := lua.NewTable()
+			t.Set("set", m)
+			return t
+		}
+		return replyToLua([]interface{}(v), resp)
+	case []interface{}:
+		t := lua.NewTable()
+		for i, item := range v {
+			t.Set(float64(i+1), replyToLua(item, resp))
+		}
+		return t
+	}
+	return nil
+}
+
+// luaToReply encodes a value returned by a script for a client speaking
+// the protocol version proto.
+func luaToReply(v lua.Value, proto int) string {
+	switch val := v.(type) {
+	case nil:
+		return createReply(nil, proto)
+	case bool:
+		if val {
+			return createNumRepr(1)
+		}
+		return createReply(nil, proto)
+	case float64:
+		return createNumRepr(int(val))
+	case string:
+		return createBulkString(val)
+	case *lua.Table:
+		if msg, ok := val.Get("err").(string); ok {
+			return fmt.Sprintf("-%s\r\n", msg)
+		}
+		if status, ok := val.Get("ok").(string); ok {
+			return createSimpleString(status)
+		}
+		if d, ok := val.Get("double").(float64); ok {
+			return createDouble(d, proto)
+		}
+		if m, ok := val.Get("map").(*lua.Table); ok {
+			var items []string
+			for k, item, _ := m.Next(nil); k != nil; k, item, _ = m.Next(k) {
+				items = append(items, luaToReply(k, proto), luaToReply(item, proto))
+			}
+			kind, n := mapType, len(items)/2
+			if proto < 3 {
+				kind, n = arrayType, len(items)
+			}
+			return fmt.Sprintf("%c%d\r\n%s", kind, n, strings.Join(items, ""))
+		}
+		if set, ok := val.Get("set").(*lua.Table); ok {
+			var items []string
+			for k, _, _ := set.Next(nil); k != nil; k, _, _ = set.Next(k) {
+				items = append(items, luaToReply(k, proto))
+			}
+			kind := setType
+			if proto < 3 {
+				kind = arrayType
+			}
+			return fmt.Sprintf("%c%d\r\n%s", kind, len(items), strings.Join(items, ""))
+		}
+		var items []string
+		for i := 1; ; i++ {
+			item := val.Get(float64(i))
+			if item == nil {
+				break
+			}
+			items = append(items, luaToReply(item, proto))
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+	}
+	return createReply(nil, proto)
+}
+
+// scriptErrorReply converts an error raised by a script into the reply,
+// name is the script sha or the function name.
+func scriptErrorReply(err error, name, chunk string, line int) string {
+	if lerr, ok := err.(*lua.Error); ok {
+		if t, ok := lerr.Value.(*lua.Table); ok {
+			if msg, ok := t.Get("err").(string); ok {
+				return fmt.Sprintf("-%s\r\n", msg)
+			}
+		}
+	}
+	return fmt.Sprintf("-ERR %s script: %s, on @%s:%d.\r\n", err.Error(), name, chunk, line)
+}
+
+// parseKeysArgs splits `numkeys key [key ...] arg [arg ...]` into KEYS
+// and ARGV.
+func parseKeysArgs(args []interface{}) (keys, argv []interface{}, err error) {
+	numkeys, converr := argInt(args[0])
+	if converr != nil {
+		return nil, nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if numkeys < 0 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be negative")
+	}
+	if numkeys > len(args)-1 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : numkeys+1], args[numkeys+1:], nil
+}
+
+func stringTable(vals []interface{}) *lua.Table {
+	t := lua.NewTable()
+	for _, v := range vals {
+		t.Append(argString(v))
+	}
+	return t
+}
+
+// runScript executes body atomically, the server lock is already held by
+// runCommand.
+func runScript(c net.Conn, sha, body string, args []interface{}, readOnly bool) {
+	keys, argv, err := parseKeysArgs(args)
+	if err != nil {
+		SendError(c, err.Error())
+		return
+	}
+	cc := clientOf(c)
+	env := &scriptEnv{runner: newScriptRunner(cc, readOnly)}
+	l := newScriptState(env)
+	l.Globals.Set("KEYS", stringTable(keys))
+	l.Globals.Set("ARGV", stringTable(argv))
+	l.StrictGlobals = true
+	fn, err := l.Load(body)
+	if err != nil {
+		SendError(c, fmt.Sprintf("ERR Error compiling script (new function): %s", err.Error()))
+		return
+	}
+	run := cc.srv.startScript(false)
+	defer cc.srv.endScript(run)
+	l.Hook, l.HookCount = cc.srv.scriptHook(run), scriptHookCount
+	rets, err := l.PCall(fn)
+	if err != nil {
+		c.Write([]byte(scriptErrorReply(err, sha, l.Chunk, l.Line())))
+		return
+	}
+	var ret lua.Value
+	if len(rets) > 0 {
+		ret = rets[0]
+	}
+	c.Write([]byte(luaToReply(ret, cc.proto)))
+}
+
+func evalCommand(c net.Conn, args []interface{}, readOnly bool) {
+	if len(args) < 2 {
+		SendError(c, "ERR wrong number of arguments for 'eval' command")
+		return
+	}
+	body := argString(args[0])
+	sha := sha1hex(body)
+	if fn, ok := scriptOverrides[sha]; ok {
+		runGoScript(c, fn, args[1:], readOnly)
+		return
+	}
+	clientOf(c).srv.scripts[sha] = body
+	runScript(c, sha, body, args[1:], readOnly)
+}
+
+func evalshaCommand(c net.Conn, args []interface{}, readOnly bool) {
+	if len(args) < 2 {
+		SendError(c, "ERR wrong number of arguments for 'evalsha' command")
+		return
+	}
+	sha := strings.ToLower(argString(args[0]))
+	if fn, ok := scriptOverrides[sha]; ok {
+		runGoScript(c, fn, args[1:], readOnly)
+		return
+	}
+	body, ok := clientOf(c).srv.scripts[sha]
+	if !ok {
+		SendError(c, "NOSCRIPT No matching script. Please use EVAL.")
+		return
+	}
+	runScript(c, sha, body, args[1:], readOnly)
+}
+
+func eval(c net.Conn, args []interface{}) {
+	evalCommand(c, args, false)
+}
+
+func evalRO(c net.Conn, args []interface{}) {
+	evalCommand(c, args, true)
+}
+
+func evalsha(c net.Conn, args []interface{}) {
+	evalshaCommand(c, args, false)
+}
+
+func evalshaRO(c net.Conn, args []interface{}) {
+	evalshaCommand(c, args, true)
+}
+
+func scriptCommand(c net.Conn, args []interface{}) {
+	if len(args) < 1 {
+		SendError(c, "ERR wrong number of arguments for 'script' command")
+		return
+	}
+	s := clientOf(c).srv
+	switch sub := strings.ToLower(argString(args[0])); sub {
+	case "load":
+		if len(args) != 2 {
+			SendError(c, "ERR wrong number of arguments for 'script|load' command")
+			return
+		}
+		body := argString(args[1])
+		l := lua.NewState()
+		if _, err := l.Load(body); err != nil {
+			SendError(c, fmt.Sprintf("ERR Error compiling script (new function): %s", err.Error()))
+			return
+		}
+		sha := sha1hex(body)
+		s.scripts[sha] = body
+		SendBulk(c, sha)
+	case "exists":
+		if len(args) < 2 {
+			SendError(c, "ERR wrong number of arguments for 'script|exists' command")
+			return
+		}
+		result := make([]interface{}, len(args)-1)
+		for i, sha := range args[1:] {
+			result[i] = 0
+			sha := strings.ToLower(argString(sha))
+			if _, ok := s.scripts[sha]; ok {
+				result[i] = 1
+			} else if _, ok := scriptOverrides[sha]; ok {
+				result[i] = 1
+			}
+		}
+		SendValue(c, result)
+	case "flush":
+		if !flushOpt(c, args[1:]) {
+			return
+		}
+		s.scripts = map[string]string{}
+		SendOk(c)
+	case "kill":
+		// a running script is killed by scriptBusy, without the lock
+		SendError(c, errNotBusy)
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", argString(args[0])))
+	}
+}
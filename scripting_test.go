@@ -0,0 +1,114 @@
+package localredis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	runCommand(cc, []interface{}{"eval", "return {KEYS[1], ARGV[1], 3.9, redis.call('ping'), false}", "1", "key", "arg"})
+	expected := "*5\r\n$3\r\nkey\r\n$3\r\narg\r\n:3\r\n+PONG\r\n$-1\r\n"
+	if reply := readReply(t, mconn); reply != expected {
+		t.Errorf("invalid eval reply, expected %q, got %q", expected, reply)
+	}
+
+	release := `if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`
+	runCommand(cc, []interface{}{"script", "load", release})
+	sha := sha1hex(release)
+	if reply := readReply(t, mconn); reply != createBulkString(sha) {
+		t.Fatalf("invalid script load reply, got %q", reply)
+	}
+	setmap(cc, []interface{}{"lock", "token-1"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"evalsha", sha, "1", "lock", "token-2"})
+	if reply := readReply(t, mconn); reply != ":0\r\n" {
+		t.Errorf("lock released with the wrong token, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"evalsha", strings.ToUpper(sha), "1", "lock", "token-1"})
+	if reply := readReply(t, mconn); reply != ":1\r\n" {
+		t.Errorf("lock not released, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"script", "exists", sha, "0000"})
+	if reply := readReply(t, mconn); reply != "*2\r\n:1\r\n:0\r\n" {
+		t.Errorf("invalid script exists reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"script", "flush"})
+	readReply(t, mconn)
+	runCommand(cc, []interface{}{"evalsha", sha, "0"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-NOSCRIPT") {
+		t.Errorf("expected NOSCRIPT after flush, got %q", reply)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+
+	cases := []struct {
+		args   []interface{}
+		prefix string
+	}{
+		{[]interface{}{"eval", "return 1", "2", "a"}, "-ERR Number of keys can't be greater than number of args"},
+		{[]interface{}{"eval", "x = 1", "0"}, "-ERR user_script:1: Script attempted to create global variable 'x'"},
+		{[]interface{}{"eval", "return redis.error_reply('MY failure')", "0"}, "-MY failure"},
+		{[]interface{}{"eval", "return redis.call('select', 'x')", "0"}, "-ERR value is not an integer"},
+		{[]interface{}{"eval", "return redis.pcall('nosuchcmd').err", "0"}, "$44\r\nERR Unknown Redis command called from script"},
+		{[]interface{}{"eval", "return redis.call('eval', 'return 1', '0')", "0"}, "-ERR This Redis command is not allowed from script"},
+		{[]interface{}{"eval_ro", "return redis.call('del', 'x')", "0"}, "-ERR Write commands are not allowed from read-only scripts."},
+		{[]interface{}{"eval", "return (", "0"}, "-ERR Error compiling script"},
+	}
+	for _, tc := range cases {
+		runCommand(cc, tc.args)
+		if reply := readReply(t, mconn); !strings.HasPrefix(reply, tc.prefix) {
+			t.Errorf("%v: expected prefix %q, got %q", tc.args, tc.prefix, reply)
+		}
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	other := NewConnOverride()
+	oc := srv.addClient(other)
+
+	runCommand(oc, []interface{}{"script", "kill"})
+	runCommand(oc, []interface{}{"config", "set", "lua-time-limit", "20"})
+	if reply := readReply(t, other); reply != "-"+errNotBusy+"\r\n+OK\r\n" {
+		t.Fatalf("got %q", reply)
+	}
+	done := make(chan struct{})
+	go func() {
+		runCommand(cc, []interface{}{"eval", "while true do pcall(function() while true do end end) end", "0"})
+		close(done)
+	}()
+	for busy := false; !busy; {
+		srv.busyMu.Lock()
+		busy = srv.busy != nil
+		srv.busyMu.Unlock()
+	}
+	runCommand(oc, []interface{}{"get", "k"})
+	runCommand(oc, []interface{}{"function", "kill"})
+	runCommand(oc, []interface{}{"script", "kill"})
+	expected := "-" + errBusyScript + "\r\n-" + errBusyScript + "\r\n+OK\r\n"
+	if reply := readReply(t, other); reply != expected {
+		t.Errorf("got %q, expected %q", reply, expected)
+	}
+	<-done
+	if reply := readReply(t, mconn); reply != "-ERR Script killed by user with SCRIPT KILL...\r\n" {
+		t.Errorf("the killed script replied %q", reply)
+	}
+	runCommand(oc, []interface{}{"get", "k"})
+	if reply := readReply(t, other); reply != "-1\r\n" {
+		t.Errorf("the server is still busy, got %q", reply)
+	}
+}
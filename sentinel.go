@@ -0,0 +1,497 @@
+package localredis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sentinelInfoPeriod is how often a sentinel refreshes the replicas of its
+// masters with INFO replication.
+const sentinelInfoPeriod = time.Second
+
+// sentinelCommands are the commands served in sentinel mode.
+var sentinelCommands = map[string]bool{
+	"sentinel":     true,
+	"ping":         true,
+	"quit":         true,
+	"hello":        true,
+	"client":       true,
+	"info":         true,
+	"role":         true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"publish":      true,
+	"auth":         true,
+	"acl":          true,
+}
+
+type sentinelState struct {
+	myID    string
+	masters map[string]*sentinelMaster
+}
+
+// sentinelMaster is a master monitored by the sentinel with the replicas
+// it reported last.
+type sentinelMaster struct {
+	name        string
+	host        string
+	port        int
+	quorum      int
+	replicas    []sentinelReplica
+	down        bool
+	lastOK      time.Time
+	failingOver bool
+	configEpoch int
+	stop        chan struct{}
+}
+
+type sentinelReplica struct {
+	host   string
+	port   int
+	offset int64
+	online bool
+}
+
+func (m *sentinelMaster) addr() string {
+	return net.JoinHostPort(m.host, strconv.Itoa(m.port))
+}
+
+func (r sentinelReplica) addr() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.port))
+}
+
+// NewSentinel returns a server in sentinel mode, it only serves the
+// SENTINEL, pub/sub and introspection commands.
+func NewSentinel() *Client {
+	s := NewClient()
+	s.sentinel = &sentinelState{myID: newReplID(), masters: map[string]*sentinelMaster{}}
+	return s
+}
+
+// SentinelMonitor starts monitoring the master at host:port under name,
+// like `SENTINEL MONITOR`.
+func (s *Client) SentinelMonitor(name, host string, port, quorum int) error {
+	s.mu.Lock()
+	defer s.unlock()
+	return s.sentinelMonitor(name, host, port, quorum)
+}
+
+func (s *Client) sentinelMonitor(name, host string, port, quorum int) error {
+	if s.sentinel == nil {
+		return errors.New("ERR This instance is not a sentinel")
+	}
+	if _, ok := s.sentinel.masters[name]; ok {
+		return errors.New("ERR Duplicated master name")
+	}
+	if port <= 0 || port > 65535 {
+		return errors.New("ERR Invalid port number")
+	}
+	if quorum <= 0 {
+		return errors.New("ERR Quorum must be 1 or greater.")
+	}
+	m := &sentinelMaster{name: name, host: host, port: port, quorum: quorum, stop: make(chan struct{})}
+	s.sentinel.masters[name] = m
+	go s.watchMaster(m)
+	return nil
+}
+
+// watchMaster refreshes the state of the master until it is removed.
+func (s *Client) watchMaster(m *sentinelMaster) {
+	ticker := time.NewTicker(sentinelInfoPeriod)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		addr := m.addr()
+		s.unlock()
+		reply, err := sentinelQuery(addr, "INFO", "replication")
+		s.mu.Lock()
+		if m.addr() == addr {
+			m.down = err != nil
+			if err == nil {
+				m.lastOK = time.Now()
+				m.replicas = parseReplicas(reply)
+			}
+		}
+		s.unlock()
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseReplicas reads the replicas listed by INFO replication, e.g.
+// `slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0`.
+func parseReplicas(info string) []sentinelReplica {
+	var replicas []sentinelReplica
+	for _, line := range strings.Split(info, "\r\n") {
+		if !strings.HasPrefix(line, "slave") || !strings.Contains(line, ":ip=") {
+			continue
+		}
+		var r sentinelReplica
+		for _, field := range strings.Split(line[strings.IndexByte(line, ':')+1:], ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "ip":
+				r.host = kv[1]
+			case "port":
+				r.port, _ = strconv.Atoi(kv[1])
+			case "offset":
+				r.offset, _ = strconv.ParseInt(kv[1], 10, 64)
+			case "state":
+				r.online = kv[1] == "online"
+			}
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+// sentinelQuery sends a command to the server at addr and returns its
+// reply as a string, error replies are returned as errors.
+func sentinelQuery(addr string, args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(appendRESPCommand(nil, args)); err != nil {
+		return "", err
+	}
+	r := &respReader{conn: conn}
+	frame, err := r.frame()
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSuffix(string(frame[:strings.IndexByte(string(frame), '\n')+1]), "\r\n")
+	switch redisType(frame[0]) {
+	case errorType:
+		return "", errors.New(line[1:])
+	case bulkStringType, verbatimType:
+		body := string(frame[len(line)+2 : len(frame)-2])
+		if frame[0] == byte(verbatimType) {
+			body = body[4:]
+		}
+		return body, nil
+	}
+	return line[1:], nil
+}
+
+// SentinelFailover promotes the most up to date replica of the master
+// monitored as name, the other replicas and the old master are made
+// replicas of it. The clients subscribed to +switch-master are notified.
+func (s *Client) SentinelFailover(name string) error {
+	s.mu.Lock()
+	m, replicas, err := s.startFailover(name)
+	s.unlock()
+	if err != nil {
+		return err
+	}
+	return s.failover(m, replicas)
+}
+
+func (s *Client) startFailover(name string) (*sentinelMaster, []sentinelReplica, error) {
+	if s.sentinel == nil {
+		return nil, nil, errors.New("ERR This instance is not a sentinel")
+	}
+	m, ok := s.sentinel.masters[name]
+	if !ok {
+		return nil, nil, errors.New("ERR No such master with that name")
+	}
+	if m.failingOver {
+		return nil, nil, errors.New("INPROG Failover already in progress")
+	}
+	var replicas []sentinelReplica
+	for _, r := range m.replicas {
+		if r.online {
+			replicas = append(replicas, r)
+		}
+	}
+	if len(replicas) == 0 {
+		return nil, nil, errors.New("NOGOODSLAVE No suitable replica to promote")
+	}
+	m.failingOver = true
+	s.publish("+try-failover", fmt.Sprintf("master %s %s %d", m.name, m.host, m.port))
+	return m, replicas, nil
+}
+
+func (s *Client) failover(m *sentinelMaster, replicas []sentinelReplica) error {
+	sort.SliceStable(replicas, func(i, j int) bool { return replicas[i].offset > replicas[j].offset })
+	s.mu.Lock()
+	old := sentinelReplica{host: m.host, port: m.port}
+	s.unlock()
+	promoted := -1
+	for i, r := range replicas {
+		if _, err := sentinelQuery(r.addr(), "REPLICAOF", "NO", "ONE"); err == nil {
+			promoted = i
+			break
+		}
+	}
+	if promoted < 0 {
+		s.mu.Lock()
+		m.failingOver = false
+		s.publish("-failover-abort-no-good-slave", fmt.Sprintf("master %s %s %d", m.name, m.host, m.port))
+		s.unlock()
+		s.log().Warn("failover aborted, no replica promoted", "master", m.name)
+		return errors.New("NOGOODSLAVE No suitable replica to promote")
+	}
+	chosen := replicas[promoted]
+	port := strconv.Itoa(chosen.port)
+	var followers []sentinelReplica
+	for i, r := range append(replicas, old) {
+		if i == promoted {
+			continue
+		}
+		// the old master may be down, it is reconfigured when it comes back
+		// in redis, here it just stays out
+		if _, err := sentinelQuery(r.addr(), "REPLICAOF", chosen.host, port); err == nil {
+			followers = append(followers, sentinelReplica{host: r.host, port: r.port})
+		}
+	}
+	s.mu.Lock()
+	defer s.unlock()
+	m.host, m.port = chosen.host, chosen.port
+	m.replicas = followers
+	m.down = false
+	m.configEpoch++
+	m.failingOver = false
+	s.publish("+failover-end", fmt.Sprintf("master %s %s %d", m.name, old.host, old.port))
+	s.publish("+switch-master", fmt.Sprintf("%s %s %d %s %d", m.name, old.host, old.port, m.host, m.port))
+	s.log().Info("failover done", "master", m.name, "from", old.addr(), "to", chosen.addr())
+	return nil
+}
+
+// stopSentinel stops watching the masters, the server lock must be held.
+func (s *Client) stopSentinel() {
+	if s.sentinel == nil {
+		return
+	}
+	for name, m := range s.sentinel.masters {
+		close(m.stop)
+		delete(s.sentinel.masters, name)
+	}
+}
+
+func (m *sentinelMaster) flags() string {
+	flags := "master"
+	if m.down {
+		flags += ",s_down,o_down"
+	}
+	if m.failingOver {
+		flags += ",failover_in_progress"
+	}
+	return flags
+}
+
+func (m *sentinelMaster) fields() RespMap {
+	lastOK := int64(0)
+	if !m.lastOK.IsZero() {
+		lastOK = time.Since(m.lastOK).Milliseconds()
+	}
+	return RespMap{
+		"name", m.name,
+		"ip", m.host,
+		"port", strconv.Itoa(m.port),
+		"runid", "",
+		"flags", m.flags(),
+		"link-pending-commands", "0",
+		"link-refcount", "1",
+		"last-ping-sent", "0",
+		"last-ok-ping-reply", strconv.FormatInt(lastOK, 10),
+		"last-ping-reply", strconv.FormatInt(lastOK, 10),
+		"down-after-milliseconds", "30000",
+		"role-reported", "master",
+		"config-epoch", strconv.Itoa(m.configEpoch),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", "0",
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", "180000",
+		"parallel-syncs", "1",
+	}
+}
+
+func (m *sentinelMaster) replicaFields(r sentinelReplica) RespMap {
+	flags, status := "slave", "ok"
+	if !r.online {
+		flags, status = "slave,s_down", "err"
+	}
+	return RespMap{
+		"name", r.addr(),
+		"ip", r.host,
+		"port", strconv.Itoa(r.port),
+		"runid", "",
+		"flags", flags,
+		"role-reported", "slave",
+		"master-link-status", status,
+		"master-host", m.host,
+		"master-port", strconv.Itoa(m.port),
+		"slave-priority", "100",
+		"slave-repl-offset", strconv.FormatInt(r.offset, 10),
+	}
+}
+
+// sentinelCommand handles the SENTINEL subcommands.
+func sentinelCommand(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	if s.sentinel == nil {
+		SendError(c, "ERR This instance has sentinel support disabled.")
+		return
+	}
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'sentinel' command")
+		return
+	}
+	sub := strings.ToLower(argString(args[0]))
+	master := func() *sentinelMaster {
+		if len(args) != 2 {
+			SendError(c, fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", sub))
+			return nil
+		}
+		m, ok := s.sentinel.masters[argString(args[1])]
+		if !ok {
+			SendError(c, "ERR No such master with that name")
+		}
+		return m
+	}
+	switch sub {
+	case "myid":
+		SendBulk(c, s.sentinel.myID)
+	case "masters":
+		masters := []interface{}{}
+		for _, name := range sortedKeys(s.sentinel.masters) {
+			masters = append(masters, s.sentinel.masters[name].fields())
+		}
+		SendValue(c, masters)
+	case "master":
+		if m := master(); m != nil {
+			SendValue(c, m.fields())
+		}
+	case "replicas", "slaves":
+		if m := master(); m != nil {
+			replicas := []interface{}{}
+			for _, r := range m.replicas {
+				replicas = append(replicas, m.replicaFields(r))
+			}
+			SendValue(c, replicas)
+		}
+	case "sentinels":
+		if m := master(); m != nil {
+			SendValue(c, []interface{}{})
+		}
+	case "get-master-addr-by-name":
+		if len(args) != 2 {
+			SendError(c, "ERR wrong number of arguments for 'sentinel|get-master-addr-by-name' command")
+			return
+		}
+		m, ok := s.sentinel.masters[argString(args[1])]
+		if !ok {
+			SendNil(c)
+			return
+		}
+		SendValue(c, []interface{}{m.host, strconv.Itoa(m.port)})
+	case "ckquorum":
+		if m := master(); m != nil {
+			if m.quorum > 1 {
+				SendError(c, fmt.Sprintf("NOQUORUM 1 usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master (%d)", m.quorum))
+				return
+			}
+			c.Write([]byte(createSimpleString("OK 1 usable Sentinels. Quorum and failover authorization can be reached")))
+		}
+	case "monitor":
+		if len(args) != 5 {
+			SendError(c, "ERR wrong number of arguments for 'sentinel|monitor' command")
+			return
+		}
+		port, err := strconv.Atoi(argString(args[3]))
+		if err != nil {
+			SendError(c, "ERR Invalid port number")
+			return
+		}
+		quorum, err := strconv.Atoi(argString(args[4]))
+		if err != nil {
+			SendError(c, "ERR Invalid quorum")
+			return
+		}
+		if err := s.sentinelMonitor(argString(args[1]), argString(args[2]), port, quorum); err != nil {
+			SendError(c, err.Error())
+			return
+		}
+		SendOk(c)
+	case "remove":
+		if m := master(); m != nil {
+			close(m.stop)
+			delete(s.sentinel.masters, m.name)
+			SendOk(c)
+		}
+	case "reset":
+		if len(args) != 2 {
+			SendError(c, "ERR wrong number of arguments for 'sentinel|reset' command")
+			return
+		}
+		n := 0
+		for _, m := range s.sentinel.masters {
+			if globMatch(argString(args[1]), m.name) {
+				m.replicas = nil
+				n++
+			}
+		}
+		SendValue(c, n)
+	case "failover":
+		if len(args) != 2 {
+			SendError(c, "ERR wrong number of arguments for 'sentinel|failover' command")
+			return
+		}
+		m, replicas, err := s.startFailover(argString(args[1]))
+		if err != nil {
+			SendError(c, err.Error())
+			return
+		}
+		go s.failover(m, replicas)
+		SendOk(c)
+	default:
+		SendError(c, fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", argString(args[0])))
+	}
+}
+
+func stringValues(strs []string) []interface{} {
+	values := make([]interface{}, len(strs))
+	for i, s := range strs {
+		values[i] = s
+	}
+	return values
+}
+
+func sentinelInfo(s *Client) []string {
+	if s.sentinel == nil {
+		return nil
+	}
+	lines := []string{
+		fmt.Sprintf("sentinel_masters:%d", len(s.sentinel.masters)),
+		"sentinel_tilt:0",
+		"sentinel_running_scripts:0",
+		"sentinel_scripts_queue_length:0",
+		"sentinel_simulate_failure_flags:0",
+	}
+	for i, name := range sortedKeys(s.sentinel.masters) {
+		m := s.sentinel.masters[name]
+		status := "ok"
+		if m.down {
+			status = "odown"
+		}
+		lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=1",
+			i, m.name, status, m.addr(), len(m.replicas)))
+	}
+	return lines
+}
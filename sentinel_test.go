@@ -0,0 +1,74 @@
+package localredis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSentinelFailover(t *testing.T) {
+	useCommand(t, "set", setmap)
+	master := NewClient()
+	masterPort := serveLocal(t, master)
+	replicas := []*Client{NewClient(), NewClient()}
+	ports := map[int]*Client{}
+	for _, r := range replicas {
+		ports[serveLocal(t, r)] = r
+		r.ReplicaOf("127.0.0.1", masterPort)
+	}
+
+	sentinel := NewSentinel()
+	serveLocal(t, sentinel)
+	if err := sentinel.SentinelMonitor("mymaster", "127.0.0.1", masterPort, 1); err != nil {
+		t.Fatal(err)
+	}
+	mconn := NewConnOverride()
+	cc := sentinel.addClient(mconn)
+	subConn := NewConnOverride()
+	sub := sentinel.addClient(subConn)
+	runCommand(sub, []interface{}{"subscribe", "+switch-master"})
+	subConn.Reset()
+
+	runCommand(cc, []interface{}{"sentinel", "get-master-addr-by-name", "mymaster"})
+	if reply, expected := readReply(t, mconn), fmt.Sprintf("*2\r\n+127.0.0.1\r\n+%d\r\n", masterPort); reply != expected {
+		t.Errorf("invalid master address, got %q expected %q", reply, expected)
+	}
+	runCommand(cc, []interface{}{"get", "k"})
+	if reply := readReply(t, mconn); !strings.HasPrefix(reply, "-ERR unknown command 'get'") {
+		t.Errorf("data command served by the sentinel, got %q", reply)
+	}
+	waitFor(t, "the sentinel to see the replicas", func() bool {
+		runCommand(cc, []interface{}{"sentinel", "replicas", "mymaster"})
+		return strings.HasPrefix(readReply(t, mconn), "*2\r\n")
+	})
+
+	if err := sentinel.SentinelFailover("mymaster"); err != nil {
+		t.Fatal(err)
+	}
+	runCommand(cc, []interface{}{"sentinel", "get-master-addr-by-name", "mymaster"})
+	reply := readReply(t, mconn)
+	var newPort int
+	if _, err := fmt.Sscanf(reply, "*2\r\n+127.0.0.1\r\n+%d\r\n", &newPort); err != nil || ports[newPort] == nil {
+		t.Fatalf("master not switched to a replica, got %q", reply)
+	}
+	message := fmt.Sprintf("mymaster 127.0.0.1 %d 127.0.0.1 %d", masterPort, newPort)
+	if reply, expected := readReply(t, subConn), fmt.Sprintf("*3\r\n+message\r\n++switch-master\r\n+%s\r\n", message); reply != expected {
+		t.Errorf("invalid +switch-master message, got %q expected %q", reply, expected)
+	}
+
+	// the other replica and the old master follow the new master
+	promoted := ports[newPort]
+	pconn := NewConnOverride()
+	pcc := promoted.addClient(pconn)
+	runCommand(pcc, []interface{}{"set", "after", "failover"})
+	pconn.Reset()
+	runCommand(pcc, []interface{}{"wait", "2", "5000"})
+	if reply := readReply(t, pconn); reply != ":2\r\n" {
+		t.Errorf("invalid wait reply on the new master, got %q", reply)
+	}
+	master.mu.Lock()
+	if v, _ := master.dbs[0].load("after"); v != "failover" {
+		t.Errorf("old master not following the new one, got %v", v)
+	}
+	master.mu.Unlock()
+}
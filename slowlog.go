@@ -0,0 +1,210 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The limits of the arguments kept in a slowlog entry, like redis.
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+// latencyHistoryLen is the number of samples kept by event.
+const latencyHistoryLen = 160
+
+// slowlogSkipped are the commands never logged in the slowlog, either
+// carrying passwords or blocking by design.
+var slowlogSkipped = map[string]bool{
+	"auth":  true,
+	"hello": true,
+	"wait":  true,
+}
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []interface{}
+	addr     string
+	name     string
+}
+
+type latencySample struct {
+	time    time.Time
+	latency int // milliseconds
+}
+
+// latencyEvent is the history of an event of LATENCY, with a sample by
+// second keeping the highest latency.
+type latencyEvent struct {
+	samples []latencySample
+	max     int
+}
+
+// recordCommand adds the command vals of cc that took elapsed to the
+// slowlog and to the latency monitor when over their thresholds, the
+// server lock must be held.
+func (s *Client) recordCommand(cc *ClientConn, name string, vals []interface{}, elapsed time.Duration) {
+	if slowlogSkipped[name] {
+		return
+	}
+	if s.slowlogSlowerThan >= 0 && elapsed.Microseconds() >= int64(s.slowlogSlowerThan) {
+		s.slowlogID++
+		s.slowlog = append([]slowlogEntry{{
+			id:       s.slowlogID - 1,
+			time:     time.Now(),
+			duration: elapsed,
+			args:     slowlogArgs(vals),
+			addr:     cc.RemoteAddr().String(),
+			name:     cc.name,
+		}}, s.slowlog...)
+		s.trimSlowlog()
+	}
+	if ms := int(elapsed.Milliseconds()); s.latencyThreshold > 0 && ms >= s.latencyThreshold {
+		s.addLatencySample("command", ms)
+	}
+}
+
+func (s *Client) trimSlowlog() {
+	if len(s.slowlog) > s.slowlogMaxLen {
+		s.slowlog = s.slowlog[:s.slowlogMaxLen]
+	}
+}
+
+// slowlogArgs redacts and truncates the arguments of a command like
+// redis.
+func slowlogArgs(vals []interface{}) []interface{} {
+	vals = redactArgs(vals)
+	n := len(vals)
+	if n > slowlogMaxArgc {
+		n = slowlogMaxArgc - 1
+	}
+	args := make([]interface{}, 0, n+1)
+	for _, val := range vals[:n] {
+		arg := argString(val)
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		args = append(args, arg)
+	}
+	if n < len(vals) {
+		args = append(args, fmt.Sprintf("... (%d more arguments)", len(vals)-n))
+	}
+	return args
+}
+
+func (s *Client) addLatencySample(event string, ms int) {
+	if s.latency == nil {
+		s.latency = map[string]*latencyEvent{}
+	}
+	ev, ok := s.latency[event]
+	if !ok {
+		ev = &latencyEvent{}
+		s.latency[event] = ev
+	}
+	now := time.Now()
+	if ms > ev.max {
+		ev.max = ms
+	}
+	if last := len(ev.samples) - 1; last >= 0 && ev.samples[last].time.Unix() == now.Unix() {
+		if ms > ev.samples[last].latency {
+			ev.samples[last].latency = ms
+		}
+		return
+	}
+	ev.samples = append(ev.samples, latencySample{now, ms})
+	if len(ev.samples) > latencyHistoryLen {
+		ev.samples = ev.samples[1:]
+	}
+}
+
+// slowlogCommand handles `SLOWLOG GET [count]`, `SLOWLOG LEN` and
+// `SLOWLOG RESET`.
+func slowlogCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'slowlog' command")
+		return
+	}
+	s := clientOf(c).srv
+	switch sub := strings.ToLower(argString(args[0])); {
+	case sub == "get" && len(args) <= 2:
+		count := 10
+		if len(args) == 2 {
+			n, err := strconv.Atoi(argString(args[1]))
+			if err != nil || n < -1 {
+				SendError(c, "ERR count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		if count == -1 || count > len(s.slowlog) {
+			count = len(s.slowlog)
+		}
+		entries := make([]interface{}, 0, count)
+		for _, e := range s.slowlog[:count] {
+			entries = append(entries, []interface{}{
+				int(e.id), int(e.time.Unix()), int(e.duration.Microseconds()), e.args, e.addr, e.name,
+			})
+		}
+		SendValue(c, entries)
+	case sub == "len" && len(args) == 1:
+		SendValue(c, len(s.slowlog))
+	case sub == "reset" && len(args) == 1:
+		s.slowlog = nil
+		SendOk(c)
+	case sub == "get" || sub == "len" || sub == "reset":
+		SendError(c, fmt.Sprintf("ERR wrong number of arguments for 'slowlog|%s' command", sub))
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try SLOWLOG HELP.", argString(args[0])))
+	}
+}
+
+// latencyCommand handles `LATENCY LATEST`, `LATENCY HISTORY event` and
+// `LATENCY RESET [event ...]`.
+func latencyCommand(c net.Conn, args []interface{}) {
+	if len(args) == 0 {
+		SendError(c, "ERR wrong number of arguments for 'latency' command")
+		return
+	}
+	s := clientOf(c).srv
+	switch sub := strings.ToLower(argString(args[0])); {
+	case sub == "latest" && len(args) == 1:
+		events := []interface{}{}
+		for _, name := range sortedKeys(s.latency) {
+			ev := s.latency[name]
+			last := ev.samples[len(ev.samples)-1]
+			events = append(events, []interface{}{name, int(last.time.Unix()), last.latency, ev.max})
+		}
+		SendValue(c, events)
+	case sub == "history" && len(args) == 2:
+		samples := []interface{}{}
+		if ev, ok := s.latency[argString(args[1])]; ok {
+			for _, sample := range ev.samples {
+				samples = append(samples, []interface{}{int(sample.time.Unix()), sample.latency})
+			}
+		}
+		SendValue(c, samples)
+	case sub == "reset":
+		reset := 0
+		if len(args) == 1 {
+			reset = len(s.latency)
+			s.latency = nil
+		}
+		for _, arg := range args[1:] {
+			if _, ok := s.latency[argString(arg)]; ok {
+				delete(s.latency, argString(arg))
+				reset++
+			}
+		}
+		SendValue(c, reset)
+	case sub == "latest" || sub == "history":
+		SendError(c, fmt.Sprintf("ERR wrong number of arguments for 'latency|%s' command", sub))
+	default:
+		SendError(c, fmt.Sprintf("ERR unknown subcommand '%s'. Try LATENCY HELP.", argString(args[0])))
+	}
+}
@@ -0,0 +1,89 @@
+package localredis
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowlog(t *testing.T) {
+	CommandOverride("sleepms", func(c net.Conn, args []interface{}) {
+		n, _ := argInt(args[0])
+		time.Sleep(time.Duration(n) * time.Millisecond)
+		SendOk(c)
+	})
+	defer delete(commandMap, "sleepms")
+
+	srv := NewClient()
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	cc.name = "tester"
+	runCommand(cc, []interface{}{"config", "set", "slowlog-log-slower-than", "5000", "latency-monitor-threshold", "5"})
+	runCommand(cc, []interface{}{"set", "fast", "v"})
+	runCommand(cc, []interface{}{"sleepms", "10"})
+	long := strings.Repeat("x", 200)
+	runCommand(cc, []interface{}{"sleepms", "6", long})
+	mconn.Reset()
+
+	runCommand(cc, []interface{}{"slowlog", "len"})
+	if reply := readReply(t, mconn); reply != ":2\r\n" {
+		t.Fatalf("expected 2 slow commands, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"slowlog", "get", "1"})
+	addr := regexp.QuoteMeta(cc.RemoteAddr().String())
+	pattern := `^\*1\r\n\*6\r\n:1\r\n:\d+\r\n:\d{4,}\r\n\*3\r\n\+sleepms\r\n\+6\r\n\+x{128}\.\.\. \(72 more bytes\)\r\n\+` +
+		addr + `\r\n\+tester\r\n$`
+	if reply := readReply(t, mconn); !regexp.MustCompile(pattern).MatchString(reply) {
+		t.Errorf("invalid slowlog entry %q", reply)
+	}
+
+	args := []interface{}{"sleepms", "0"}
+	for i := 0; i < 40; i++ {
+		args = append(args, "a")
+	}
+	runCommand(cc, []interface{}{"config", "set", "slowlog-log-slower-than", "0", "slowlog-max-len", "2"})
+	runCommand(cc, args)
+	mconn.Reset()
+	runCommand(cc, []interface{}{"slowlog", "get", "-1"})
+	reply := readReply(t, mconn)
+	if !strings.HasPrefix(reply, "*2\r\n") || !strings.Contains(reply, "+... (11 more arguments)\r\n") {
+		t.Errorf("invalid slowlog after trimming %q", reply)
+	}
+	runCommand(cc, []interface{}{"acl", "setuser", "bob", "on", ">secret"})
+	mconn.Reset()
+	runCommand(cc, []interface{}{"slowlog", "get", "1"})
+	if reply := readReply(t, mconn); !strings.Contains(reply, "*5\r\n+acl\r\n+setuser\r\n+(redacted)\r\n") || strings.Contains(reply, "secret") {
+		t.Errorf("ACL SETUSER not redacted in the slowlog %q", reply)
+	}
+	runCommand(cc, []interface{}{"config", "set", "slowlog-log-slower-than", "-1"})
+	runCommand(cc, []interface{}{"slowlog", "reset"})
+	runCommand(cc, []interface{}{"slowlog", "len"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n+OK\r\n:0\r\n" {
+		t.Errorf("slowlog not reset, got %q", reply)
+	}
+
+	runCommand(cc, []interface{}{"latency", "latest"})
+	pattern = `^\*1\r\n\*4\r\n\+command\r\n:\d+\r\n:(\d+)\r\n:(\d+)\r\n$`
+	m := regexp.MustCompile(pattern).FindStringSubmatch(readReply(t, mconn))
+	if m == nil {
+		t.Fatal("invalid latency latest reply")
+	}
+	if latest, _ := strconv.Atoi(m[1]); latest < 5 {
+		t.Errorf("latest latency %dms under the threshold", latest)
+	}
+	if max, _ := strconv.Atoi(m[2]); max < 10 {
+		t.Errorf("max latency %dms, expected at least 10ms", max)
+	}
+	runCommand(cc, []interface{}{"latency", "history", "command"})
+	if reply := readReply(t, mconn); !regexp.MustCompile(`^\*[12]\r\n\*2\r\n:\d+\r\n:\d+\r\n`).MatchString(reply) {
+		t.Errorf("invalid latency history %q", reply)
+	}
+	runCommand(cc, []interface{}{"latency", "reset", "command", "other"})
+	runCommand(cc, []interface{}{"latency", "latest"})
+	if reply := readReply(t, mconn); reply != ":1\r\n*0\r\n" {
+		t.Errorf("latency not reset, got %q", reply)
+	}
+}
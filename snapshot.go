@@ -0,0 +1,334 @@
+package localredis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDir         = "."
+	defaultDBFilename  = "dump.rdb"
+	defaultAOFFilename = "appendonly.aof"
+)
+
+// SetRDBFile sets the directory and the file name that SAVE and BGSAVE
+// write the snapshot to.
+func (s *Client) SetRDBFile(dir, filename string) {
+	s.mu.Lock()
+	defer s.unlock()
+	s.dir = dir
+	s.dbFilename = filename
+}
+
+// SetRDBFile sets the snapshot file of the default server.
+func SetRDBFile(dir, filename string) {
+	defaultClient.SetRDBFile(dir, filename)
+}
+
+func (s *Client) rdbPath() string {
+	return filepath.Join(s.dir, s.dbFilename)
+}
+
+// rdbSnapshot serializes the functions and all the databases in the RDB
+// file format, the server lock must be held.
+func (s *Client) rdbSnapshot() []byte {
+	buf := []byte(fmt.Sprintf("REDIS%04d", rdbVersion))
+	aux := []string{
+		"redis-ver", redisVersion,
+		"redis-bits", strconv.Itoa(strconv.IntSize),
+		"ctime", strconv.FormatInt(time.Now().Unix(), 10),
+		"aof-base", "0",
+	}
+	if s.replica != nil && s.replSynced {
+		// the database selected in the stream forwarded to sub-replicas
+		aux = append(aux, "repl-stream-db", strconv.Itoa(s.replStreamDB))
+	}
+	for i := 0; i < len(aux); i += 2 {
+		buf = append(buf, rdbOpcodeAux)
+		buf = appendRDBString(buf, aux[i])
+		buf = appendRDBString(buf, aux[i+1])
+	}
+	for _, lib := range s.sortedLibraries() {
+		buf = append(buf, rdbOpcodeFunction2)
+		buf = appendRDBString(buf, lib.code)
+	}
+	for i, db := range s.dbs {
+		keys := db.keys()
+		if len(keys) == 0 {
+			continue
+		}
+		buf = append(buf, rdbOpcodeSelectDB)
+		buf = appendRDBLength(buf, uint64(i))
+		buf = append(buf, rdbOpcodeResizeDB)
+		buf = appendRDBLength(buf, uint64(len(keys)))
+		buf = appendRDBLength(buf, uint64(len(db.timeout)))
+		for _, key := range keys {
+			value, ok := db.load(key)
+			if !ok {
+				continue
+			}
+			if until, ok := db.timeout[key]; ok {
+				buf = append(buf, rdbOpcodeExpireTimeMs)
+				buf = appendRDBMillis(buf, until.UnixMilli())
+			}
+			obj := appendRDBObject(nil, value)
+			buf = append(buf, obj[0])
+			buf = appendRDBString(buf, key)
+			buf = append(buf, obj[1:]...)
+		}
+	}
+	buf = append(buf, rdbOpcodeEOF)
+	return appendRDBMillis(buf, int64(crc64(0, buf)))
+}
+
+// writeSnapshot writes data to path through a temporary file renamed in
+// place, so a crash never leaves a truncated snapshot.
+func writeSnapshot(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.temp-%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// SaveRDB writes the snapshot of the server to path.
+func (s *Client) SaveRDB(path string) error {
+	s.mu.Lock()
+	defer s.unlock()
+	return s.saveRDB(path)
+}
+
+func (s *Client) saveRDB(path string) error {
+	if err := writeSnapshot(path, s.rdbSnapshot()); err != nil {
+		return err
+	}
+	s.lastSave = time.Now()
+	s.dirty = 0
+	return nil
+}
+
+// LoadRDB replaces the content of the server with the RDB file at path,
+// e.g. a dump.rdb taken from a redis instance.
+func (s *Client) LoadRDB(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.unlock()
+	_, err = s.loadRDB(data)
+	return err
+}
+
+// Load loads the dataset at startup like redis-server, from the append
+// only file when appendonly is enabled, otherwise from the RDB snapshot
+// when there is one.
+func (s *Client) Load() error {
+	s.mu.Lock()
+	appendonly := s.appendonly && s.aof == nil
+	aofPath := filepath.Join(s.dir, s.aofFilename)
+	fsync := s.aofFsync
+	rdbPath := s.rdbPath()
+	s.unlock()
+	if appendonly {
+		return s.OpenAOF(aofPath, fsync)
+	}
+	if err := s.LoadRDB(rdbPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Load loads the dataset of the default server.
+func Load() error {
+	return defaultClient.Load()
+}
+
+// LoadRDB loads the RDB file at path into the default server.
+func LoadRDB(path string) error {
+	return defaultClient.LoadRDB(path)
+}
+
+// SaveRDB writes the snapshot of the default server to path.
+func SaveRDB(path string) error {
+	return defaultClient.SaveRDB(path)
+}
+
+// loadRDB loads the RDB at the start of data and returns its length, the
+// rest of data is the log of an append only file with an RDB preamble.
+func (s *Client) loadRDB(data []byte) (int, error) {
+	if len(data) < 9 || !bytes.HasPrefix(data, []byte("REDIS")) {
+		return 0, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbVersion+1 {
+		return 0, fmt.Errorf("can't handle RDB format version %s", data[5:9])
+	}
+	r := &rdbReader{buf: data, pos: 9}
+	for _, db := range s.dbs {
+		db.flush()
+	}
+	s.libraries = map[string]*library{}
+	s.functions = map[string]*function{}
+	s.replStreamDB = 0
+	db := s.dbs[0]
+	var expireAt int64 = -1
+	for {
+		opcode, err := r.byte()
+		if err != nil {
+			return 0, errors.New("unexpected EOF reading RDB file")
+		}
+		switch opcode {
+		case rdbOpcodeEOF:
+			if version < 5 {
+				return r.pos, nil
+			}
+			if len(data)-r.pos < 8 {
+				return 0, errors.New("unexpected EOF reading RDB file")
+			}
+			sum := binary.LittleEndian.Uint64(data[r.pos:])
+			if sum != 0 && sum != crc64(0, data[:r.pos]) {
+				return 0, errors.New("wrong RDB checksum")
+			}
+			return r.pos + 8, nil
+		case rdbOpcodeSelectDB:
+			n, err := r.uint()
+			if err != nil {
+				return 0, err
+			}
+			if n >= uint64(len(s.dbs)) {
+				return 0, fmt.Errorf("FATAL: Data file was created with a Redis server configured to handle more than %d databases", len(s.dbs))
+			}
+			db = s.dbs[n]
+		case rdbOpcodeResizeDB:
+			if _, err := r.uint(); err != nil {
+				return 0, err
+			}
+			if _, err := r.uint(); err != nil {
+				return 0, err
+			}
+		case rdbOpcodeAux:
+			aux, err := r.strings(2)
+			if err != nil {
+				return 0, err
+			}
+			if n, err := strconv.Atoi(aux[1]); aux[0] == "repl-stream-db" && err == nil {
+				s.replStreamDB = n
+			}
+		case rdbOpcodeExpireTimeMs:
+			if expireAt, err = r.millis(); err != nil {
+				return 0, err
+			}
+		case rdbOpcodeExpireTime:
+			b, err := r.bytes(4)
+			if err != nil {
+				return 0, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(b)) * 1000
+		case rdbOpcodeFreq:
+			if _, err := r.byte(); err != nil {
+				return 0, err
+			}
+		case rdbOpcodeIdle:
+			if _, err := r.uint(); err != nil {
+				return 0, err
+			}
+		case rdbOpcodeSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.uint(); err != nil {
+					return 0, err
+				}
+			}
+		case rdbOpcodeFunction2:
+			code, err := r.string()
+			if err != nil {
+				return 0, err
+			}
+			lib, err := compileLibrary(code)
+			if err != nil {
+				return 0, err
+			}
+			if err := s.installLibraries([]*library{lib}, true); err != nil {
+				return 0, err
+			}
+		case rdbOpcodeModuleAux, rdbOpcodeFunctionPreGA:
+			return 0, fmt.Errorf("unsupported RDB opcode %d", opcode)
+		default:
+			key, err := r.string()
+			if err != nil {
+				return 0, err
+			}
+			value, err := r.object(opcode)
+			if err != nil {
+				return 0, fmt.Errorf("loading key %q: %w", key, err)
+			}
+			if expireAt >= 0 {
+				until := time.UnixMilli(expireAt)
+				expireAt = -1
+				if !until.After(time.Now()) {
+					continue
+				}
+				db.timeout[key] = until
+				go s.expireAfter(db, key, time.Until(until))
+			}
+			db.store(key, value)
+		}
+	}
+}
+
+func save(c net.Conn, args []interface{}) {
+	s := clientOf(c).srv
+	if s.bgsaveRunning {
+		SendError(c, "ERR Background save already in progress")
+		return
+	}
+	if err := s.saveRDB(s.rdbPath()); err != nil {
+		SendError(c, "ERR "+err.Error())
+		return
+	}
+	SendOk(c)
+}
+
+// bgsave takes the snapshot right away, only writing it to the disk is
+// done in the background.
+func bgsave(c net.Conn, args []interface{}) {
+	if len(args) > 1 || len(args) == 1 && strings.ToLower(argString(args[0])) != "schedule" {
+		SendError(c, "ERR syntax error")
+		return
+	}
+	s := clientOf(c).srv
+	if s.bgsaveRunning {
+		SendError(c, "ERR Background save already in progress")
+		return
+	}
+	s.bgsaveRunning = true
+	data, path, dirty := s.rdbSnapshot(), s.rdbPath(), s.dirty
+	go func() {
+		err := writeSnapshot(path, data)
+		s.mu.Lock()
+		defer s.unlock()
+		s.bgsaveRunning = false
+		s.lastBgsaveErr = err
+		if err == nil {
+			s.lastSave = time.Now()
+			s.dirty -= dirty
+		}
+	}()
+	c.Write([]byte(createSimpleString("Background saving started")))
+}
+
+func lastsave(c net.Conn, args []interface{}) {
+	SendValue(c, int(clientOf(c).srv.lastSave.Unix()))
+}
@@ -0,0 +1,181 @@
+package localredis
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRDBSaveAndLoad(t *testing.T) {
+	srv := NewClient()
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	stream := &Stream{
+		Entries: []StreamEntry{
+			{ID: StreamID{1700000000000, 0}, Fields: []string{"temp", "21", "unit", "c"}},
+			{ID: StreamID{1700000000000, 1}, Fields: []string{"temp", "22", "unit", "c"}},
+			{ID: StreamID{1700000000500, 0}, Fields: []string{"note", strings.Repeat("x", 100)}},
+		},
+		LastID:       StreamID{1700000000500, 0},
+		EntriesAdded: 3,
+		groups: []*streamGroup{{
+			name:        "workers",
+			lastID:      StreamID{1700000000000, 1},
+			entriesRead: 2,
+			pending:     []streamPending{{id: StreamID{1700000000000, 1}, deliveryTime: 1700000001000, deliveryCount: 1}},
+			consumers: []*streamConsumer{{
+				name: "w1", seenTime: 1700000001000, activeTime: 1700000001000,
+				pending: []StreamID{{1700000000000, 1}},
+			}},
+		}},
+	}
+	values := map[string]interface{}{
+		"str":    "hello",
+		"num":    "12345",
+		"list":   List{"a", "-7", "300", strings.Repeat("long", 40)},
+		"hash":   Hash{"field": "value", "n": "-100000"},
+		"set":    Set{"x": {}, "y": {}},
+		"zset":   SortedSet{"low": -1.5, "high": math.Inf(1)},
+		"stream": stream,
+	}
+	db := srv.dbs[0]
+	for k, v := range values {
+		db.store(k, v)
+	}
+	srv.dbs[3].store("other", "db3")
+	srv.dbs[3].store("volatile", "soon")
+	srv.dbs[3].timeout["volatile"] = time.Now().Add(time.Hour)
+	srv.dbs[3].store("gone", "expired")
+	srv.dbs[3].timeout["gone"] = time.Now().Add(-time.Second)
+	lib, err := compileLibrary(counterLibrary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.installLibraries([]*library{lib}, false)
+
+	if err := srv.SaveRDB(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewClient()
+	if err := loaded.LoadRDB(path); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		got, ok := loaded.dbs[0].load(k)
+		if !ok {
+			t.Errorf("key %s not loaded", k)
+			continue
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("key %s loaded as %#v, expected %#v", k, got, v)
+		}
+	}
+	if v, _ := loaded.dbs[3].load("other"); v != "db3" {
+		t.Errorf("invalid key of db 3, got %v", v)
+	}
+	if until := loaded.dbs[3].timeout["volatile"]; time.Until(until) < 59*time.Minute {
+		t.Errorf("expiration not loaded, got %v", until)
+	}
+	if _, ok := loaded.dbs[3].load("gone"); ok {
+		t.Error("expired key saved")
+	}
+	if _, ok := loaded.functions["counter_incr"]; !ok {
+		t.Error("functions not loaded")
+	}
+}
+
+func TestRDBLoadErrors(t *testing.T) {
+	srv := NewClient()
+	data := srv.rdbSnapshot()
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := srv.loadRDB(corrupted); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+	if _, err := srv.loadRDB([]byte("NOTREDIS")); err == nil {
+		t.Error("expected signature error")
+	}
+	if _, err := srv.loadRDB(data[:len(data)-9]); err == nil {
+		t.Error("expected error on truncated file")
+	}
+}
+
+func TestPackedEncodings(t *testing.T) {
+	// ziplist of "ab", 5 (immediate), 300 (int16) and -2 (int8)
+	zl := []byte{0, 0, 0, 0, 0, 0, 0, 0, 4, 0,
+		0, 0x02, 'a', 'b',
+		4, 0xf6,
+		2, 0xc0, 0x2c, 0x01,
+		4, 0xfe, 0xfe,
+		0xff}
+	entries, err := ziplistEntries(zl)
+	if err != nil || !reflect.DeepEqual(entries, []string{"ab", "5", "300", "-2"}) {
+		t.Errorf("invalid ziplist entries %v, %v", entries, err)
+	}
+	is := []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 7, 0}
+	entries, err = intsetEntries(is)
+	if err != nil || !reflect.DeepEqual(entries, []string{"-1", "7"}) {
+		t.Errorf("invalid intset entries %v, %v", entries, err)
+	}
+	items := []string{"0", "127", "-1", "4095", "-4096", "70000", "-9000000000", "", strings.Repeat("s", 5000)}
+	lp := newListpackBuilder()
+	for _, item := range items {
+		lp.appendString(item)
+	}
+	entries, err = listpackEntries(lp.bytes())
+	if err != nil || !reflect.DeepEqual(entries, items) {
+		t.Errorf("invalid listpack round trip %v, %v", entries, err)
+	}
+	compressed := []byte{0x02, 'a', 'b', 'c', 0xe0, 0x03, 0x02}
+	out, err := lzfDecompress(compressed, 15)
+	if err != nil || string(out) != "abcabcabcabcabc" {
+		t.Errorf("invalid lzf decompression %q, %v", out, err)
+	}
+}
+
+func TestSaveCommands(t *testing.T) {
+	srv := NewClient()
+	srv.SetRDBFile(t.TempDir(), "test.rdb")
+	mconn := NewConnOverride()
+	cc := srv.addClient(mconn)
+	setmap(cc, []interface{}{"key", "value"})
+	readReply(t, mconn)
+
+	runCommand(cc, []interface{}{"save"})
+	if reply := readReply(t, mconn); reply != "+OK\r\n" {
+		t.Fatalf("invalid save reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"lastsave"})
+	if reply := readReply(t, mconn); reply != createNumRepr(int(srv.lastSave.Unix())) {
+		t.Errorf("invalid lastsave reply, got %q", reply)
+	}
+	runCommand(cc, []interface{}{"bgsave"})
+	if reply := readReply(t, mconn); reply != "+Background saving started\r\n" {
+		t.Errorf("invalid bgsave reply, got %q", reply)
+	}
+	for running := true; running; {
+		srv.mu.Lock()
+		running = srv.bgsaveRunning
+		srv.mu.Unlock()
+	}
+	loaded := NewClient()
+	if err := loaded.LoadRDB(srv.rdbPath()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := loaded.dbs[0].load("key"); v != "value" {
+		t.Errorf("saved key not loaded, got %v", v)
+	}
+	loaded.dbs[0].store("list", List{"a"})
+	lconn := NewConnOverride()
+	lc := loaded.addClient(lconn)
+	runCommand(lc, []interface{}{"type", "list"})
+	if reply := readReply(t, lconn); reply != "+list\r\n" {
+		t.Errorf("invalid type reply, got %q", reply)
+	}
+	runCommand(lc, []interface{}{"get", "list"})
+	if reply := readReply(t, lconn); !strings.HasPrefix(reply, "-WRONGTYPE") {
+		t.Errorf("expected wrong type error, got %q", reply)
+	}
+}
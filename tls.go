@@ -0,0 +1,166 @@
+package localredis
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+// ListenAndServeTLS listens on the TCP address addressPort and serves the
+// connections over TLS with config, which has at least the certificate
+// of the server. The clients are verified by config.ClientAuth and
+// config.ClientCAs.
+func (s *Client) ListenAndServeTLS(addressPort string, config *tls.Config) error {
+	if config == nil || len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return errors.New("localredis: TLS without a server certificate")
+	}
+	l, err := tls.Listen("tcp", addressPort, config)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS serves the default server over TLS on addressPort.
+func ListenAndServeTLS(addressPort string, config *tls.Config) error {
+	return defaultClient.ListenAndServeTLS(addressPort, config)
+}
+
+// TLSCertificates are a throwaway CA and the server and client
+// certificates it signed, generated in memory so that the TLS path can
+// be used with no files.
+type TLSCertificates struct {
+	CA *x509.Certificate
+	// CAPEM is the CA certificate in PEM, e.g. for redis-cli --cacert.
+	CAPEM  []byte
+	Server tls.Certificate
+	Client tls.Certificate
+}
+
+// GenerateTLSCertificates generates a CA valid for a year, a server
+// certificate for hosts, localhost and the loopback addresses by
+// default, and a client certificate.
+func GenerateTLSCertificates(hosts ...string) (*TLSCertificates, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"localredis"}, CommonName: "localredis CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if caTemplate.SerialNumber, err = serialNumber(); err != nil {
+		return nil, err
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+	certs := &TLSCertificates{
+		CA:    ca,
+		CAPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+	}
+
+	server := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"localredis"}, CommonName: hosts[0]},
+		NotBefore:   caTemplate.NotBefore,
+		NotAfter:    caTemplate.NotAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if certs.Server, err = signCertificate(server, ca, caKey); err != nil {
+		return nil, err
+	}
+	client := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"localredis"}, CommonName: "localredis client"},
+		NotBefore:   caTemplate.NotBefore,
+		NotAfter:    caTemplate.NotAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if certs.Client, err = signCertificate(client, ca, caKey); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// signCertificate generates a key for template and signs it with the CA.
+func signCertificate(template, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if template.SerialNumber, err = serialNumber(); err != nil {
+		return tls.Certificate{}, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// CertPool is a pool with the CA, to verify the server or the clients.
+func (c *TLSCertificates) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.CA)
+	return pool
+}
+
+// ServerConfig is the configuration of a server with the server
+// certificate. The clients must present a certificate signed by the CA
+// when verifyClients is set, like tls-auth-clients yes, otherwise it is
+// only verified when they present one.
+func (c *TLSCertificates) ServerConfig(verifyClients bool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{c.Server},
+		ClientCAs:    c.CertPool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if verifyClients {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// ClientConfig is the configuration of a client trusting the CA and
+// presenting the client certificate.
+func (c *TLSCertificates) ClientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{c.Client},
+		RootCAs:      c.CertPool(),
+		MinVersion:   tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,55 @@
+package localredis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestTLS(t *testing.T) {
+	useCommand(t, "set", setmap)
+	certs, err := GenerateTLSCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x509.ParseCertificate(certs.Server.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.ServerConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewClient()
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), certs.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n*2\r\n$3\r\nget\r\n$1\r\nk\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"+OK\r\n", "+v\r\n"} {
+		if line, err := r.ReadString('\n'); err != nil || line != expected {
+			t.Errorf("got %q (%v), expected %q", line, err, expected)
+		}
+	}
+
+	// the clients must present a certificate signed by the CA
+	anonymous := &tls.Config{RootCAs: certs.CertPool()}
+	if conn, err := tls.Dial("tcp", ln.Addr().String(), anonymous); err == nil {
+		conn.Write([]byte("*1\r\n$4\r\nping\r\n"))
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+			t.Error("a client without certificate was served")
+		}
+		conn.Close()
+	}
+
+	if err := srv.ListenAndServeTLS("127.0.0.1:0", &tls.Config{}); err == nil {
+		t.Error("served TLS without a certificate")
+	}
+}
@@ -0,0 +1,104 @@
+package localredis
+
+import (
+	"fmt"
+	"net"
+)
+
+// List is the value of a list key.
+type List []string
+
+// Hash is the value of a hash key.
+type Hash map[string]string
+
+// Set is the value of a set key.
+type Set map[string]struct{}
+
+// SortedSet is the value of a sorted set key, members mapped to their
+// scores.
+type SortedSet map[string]float64
+
+// StreamID identifies a stream entry, written as <ms>-<seq>.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+func (id StreamID) less(other StreamID) bool {
+	return id.Ms < other.Ms || id.Ms == other.Ms && id.Seq < other.Seq
+}
+
+// StreamEntry is a stream entry with its fields and values alternating
+// in Fields.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// Stream is the value of a stream key, with Entries sorted by ID.
+type Stream struct {
+	Entries      []StreamEntry
+	LastID       StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+
+	groups []*streamGroup
+}
+
+// streamGroup is a consumer group, only kept so snapshots round trip.
+type streamGroup struct {
+	name        string
+	lastID      StreamID
+	entriesRead uint64
+	pending     []streamPending
+	consumers   []*streamConsumer
+}
+
+type streamPending struct {
+	id            StreamID
+	deliveryTime  int64
+	deliveryCount uint64
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   int64
+	activeTime int64
+	pending    []StreamID
+}
+
+// typeName is the name of the type of value as replied by TYPE.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case List:
+		return "list"
+	case Hash:
+		return "hash"
+	case Set:
+		return "set"
+	case SortedSet:
+		return "zset"
+	case *Stream:
+		return "stream"
+	}
+	return "string"
+}
+
+const wrongTypeError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+func typeCommand(c net.Conn, args []interface{}) {
+	if len(args) != 1 {
+		SendError(c, "ERR wrong number of arguments for 'type' command")
+		return
+	}
+	val, ok := dbOf(c).load(argString(args[0]))
+	if !ok {
+		c.Write([]byte(createSimpleString("none")))
+		return
+	}
+	c.Write([]byte(createSimpleString(typeName(val))))
+}